@@ -0,0 +1,483 @@
+package djijoe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// a rule fires at most once per device during its cooldown
+	ALERT_DEFAULT_COOLDOWN = 5 * time.Minute
+	ALERT_ACTION_TIMEOUT   = 30 * time.Second
+	ALERT_DEFAULT_SMTP     = "localhost:25"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+/*
+The hours (and optionally the days) a rule applies, e.g. from "22:00" to
+"06:00" for the night. The day is the one of the detection, even after
+midnight.
+*/
+type TimeWindow struct {
+	From string   `json:"from"`
+	To   string   `json:"to"`
+	Days []string `json:"days,omitempty"`
+
+	from, to int
+	days     map[time.Weekday]bool
+}
+
+func parseTimeOfDay(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day '%s', expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (w *TimeWindow) compile() error {
+	var err error
+	if w.from, err = parseTimeOfDay(w.From); err != nil {
+		return err
+	}
+	if w.to, err = parseTimeOfDay(w.To); err != nil {
+		return err
+	}
+
+	w.days = make(map[time.Weekday]bool)
+	for _, day := range w.Days {
+		weekday, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return fmt.Errorf("invalid day '%s', expected mon, tue... sun", day)
+		}
+		w.days[weekday] = true
+	}
+	return nil
+}
+
+/*
+Returns whether `ts` (in the time zone of the probe) is in the window, which
+may span midnight.
+*/
+func (w *TimeWindow) Contains(ts time.Time) bool {
+	if len(w.days) > 0 && !w.days[ts.Weekday()] {
+		return false
+	}
+
+	minutes := ts.Hour()*60 + ts.Minute()
+	if w.from <= w.to {
+		return minutes >= w.from && minutes < w.to
+	}
+	return minutes >= w.from || minutes < w.to
+}
+
+/*
+What to do when a rule fires: post the alert to a webhook, mail it to
+recipients through the SMTP relay, or run a program. Exactly one of them is
+set.
+*/
+type AlertAction struct {
+	Webhook string   `json:"webhook,omitempty"`
+	Email   []string `json:"email,omitempty"`
+	Exec    []string `json:"exec,omitempty"`
+}
+
+func (a *AlertAction) String() string {
+	switch {
+	case a.Webhook != "":
+		return "webhook " + a.Webhook
+	case len(a.Email) > 0:
+		return "email to " + strings.Join(a.Email, ", ")
+	}
+	return "exec " + strings.Join(a.Exec, " ")
+}
+
+/*
+A rule: the detections of a device matching all its conditions fire its
+actions, then not again for this device until its cooldown (in seconds) has
+passed. `Vendor` and `Model` are case-insensitive patterns which the names
+must contain, `MinRssi` is in dBm, `MinDwell` is the time (in seconds) since
+the device was first seen, and `Zone` a GeoJSON Polygon or MultiPolygon (or a
+Feature or FeatureCollection of them) which the Remote ID position of the
+drone must be in.
+*/
+type AlertRule struct {
+	Name     string          `json:"name"`
+	Vendor   string          `json:"vendor,omitempty"`
+	Model    string          `json:"model,omitempty"`
+	MinRssi  *int            `json:"min_rssi,omitempty"`
+	MinDwell float64         `json:"min_dwell,omitempty"`
+	Zone     json.RawMessage `json:"zone,omitempty"`
+	Window   *TimeWindow     `json:"window,omitempty"`
+	Actions  []AlertAction   `json:"actions"`
+	Cooldown *float64        `json:"cooldown,omitempty"`
+
+	zone     GeoZone
+	cooldown time.Duration
+}
+
+func (r *AlertRule) compile() error {
+	if r.Name == "" {
+		return errors.New("rule without a name")
+	}
+	if len(r.Actions) == 0 {
+		return fmt.Errorf("rule '%s' has no action", r.Name)
+	}
+	for _, action := range r.Actions {
+		set := 0
+		for _, isSet := range []bool{action.Webhook != "", len(action.Email) > 0, len(action.Exec) > 0} {
+			if isSet {
+				set++
+			}
+		}
+		if set != 1 {
+			return fmt.Errorf("rule '%s': an action needs exactly one of webhook, email or exec", r.Name)
+		}
+	}
+
+	if len(r.Zone) > 0 {
+		zone, err := ParseGeoJson(r.Zone)
+		if err != nil {
+			return fmt.Errorf("rule '%s': %v", r.Name, err)
+		}
+		r.zone = zone
+	}
+	if r.Window != nil {
+		if err := r.Window.compile(); err != nil {
+			return fmt.Errorf("rule '%s': %v", r.Name, err)
+		}
+	}
+
+	r.cooldown = ALERT_DEFAULT_COOLDOWN
+	if r.Cooldown != nil {
+		if *r.Cooldown < 0 {
+			return fmt.Errorf("rule '%s': negative cooldown", r.Name)
+		}
+		r.cooldown = time.Duration(*r.Cooldown * float64(time.Second))
+	}
+	return nil
+}
+
+/*
+Returns whether a detection matches the conditions of the rule, `local` being
+its time in the time zone of the probe.
+*/
+func (r *AlertRule) Match(info DroneInfoMessage, firstSeen time.Time, local time.Time) bool {
+	if r.Vendor != "" && !strings.Contains(strings.ToLower(info.Vendor), strings.ToLower(r.Vendor)) {
+		return false
+	}
+	if r.Model != "" && !strings.Contains(strings.ToLower(info.Model), strings.ToLower(r.Model)) {
+		return false
+	}
+	if r.MinRssi != nil && int(info.SignalStrength) < *r.MinRssi {
+		return false
+	}
+	if r.MinDwell > 0 && info.Timestamp.Sub(firstSeen).Seconds() < r.MinDwell {
+		return false
+	}
+	if r.zone != nil && (info.RemoteId == nil || !r.zone.Contains(info.RemoteId.Latitude, info.RemoteId.Longitude)) {
+		return false
+	}
+	if r.Window != nil && !r.Window.Contains(local) {
+		return false
+	}
+	return true
+}
+
+/*
+What the actions of a rule get, as JSON.
+*/
+type Alert struct {
+	Rule      string           `json:"rule"`
+	Timestamp time.Time        `json:"ts"`
+	Dwell     float64          `json:"dwell"`
+	Detection DroneInfoMessage `json:"detection"`
+}
+
+func (a *Alert) String() string {
+	info := a.Detection
+	description := fmt.Sprintf("%s %s (%s)", info.Vendor, info.Model, info.MacAddress)
+	if info.Model == "" {
+		description = fmt.Sprintf("%s (%s)", info.Vendor, info.MacAddress)
+	}
+	return fmt.Sprintf("Alert '%s': %s at %d dBm, seen for %.0fs, by probe '%s'",
+		a.Rule, description, info.SignalStrength, a.Dwell, info.Hostname)
+}
+
+/*
+Evaluates the rules on the detections, and runs the actions of the ones which
+fire in the background. `Smtp` is the relay the emails are sent through (no
+authentication), from `From`.
+*/
+type Alerter struct {
+	Rules    []*AlertRule   `json:"rules"`
+	Smtp     string         `json:"smtp,omitempty"`
+	From     string         `json:"from,omitempty"`
+	Location *time.Location `json:"-"`
+	Log      Logger         `json:"-"`
+	Client   *http.Client   `json:"-"`
+
+	// until when each rule is in its cooldown for each device
+	fired     map[string]time.Time
+	lastPrune time.Time
+	lock      sync.Mutex
+	pending   sync.WaitGroup
+}
+
+/*
+Parses the rules of a JSON file:
+
+	{
+	  "smtp": "localhost:25",
+	  "from": "dji-joe@probe",
+	  "rules": [
+	    {"name": "close", "min_rssi": -50, "actions": [{"exec": ["./page.sh"]}]}
+	  ]
+	}
+*/
+func ParseAlertRules(data []byte, log Logger) (*Alerter, error) {
+	a := &Alerter{}
+	if err := json.Unmarshal(data, a); err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for _, rule := range a.Rules {
+		if err := rule.compile(); err != nil {
+			return nil, err
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("duplicate rule '%s'", rule.Name)
+		}
+		names[rule.Name] = true
+	}
+
+	if a.Smtp == "" {
+		a.Smtp = ALERT_DEFAULT_SMTP
+	}
+	if a.From == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "localhost"
+		}
+		a.From = SYSLOG_APP_NAME + "@" + hostname
+	}
+	if log == nil {
+		log = NopLogger{}
+	}
+	a.Log = log
+	a.Location = time.Local
+	a.Client = &http.Client{Timeout: ALERT_ACTION_TIMEOUT}
+	a.fired = make(map[string]time.Time)
+	return a, nil
+}
+
+func LoadAlertRulesFromFile(filePath string, log Logger) (*Alerter, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := ParseAlertRules(data, log)
+	if err != nil {
+		return nil, fmt.Errorf("invalid alert rules '%s': %v", filePath, err)
+	}
+	return a, nil
+}
+
+/*
+Returns whether a rule fires for a device at `ts`, i.e. if it did not within
+its cooldown, and records it. Detections may come slightly out of order.
+*/
+func (a *Alerter) shouldFire(rule *AlertRule, device string, ts time.Time) bool {
+	key := rule.Name + "/" + device
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.prune(ts)
+
+	until, fired := a.fired[key]
+	if fired && ts.Before(until) {
+		return false
+	}
+	a.fired[key] = ts.Add(rule.cooldown)
+	return true
+}
+
+/*
+Forgets the rules and devices whose cooldown is over.
+*/
+func (a *Alerter) prune(now time.Time) {
+	if now.Sub(a.lastPrune) < time.Minute {
+		return
+	}
+	a.lastPrune = now
+
+	for key, until := range a.fired {
+		if !now.Before(until) {
+			delete(a.fired, key)
+		}
+	}
+}
+
+/*
+Evaluates the rules on a detection of a device first seen at `firstSeen`, and
+returns the alerts fired. Only the frames sent by the devices are evaluated
+(a zero `firstSeen` otherwise), as the signal of what they receive is the one
+of the other end.
+*/
+func (a *Alerter) Evaluate(info DroneInfoMessage, firstSeen time.Time) []Alert {
+	if firstSeen.IsZero() || (info.Role != "" && info.Role != ROLE_TRANSMITTER) {
+		return nil
+	}
+
+	device := info.DeviceId
+	if device == "" {
+		device = info.MacAddress.String()
+	}
+	local := info.Timestamp.In(a.Location)
+
+	var alerts []Alert
+	for _, rule := range a.Rules {
+		if !rule.Match(info, firstSeen, local) || !a.shouldFire(rule, device, info.Timestamp) {
+			continue
+		}
+
+		alert := Alert{
+			Rule:      rule.Name,
+			Timestamp: info.Timestamp,
+			Dwell:     info.Timestamp.Sub(firstSeen).Seconds(),
+			Detection: info,
+		}
+		a.Log.NoticeF("%s", alert.String())
+		alerts = append(alerts, alert)
+
+		a.pending.Add(1)
+		go func(rule *AlertRule) {
+			defer a.pending.Done()
+			for _, action := range rule.Actions {
+				if err := a.run(action, alert); err != nil {
+					a.Log.ErrorF("Alert '%s': %s failed: %+v", rule.Name, action.String(), err)
+				}
+			}
+		}(rule)
+	}
+	return alerts
+}
+
+/*
+Waits for the actions still running.
+*/
+func (a *Alerter) Wait() {
+	a.pending.Wait()
+}
+
+func (a *Alerter) run(action AlertAction, alert Alert) error {
+	switch {
+	case action.Webhook != "":
+		return a.postWebhook(action.Webhook, alert)
+	case len(action.Email) > 0:
+		return a.sendEmail(action.Email, alert)
+	}
+	return a.exec(action.Exec, alert)
+}
+
+func (a *Alerter) postWebhook(url string, alert Alert) error {
+	jsonValue, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	resp, err := a.Client.Post(url, "application/json", bytes.NewBuffer(jsonValue))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	return nil
+}
+
+func (a *Alerter) sendEmail(to []string, alert Alert) error {
+	info := alert.Detection
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "From: %s\r\n", a.From)
+	fmt.Fprintf(&body, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&body, "Subject: [%s] %s: %s %s\r\n", PROGNAME, alert.Rule, info.Vendor, info.MacAddress)
+	fmt.Fprintf(&body, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&body, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+
+	fmt.Fprintf(&body, "%s\r\n\r\n", alert.String())
+	fmt.Fprintf(&body, "Time:      %s\r\n", info.Timestamp.Format(time.RFC3339))
+	fmt.Fprintf(&body, "Device:    %s\r\n", info.MacAddress)
+	fmt.Fprintf(&body, "Vendor:    %s\r\n", info.Vendor)
+	if info.Model != "" {
+		fmt.Fprintf(&body, "Model:     %s\r\n", info.Model)
+	}
+	if info.Ssid != "" {
+		fmt.Fprintf(&body, "SSID:      %s\r\n", info.Ssid)
+	}
+	fmt.Fprintf(&body, "RSSI:      %d dBm\r\n", info.SignalStrength)
+	fmt.Fprintf(&body, "Frequency: %d MHz\r\n", info.Frequency)
+	if rid := info.RemoteId; rid != nil {
+		fmt.Fprintf(&body, "Position:  %.6f, %.6f (%.0f m)\r\n", rid.Latitude, rid.Longitude, rid.Altitude)
+	}
+
+	return smtp.SendMail(a.Smtp, nil, a.From, to, body.Bytes())
+}
+
+/*
+Runs a program with the alert as JSON on its stdin, and its main fields in the
+environment.
+*/
+func (a *Alerter) exec(argv []string, alert Alert) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ALERT_ACTION_TIMEOUT)
+	defer cancel()
+
+	jsonValue, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	info := alert.Detection
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Stdin = bytes.NewReader(jsonValue)
+	cmd.Env = append(os.Environ(),
+		"DJIJOE_RULE="+alert.Rule,
+		"DJIJOE_MAC="+info.MacAddress.String(),
+		"DJIJOE_VENDOR="+info.Vendor,
+		"DJIJOE_MODEL="+info.Model,
+		"DJIJOE_RSSI="+strconv.Itoa(int(info.SignalStrength)),
+		"DJIJOE_PROBE="+info.Hostname,
+	)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(output))
+	}
+	return nil
+}
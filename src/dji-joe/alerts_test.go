@@ -0,0 +1,445 @@
+package djijoe
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const testZone = `{
+	"type": "Feature",
+	"properties": {"name": "stadium"},
+	"geometry": {
+		"type": "Polygon",
+		"coordinates": [
+			[[2.29, 48.86], [2.30, 48.86], [2.30, 48.87], [2.29, 48.87], [2.29, 48.86]],
+			[[2.296, 48.865], [2.298, 48.865], [2.298, 48.867], [2.296, 48.867], [2.296, 48.865]]
+		]
+	}
+}`
+
+func mustParseAlertRules(t *testing.T, data string) *Alerter {
+	a, err := ParseAlertRules([]byte(data), NopLogger{})
+	if err != nil {
+		t.Fatalf("ParseAlertRules: %v", err)
+	}
+	a.Location = time.UTC
+	return a
+}
+
+func TestGeoZone(t *testing.T) {
+	zone, err := ParseGeoJson([]byte(testZone))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		lat, lng float64
+		inside   bool
+	}{
+		{48.861, 2.291, true},
+		{48.869, 2.299, true},
+		// in the hole
+		{48.866, 2.297, false},
+		{48.859, 2.295, false},
+		{48.865, 2.301, false},
+	}
+	for _, test := range tests {
+		if zone.Contains(test.lat, test.lng) != test.inside {
+			t.Errorf("(%f, %f): expected inside=%v", test.lat, test.lng, test.inside)
+		}
+	}
+
+	collection := `{"type": "FeatureCollection", "features": [` + testZone + `,
+		{"type": "Feature", "geometry": {"type": "MultiPolygon", "coordinates": [[[[0, 0], [1, 0], [1, 1], [0, 0]]]]}}]}`
+	zone, err = ParseGeoJson([]byte(collection))
+	if err != nil || len(zone) != 2 || !zone.Contains(0.2, 0.5) || !zone.Contains(48.861, 2.291) {
+		t.Errorf("FeatureCollection: %v %v", zone, err)
+	}
+
+	for _, bad := range []string{
+		`{"type": "Point", "coordinates": [2.29, 48.86]}`,
+		`{"type": "Polygon", "coordinates": [[[0, 0], [1, 0], [0, 0]]]}`,
+		`{"type": "Polygon", "coordinates": []}`,
+		`{"type": "Feature"}`,
+		`[`,
+	} {
+		if _, err := ParseGeoJson([]byte(bad)); err == nil {
+			t.Errorf("%s: no error", bad)
+		}
+	}
+}
+
+func TestTimeWindow(t *testing.T) {
+	night := &TimeWindow{From: "22:00", To: "06:30", Days: []string{"Sat", "sun"}}
+	if err := night.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ts     time.Time
+		inside bool
+	}{
+		// a Saturday
+		{time.Date(2020, 1, 4, 23, 0, 0, 0, time.UTC), true},
+		{time.Date(2020, 1, 4, 6, 29, 0, 0, time.UTC), true},
+		{time.Date(2020, 1, 4, 6, 30, 0, 0, time.UTC), false},
+		{time.Date(2020, 1, 4, 12, 0, 0, 0, time.UTC), false},
+		// a Monday
+		{time.Date(2020, 1, 6, 1, 0, 0, 0, time.UTC), false},
+	}
+	for _, test := range tests {
+		if night.Contains(test.ts) != test.inside {
+			t.Errorf("%s: expected inside=%v", test.ts, test.inside)
+		}
+	}
+
+	for _, bad := range []TimeWindow{{From: "25:00", To: "06:00"}, {From: "22:00", To: "6h"}, {From: "22:00", To: "06:00", Days: []string{"monday"}}} {
+		if err := bad.compile(); err == nil {
+			t.Errorf("%+v: no error", bad)
+		}
+	}
+}
+
+func TestParseAlertRulesErrors(t *testing.T) {
+	for _, bad := range []string{
+		`{"rules": [{"actions": [{"exec": ["true"]}]}]}`,
+		`{"rules": [{"name": "a"}]}`,
+		`{"rules": [{"name": "a", "actions": [{}]}]}`,
+		`{"rules": [{"name": "a", "actions": [{"exec": ["true"], "webhook": "http://h"}]}]}`,
+		`{"rules": [{"name": "a", "actions": [{"exec": ["true"]}]}, {"name": "a", "actions": [{"exec": ["true"]}]}]}`,
+		`{"rules": [{"name": "a", "zone": {"type": "Point"}, "actions": [{"exec": ["true"]}]}]}`,
+		`{"rules": [{"name": "a", "window": {"from": "noon", "to": "13:00"}, "actions": [{"exec": ["true"]}]}]}`,
+		`{"rules": [{"name": "a", "cooldown": -1, "actions": [{"exec": ["true"]}]}]}`,
+	} {
+		if _, err := ParseAlertRules([]byte(bad), nil); err == nil {
+			t.Errorf("%s: no error", bad)
+		}
+	}
+
+	a := mustParseAlertRules(t, `{"rules": []}`)
+	if a.Smtp != ALERT_DEFAULT_SMTP || !strings.HasPrefix(a.From, SYSLOG_APP_NAME+"@") {
+		t.Errorf("defaults: smtp=%q from=%q", a.Smtp, a.From)
+	}
+}
+
+func TestAlerterConditions(t *testing.T) {
+	// the actions run in the background, and fail
+	a := mustParseAlertRules(t, `{"rules": [
+		{"name": "dji", "vendor": "dji", "model": "phantom", "cooldown": 0, "actions": [{"exec": ["false"]}]},
+		{"name": "close", "min_rssi": -50, "cooldown": 0, "actions": [{"exec": ["false"]}]},
+		{"name": "lingering", "min_dwell": 60, "cooldown": 0, "actions": [{"exec": ["false"]}]},
+		{"name": "stadium", "zone": `+testZone+`, "cooldown": 0, "actions": [{"exec": ["false"]}]},
+		{"name": "night", "window": {"from": "22:00", "to": "06:00"}, "cooldown": 0, "actions": [{"exec": ["false"]}]}
+	]}`)
+	defer a.Wait()
+
+	firstSeen := time.Date(2020, 1, 2, 2, 0, 0, 0, time.UTC)
+	fired := func(info DroneInfoMessage) string {
+		var names []string
+		for _, alert := range a.Evaluate(info, firstSeen) {
+			names = append(names, alert.Rule)
+		}
+		return strings.Join(names, ",")
+	}
+
+	// testDetection is a Phantom 3 at -42 dBm
+	info := testDetection(t, firstSeen)
+	if got := fired(info); got != "dji,close,night" {
+		t.Errorf("first detection fired %q", got)
+	}
+
+	info = testDetection(t, firstSeen.Add(10*time.Hour))
+	info.SignalStrength = -70
+	info.Model = ""
+	if got := fired(info); got != "lingering" {
+		t.Errorf("weak, unknown model, after 10h fired %q", got)
+	}
+
+	info.RemoteId = &RemoteId{Latitude: 48.861, Longitude: 2.291}
+	if got := fired(info); got != "lingering,stadium" {
+		t.Errorf("in the zone fired %q", got)
+	}
+	// the actions may still be reading the previous one
+	info.RemoteId = &RemoteId{Latitude: 48.866, Longitude: 2.297}
+	if got := fired(info); got != "lingering" {
+		t.Errorf("in the hole of the zone fired %q", got)
+	}
+
+	// what a device receives says nothing of it
+	info.Role = ROLE_RECEIVER
+	if got := fired(info); got != "" {
+		t.Errorf("receiver fired %q", got)
+	}
+	if alerts := a.Evaluate(testDetection(t, firstSeen), time.Time{}); len(alerts) != 0 {
+		t.Errorf("never seen device fired %v", alerts)
+	}
+}
+
+func TestAlerterCooldown(t *testing.T) {
+	a := mustParseAlertRules(t, `{"rules": [
+		{"name": "default", "vendor": "dji", "actions": [{"exec": ["true"]}]},
+		{"name": "short", "vendor": "dji", "cooldown": 30, "actions": [{"exec": ["true"]}]}
+	]}`)
+	defer a.Wait()
+
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		delay    time.Duration
+		mac      string
+		expected string
+	}{
+		{0, "60:60:1f:42:11:b8", "default,short"},
+		{10 * time.Second, "60:60:1f:42:11:b8", ""},
+		// another device
+		{10 * time.Second, "60:60:1f:42:11:b9", "default,short"},
+		// from another worker, a bit late
+		{5 * time.Second, "60:60:1f:42:11:b8", ""},
+		{30 * time.Second, "60:60:1f:42:11:b8", "short"},
+		{5 * time.Minute, "60:60:1f:42:11:b8", "default,short"},
+	}
+	for i, test := range tests {
+		info := testDetection(t, start.Add(test.delay))
+		info.MacAddress = mustParseMAC(t, test.mac)
+
+		var names []string
+		for _, alert := range a.Evaluate(info, start) {
+			names = append(names, alert.Rule)
+		}
+		if got := strings.Join(names, ","); got != test.expected {
+			t.Errorf("%d: fired %q, expected %q", i, got, test.expected)
+		}
+	}
+
+	// a randomizing device is the same whatever its address
+	info := testDetection(t, start.Add(6*time.Minute))
+	info.MacAddress = mustParseMAC(t, "02:00:00:00:00:01")
+	info.DeviceId = "fp-1"
+	if alerts := a.Evaluate(info, start); len(alerts) != 2 {
+		t.Errorf("first detection of fp-1: %v", alerts)
+	}
+	info.MacAddress = mustParseMAC(t, "02:00:00:00:00:02")
+	if alerts := a.Evaluate(info, start); len(alerts) != 0 {
+		t.Errorf("fp-1 under another address: %v", alerts)
+	}
+}
+
+func TestAlerterForgetsCooldowns(t *testing.T) {
+	a := mustParseAlertRules(t, `{"rules": [
+		{"name": "short", "vendor": "dji", "cooldown": 30, "actions": [{"exec": ["true"]}]}
+	]}`)
+	defer a.Wait()
+
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		info := testDetection(t, start)
+		info.DeviceId = fmt.Sprintf("device-%d", i)
+		a.Evaluate(info, start)
+	}
+
+	// the cooldowns of the first devices are over
+	info := testDetection(t, start.Add(time.Minute))
+	info.DeviceId = "device-10"
+	if alerts := a.Evaluate(info, start); len(alerts) != 1 {
+		t.Errorf("device-10: %v", alerts)
+	}
+	if len(a.fired) != 1 {
+		t.Errorf("%d cooldowns remembered", len(a.fired))
+	}
+}
+
+/*
+A SMTP server accepting the emails of a single client.
+*/
+func listenSmtp(t *testing.T) (string, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	mails := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		reply("220 smtp.test ESMTP")
+
+		var envelope []string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			command := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+				reply("250 smtp.test")
+			case strings.HasPrefix(command, "MAIL FROM:"), strings.HasPrefix(command, "RCPT TO:"):
+				envelope = append(envelope, strings.TrimSpace(line))
+				reply("250 OK")
+			case command == "DATA":
+				reply("354 Go ahead")
+				var data strings.Builder
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				reply("250 OK")
+				mails <- strings.Join(envelope, "\n") + "\n\n" + data.String()
+			case command == "QUIT":
+				reply("221 Bye")
+				return
+			default:
+				reply("502 Not implemented")
+			}
+		}
+	}()
+	return listener.Addr().String(), mails
+}
+
+func TestAlerterActions(t *testing.T) {
+	var lock sync.Mutex
+	var posted []Alert
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var alert Alert
+		if err := json.NewDecoder(req.Body).Decode(&alert); err != nil {
+			t.Errorf("invalid webhook payload: %v", err)
+		}
+		lock.Lock()
+		posted = append(posted, alert)
+		lock.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	relay, mails := listenSmtp(t)
+	output := filepath.Join(t.TempDir(), "alert")
+
+	rules := map[string]interface{}{
+		"smtp": relay,
+		"from": "joe@probe.test",
+		"rules": []map[string]interface{}{{
+			"name":   "dji",
+			"vendor": "DJI",
+			"actions": []map[string]interface{}{
+				{"webhook": server.URL},
+				{"email": []string{"ops@example.com", "pilot@example.com"}},
+				{"exec": []string{"sh", "-c", `{ echo "$DJIJOE_RULE $DJIJOE_MAC $DJIJOE_RSSI $DJIJOE_MODEL"; cat; } > "$0"`, output}},
+			},
+		}},
+	}
+	data, _ := json.Marshal(rules)
+	a := mustParseAlertRules(t, string(data))
+
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	alerts := a.Evaluate(testDetection(t, ts), ts.Add(-90*time.Second))
+	a.Wait()
+	if len(alerts) != 1 || alerts[0].Dwell != 90 {
+		t.Fatalf("fired %+v", alerts)
+	}
+
+	if len(posted) != 1 || posted[0].Rule != "dji" || posted[0].Detection.Model != "Phantom 3" || !posted[0].Timestamp.Equal(ts) {
+		t.Errorf("webhook got %+v", posted)
+	}
+
+	select {
+	case mail := <-mails:
+		for _, expected := range []string{
+			"MAIL FROM:<joe@probe.test>", "RCPT TO:<ops@example.com>", "RCPT TO:<pilot@example.com>",
+			"To: ops@example.com, pilot@example.com\r\n", "Subject: [DJI-Joe] dji: SZ DJI Technology Co.,Ltd 60:60:1f:42:11:b8\r\n",
+			"Alert 'dji': SZ DJI Technology Co.,Ltd Phantom 3 (60:60:1f:42:11:b8) at -42 dBm, seen for 90s, by probe 'probe-1'",
+			"RSSI:      -42 dBm\r\n",
+		} {
+			if !strings.Contains(mail, expected) {
+				t.Errorf("no %q in the email:\n%s", expected, mail)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("no email")
+	}
+
+	got, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitN(string(got), "\n", 2)
+	if lines[0] != "dji 60:60:1f:42:11:b8 -42 Phantom 3" {
+		t.Errorf("exec environment %q", lines[0])
+	}
+	if obj := decodeObject(t, []byte(lines[1])); obj["rule"] != "dji" || obj["dwell"] != 90.0 {
+		t.Errorf("exec stdin %q", lines[1])
+	}
+}
+
+func TestEngineAlertsOnRemoteId(t *testing.T) {
+	scenario := DefaultScenario()
+	scenario.Duration = 30
+	packets, err := scenario.Generate(scenario.Probes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(t.TempDir(), "alerts")
+
+	// the DJI flies north into the zone after about 20s
+	alerts := mustParseAlertRules(t, `{"rules": [
+		{"name": "stadium", "zone": `+testZone+`, "actions": [{"exec": ["sh", "-c", "cat >> $0; echo >> $0", "`+output+`"]}]}
+	]}`)
+	cfg := Config{Log: NopLogger{}, Vendors: loadTestVendors(t), Alerts: alerts}
+	_, detections := runEngine(t, NewSliceSource(layers.LinkTypeIEEE80211Radio, packets), cfg)
+
+	located := 0
+	for _, info := range detections {
+		if info.RemoteId != nil {
+			located++
+			if info.RemoteId.SerialNumber != "1581F4XFC00000000001" {
+				t.Errorf("Remote ID %+v", info.RemoteId)
+			}
+		}
+	}
+	if located == 0 {
+		t.Fatalf("no Remote ID decoded from %d detections", len(detections))
+	}
+
+	got, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(got)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected a single alert, got %d", len(lines))
+	}
+
+	var alert Alert
+	if err := json.Unmarshal([]byte(lines[0]), &alert); err != nil {
+		t.Fatal(err)
+	}
+	rid := alert.Detection.RemoteId
+	if alert.Detection.MacAddress.String() != "60:60:1f:de:ad:01" || rid == nil || rid.Latitude < 48.86 || alert.Dwell < 15 || alert.Dwell > 25 {
+		t.Errorf("alert %+v at %+v", alert, rid)
+	}
+}
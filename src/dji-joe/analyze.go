@@ -0,0 +1,211 @@
+package djijoe
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const REPORT_TIME_FORMAT string = "2006-01-02 15:04:05"
+
+/*
+Summary of all the flagged devices seen in a capture.
+*/
+type SightingReport struct {
+	Source    string    `json:"source"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	NbPackets uint64    `json:"nb_packets"`
+	NbBytes   uint64    `json:"nb_bytes"`
+	Devices   []*Device `json:"devices"`
+}
+
+/*
+Wraps the source of an analysis: measures what it delivers, stops at its first
+error (a file does not get better), and hides its injection and filtering
+methods, if any.
+*/
+type analyzedSource struct {
+	source PacketSource
+	report *SightingReport
+	err    error
+}
+
+func (s *analyzedSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := s.source.ReadPacketData()
+	if err != nil {
+		if err != io.EOF {
+			s.err = err
+		}
+		return nil, ci, io.EOF
+	}
+
+	r := s.report
+	if r.NbPackets == 0 || ci.Timestamp.Before(r.Start) {
+		r.Start = ci.Timestamp
+	}
+	if ci.Timestamp.After(r.End) {
+		r.End = ci.Timestamp
+	}
+	r.NbPackets++
+	r.NbBytes += uint64(len(data))
+	return data, ci, nil
+}
+
+func (s *analyzedSource) LinkType() layers.LinkType {
+	return s.source.LinkType()
+}
+
+// the caller closes the source it passed
+func (s *analyzedSource) Close() {}
+
+/*
+Reads all the packets from `src` (as fast as it can deliver them) and builds the
+report of every device matching one of the `vendors`. The frames go through an
+engine, so the report holds what a probe would have detected; but nothing is
+sent over the air nor to the API.
+*/
+func Analyze(name string, src PacketSource, vendors Vendors) (*SightingReport, error) {
+	report := &SightingReport{Source: name}
+	source := &analyzedSource{source: src, report: report}
+
+	engine := NewEngine(source, Config{Vendors: vendors})
+	if err := engine.Run(context.Background()); err != nil {
+		return nil, err
+	}
+	if source.err != nil {
+		return nil, source.err
+	}
+
+	devices := engine.Devices()
+	report.Devices = make([]*Device, len(devices))
+	for i := range devices {
+		report.Devices[i] = &devices[i]
+	}
+	return report, nil
+}
+
+func formatSignalRange(d *Device) string {
+	return fmt.Sprintf("%d..%d dBm", d.MinSignal, d.MaxSignal)
+}
+
+func formatChannels(d *Device) string {
+	channels := make([]string, len(d.Channels))
+	for i, channel := range d.Channels {
+		channels[i] = strconv.Itoa(channel)
+	}
+	return strings.Join(channels, ",")
+}
+
+func formatFrames(d *Device) string {
+	return fmt.Sprintf("%d (B:%d P:%d D:%d)", d.NbFrames, d.NbBeacons, d.NbProbes, d.NbData)
+}
+
+func (r *SightingReport) header() []string {
+	return []string{"Vendor", "Model", "MAC", "SSID", "First seen", "Last seen",
+		"Frames", "RSSI", "Channels", "Clients"}
+}
+
+func (r *SightingReport) rows() [][]string {
+	var rows [][]string
+	for _, d := range r.Devices {
+		rows = append(rows, []string{
+			d.Vendor,
+			d.Model,
+			d.MacAddress.String(),
+			strings.Join(d.Ssids, ","),
+			d.FirstSeen.Format(REPORT_TIME_FORMAT),
+			d.LastSeen.Format(REPORT_TIME_FORMAT),
+			formatFrames(d),
+			formatSignalRange(d),
+			formatChannels(d),
+			strings.Join(d.Clients, ","),
+		})
+	}
+	return rows
+}
+
+/*
+Writes the report as a plain-text table.
+*/
+func (r *SightingReport) WriteTable(out io.Writer) error {
+	fmt.Fprintf(out, "Source: %s (%d packets, %d bytes, %s -> %s)\n\n",
+		r.Source, r.NbPackets, r.NbBytes,
+		r.Start.Format(REPORT_TIME_FORMAT), r.End.Format(REPORT_TIME_FORMAT))
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(r.header(), "\t"))
+	for _, row := range r.rows() {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	err := w.Flush()
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(out, "\n%d device(s) flagged\n", len(r.Devices))
+	return err
+}
+
+/*
+Writes the report as a Markdown table.
+*/
+func (r *SightingReport) WriteMarkdown(out io.Writer) error {
+	fmt.Fprintf(out, "## Sightings from `%s`\n\n", r.Source)
+	fmt.Fprintf(out, "%d packets, %d bytes, from %s to %s\n\n",
+		r.NbPackets, r.NbBytes,
+		r.Start.Format(REPORT_TIME_FORMAT), r.End.Format(REPORT_TIME_FORMAT))
+
+	header := r.header()
+	separator := make([]string, len(header))
+	for i := range separator {
+		separator[i] = "---"
+	}
+
+	fmt.Fprintf(out, "| %s |\n", strings.Join(header, " | "))
+	fmt.Fprintf(out, "| %s |\n", strings.Join(separator, " | "))
+	for _, row := range r.rows() {
+		for i, cell := range row {
+			row[i] = strings.Replace(cell, "|", "\\|", -1)
+		}
+		_, err := fmt.Fprintf(out, "| %s |\n", strings.Join(row, " | "))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Writes the report as JSON.
+*/
+func (r *SightingReport) WriteJSON(out io.Writer) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+/*
+The reports of several captures.
+*/
+type SightingReports []*SightingReport
+
+/*
+Writes the reports as a single JSON array.
+*/
+func (r SightingReports) WriteJSON(out io.Writer) error {
+	if r == nil {
+		r = SightingReports{}
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
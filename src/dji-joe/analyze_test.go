@@ -0,0 +1,140 @@
+package djijoe
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestAnalyzePcap(t *testing.T) {
+	vendors := loadTestVendors(t)
+
+	source, err := OpenFileSource("../../pcaps/test.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	report, err := Analyze("test.pcap", source, vendors)
+	if err != nil {
+		t.Fatalf("Analyze: %v", err)
+	}
+
+	if report.NbPackets != 1776 || report.NbBytes != 360464 {
+		t.Errorf("read %d packets (%d bytes), expected 1776 (360464)", report.NbPackets, report.NbBytes)
+	}
+	if len(report.Devices) != 1 {
+		t.Fatalf("got %d devices, expected 1", len(report.Devices))
+	}
+
+	d := report.Devices[0]
+	expected := Device{
+		MacAddress: mustParseMAC(t, "60:60:1f:42:11:b8"),
+		Vendor:     "SZ DJI Technology Co.,Ltd",
+		Ssids:      []string{"PHANTOM3_430fd3"},
+		FirstSeen:  time.Date(2017, 6, 1, 21, 24, 36, 661535000, time.UTC),
+		LastSeen:   time.Date(2017, 6, 1, 21, 24, 54, 484332000, time.UTC),
+		NbFrames:   22,
+		NbProbes:   22,
+		MinSignal:  -51,
+		MaxSignal:  -32,
+		LastSignal: -39,
+		Channels:   []int{1},
+	}
+
+	got, _ := json.Marshal(d)
+	want, _ := json.Marshal(&expected)
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %s\nexpected %s", got, want)
+	}
+
+	var table bytes.Buffer
+	if err := report.WriteTable(&table); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(table.String(), "60:60:1f:42:11:b8") || !strings.Contains(table.String(), "-51..-32 dBm") {
+		t.Errorf("unexpected table:\n%s", table.String())
+	}
+
+	var markdown bytes.Buffer
+	if err := report.WriteMarkdown(&markdown); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(markdown.String(), "| SZ DJI Technology Co.,Ltd |  | 60:60:1f:42:11:b8 | PHANTOM3_430fd3 |") {
+		t.Errorf("unexpected markdown:\n%s", markdown.String())
+	}
+
+	// several reports make one JSON document
+	var out bytes.Buffer
+	if err := (SightingReports{report, report}).WriteJSON(&out); err != nil {
+		t.Fatal(err)
+	}
+	var reports []map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &reports); err != nil || len(reports) != 2 || reports[1]["nb_packets"] != 1776.0 {
+		t.Errorf("unexpected JSON (%v):\n%s", err, out.String())
+	}
+}
+
+func TestAnalyzeMatchesEngine(t *testing.T) {
+	vendors := loadTestVendors(t)
+
+	source, err := OpenFileSource("../../pcaps/test.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	report, err := Analyze("test.pcap", source, vendors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	live, err := OpenFileSource("../../pcaps/test.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.Close()
+	engine, _ := runEngine(t, live, Config{Vendors: vendors})
+
+	got, _ := json.Marshal(report.Devices)
+	devices := engine.Devices()
+	want, _ := json.Marshal(devices)
+	if !bytes.Equal(got, want) {
+		t.Errorf("the analysis found %s\nthe engine %s", got, want)
+	}
+}
+
+func TestAnalyzeDataFrames(t *testing.T) {
+	vendors := loadTestVendors(t)
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	dji := mustParseMAC(t, "60:60:1f:00:00:01")
+	phone := mustParseMAC(t, "b8:27:eb:00:00:03")
+	laptop := mustParseMAC(t, "b8:27:eb:00:00:04")
+
+	frames := []RawPacket{
+		// the DJI is the access point of the phone
+		buildFrame(t, ts, -40, 2437,
+			&layers.Dot11{Type: layers.Dot11TypeData, Flags: layers.Dot11FlagsFromDS, Address1: phone, Address2: dji, Address3: dji},
+			gopacket.Payload(make([]byte, 32))),
+		buildFrame(t, ts.Add(time.Second), -60, 2437,
+			&layers.Dot11{Type: layers.Dot11TypeData, Flags: layers.Dot11FlagsToDS, Address1: dji, Address2: laptop, Address3: dji},
+			gopacket.Payload(make([]byte, 32))),
+	}
+	report, err := Analyze("synthetic", NewSliceSource(layers.LinkTypeIEEE80211Radio, frames), vendors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.NbPackets != 2 || len(report.Devices) != 1 {
+		t.Fatalf("analyzed %d frames, %d devices", report.NbPackets, len(report.Devices))
+	}
+	d := report.Devices[0]
+	if !bytes.Equal(d.MacAddress, dji) || d.NbData != 1 || d.LastSignal != -40 ||
+		strings.Join(d.Clients, ",") != phone.String()+","+laptop.String() {
+		t.Errorf("got %+v", d)
+	}
+}
@@ -0,0 +1,121 @@
+package djijoe
+
+import (
+	"fmt"
+	"strings"
+)
+
+// above this many prefixes, the BPF program would exceed the size limit of
+// the kernel (4096 instructions): the capture is then left unfiltered
+const BPF_MAX_PREFIXES = 256
+
+// offsets of the addresses in the 802.11 header
+const (
+	DOT11_ADDR1_OFFSET = 4
+	DOT11_ADDR2_OFFSET = 10
+	DOT11_ADDR3_OFFSET = 16
+)
+
+/*
+Implemented by the sources able to filter the frames in the kernel.
+*/
+type FilterableSource interface {
+	SetFilter(expr string) error
+}
+
+/*
+Returns the pcap-filter expression comparing the address at `offset` in the
+802.11 header to `prefix`, 32 bits at most at a time.
+*/
+func bpfPrefixCondition(offset int, prefix MacPrefix) string {
+	var terms []string
+
+	for _, chunk := range []struct{ start, size int }{{0, 4}, {4, 2}} {
+		var value, mask uint32
+		for i := 0; i < chunk.size; i++ {
+			bits := prefix.Length - 8*(chunk.start+i)
+			if bits > 8 {
+				bits = 8
+			}
+			var byteMask uint32
+			if bits > 0 {
+				byteMask = (0xff << uint(8-bits)) & 0xff
+			}
+
+			value = value<<8 | uint32(prefix.Address[chunk.start+i])&byteMask
+			mask = mask<<8 | byteMask
+		}
+		if mask == 0 {
+			continue
+		}
+
+		load := fmt.Sprintf("wlan[%d:%d]", offset+chunk.start, chunk.size)
+		if mask != uint32(0xffffffff)>>uint(32-8*chunk.size) {
+			load = fmt.Sprintf("%s & 0x%0*x", load, 2*chunk.size, mask)
+		}
+		terms = append(terms, fmt.Sprintf("%s = 0x%0*x", load, 2*chunk.size, value))
+	}
+
+	return strings.Join(terms, " and ")
+}
+
+/*
+Builds the capture filter of a vendor list: the probe requests (to fingerprint
+their senders, whatever their address), and the frames with an address
+matching one of the prefixes. The transmitter address comes first, as the
+receiver address is all the control frames have (loading past the end of a
+frame rejects it). `extra`, if any, is ANDed with it.
+
+Returns only `extra` if there are too many prefixes for a BPF program.
+*/
+func BuildBpfFilter(vendors Vendors, extra string) (string, error) {
+	var prefixes []MacPrefix
+	for _, vendor := range vendors {
+		prefixes = append(prefixes, vendor.MacAddressPrefixes...)
+	}
+
+	if len(prefixes) > BPF_MAX_PREFIXES {
+		return extra, fmt.Errorf("%d MAC address prefixes, more than the %d a BPF program can hold", len(prefixes), BPF_MAX_PREFIXES)
+	}
+
+	terms := []string{"(type mgt subtype probe-req)"}
+	for _, offset := range []int{DOT11_ADDR2_OFFSET, DOT11_ADDR1_OFFSET, DOT11_ADDR3_OFFSET} {
+		for _, prefix := range prefixes {
+			terms = append(terms, "("+bpfPrefixCondition(offset, prefix)+")")
+		}
+	}
+
+	filter := strings.Join(terms, " or ")
+	if strings.TrimSpace(extra) != "" {
+		filter = fmt.Sprintf("(%s) and (%s)", filter, extra)
+	}
+	return filter, nil
+}
+
+/*
+Installs the capture filter of the vendors in `set` (if `Config.BpfPrefilter`)
+and/or `Config.BpfFilter` on the source, if it can filter. On error, the
+previous filter stays in place.
+*/
+func (e *Engine) installFilter(set *VendorSet) {
+	source, ok := e.Source.(FilterableSource)
+	if !ok || (!e.Config.BpfPrefilter && e.Config.BpfFilter == "") {
+		return
+	}
+
+	filter := e.Config.BpfFilter
+	if e.Config.BpfPrefilter {
+		var err error
+		filter, err = BuildBpfFilter(set.Vendors, e.Config.BpfFilter)
+		if err != nil {
+			e.log.WarningF("No capture filter on the vendors: %+v", err)
+		}
+	}
+
+	err := source.SetFilter(filter)
+	if err != nil {
+		e.log.ErrorF("Failed to install the capture filter '%s': %+v", filter, err)
+		return
+	}
+	e.log.DebugF("Capture filter: %s", filter)
+}
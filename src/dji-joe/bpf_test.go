@@ -0,0 +1,100 @@
+package djijoe
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+/*
+A source recording the capture filters installed on it.
+*/
+type filteringSource struct {
+	*SliceSource
+	filters []string
+}
+
+func (s *filteringSource) SetFilter(expr string) error {
+	s.filters = append(s.filters, expr)
+	return nil
+}
+
+func TestBpfPrefixCondition(t *testing.T) {
+	tests := map[string]string{
+		"60:60:1f":      "wlan[10:4] & 0xffffff00 = 0x60601f00",
+		"70:b3:d5:f/28": "wlan[10:4] & 0xfffffff0 = 0x70b3d5f0",
+		"70:b3:d5:f2:d": "wlan[10:4] = 0x70b3d5f2 and wlan[14:2] & 0xf000 = 0xd000",
+	}
+
+	for s, expected := range tests {
+		prefix, err := ParseMacPrefix(s)
+		if err != nil {
+			t.Fatalf("ParseMacPrefix(%q): %v", s, err)
+		}
+		if condition := bpfPrefixCondition(DOT11_ADDR2_OFFSET, prefix); condition != expected {
+			t.Errorf("%s: got %q, expected %q", s, condition, expected)
+		}
+	}
+}
+
+func TestBuildBpfFilter(t *testing.T) {
+	prefix, _ := ParseMacPrefix("60:60:1f")
+	vendors := Vendors{{Name: "DJI", MacAddressPrefixes: []MacPrefix{prefix}}}
+
+	filter, err := BuildBpfFilter(vendors, "not subtype beacon")
+	expected := "((type mgt subtype probe-req) or (wlan[10:4] & 0xffffff00 = 0x60601f00) or " +
+		"(wlan[4:4] & 0xffffff00 = 0x60601f00) or (wlan[16:4] & 0xffffff00 = 0x60601f00)) and (not subtype beacon)"
+	if err != nil || filter != expected {
+		t.Errorf("got %q (%v), expected %q", filter, err, expected)
+	}
+
+	// too many prefixes: only the extra expression is left
+	for i := 0; i < BPF_MAX_PREFIXES; i++ {
+		vendors[0].MacAddressPrefixes = append(vendors[0].MacAddressPrefixes, prefix)
+	}
+	filter, err = BuildBpfFilter(vendors, "not subtype beacon")
+	if err == nil || filter != "not subtype beacon" {
+		t.Errorf("got %q (%v) with %d prefixes", filter, err, len(vendors[0].MacAddressPrefixes))
+	}
+}
+
+func TestEngineInstallsFilter(t *testing.T) {
+	source := &filteringSource{SliceSource: NewSliceSource(layers.LinkTypeIEEE80211Radio, nil)}
+	engine, _ := runEngine(t, source, Config{Vendors: loadTestVendors(t), BpfPrefilter: true, BpfFilter: "not subtype beacon"})
+
+	if len(source.filters) != 1 || !strings.Contains(source.filters[0], "0x60601f00") ||
+		!strings.HasSuffix(source.filters[0], " and (not subtype beacon)") {
+		t.Fatalf("got filters %q", source.filters)
+	}
+
+	// the filter follows the vendors
+	prefix, _ := ParseMacPrefix("90:03:b7")
+	set, err := NewVendorSet(Vendors{{Name: "Parrot SA", MacAddressPrefixes: []MacPrefix{prefix}}}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine.SetVendors(set)
+	if len(source.filters) != 2 || strings.Contains(source.filters[1], "0x60601f00") ||
+		!strings.Contains(source.filters[1], "0x9003b700") {
+		t.Errorf("got filters %q", source.filters)
+	}
+}
+
+func TestEngineUserFilterOnly(t *testing.T) {
+	source := &filteringSource{SliceSource: NewSliceSource(layers.LinkTypeIEEE80211Radio, nil)}
+	runEngine(t, source, Config{Vendors: loadTestVendors(t), BpfFilter: "type mgt"})
+
+	if len(source.filters) != 1 || source.filters[0] != "type mgt" {
+		t.Errorf("got filters %q", source.filters)
+	}
+}
+
+func TestEngineNoPrefilterWithFlaggedBssid(t *testing.T) {
+	source := &filteringSource{SliceSource: NewSliceSource(layers.LinkTypeIEEE80211Radio, nil)}
+	runEngine(t, source, Config{Vendors: loadTestVendors(t), BpfPrefilter: true, BpfFilter: "type mgt", OutputFlaggedBssid: true})
+
+	if len(source.filters) != 1 || source.filters[0] != "type mgt" {
+		t.Errorf("got filters %q", source.filters)
+	}
+}
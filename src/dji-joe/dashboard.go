@@ -0,0 +1,87 @@
+package djijoe
+
+/*
+The dashboard served by the status API: the live drones, the strongest signal
+first, refreshed every few seconds. Self-contained, to work without Internet
+access in the field.
+*/
+const statusDashboard = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>DJI-Joe</title>
+<style>
+body { font-family: sans-serif; margin: 0; padding: 0.5em; background: #111; color: #eee; }
+h1 { font-size: 1.2em; margin: 0.2em 0; }
+#status { font-size: 0.85em; color: #aaa; margin-bottom: 0.5em; }
+table { width: 100%; border-collapse: collapse; }
+th, td { text-align: left; padding: 0.4em 0.3em; border-bottom: 1px solid #333; }
+th { font-size: 0.8em; color: #aaa; }
+td.rssi { font-weight: bold; white-space: nowrap; }
+.strong { color: #f55; } .medium { color: #fb3; } .weak { color: #8c8; }
+.mac { font-family: monospace; }
+#empty { color: #888; padding: 1em 0; }
+</style>
+</head>
+<body>
+<h1>DJI-Joe <span id="host"></span></h1>
+<div id="status">Loading...</div>
+<table>
+<thead><tr><th>RSSI</th><th>Vendor / model</th><th>MAC</th><th>SSID</th><th>Ch.</th><th>Last seen</th></tr></thead>
+<tbody id="devices"></tbody>
+</table>
+<div id="empty" hidden>No drone seen in the last 5 minutes.</div>
+<script>
+function text(value) {
+	return String(value === undefined || value === null ? "" : value)
+		.replace(/&/g, "&amp;").replace(/</g, "&lt;").replace(/>/g, "&gt;");
+}
+
+function strength(rssi) {
+	if (rssi >= -50) return "strong";
+	if (rssi >= -70) return "medium";
+	return "weak";
+}
+
+function ago(ts) {
+	var seconds = Math.max(0, Math.round((Date.now() - Date.parse(ts)) / 1000));
+	return seconds < 60 ? seconds + "s" : Math.floor(seconds / 60) + "m" + (seconds % 60) + "s";
+}
+
+function get(path) {
+	return fetch(path, {cache: "no-store"}).then(function (r) { return r.json(); });
+}
+
+function refresh() {
+	Promise.all([get("api/devices?live=1"), get("api/stats"), get("api/radio")]).then(function (all) {
+		var devices = all[0], stats = all[1], radio = all[2];
+
+		document.getElementById("host").textContent = "on " + stats.host;
+		var status = stats.engine.captured + " frames, " + stats.nb_vendors + " vendors";
+		if (radio) {
+			status += ", " + radio.interface + " on channel " + radio.channel;
+		}
+		document.getElementById("status").textContent = status;
+
+		var rows = devices.map(function (d) {
+			return "<tr><td class='rssi " + strength(d.last_strength) + "'>" + d.last_strength + " dBm</td>" +
+				"<td>" + text(d.vendor) + (d.model ? "<br>" + text(d.model) : "") + "</td>" +
+				"<td class='mac'>" + text(d.macaddr) + "</td>" +
+				"<td>" + text((d.ssids || []).join(", ")) + "</td>" +
+				"<td>" + text((d.channels || []).join(",")) + "</td>" +
+				"<td>" + ago(d.last_seen) + "</td></tr>";
+		});
+		document.getElementById("devices").innerHTML = rows.join("");
+		document.getElementById("empty").hidden = devices.length > 0;
+	}).catch(function (err) {
+		document.getElementById("status").textContent = "Probe unreachable: " + err;
+	});
+}
+
+refresh();
+setInterval(refresh, 3000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,166 @@
+package djijoe
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"sort"
+	"time"
+)
+
+/*
+Everything known about a flagged device, aggregated over all its frames.
+*/
+type Device struct {
+	MacAddress net.HardwareAddr `json:"macaddr"`
+	Vendor     string           `json:"vendor"`
+	Model      string           `json:"model,omitempty"`
+	Ssids      []string         `json:"ssids,omitempty"`
+	FirstSeen  time.Time        `json:"first_seen"`
+	LastSeen   time.Time        `json:"last_seen"`
+	NbFrames   uint64           `json:"nb_frames"`
+	NbBeacons  uint64           `json:"nb_beacons"`
+	NbProbes   uint64           `json:"nb_probes"`
+	NbData     uint64           `json:"nb_data"`
+	MinSignal  int8             `json:"min_strength"`
+	MaxSignal  int8             `json:"max_strength"`
+	LastSignal int8             `json:"last_strength"`
+	Channels   []int            `json:"channels,omitempty"`
+	Clients    []string         `json:"clients,omitempty"`
+}
+
+/*
+Marshals the device with its MAC address in its usual text form.
+*/
+func (d *Device) MarshalJSON() ([]byte, error) {
+	type device Device
+	return json.Marshal(&struct {
+		MacAddress string `json:"macaddr"`
+		*device
+	}{
+		MacAddress: d.MacAddress.String(),
+		device:     (*device)(d),
+	})
+}
+
+/*
+Records a new frame from the device.
+*/
+func (d *Device) Update(ts time.Time, messageType int, signal int8, frequency uint16) {
+	if d.NbFrames == 0 || ts.Before(d.FirstSeen) {
+		d.FirstSeen = ts
+	}
+	if d.NbFrames == 0 || !ts.Before(d.LastSeen) {
+		d.LastSeen = ts
+		d.LastSignal = signal
+	}
+
+	if d.NbFrames == 0 || signal < d.MinSignal {
+		d.MinSignal = signal
+	}
+	if d.NbFrames == 0 || signal > d.MaxSignal {
+		d.MaxSignal = signal
+	}
+	d.NbFrames++
+
+	switch messageType {
+	case TYPE_BEACON:
+		d.NbBeacons++
+	case TYPE_PROBE_REQUEST:
+		d.NbProbes++
+	case TYPE_DATA, TYPE_NULL_DATA:
+		d.NbData++
+	}
+
+	channel := FrequencyToChannel(frequency)
+	if channel != 0 && !containsInt(d.Channels, channel) {
+		d.Channels = append(d.Channels, channel)
+		sort.Ints(d.Channels)
+	}
+}
+
+/*
+Returns a copy of the device, sharing nothing with it.
+*/
+func (d *Device) Clone() Device {
+	clone := *d
+	clone.MacAddress = append(net.HardwareAddr(nil), d.MacAddress...)
+	clone.Ssids = append([]string(nil), d.Ssids...)
+	clone.Channels = append([]int(nil), d.Channels...)
+	clone.Clients = append([]string(nil), d.Clients...)
+	return clone
+}
+
+func (d *Device) AddSsid(ssid string) {
+	if ssid == "" || containsString(d.Ssids, ssid) {
+		return
+	}
+	d.Ssids = append(d.Ssids, ssid)
+}
+
+func (d *Device) AddClient(hwaddr net.HardwareAddr) {
+	if isGroupMac(hwaddr) || bytes.Equal(hwaddr, d.MacAddress) {
+		return
+	}
+
+	client := hwaddr.String()
+	if containsString(d.Clients, client) {
+		return
+	}
+	d.Clients = append(d.Clients, client)
+}
+
+/*
+The set of flagged devices, indexed by MAC address.
+*/
+type DeviceTable struct {
+	devices map[string]*Device
+}
+
+func NewDeviceTable() *DeviceTable {
+	return &DeviceTable{
+		devices: make(map[string]*Device),
+	}
+}
+
+/*
+Returns the device with the given MAC address, or nil if it was never seen.
+*/
+func (t *DeviceTable) Get(hwaddr net.HardwareAddr) *Device {
+	return t.devices[string(hwaddr)]
+}
+
+func (t *DeviceTable) GetOrCreate(hwaddr net.HardwareAddr, vendor string, model string) *Device {
+	device, ok := t.devices[string(hwaddr)]
+	if !ok {
+		device = &Device{
+			MacAddress: append(net.HardwareAddr(nil), hwaddr...),
+			Vendor:     vendor,
+			Model:      model,
+		}
+		t.devices[string(hwaddr)] = device
+	}
+	return device
+}
+
+func (t *DeviceTable) Len() int {
+	return len(t.devices)
+}
+
+/*
+Returns all the devices, sorted by the time they were first seen.
+*/
+func (t *DeviceTable) Devices() []*Device {
+	devices := make([]*Device, 0, len(t.devices))
+	for _, device := range t.devices {
+		devices = append(devices, device)
+	}
+
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].FirstSeen.Equal(devices[j].FirstSeen) {
+			return bytes.Compare(devices[i].MacAddress, devices[j].MacAddress) < 0
+		}
+		return devices[i].FirstSeen.Before(devices[j].FirstSeen)
+	})
+	return devices
+}
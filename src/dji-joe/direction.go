@@ -0,0 +1,366 @@
+package djijoe
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// width of the heading bins, in degrees
+	DF_BIN_WIDTH = 10
+	DF_NB_BINS   = 360 / DF_BIN_WIDTH
+	// a frame only counts if a heading was read this close to it
+	DF_MAX_HEADING_AGE = 2 * time.Second
+	// samples older than this are forgotten, as the target may have moved
+	DF_WINDOW = 2 * time.Minute
+	// bins needed for an estimate
+	DF_MIN_BINS = 3
+	// contrast (in dB) between the peak and the other bins, and number of bins
+	// covered by the sweep, for a full confidence
+	DF_FULL_CONTRAST = 10.0
+	DF_FULL_COVERAGE = DF_NB_BINS / 2
+	// how often the estimate is logged
+	DF_REPORT_INTERVAL = 10 * time.Second
+)
+
+/*
+The direction a target is estimated to be in: `Bearing` in degrees from the
+north (as the compass gives it), and `Confidence` between 0 and 1. A sweep
+over half the horizon showing 10 dB between the peak and the other headings
+gives a full confidence.
+*/
+type BearingEstimate struct {
+	Bearing    float64 `json:"degrees"`
+	Confidence float64 `json:"confidence"`
+	Samples    int     `json:"samples"`
+}
+
+type headingSample struct {
+	ts      time.Time
+	heading float64
+}
+
+type signalSample struct {
+	ts      time.Time
+	heading float64
+	signal  int8
+}
+
+/*
+Estimates the bearing of one target, swept with a directional antenna: the
+signal of its frames is binned by the heading of the antenna when they were
+received. `Offset` is added to the headings, for an antenna not aligned with
+the compass.
+*/
+type DirectionFinder struct {
+	Target net.HardwareAddr
+	Offset float64
+	Log    Logger
+
+	headings []headingSample
+	samples  []signalSample
+	lock     sync.Mutex
+}
+
+func NewDirectionFinder(target net.HardwareAddr, log Logger) *DirectionFinder {
+	if log == nil {
+		log = NopLogger{}
+	}
+	return &DirectionFinder{Target: target, Log: log}
+}
+
+/*
+Records the heading of the antenna at `ts`.
+*/
+func (d *DirectionFinder) SetHeading(heading float64, ts time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	heading = math.Mod(heading+d.Offset, 360)
+	if heading < 0 {
+		heading += 360
+	}
+	d.headings = append(d.headings, headingSample{ts, heading})
+
+	for len(d.headings) > 0 && ts.Sub(d.headings[0].ts) > DF_WINDOW {
+		d.headings = d.headings[1:]
+	}
+}
+
+/*
+Returns the heading read the closest to `ts`, if close enough. The headings
+are in the order they were read.
+*/
+func (d *DirectionFinder) headingAt(ts time.Time) (float64, bool) {
+	i := sort.Search(len(d.headings), func(i int) bool {
+		return !d.headings[i].ts.Before(ts)
+	})
+
+	best, bestDelay := -1, DF_MAX_HEADING_AGE
+	for _, j := range []int{i - 1, i} {
+		if j < 0 || j >= len(d.headings) {
+			continue
+		}
+		delay := d.headings[j].ts.Sub(ts)
+		if delay < 0 {
+			delay = -delay
+		}
+		if delay <= bestDelay {
+			best, bestDelay = j, delay
+		}
+	}
+
+	if best < 0 {
+		return 0, false
+	}
+	return d.headings[best].heading, true
+}
+
+/*
+Records a detection if it was sent by the target, and returns the updated
+estimate of its bearing (nil for the other devices, or without enough data).
+*/
+func (d *DirectionFinder) Observe(info DroneInfoMessage) *BearingEstimate {
+	if !bytes.Equal(info.MacAddress, d.Target) || (info.Role != "" && info.Role != ROLE_TRANSMITTER) {
+		return nil
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if heading, ok := d.headingAt(info.Timestamp); ok {
+		d.samples = append(d.samples, signalSample{info.Timestamp, heading, info.SignalStrength})
+	}
+	for len(d.samples) > 0 && info.Timestamp.Sub(d.samples[0].ts) > DF_WINDOW {
+		d.samples = d.samples[1:]
+	}
+
+	return d.estimate()
+}
+
+/*
+Returns the current estimate of the bearing of the target, or nil without
+enough data.
+*/
+func (d *DirectionFinder) Estimate() *BearingEstimate {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.estimate()
+}
+
+/*
+The bearing is the mean of the centers of the strongest bin and of its
+neighbours, weighted by their (linear) power. The confidence grows with the
+contrast between the strongest bin and the others, and with the part of the
+horizon swept.
+*/
+func (d *DirectionFinder) estimate() *BearingEstimate {
+	var power [DF_NB_BINS]float64
+	var counts [DF_NB_BINS]int
+	for _, sample := range d.samples {
+		bin := int(sample.heading/DF_BIN_WIDTH) % DF_NB_BINS
+		power[bin] += math.Pow(10, float64(sample.signal)/10)
+		counts[bin]++
+	}
+
+	var covered int
+	var levels [DF_NB_BINS]float64
+	peak := -1
+	for bin := range power {
+		if counts[bin] == 0 {
+			continue
+		}
+		covered++
+		power[bin] /= float64(counts[bin])
+		levels[bin] = 10 * math.Log10(power[bin])
+		if peak < 0 || levels[bin] > levels[peak] {
+			peak = bin
+		}
+	}
+	if covered < DF_MIN_BINS {
+		return nil
+	}
+
+	var x, y, others float64
+	var nbOthers int
+	for bin := range power {
+		if counts[bin] == 0 {
+			continue
+		}
+		distance := (bin - peak + DF_NB_BINS) % DF_NB_BINS
+		if distance <= 1 || distance == DF_NB_BINS-1 {
+			angle := (float64(bin) + 0.5) * DF_BIN_WIDTH * math.Pi / 180
+			x += power[bin] * math.Cos(angle)
+			y += power[bin] * math.Sin(angle)
+		} else {
+			others += levels[bin]
+			nbOthers++
+		}
+	}
+
+	bearing := math.Atan2(y, x) * 180 / math.Pi
+	if bearing < 0 {
+		bearing += 360
+	}
+
+	var contrast float64
+	if nbOthers > 0 {
+		contrast = levels[peak] - others/float64(nbOthers)
+	}
+	confidence := math.Min(1, contrast/DF_FULL_CONTRAST) * math.Min(1, float64(covered)/DF_FULL_COVERAGE)
+
+	return &BearingEstimate{
+		Bearing:    math.Round(bearing*10) / 10,
+		Confidence: math.Round(confidence*100) / 100,
+		Samples:    len(d.samples),
+	}
+}
+
+/*
+Reads the headings of a compass, one per line, until `ctx` is cancelled or
+`input` is exhausted, and logs the estimate every DF_REPORT_INTERVAL.
+*/
+func (d *DirectionFinder) Run(ctx context.Context, input io.Reader) error {
+	lines := make(chan string)
+	errc := make(chan error, 1)
+	go func() {
+		scanner := bufio.NewScanner(input)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-ctx.Done():
+				return
+			}
+		}
+		errc <- scanner.Err()
+	}()
+
+	ticker := time.NewTicker(DF_REPORT_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case err := <-errc:
+			return err
+
+		case line := <-lines:
+			heading, ok := ParseHeading(line)
+			if ok {
+				d.SetHeading(heading, time.Now())
+			}
+
+		case <-ticker.C:
+			if estimate := d.Estimate(); estimate != nil {
+				d.Log.NoticeF("%s is at %.0f° (confidence %.0f%%, %d samples)",
+					d.Target, estimate.Bearing, 100*estimate.Confidence, estimate.Samples)
+			} else {
+				d.Log.InfoF("No bearing for %s yet: sweep the antenna", d.Target)
+			}
+		}
+	}
+}
+
+/*
+Parses a heading, in degrees: either a NMEA HDT sentence from any talker (e.g.
+"$HEHDT,123.4,T*2C", its checksum is checked if present), or a line holding
+only the number of degrees.
+*/
+func ParseHeading(line string) (float64, bool) {
+	line = strings.TrimSpace(line)
+
+	if strings.HasPrefix(line, "$") {
+		sentence := line[1:]
+		if idx := strings.IndexByte(sentence, '*'); idx >= 0 {
+			expected, err := strconv.ParseUint(sentence[idx+1:], 16, 8)
+			if err != nil {
+				return 0, false
+			}
+			var checksum byte
+			for i := 0; i < idx; i++ {
+				checksum ^= sentence[i]
+			}
+			if checksum != byte(expected) {
+				return 0, false
+			}
+			sentence = sentence[:idx]
+		}
+
+		fields := strings.Split(sentence, ",")
+		if len(fields) < 2 || len(fields[0]) != 5 || fields[0][2:] != "HDT" {
+			return 0, false
+		}
+		line = fields[1]
+	}
+
+	heading, err := strconv.ParseFloat(line, 64)
+	if err != nil || heading < 0 || heading >= 360 || math.IsNaN(heading) {
+		return 0, false
+	}
+	return heading, true
+}
+
+/*
+Opens the input of a compass: "-" for stdin, "udp://[host]:port" to listen for
+datagrams of headings, or the path to a (serial) device, already configured
+(e.g. with `stty`).
+*/
+func OpenCompass(spec string) (io.ReadCloser, error) {
+	switch {
+	case spec == "-":
+		return os.Stdin, nil
+
+	case strings.HasPrefix(spec, "udp://"):
+		conn, err := net.ListenPacket("udp", strings.TrimPrefix(spec, "udp://"))
+		if err != nil {
+			return nil, err
+		}
+		return &datagramReader{conn: conn}, nil
+	}
+
+	file, err := os.Open(spec)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open compass '%s': %v", spec, err)
+	}
+	return file, nil
+}
+
+/*
+Reads datagrams as lines, even without their trailing newline.
+*/
+type datagramReader struct {
+	conn    net.PacketConn
+	pending []byte
+	buffer  [2048]byte
+}
+
+func (r *datagramReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		n, _, err := r.conn.ReadFrom(r.buffer[:])
+		if err != nil {
+			return 0, err
+		}
+		r.pending = append(r.buffer[:n:n], '\n')
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *datagramReader) Close() error {
+	return r.conn.Close()
+}
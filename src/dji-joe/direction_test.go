@@ -0,0 +1,191 @@
+package djijoe
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func nmeaSentence(body string) string {
+	var checksum byte
+	for i := 0; i < len(body); i++ {
+		checksum ^= body[i]
+	}
+	return fmt.Sprintf("$%s*%02X", body, checksum)
+}
+
+func TestParseHeading(t *testing.T) {
+	tests := map[string]float64{
+		nmeaSentence("HEHDT,123.4,T"): 123.4,
+		nmeaSentence("HCHDT,0.0,T"):   0,
+		"$GPHDT,45.5,T":               45.5,
+		" 270.5\r":                    270.5,
+		"$HEHDT,123.4,T*00":           -1,
+		nmeaSentence("GPGGA,1,2,3"):   -1,
+		"$HEHDT,,T":                   -1,
+		"360":                         -1,
+		"-1":                          -1,
+		"north":                       -1,
+	}
+
+	for line, expected := range tests {
+		heading, ok := ParseHeading(line)
+		if ok != (expected >= 0) || (ok && heading != expected) {
+			t.Errorf("%q: got %v (%v), expected %v", line, heading, ok, expected)
+		}
+	}
+}
+
+/*
+The signal of a target at `bearing`, through an antenna pointed at `heading`:
+-45 dBm in its direction, 1 dB less every 6 degrees away from it.
+*/
+func yagiSignal(bearing float64, heading float64) int8 {
+	diff := math.Abs(math.Mod(heading-bearing+540, 360) - 180)
+	return int8(-45 - diff/6)
+}
+
+/*
+Sweeps the antenna from `from` over `span` degrees, 1 degree per 100 ms, with a
+frame from the target at each step.
+*/
+func sweep(d *DirectionFinder, start time.Time, bearing float64, from float64, span float64) *BearingEstimate {
+	var estimate *BearingEstimate
+	for step := 0.0; step < span; step++ {
+		ts := start.Add(time.Duration(step) * 100 * time.Millisecond)
+		heading := math.Mod(from+step, 360)
+		d.SetHeading(heading, ts)
+		estimate = d.Observe(DroneInfoMessage{
+			Timestamp:      ts.Add(30 * time.Millisecond),
+			MacAddress:     d.Target,
+			Role:           ROLE_TRANSMITTER,
+			SignalStrength: yagiSignal(bearing, heading),
+		})
+	}
+	return estimate
+}
+
+func TestDirectionFinder(t *testing.T) {
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	target := mustParseMAC(t, "60:60:1f:42:11:b8")
+
+	tests := []struct {
+		name          string
+		bearing       float64
+		from, span    float64
+		minConfidence float64
+		maxConfidence float64
+	}{
+		{"full sweep", 120, 0, 360, 1, 1},
+		{"across the north", 355, 200, 360, 1, 1},
+		{"partial sweep", 120, 60, 120, 0.2, 0.5},
+	}
+
+	for _, test := range tests {
+		d := NewDirectionFinder(target, nil)
+		estimate := sweep(d, start, test.bearing, test.from, test.span)
+		if estimate == nil {
+			t.Errorf("%s: no estimate", test.name)
+			continue
+		}
+
+		diff := math.Abs(math.Mod(estimate.Bearing-test.bearing+540, 360) - 180)
+		if diff > DF_BIN_WIDTH/2 || estimate.Confidence < test.minConfidence ||
+			estimate.Confidence > test.maxConfidence || estimate.Samples != int(test.span) {
+			t.Errorf("%s: got %+v, expected %v°", test.name, estimate, test.bearing)
+		}
+	}
+}
+
+func TestDirectionFinderIgnores(t *testing.T) {
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	d := NewDirectionFinder(mustParseMAC(t, "60:60:1f:42:11:b8"), nil)
+	d.Offset = 20
+
+	d.SetHeading(350, start)
+	if heading, ok := d.headingAt(start.Add(time.Second)); !ok || heading != 10 {
+		t.Errorf("offset heading: got %v (%v)", heading, ok)
+	}
+
+	for i := 0; i < 10; i++ {
+		info := DroneInfoMessage{Timestamp: start, MacAddress: d.Target, Role: ROLE_TRANSMITTER, SignalStrength: -50}
+		// no heading close enough
+		info.Timestamp = start.Add(DF_MAX_HEADING_AGE + time.Second)
+		d.Observe(info)
+		// the signal of the other end
+		info.Timestamp, info.Role = start, ROLE_RECEIVER
+		d.Observe(info)
+		// another device
+		info.Role, info.MacAddress = ROLE_TRANSMITTER, mustParseMAC(t, "60:60:1f:00:00:01")
+		d.Observe(info)
+	}
+
+	if len(d.samples) != 0 || d.Estimate() != nil {
+		t.Errorf("got %d samples", len(d.samples))
+	}
+}
+
+func TestEngineReportsBearing(t *testing.T) {
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	dji := mustParseMAC(t, "60:60:1f:00:00:01")
+	broadcast := mustParseMAC(t, "ff:ff:ff:ff:ff:ff")
+	d := NewDirectionFinder(dji, nil)
+
+	// a full turn, 10 degrees a second
+	var frames []RawPacket
+	for i := 0; i < 36; i++ {
+		ts := start.Add(time.Duration(i) * time.Second)
+		heading := float64(10 * i)
+		d.SetHeading(heading, ts)
+		frames = append(frames, buildFrame(t, ts.Add(100*time.Millisecond), yagiSignal(200, heading), 2412,
+			&layers.Dot11{
+				Type:     layers.Dot11TypeMgmtProbeReq,
+				Address1: broadcast,
+				Address2: dji,
+				Address3: broadcast,
+			},
+			ssidElement("")))
+	}
+
+	source := NewSliceSource(layers.LinkTypeIEEE80211Radio, frames)
+	_, detections := runEngine(t, source, Config{Vendors: loadTestVendors(t), DirectionFinder: d})
+
+	if len(detections) != 36 || detections[0].Bearing != nil {
+		t.Fatalf("got %d detections, the first one with %+v", len(detections), detections[0].Bearing)
+	}
+	last := detections[len(detections)-1].Bearing
+	if last == nil || math.Abs(last.Bearing-200) > DF_BIN_WIDTH/2 || last.Confidence != 1 || last.Samples != 36 {
+		t.Errorf("got %+v, expected 200°", last)
+	}
+}
+
+func TestOpenCompassUdp(t *testing.T) {
+	compass, err := OpenCompass("udp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer compass.Close()
+
+	conn, err := net.Dial("udp", compass.(*datagramReader).conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("123.4"))
+	conn.Write([]byte(nmeaSentence("HEHDT,45.0,T") + "\r\n"))
+
+	scanner := bufio.NewScanner(compass)
+	for _, expected := range []float64{123.4, 45} {
+		if !scanner.Scan() {
+			t.Fatalf("no line: %v", scanner.Err())
+		}
+		if heading, ok := ParseHeading(scanner.Text()); !ok || heading != expected {
+			t.Errorf("%q: got %v, expected %v", scanner.Text(), heading, expected)
+		}
+	}
+}
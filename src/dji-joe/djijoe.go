@@ -1,17 +1,22 @@
 package djijoe
 
 import (
+	"bytes"
+	"context"
 	"encoding/hex"
+	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/apsdehal/go-logger"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 )
 
 const PROGNAME string = "DJI-Joe"
@@ -19,58 +24,250 @@ const VERSION string = "0.1"
 
 const NB_DEAUTH_PACKETS int = 10
 
-var Log *logger.Logger
-var do_loop bool
-var Cfg Config
-
 const (
 	API_HEARTBEAT    = "/api/heartbeat"
 	API_WAKEUP       = "/api/wakeup"
 	API_SHUTDOWN     = "/api/shutdown"
 	API_NEWDRONEINFO = "/api/info"
+	API_VENDORS      = "/api/vendors"
+)
+
+// the role of the address which got a frame flagged
+const (
+	ROLE_TRANSMITTER = "transmitter"
+	ROLE_RECEIVER    = "receiver"
+	ROLE_BSSID       = "bssid"
 )
 
 type Config struct {
 	Interface           net.Interface
-	Handle              *pcap.Handle
+	Log                 Logger
 	Vendors             Vendors
 	ApiEndpoint         string
 	Verbosity           int
 	InitialGpsLatitude  float64
 	InitialGpsLongitude float64
+	Output              *PcapngWriter
+	OutputFlaggedBssid  bool
+	Fingerprints        KnownFingerprints
+
+	// number of decoding goroutines, one per CPU if 0
+	Workers int
+
+	// filter the frames in the kernel on the vendors' prefixes, and/or on a
+	// pcap-filter expression. The prefilter is turned off with
+	// OutputFlaggedBssid: the frames of a flagged BSSID carry no flagged address
+	BpfPrefilter bool
+	BpfFilter    string
+
+	// estimates the bearing of one of the devices, if any
+	DirectionFinder *DirectionFinder
+
+	// where the events are reported, besides the API server (if any)
+	Reporters []Reporter
+
+	// evaluates the alert rules on the detections, if any
+	Alerts *Alerter
+}
+
+func (e *Engine) isFlaggedMac(hwaddr net.HardwareAddr) (bool, string) {
+	vendor, _ := e.Vendors().Index.Lookup(hwaddr)
+	if vendor == nil {
+		return false, ""
+	}
+
+	return true, vendor.Name
+}
+
+/*
+An address of a 802.11 frame, and the role of its owner in the exchange.
+*/
+type FrameAddress struct {
+	Address net.HardwareAddr
+	Role    string
+}
+
+/*
+Returns the unicast addresses of a frame, with their role according to the
+ToDS/FromDS flags: the transmitters first, then the BSSID, then the receivers.
+The source and destination of a relayed frame count as its transmitter and
+receiver.
+*/
+func frameAddresses(dot11Packet *layers.Dot11) []FrameAddress {
+	var candidates []FrameAddress
+
+	toDS, fromDS := dot11Packet.Flags.ToDS(), dot11Packet.Flags.FromDS()
+	switch {
+	case !toDS && !fromDS:
+		// management, control, and data frames within an IBSS
+		candidates = []FrameAddress{
+			{dot11Packet.Address2, ROLE_TRANSMITTER},
+			{dot11Packet.Address3, ROLE_BSSID},
+			{dot11Packet.Address1, ROLE_RECEIVER},
+		}
+	case toDS && !fromDS:
+		// station -> AP
+		candidates = []FrameAddress{
+			{dot11Packet.Address2, ROLE_TRANSMITTER},
+			{dot11Packet.Address1, ROLE_BSSID},
+			{dot11Packet.Address3, ROLE_RECEIVER},
+		}
+	case !toDS && fromDS:
+		// AP -> station
+		candidates = []FrameAddress{
+			{dot11Packet.Address3, ROLE_TRANSMITTER},
+			{dot11Packet.Address2, ROLE_BSSID},
+			{dot11Packet.Address1, ROLE_RECEIVER},
+		}
+	default:
+		// WDS / mesh: no BSSID
+		candidates = []FrameAddress{
+			{dot11Packet.Address4, ROLE_TRANSMITTER},
+			{dot11Packet.Address2, ROLE_TRANSMITTER},
+			{dot11Packet.Address1, ROLE_RECEIVER},
+			{dot11Packet.Address3, ROLE_RECEIVER},
+		}
+	}
+
+	var addresses []FrameAddress
+	for _, candidate := range candidates {
+		if len(candidate.Address) == 6 && !isGroupMac(candidate.Address) {
+			addresses = append(addresses, candidate)
+		}
+	}
+	return addresses
+}
+
+/*
+Returns the BSSID of a frame, or nil if it has none.
+*/
+func frameBssid(dot11Packet *layers.Dot11) net.HardwareAddr {
+	for _, address := range frameAddresses(dot11Packet) {
+		if address.Role == ROLE_BSSID {
+			return address.Address
+		}
+	}
+	return nil
+}
+
+/*
+Looks for a flagged address in a frame, in the order of `frameAddresses()`.
+*/
+func (e *Engine) matchFrame(dot11Packet *layers.Dot11) (FrameAddress, string, bool) {
+	for _, address := range frameAddresses(dot11Packet) {
+		isFlagged, vendor := e.isFlaggedMac(address.Address)
+		if isFlagged {
+			return address, vendor, true
+		}
+	}
+	return FrameAddress{}, "", false
 }
 
-func InitLogger(name string) *logger.Logger {
-	_log, err := logger.New(name, 1, os.Stderr)
+/*
+Writes a frame to the pcapng output (if any), commented with what flagged it.
+*/
+func (e *Engine) writeFlaggedFrame(packet gopacket.Packet, vendor string, messageType int) {
+	if e.Config.Output == nil {
+		return
+	}
+
+	comment := fmt.Sprintf("vendor=%s; type=%s; probe=%s",
+		vendor, MessageTypeToString(messageType), e.Probe.Hostname)
+
+	err := e.Config.Output.WritePacket(packet.Metadata().CaptureInfo, packet.Data(), comment)
 	if err != nil {
-		panic(err)
+		e.log.ErrorF("Failed to write to '%s': %+v", e.Config.Output.CurrentPath(), err)
 	}
+}
 
-	return _log
+/*
+Returns the TYPE_* of a 802.11 packet. Frames are classified from their header,
+so protected frames (whose body gopacket cannot decode) get their subtype too.
+*/
+func classifyPacket(packet gopacket.Packet) int {
+	dot11Layer := packet.Layer(layers.LayerTypeDot11)
+	if dot11Layer == nil {
+		return TYPE_UNDEFINED
+	}
+	dot11Packet, _ := dot11Layer.(*layers.Dot11)
+	return classifyDot11(dot11Packet)
 }
 
-func isFlaggedMac(hwaddr net.HardwareAddr) (bool, string) {
-	target := []byte{hwaddr[0], hwaddr[1], hwaddr[2]}
-	for _, vendor := range Cfg.Vendors {
-		if vendor.HasPrefix(target) {
-			return true, vendor.Name
+func classifyDot11(dot11Packet *layers.Dot11) int {
+	switch dot11Packet.Type.MainType() {
+	case layers.Dot11TypeMgmt:
+		switch dot11Packet.Type {
+		case layers.Dot11TypeMgmtProbeReq:
+			return TYPE_PROBE_REQUEST
+		case layers.Dot11TypeMgmtProbeResp:
+			return TYPE_PROBE_RESPONSE
+		case layers.Dot11TypeMgmtBeacon:
+			return TYPE_BEACON
+		case layers.Dot11TypeMgmtAssociationReq:
+			return TYPE_ASSOCIATION_REQUEST
+		case layers.Dot11TypeMgmtAssociationResp:
+			return TYPE_ASSOCIATION_RESPONSE
+		case layers.Dot11TypeMgmtReassociationReq:
+			return TYPE_REASSOCIATION_REQUEST
+		case layers.Dot11TypeMgmtReassociationResp:
+			return TYPE_REASSOCIATION_RESPONSE
+		case layers.Dot11TypeMgmtAuthentication:
+			return TYPE_AUTHENTICATION
+		case layers.Dot11TypeMgmtDeauthentication:
+			return TYPE_DEAUTHENTICATION
+		case layers.Dot11TypeMgmtDisassociation:
+			return TYPE_DISASSOCIATION
+		case layers.Dot11TypeMgmtAction, layers.Dot11TypeMgmtActionNoAck:
+			return TYPE_ACTION
+		default:
+			// ATIM, measurement pilot and reserved subtypes
+			return TYPE_OTHER_MANAGEMENT
+		}
+
+	case layers.Dot11TypeData:
+		switch dot11Packet.Type {
+		case layers.Dot11TypeDataNull,
+			layers.Dot11TypeDataCFAckNoData,
+			layers.Dot11TypeDataCFPollNoData,
+			layers.Dot11TypeDataCFAckPollNoData,
+			layers.Dot11TypeDataQOSNull,
+			layers.Dot11TypeDataQOSCFPollNoData,
+			layers.Dot11TypeDataQOSCFAckPollNoData:
+			return TYPE_NULL_DATA
+		default:
+			// a DATA packet (i.e. drone <-> AP already associated), protected
+			// or not
+			return TYPE_DATA
 		}
+
+	case layers.Dot11TypeCtrl:
+		return TYPE_CONTROL
 	}
 
-	return false, ""
+	return TYPE_UNDEFINED
 }
 
-func SendDeAuthPacket(src gopacket.Packet) error {
+/*
+Sends DeAuth frames to both ends of the exchange `src` was part of.
+*/
+func (e *Engine) SendDeAuthPacket(src gopacket.Packet) error {
 	var buffer gopacket.SerializeBuffer
-	var options gopacket.SerializeOptions
+	var options = gopacket.SerializeOptions{FixLengths: true}
+
+	injector, ok := e.Source.(PacketInjector)
+	if !ok {
+		return InjectionNotSupportedError
+	}
 
 	dot11Layer := src.Layer(layers.LayerTypeDot11)
 	dot11PacketSrc, _ := dot11Layer.(*layers.Dot11)
 
 	radioLayer := &layers.RadioTap{}
 	dot11 := &layers.Dot11{
+		Type:     layers.Dot11TypeMgmtDeauthentication,
 		Address1: dot11PacketSrc.Address2,
 		Address2: dot11PacketSrc.Address1,
+		Address3: dot11PacketSrc.Address3,
 	}
 	deauth := &layers.Dot11MgmtDeauthentication{
 		Reason: layers.Dot11ReasonAuthExpired,
@@ -81,131 +278,418 @@ func SendDeAuthPacket(src gopacket.Packet) error {
 		radioLayer, dot11, deauth)
 
 	for idx := 0; idx < NB_DEAUTH_PACKETS; idx++ {
-		err := Cfg.Handle.WritePacketData(buffer.Bytes())
+		err := injector.WritePacketData(buffer.Bytes())
 		if err != nil {
-			Log.FatalF("WritePacketData failed: %+v", err)
+			e.log.ErrorF("WritePacketData failed: %+v", err)
 			return err
 		}
 	}
 
-	Log.NoticeF("Sent DeAuth from %s to %s",
+	e.log.NoticeF("Sent DeAuth from %s to %s",
 		hex.EncodeToString(dot11.Address1),
 		hex.EncodeToString(dot11.Address2))
 
 	return nil
 }
 
-func DjiGo() {
-	var decoder gopacket.Decoder
-	var ok bool
+/*
+The detection engine: reads frames from its `Source` and reports the ones sent
+by flagged devices.
+*/
+type Engine struct {
+	Source PacketSource
+	Config Config
+	Probe  *Probe
+
+	log Logger
+
+	// the current *VendorSet, swapped as a whole on reload
+	vendors atomic.Value
+
+	// BSSIDs seen in flagged frames, and the vendor that flagged them
+	flaggedBssids     map[string]string
+	flaggedBssidsLock sync.RWMutex
+
+	linker *DeviceLinker
+
+	counters *engineCounters
+	// number of detections, by vendor
+	detections     map[string]uint64
+	detectionsLock sync.Mutex
+
+	// the flagged devices, and the last detections, for the status API
+	devices     *DeviceTable
+	recent      []DroneInfoMessage
+	devicesLock sync.RWMutex
+
+	// the channels of Subscribe()
+	subscribers     []chan DroneInfoMessage
+	subscribersLock sync.Mutex
+	// the *pipeline of the current Run(), if any
+	pipeline atomic.Value
+}
+
+func NewEngine(source PacketSource, cfg Config) *Engine {
+	log := cfg.Log
+	if log == nil {
+		log = NopLogger{}
+	}
 
-	decoder, ok = gopacket.DecodersByLayerName["RadioTap"]
-	if !ok {
-		Log.Error("Failed to get the RadioTap decoder")
+	if cfg.BpfPrefilter && cfg.OutputFlaggedBssid {
+		log.WarningF("Not filtering the frames on the vendors' prefixes, to write all the frames of the flagged BSSIDs")
+		cfg.BpfPrefilter = false
+	}
+
+	probe := NewProbe(log)
+	probe.Reporters = append(probe.Reporters, cfg.Reporters...)
+	if cfg.ApiEndpoint != "" {
+		probe.SetApiEndpoint(cfg.ApiEndpoint)
+	}
+	probe.SetGpsCoordinates(cfg.InitialGpsLatitude, cfg.InitialGpsLongitude)
+
+	e := &Engine{
+		Source:        source,
+		Config:        cfg,
+		Probe:         probe,
+		log:           log,
+		flaggedBssids: make(map[string]string),
+		linker:        NewDeviceLinker(),
+		counters:      new(engineCounters),
+		detections:    make(map[string]uint64),
+		devices:       NewDeviceTable(),
+	}
+	e.vendors.Store(&VendorSet{
+		Vendors:  cfg.Vendors,
+		Index:    cfg.Vendors.Index(),
+		Source:   "configuration",
+		LoadedAt: time.Now(),
+	})
+	return e
+}
+
+/*
+Returns the vendors currently flagged. Safe to call from any goroutine.
+*/
+func (e *Engine) Vendors() *VendorSet {
+	return e.vendors.Load().(*VendorSet)
+}
+
+/*
+Replaces the vendors flagged, atomically: the frames being processed use
+either the old set or the new one, never a mix of both. The capture filter is
+rebuilt accordingly.
+*/
+func (e *Engine) SetVendors(set *VendorSet) {
+	e.vendors.Store(set)
+	e.installFilter(set)
+	e.log.InfoF("Now flagging %d vendors (%d MAC address prefixes) from %s",
+		len(set.Vendors), set.Index.NbPrefixes, set.Source)
+}
+
+/*
+Returns true if a read error means the source will not deliver anything anymore.
+*/
+func isFatalReadError(err error) bool {
+	switch err {
+	case io.ErrUnexpectedEOF, io.ErrNoProgress, io.ErrClosedPipe, io.ErrShortBuffer, syscall.EBADF:
+		return true
+	}
+	return strings.Contains(err.Error(), "use of closed file")
+}
+
+/*
+Reads and processes frames until the source is exhausted, fails, or `ctx` is
+cancelled. The frames are decoded by `Config.Workers` goroutines, and processed
+in their capture order.
+*/
+func (e *Engine) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	p := newPipeline(e, e.Config.Workers)
+	e.pipeline.Store(p)
+
+	e.installFilter(e.Vendors())
+	e.log.InfoF("Starting to read packets (%d decoding workers)", p.nbWorkers)
+	e.Probe.Wakeup()
+
+	err := p.run(ctx)
+
+	e.logStats()
+	e.pipeline.Store((*pipeline)(nil))
+
+	e.Probe.NbBytesCollected = atomic.LoadUint64(&e.counters.bytes)
+	e.Probe.NbBadFcs = atomic.LoadUint64(&e.counters.badFcs)
+	if e.Config.Alerts != nil {
+		e.Config.Alerts.Wait()
+	}
+	e.Probe.Shutdown()
+	return err
+}
+
+/*
+Fingerprints the probe requests, to link the addresses of the same device, and
+to recognize known models whatever their address. Returns nil for the other
+frames.
+*/
+func (e *Engine) observeDevice(packet gopacket.Packet, dot11Packet *layers.Dot11, isFlagged bool, vendor string) *PhysicalDevice {
+	fingerprint := FingerprintProbeRequest(packet)
+	if fingerprint == nil {
+		return nil
+	}
+
+	hwaddr := dot11Packet.Address2
+	device, linked := e.linker.Observe(hwaddr, fingerprint, dot11Packet.SequenceNumber, packetTimestamp(packet))
+	atomic.StoreUint64(&e.counters.devices, uint64(e.linker.Active()))
+	if linked {
+		e.log.InfoF("%s is %s (fingerprint %s), previously seen as %s",
+			hwaddr, device.Id, fingerprint.ID(), device.Addresses[len(device.Addresses)-2])
+	}
+
+	if device.Vendor != "" {
+		return device
+	}
+
+	if isFlagged {
+		device.Vendor = vendor
+		_, device.Model = e.Vendors().Index.Lookup(hwaddr)
+	} else if known := e.Config.Fingerprints.Match(fingerprint); known != nil {
+		device.Vendor = known.Vendor
+		device.Model = known.Model
+		e.log.NoticeF("%s (%s) has the fingerprint of %s %s", hwaddr, device.Id, known.Vendor, known.Model)
+	} else {
+		e.log.DebugF("Fingerprint %s of %s: %s", fingerprint.ID(), hwaddr, fingerprint.Signature)
+	}
+	return device
+}
+
+/*
+Looks for a flagged device in one frame, and reports it, synchronously: unlike
+Run(), it does not go through the pipeline.
+*/
+func (e *Engine) ProcessPacket(packet gopacket.Packet) {
+	atomic.AddUint64(&e.counters.captured, 1)
+	atomic.AddUint64(&e.counters.bytes, uint64(len(packet.Data())))
+
+	// corrupted frames would flag random addresses
+	if hasBadFcs(packet) {
+		atomic.AddUint64(&e.counters.badFcs, 1)
 		return
 	}
+	if dot11Packet, ok := packet.Layer(layers.LayerTypeDot11).(*layers.Dot11); ok {
+		e.countFrame(dot11Packet)
+	}
 
-	source := gopacket.NewPacketSource(Cfg.Handle, decoder)
-	source.NoCopy = true
-	source.DecodeStreamsAsDatagrams = true
+	atomic.AddUint64(&e.counters.processed, 1)
+	e.processFrame(packet)
+}
 
-	Log.Info("Starting to read packets")
-	probe := new(Probe)
-	probe.SetApiEndpoint(Cfg.ApiEndpoint)
-	probe.SetGpsCoordinates(Cfg.InitialGpsLatitude, Cfg.InitialGpsLongitude)
+/*
+Returns the vendor which flagged a BSSID, if any.
+*/
+func (e *Engine) flaggedBssidVendor(bssid net.HardwareAddr) (string, bool) {
+	if bssid == nil {
+		return "", false
+	}
 
-	sigc := make(chan os.Signal, 1)
-	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		sig := <-sigc
-		Log.InfoF("Got '%+v': stopping cleanly", sig)
-		do_loop = false
-		probe.State = PROBE_STATE_SHUTDOWN
-	}()
+	e.flaggedBssidsLock.RLock()
+	defer e.flaggedBssidsLock.RUnlock()
+	vendor, ok := e.flaggedBssids[string(bssid)]
+	return vendor, ok
+}
 
-	probe.Wakeup()
+/*
+Reports a detection: through the reporting goroutine when running the
+pipeline, directly otherwise.
+*/
+func (e *Engine) report(info DroneInfoMessage) {
+	e.detectionsLock.Lock()
+	e.detections[info.Vendor]++
+	e.detectionsLock.Unlock()
+	firstSeen := e.recordDetection(info)
+	if e.Config.Alerts != nil {
+		e.Config.Alerts.Evaluate(info, firstSeen)
+	}
 
-	do_loop = true
-	for packet := range source.Packets() {
-		if do_loop == false || probe.State == PROBE_STATE_SHUTDOWN {
-			break
-		}
-		probe.NbBytesCollected += uint64(len(packet.Data()))
+	if p, _ := e.pipeline.Load().(*pipeline); p != nil {
+		p.events <- info
+		return
+	}
+	e.sendReport(info)
+}
+
+/*
+Returns a channel receiving the detections, as they are sent to the API server.
+Detections are dropped rather than holding the reporting when the channel (of
+capacity `size`) is full.
+*/
+func (e *Engine) Subscribe(size int) <-chan DroneInfoMessage {
+	events := make(chan DroneInfoMessage, size)
+
+	e.subscribersLock.Lock()
+	e.subscribers = append(e.subscribers, events)
+	e.subscribersLock.Unlock()
+	return events
+}
 
-		// extract the 802.11 layer
-		dot11Layer := packet.Layer(layers.LayerTypeDot11)
-		if dot11Layer == nil {
-			continue
+/*
+Sends a detection to the subscribers, then to the API server.
+*/
+func (e *Engine) sendReport(info DroneInfoMessage) {
+	e.subscribersLock.Lock()
+	for _, events := range e.subscribers {
+		select {
+		case events <- info:
+		default:
 		}
+	}
+	e.subscribersLock.Unlock()
 
-		var info DroneInfoMessage
-		var isFlagged bool = false
-		var vendor string = ""
+	if err := e.Probe.ProcessFlaggedPacket(info); err != nil {
+		atomic.AddUint64(&e.counters.apiFailures, 1)
+	}
+	atomic.AddUint64(&e.counters.reported, 1)
+}
 
-		dot11Packet, _ := dot11Layer.(*layers.Dot11)
+/*
+Processes a frame which passed the checks of the decoding stage.
+*/
+func (e *Engine) processFrame(packet gopacket.Packet) {
+	probe := e.Probe
 
-		if len(dot11Packet.Address2) != 6 {
-			continue
-		}
+	// extract the 802.11 layer
+	dot11Layer := packet.Layer(layers.LayerTypeDot11)
+	if dot11Layer == nil {
+		return
+	}
 
-		isFlagged, vendor = isFlaggedMac(dot11Packet.Address2)
-		if isFlagged == false {
-			continue
-		}
+	var info DroneInfoMessage
 
-		info.MessageType = TYPE_UNDEFINED
+	dot11Packet, _ := dot11Layer.(*layers.Dot11)
 
-		// we check if the packet is a 802.11 Beacon
-		dot11MgmtLayer := packet.Layer(layers.LayerTypeDot11MgmtBeacon)
-		if dot11MgmtLayer != nil {
-			info.MessageType = TYPE_BEACON
-			probe.NbBeacons++
-		}
+	match, vendor, isFlagged := e.matchFrame(dot11Packet)
+	sentByMatch := isFlagged && bytes.Equal(match.Address, dot11Packet.Address2)
 
-		// we check if the packet is a 802.11 ProbeRequest
-		dot11MgmtLayer = packet.Layer(layers.LayerTypeDot11MgmtProbeReq)
-		if dot11MgmtLayer != nil {
-			info.MessageType = TYPE_PROBE_REQUEST
-			probe.NbProbes++
-		}
+	// randomized addresses never match a prefix: the device may still be
+	// known by its fingerprint, or by another of its addresses
+	device := e.observeDevice(packet, dot11Packet, sentByMatch, vendor)
+	if device != nil && device.Vendor != "" && (!isFlagged || match.Role != ROLE_TRANSMITTER) {
+		match = FrameAddress{dot11Packet.Address2, ROLE_TRANSMITTER}
+		isFlagged, vendor, sentByMatch = true, device.Vendor, true
+	}
 
-		// we check if it's a DATA packet (i.e. drone <-> AP already associated)
-		dot11DataLayer := packet.Layer(layers.LayerTypeDot11WEP)
-		if dot11DataLayer != nil {
-			// if so, build and send DeAuth messages
-			info.MessageType = TYPE_DATA
-			err := SendDeAuthPacket(packet)
-			if err != nil {
-				Log.ErrorF("Error when sending DeAuth message: %+v", err)
+	bssid := frameBssid(dot11Packet)
+
+	if isFlagged == false {
+		if e.Config.OutputFlaggedBssid {
+			bssidVendor, ok := e.flaggedBssidVendor(bssid)
+			if ok {
+				e.writeFlaggedFrame(packet, bssidVendor, classifyPacket(packet))
 			}
-			continue
 		}
+		return
+	}
 
-		if info.MessageType == TYPE_UNDEFINED {
-			continue
+	if e.Config.OutputFlaggedBssid && bssid != nil {
+		e.flaggedBssidsLock.Lock()
+		e.flaggedBssids[string(bssid)] = vendor
+		e.flaggedBssidsLock.Unlock()
+	}
+
+	info.MessageType = classifyPacket(packet)
+
+	switch info.MessageType {
+	case TYPE_BEACON:
+		probe.NbBeacons++
+
+	case TYPE_PROBE_REQUEST:
+		probe.NbProbes++
+
+	case TYPE_DATA:
+		// drone <-> AP already associated: build and send DeAuth messages.
+		// The null data frames (power save keep-alives) are only reported.
+		signal, frequency := packetSignal(packet)
+		e.recordDataFrame(dot11Packet, match, vendor, packetTimestamp(packet), signal, frequency)
+		e.writeFlaggedFrame(packet, vendor, info.MessageType)
+		err := e.SendDeAuthPacket(packet)
+		if err != nil {
+			e.log.ErrorF("Error when sending DeAuth message: %+v", err)
 		}
+		return
+	}
 
-		// process flagged MAC
-		radioLayer := packet.Layer(layers.LayerTypeRadioTap)
-		radioPacket, _ := radioLayer.(*layers.RadioTap)
+	e.writeFlaggedFrame(packet, vendor, info.MessageType)
 
-		Log.NoticeF("Found 802.11 %s from vendor %s (device %s) - strength=%d dBm - frequency=%d MHz",
-			MessageTypeToString(info.MessageType),
-			vendor,
-			hex.EncodeToString(dot11Packet.Address2),
-			radioPacket.DBMAntennaSignal,
-			radioPacket.ChannelFrequency,
-		)
+	// control frames carry nothing but their addresses
+	if info.MessageType == TYPE_UNDEFINED || info.MessageType == TYPE_CONTROL {
+		return
+	}
+
+	// process flagged MAC: the reception metadata is only known from the
+	// radiotap header, which plain 802.11 captures do not have
+	info.SignalStrength, info.Frequency = packetSignal(packet)
+	radioPacket, _ := packet.Layer(layers.LayerTypeRadioTap).(*layers.RadioTap)
+	if radioPacket != nil {
+		if radioPacket.Present.TSFT() {
+			info.Tsft = radioPacket.TSFT
+		}
+		info.RadioInfo = ParseRadioInfo(radioPacket)
+	}
 
-		info.Hostname = probe.Hostname
-		info.Timestamp = time.Now()
-		info.MacAddress = dot11Packet.Address2
-		info.SignalStrength = radioPacket.DBMAntennaSignal
-		info.Frequency = uint16(radioPacket.ChannelFrequency)
-		info.Vendor = vendor
+	e.log.NoticeF("Found 802.11 %s from vendor %s (device %s as %s) - strength=%d dBm - frequency=%d MHz",
+		MessageTypeToString(info.MessageType),
+		vendor,
+		hex.EncodeToString(match.Address),
+		match.Role,
+		info.SignalStrength,
+		info.Frequency,
+	)
+
+	info.Hostname = probe.Hostname
+	info.Timestamp = packetTimestamp(packet)
+	info.MacAddress = match.Address
+	info.Role = match.Role
+	info.Vendor = vendor
+	info.NetworkInfo = ParseNetworkInfo(packet)
+	info.RemoteId = ParseRemoteIdElement(packet, info.Timestamp)
+	_, info.Model = e.Vendors().Index.Lookup(match.Address)
+	info.Randomized = IsLocallyAdministered(match.Address)
+	if device != nil && sentByMatch {
+		info.DeviceId = device.Id
+		info.Fingerprint = device.Fingerprint.ID()
+		if device.Model != "" {
+			info.Model = device.Model
+		}
+	}
 
-		probe.ProcessFlaggedPacket(info)
+	if e.Config.DirectionFinder != nil {
+		info.Bearing = e.Config.DirectionFinder.Observe(info)
 	}
+	e.report(info)
+}
+
+/*
+Compatibility wrapper: runs an engine on `source` until it is exhausted or the
+process receives SIGINT/SIGTERM.
+*/
+func DjiGo(source PacketSource, cfg Config) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+
+	go func() {
+		select {
+		case sig := <-sigc:
+			if cfg.Log != nil {
+				cfg.Log.InfoF("Got '%+v': stopping cleanly", sig)
+			}
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
-	probe.Shutdown()
+	return NewEngine(source, cfg).Run(ctx)
 }
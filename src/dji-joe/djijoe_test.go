@@ -0,0 +1,434 @@
+package djijoe
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func mustParseMAC(t *testing.T, s string) net.HardwareAddr {
+	hwaddr, err := net.ParseMAC(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hwaddr
+}
+
+func loadTestVendors(t *testing.T) Vendors {
+	vendors, err := LoadVendorsInfoFromFile("../../misc/oui.csv", nil)
+	if err != nil {
+		t.Fatalf("LoadVendorsInfoFromFile: %v", err)
+	}
+	return vendors
+}
+
+/*
+Runs an engine over `source` until it is exhausted, and returns the detections
+it reported to the API.
+*/
+func runEngine(t *testing.T, source PacketSource, cfg Config) (*Engine, []DroneInfoMessage) {
+	server := newApiRecorder(t)
+	cfg.ApiEndpoint = server.URL
+
+	engine := NewEngine(source, cfg)
+	if err := engine.Run(context.Background()); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	return engine, server.Detections(t)
+}
+
+/*
+Serializes a synthetic RadioTap + 802.11 frame.
+*/
+func buildFrame(t *testing.T, ts time.Time, signal int8, frequency uint16, dot11 *layers.Dot11, body ...gopacket.SerializableLayer) RawPacket {
+	radio := &layers.RadioTap{
+		Present:          layers.RadioTapPresentChannel | layers.RadioTapPresentDBMAntennaSignal,
+		ChannelFrequency: layers.RadioTapChannelFrequency(frequency),
+		ChannelFlags:     layers.RadioTapChannelFlagsGhz2,
+		DBMAntennaSignal: signal,
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	all := append([]gopacket.SerializableLayer{radio, dot11}, body...)
+	options := gopacket.SerializeOptions{FixLengths: true}
+	if err := gopacket.SerializeLayers(buffer, options, all...); err != nil {
+		t.Fatalf("SerializeLayers: %v", err)
+	}
+
+	return RawPacket{
+		Data:        buffer.Bytes(),
+		CaptureInfo: gopacket.CaptureInfo{Timestamp: ts},
+	}
+}
+
+func ssidElement(ssid string) *layers.Dot11InformationElement {
+	return &layers.Dot11InformationElement{
+		ID:     layers.Dot11InformationElementIDSSID,
+		Length: uint8(len(ssid)),
+		Info:   []byte(ssid),
+	}
+}
+
+var phantom3ProbeStrengths = []int8{
+	-33, -34, -37, -33, -33, -35, -33, -32, -33, -35, -36,
+	-37, -32, -33, -36, -51, -49, -32, -37, -34, -34, -39,
+}
+
+func TestEngineOnPcaps(t *testing.T) {
+	vendors := loadTestVendors(t)
+	phantom3 := mustParseMAC(t, "60:60:1f:42:11:b8")
+
+	tests := []struct {
+		pcap        string
+		nbBytes     uint64
+		strengths   []int8
+		nbResponses int
+	}{
+		{"../../pcaps/test.pcap", 360464, phantom3ProbeStrengths, 141},
+		{"../../pcaps/test2.pcap", 2680, phantom3ProbeStrengths, 0},
+	}
+
+	for _, test := range tests {
+		source, err := OpenFileSource(test.pcap)
+		if err != nil {
+			t.Fatalf("OpenFileSource(%s): %v", test.pcap, err)
+		}
+		engine, all := runEngine(t, source, Config{Vendors: vendors})
+		source.Close()
+
+		// the probe responses of the APs around, sent to the drone
+		var detections []DroneInfoMessage
+		nbResponses := 0
+		for _, info := range all {
+			if info.Role == ROLE_RECEIVER && info.MessageType == TYPE_PROBE_RESPONSE &&
+				bytes.Equal(info.MacAddress, phantom3) {
+				nbResponses++
+			} else {
+				detections = append(detections, info)
+			}
+		}
+		if nbResponses != test.nbResponses {
+			t.Errorf("%s: got %d probe responses to the drone, expected %d", test.pcap, nbResponses, test.nbResponses)
+		}
+
+		if engine.Probe.NbBytesCollected != test.nbBytes {
+			t.Errorf("%s: read %d bytes, expected %d", test.pcap, engine.Probe.NbBytesCollected, test.nbBytes)
+		}
+		if engine.Probe.NbProbes != uint64(len(test.strengths)) || engine.Probe.NbBeacons != 0 {
+			t.Errorf("%s: counted %d probes and %d beacons, expected %d and 0",
+				test.pcap, engine.Probe.NbProbes, engine.Probe.NbBeacons, len(test.strengths))
+		}
+		if len(detections) != len(test.strengths) {
+			t.Fatalf("%s: got %d detections, expected %d", test.pcap, len(detections), len(test.strengths))
+		}
+
+		for i, info := range detections {
+			if info.Vendor != "SZ DJI Technology Co.,Ltd" ||
+				!bytes.Equal(info.MacAddress, phantom3) ||
+				info.MessageType != TYPE_PROBE_REQUEST ||
+				info.SignalStrength != test.strengths[i] ||
+				info.Frequency != 2412 {
+				t.Errorf("%s: detection #%d = {%s %s %s %d dBm %d MHz}, expected {DJI %s ProbeRequest %d dBm 2412 MHz}",
+					test.pcap, i, info.Vendor, info.MacAddress, MessageTypeToString(info.MessageType),
+					info.SignalStrength, info.Frequency, phantom3, test.strengths[i])
+			}
+		}
+
+		// timestamps come from the capture, not from the replay
+		first := time.Date(2017, 6, 1, 21, 24, 36, 661535000, time.UTC)
+		if !detections[0].Timestamp.Equal(first) || detections[0].Tsft != 88579302 {
+			t.Errorf("%s: first detection at %s (TSFT %d), expected %s (TSFT 88579302)",
+				test.pcap, detections[0].Timestamp, detections[0].Tsft, first)
+		}
+	}
+}
+
+func TestEngineOnSyntheticFrames(t *testing.T) {
+	vendors := loadTestVendors(t)
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	dji := mustParseMAC(t, "60:60:1f:00:00:01")
+	parrot := mustParseMAC(t, "90:03:b7:00:00:02")
+	unknown := mustParseMAC(t, "b8:27:eb:00:00:03")
+	ap := mustParseMAC(t, "10:9f:a9:54:f7:bc")
+	broadcast := mustParseMAC(t, "ff:ff:ff:ff:ff:ff")
+
+	tests := []struct {
+		name        string
+		frame       RawPacket
+		mac         net.HardwareAddr
+		role        string
+		ssid        string
+		vendor      string
+		messageType int
+		strength    int8
+		frequency   uint16
+		nbDeauth    int
+	}{
+		{
+			name: "DJI beacon",
+			frame: buildFrame(t, ts, -40, 2437,
+				&layers.Dot11{Type: layers.Dot11TypeMgmtBeacon, Address1: broadcast, Address2: dji, Address3: dji},
+				&layers.Dot11MgmtBeacon{Interval: 100},
+				ssidElement("Mavic-123456")),
+			mac:         dji,
+			role:        ROLE_TRANSMITTER,
+			ssid:        "Mavic-123456",
+			vendor:      "SZ DJI Technology Co.,Ltd",
+			messageType: TYPE_BEACON,
+			strength:    -40,
+			frequency:   2437,
+		},
+		{
+			name: "Parrot probe request",
+			frame: buildFrame(t, ts, -71, 2462,
+				&layers.Dot11{Type: layers.Dot11TypeMgmtProbeReq, Address1: broadcast, Address2: parrot, Address3: broadcast},
+				ssidElement("")),
+			mac:         parrot,
+			role:        ROLE_TRANSMITTER,
+			vendor:      "Parrot SA",
+			messageType: TYPE_PROBE_REQUEST,
+			strength:    -71,
+			frequency:   2462,
+		},
+		{
+			name: "unknown vendor beacon",
+			frame: buildFrame(t, ts, -20, 2412,
+				&layers.Dot11{Type: layers.Dot11TypeMgmtBeacon, Address1: broadcast, Address2: unknown, Address3: unknown},
+				&layers.Dot11MgmtBeacon{Interval: 100},
+				ssidElement("kura_gateway")),
+		},
+		{
+			name: "DJI probe response",
+			frame: buildFrame(t, ts, -42, 2437,
+				&layers.Dot11{Type: layers.Dot11TypeMgmtProbeResp, Address1: parrot, Address2: dji, Address3: dji},
+				&layers.Dot11MgmtProbeResp{Interval: 100},
+				ssidElement("Mavic-123456")),
+			mac:         dji,
+			role:        ROLE_TRANSMITTER,
+			ssid:        "Mavic-123456",
+			vendor:      "SZ DJI Technology Co.,Ltd",
+			messageType: TYPE_PROBE_RESPONSE,
+			strength:    -42,
+			frequency:   2437,
+		},
+		{
+			name: "Parrot authentication",
+			frame: buildFrame(t, ts, -60, 2412,
+				&layers.Dot11{Type: layers.Dot11TypeMgmtAuthentication, Address1: ap, Address2: parrot, Address3: ap},
+				&layers.Dot11MgmtAuthentication{Algorithm: layers.Dot11AlgorithmOpen, Sequence: 1}),
+			mac:         parrot,
+			role:        ROLE_TRANSMITTER,
+			vendor:      "Parrot SA",
+			messageType: TYPE_AUTHENTICATION,
+			strength:    -60,
+			frequency:   2412,
+		},
+		{
+			name: "association request to a DJI",
+			frame: buildFrame(t, ts, -55, 2437,
+				&layers.Dot11{Type: layers.Dot11TypeMgmtAssociationReq, Address1: dji, Address2: unknown, Address3: dji},
+				&layers.Dot11MgmtAssociationReq{CapabilityInfo: 0x0401, ListenInterval: 10},
+				ssidElement("Mavic-123456")),
+			mac:         dji,
+			role:        ROLE_BSSID,
+			ssid:        "Mavic-123456",
+			vendor:      "SZ DJI Technology Co.,Ltd",
+			messageType: TYPE_ASSOCIATION_REQUEST,
+			strength:    -55,
+			frequency:   2437,
+		},
+		{
+			name: "probe response to a Parrot",
+			frame: buildFrame(t, ts, -65, 2412,
+				&layers.Dot11{Type: layers.Dot11TypeMgmtProbeResp, Address1: parrot, Address2: unknown, Address3: unknown},
+				&layers.Dot11MgmtProbeResp{Interval: 100},
+				ssidElement("kura_gateway")),
+			mac:         parrot,
+			role:        ROLE_RECEIVER,
+			ssid:        "kura_gateway",
+			vendor:      "Parrot SA",
+			messageType: TYPE_PROBE_RESPONSE,
+			strength:    -65,
+			frequency:   2412,
+		},
+		{
+			name: "DJI RTS",
+			frame: buildFrame(t, ts, -50, 2412,
+				&layers.Dot11{Type: layers.Dot11TypeCtrlRTS, Address1: ap, Address2: dji}),
+		},
+		{
+			name: "DJI QoS data",
+			frame: buildFrame(t, ts, -50, 2412,
+				&layers.Dot11{Type: layers.Dot11TypeDataQOSData, Address1: ap, Address2: dji, Address3: ap},
+				gopacket.Payload(make([]byte, 32))),
+			nbDeauth: NB_DEAUTH_PACKETS,
+		},
+		{
+			name: "DJI null data",
+			frame: buildFrame(t, ts, -55, 2412,
+				&layers.Dot11{Type: layers.Dot11TypeDataNull, Flags: layers.Dot11FlagsToDS, Address1: ap, Address2: dji, Address3: ap}),
+			mac:         dji,
+			role:        ROLE_TRANSMITTER,
+			vendor:      "SZ DJI Technology Co.,Ltd",
+			messageType: TYPE_NULL_DATA,
+			strength:    -55,
+			frequency:   2412,
+		},
+		{
+			name: "DJI protected data",
+			frame: buildFrame(t, ts, -50, 2412,
+				&layers.Dot11{Type: layers.Dot11TypeData, Flags: layers.Dot11FlagsWEP, Address1: ap, Address2: dji, Address3: ap},
+				gopacket.Payload(make([]byte, 32))),
+			nbDeauth: NB_DEAUTH_PACKETS,
+		},
+	}
+
+	for _, test := range tests {
+		source := NewSliceSource(layers.LinkTypeIEEE80211Radio, []RawPacket{test.frame})
+		_, detections := runEngine(t, source, Config{Vendors: vendors})
+
+		if len(source.Written) != test.nbDeauth {
+			t.Errorf("%s: %d frames sent, expected %d", test.name, len(source.Written), test.nbDeauth)
+		}
+		for _, data := range source.Written {
+			packet := gopacket.NewPacket(data, layers.LayerTypeRadioTap, gopacket.Default)
+			dot11, ok := packet.Layer(layers.LayerTypeDot11).(*layers.Dot11)
+			if !ok || packet.Layer(layers.LayerTypeDot11MgmtDeauthentication) == nil {
+				t.Errorf("%s: sent a frame which is not a DeAuth: %s", test.name, packet)
+				continue
+			}
+			if !bytes.Equal(dot11.Address1, dji) || !bytes.Equal(dot11.Address2, ap) {
+				t.Errorf("%s: sent a DeAuth from %s to %s, expected from %s to %s",
+					test.name, dot11.Address2, dot11.Address1, ap, dji)
+			}
+		}
+
+		if test.vendor == "" {
+			if len(detections) != 0 {
+				t.Errorf("%s: got %d detections, expected none", test.name, len(detections))
+			}
+			continue
+		}
+
+		if len(detections) != 1 {
+			t.Fatalf("%s: got %d detections, expected 1", test.name, len(detections))
+		}
+		info := detections[0]
+		if info.Vendor != test.vendor ||
+			!bytes.Equal(info.MacAddress, test.mac) ||
+			info.Role != test.role ||
+			info.Ssid != test.ssid ||
+			info.MessageType != test.messageType ||
+			info.SignalStrength != test.strength ||
+			info.Frequency != test.frequency ||
+			!info.Timestamp.Equal(ts) {
+			t.Errorf("%s: got %+v", test.name, info)
+		}
+	}
+}
+
+func TestEngineOnPlainDot11Frames(t *testing.T) {
+	vendors := loadTestVendors(t)
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	dji := mustParseMAC(t, "60:60:1f:00:00:01")
+	broadcast := mustParseMAC(t, "ff:ff:ff:ff:ff:ff")
+
+	// no radiotap header: nothing is known of the reception
+	buffer := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true},
+		&layers.Dot11{Type: layers.Dot11TypeMgmtBeacon, Address1: broadcast, Address2: dji, Address3: dji},
+		&layers.Dot11MgmtBeacon{Interval: 100},
+		ssidElement("Mavic-123456"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// gopacket expects the FCS at the end of the frame
+	data := binary.LittleEndian.AppendUint32(buffer.Bytes(), crc32.ChecksumIEEE(buffer.Bytes()))
+	frame := RawPacket{Data: data, CaptureInfo: gopacket.CaptureInfo{Timestamp: ts}}
+
+	source := NewSliceSource(layers.LinkTypeIEEE802_11, []RawPacket{frame})
+	_, detections := runEngine(t, source, Config{Vendors: vendors})
+	if len(detections) != 1 {
+		t.Fatalf("got %d detections, expected 1", len(detections))
+	}
+	info := detections[0]
+	if !bytes.Equal(info.MacAddress, dji) || info.Ssid != "Mavic-123456" || info.MessageType != TYPE_BEACON ||
+		info.SignalStrength != 0 || info.Frequency != 0 || !info.Timestamp.Equal(ts) {
+		t.Errorf("got %+v", info)
+	}
+}
+
+func TestEngineStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	source := NewSliceSource(layers.LinkTypeIEEE80211Radio, nil)
+	engine := NewEngine(source, Config{})
+	if err := engine.Run(ctx); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+	if engine.Probe.State != PROBE_STATE_STOPPED {
+		t.Errorf("probe state = %d, expected %d", engine.Probe.State, PROBE_STATE_STOPPED)
+	}
+}
+
+func TestMessageTypeToString(t *testing.T) {
+	seen := make(map[string]bool)
+	for messageType := TYPE_UNDEFINED; messageType <= TYPE_CONTROL; messageType++ {
+		name := MessageTypeToString(messageType)
+		if seen[name] || name == "" || name == MessageTypeToString(-1) {
+			t.Errorf("TYPE %d has name %q", messageType, name)
+		}
+		seen[name] = true
+	}
+
+	if name := MessageTypeToString(TYPE_CONTROL + 1); name != fmt.Sprintf("Unknown(%d)", TYPE_CONTROL+1) {
+		t.Errorf("got %q for an unknown type", name)
+	}
+}
+
+func TestFrameAddresses(t *testing.T) {
+	drone := mustParseMAC(t, "60:60:1f:00:00:01")
+	controller := mustParseMAC(t, "60:60:1f:00:00:02")
+	ap := mustParseMAC(t, "10:9f:a9:54:f7:bc")
+	other := mustParseMAC(t, "10:9f:a9:54:f7:bd")
+	broadcast := mustParseMAC(t, "ff:ff:ff:ff:ff:ff")
+
+	tests := []struct {
+		name     string
+		dot11    *layers.Dot11
+		expected string
+	}{
+		{"beacon", &layers.Dot11{Address1: broadcast, Address2: drone, Address3: drone},
+			"60:60:1f:00:00:01=transmitter 60:60:1f:00:00:01=bssid"},
+		{"to DS", &layers.Dot11{Flags: layers.Dot11FlagsToDS, Address1: ap, Address2: controller, Address3: drone},
+			"60:60:1f:00:00:02=transmitter 10:9f:a9:54:f7:bc=bssid 60:60:1f:00:00:01=receiver"},
+		{"from DS", &layers.Dot11{Flags: layers.Dot11FlagsFromDS, Address1: controller, Address2: ap, Address3: drone},
+			"60:60:1f:00:00:01=transmitter 10:9f:a9:54:f7:bc=bssid 60:60:1f:00:00:02=receiver"},
+		{"WDS", &layers.Dot11{Flags: layers.Dot11FlagsToDS | layers.Dot11FlagsFromDS,
+			Address1: ap, Address2: other, Address3: controller, Address4: drone},
+			"60:60:1f:00:00:01=transmitter 10:9f:a9:54:f7:bd=transmitter 10:9f:a9:54:f7:bc=receiver 60:60:1f:00:00:02=receiver"},
+		{"CTS", &layers.Dot11{Type: layers.Dot11TypeCtrlCTS, Address1: drone},
+			"60:60:1f:00:00:01=receiver"},
+	}
+
+	for _, test := range tests {
+		var got []string
+		for _, address := range frameAddresses(test.dot11) {
+			got = append(got, address.Address.String()+"="+address.Role)
+		}
+		if strings.Join(got, " ") != test.expected {
+			t.Errorf("%s: got %q, expected %q", test.name, strings.Join(got, " "), test.expected)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package djijoe
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// how far the sequence number of a device may have moved between the last
+	// frame of an address and the first one of its next address
+	LINKER_MAX_SEQ_GAP = 256
+	LINKER_MAX_DELAY   = 30 * time.Second
+	LINKER_MAX_AGE     = 10 * time.Minute
+)
+
+/*
+What a device tells about itself in its probe requests, independently of its
+MAC address: the order of the IEs, the rates it supports, and its HT, VHT and
+extended capabilities. The SSID and the current channel are left out, as they
+change from one frame to the other. Two devices of the same model (and
+firmware) share the same fingerprint.
+*/
+type Fingerprint struct {
+	Signature string
+}
+
+/*
+Returns the fingerprint of a probe request, or nil if the frame is not one.
+*/
+func FingerprintProbeRequest(packet gopacket.Packet) *Fingerprint {
+	if packet.Layer(layers.LayerTypeDot11MgmtProbeReq) == nil {
+		return nil
+	}
+
+	var ids, rates []string
+	var ht, vht, ext string
+
+	for _, ie := range managementInformationElements(packet) {
+		switch ie.ID {
+		case layers.Dot11InformationElementIDVendor:
+			// the OUI and type only, the content may be unique to the device
+			// (e.g. the UUID of WPS)
+			if len(ie.Info) >= 4 {
+				ids = append(ids, fmt.Sprintf("221(%x)", ie.Info[:4]))
+			} else {
+				ids = append(ids, "221")
+			}
+			continue
+
+		case layers.Dot11InformationElementIDRates, layers.Dot11InformationElementIDESRates:
+			rates = append(rates, hex.EncodeToString(ie.Info))
+
+		case layers.Dot11InformationElementIDHTCapabilities:
+			ht = hex.EncodeToString(ie.Info)
+
+		case layers.Dot11InformationElementIDVHTCapabilities:
+			vht = hex.EncodeToString(ie.Info)
+
+		case layers.Dot11InformationElementIDExtCapability:
+			ext = hex.EncodeToString(ie.Info)
+		}
+		ids = append(ids, strconv.Itoa(int(ie.ID)))
+	}
+
+	return &Fingerprint{
+		Signature: fmt.Sprintf("ie:%s|rates:%s|ht:%s|vht:%s|ext:%s",
+			strings.Join(ids, ","), strings.Join(rates, ","), ht, vht, ext),
+	}
+}
+
+/*
+Short identifier of the fingerprint, for the logs and reports.
+*/
+func (f *Fingerprint) ID() string {
+	sum := sha1.Sum([]byte(f.Signature))
+	return hex.EncodeToString(sum[:6])
+}
+
+/*
+The fingerprint of a known drone or controller model.
+*/
+type KnownFingerprint struct {
+	Vendor    string
+	Model     string
+	Signature string
+}
+
+type KnownFingerprints []KnownFingerprint
+
+/*
+Loads the known fingerprints, one per line: `vendor;model;signature`, as
+written in the logs (see `FingerprintProbeRequest`). Empty lines and lines
+starting with '#' are ignored.
+*/
+func LoadFingerprintsFromFile(filePath string) (KnownFingerprints, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var fingerprints KnownFingerprints
+	scanner := bufio.NewScanner(file)
+	lineno := 0
+
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Split(line, ";")
+		if len(fields) != 3 || fields[0] == "" || !strings.HasPrefix(fields[2], "ie:") {
+			return nil, fmt.Errorf("%s:%d: expected 'vendor;model;signature'", filePath, lineno)
+		}
+		fingerprints = append(fingerprints, KnownFingerprint{fields[0], fields[1], fields[2]})
+	}
+
+	return fingerprints, scanner.Err()
+}
+
+func (k KnownFingerprints) Match(f *Fingerprint) *KnownFingerprint {
+	if f == nil {
+		return nil
+	}
+
+	for i := range k {
+		if k[i].Signature == f.Signature {
+			return &k[i]
+		}
+	}
+	return nil
+}
+
+/*
+A physical device, possibly seen under several (randomized) MAC addresses.
+`Vendor` and `Model` are set once one of its addresses or its fingerprint is
+flagged.
+*/
+type PhysicalDevice struct {
+	Id          string
+	Fingerprint *Fingerprint
+	Addresses   []net.HardwareAddr
+	Vendor      string
+	Model       string
+
+	lastSeq  uint16
+	lastSeen time.Time
+}
+
+/*
+Links the MAC addresses used by the same physical device: a device switching
+to a new (randomized) address keeps its fingerprint, and its sequence number
+carries on from where the previous address stopped.
+*/
+type DeviceLinker struct {
+	MaxSeqGap uint16
+	MaxDelay  time.Duration
+	MaxAge    time.Duration
+
+	byAddress map[string]*PhysicalDevice
+	// the devices by signature, for the new addresses to find their device
+	// without going through all of them
+	bySignature map[string][]*PhysicalDevice
+	nbDevices   int
+	nbActive    int
+	lastPrune   time.Time
+}
+
+func NewDeviceLinker() *DeviceLinker {
+	return &DeviceLinker{
+		MaxSeqGap:   LINKER_MAX_SEQ_GAP,
+		MaxDelay:    LINKER_MAX_DELAY,
+		MaxAge:      LINKER_MAX_AGE,
+		byAddress:   make(map[string]*PhysicalDevice),
+		bySignature: make(map[string][]*PhysicalDevice),
+	}
+}
+
+/*
+Records a probe request, and returns the device it comes from. `linked` is true
+when the address was not known yet, and got linked to a known device.
+*/
+func (l *DeviceLinker) Observe(hwaddr net.HardwareAddr, fingerprint *Fingerprint, seq uint16, ts time.Time) (device *PhysicalDevice, linked bool) {
+	l.prune(ts)
+
+	device, ok := l.byAddress[string(hwaddr)]
+	if !ok {
+		device = l.findPrevious(fingerprint, seq, ts)
+		linked = device != nil
+
+		if device == nil {
+			l.nbDevices++
+			l.nbActive++
+			device = &PhysicalDevice{
+				Id:          fmt.Sprintf("device-%d", l.nbDevices),
+				Fingerprint: fingerprint,
+			}
+			l.bySignature[fingerprint.Signature] = append(l.bySignature[fingerprint.Signature], device)
+		}
+		device.Addresses = append(device.Addresses, append(net.HardwareAddr(nil), hwaddr...))
+		l.byAddress[string(hwaddr)] = device
+	}
+
+	device.lastSeq = seq
+	device.lastSeen = ts
+	return device, linked
+}
+
+/*
+Looks for the device which was using another address until just before.
+*/
+func (l *DeviceLinker) findPrevious(fingerprint *Fingerprint, seq uint16, ts time.Time) *PhysicalDevice {
+	var best *PhysicalDevice
+	var bestGap uint16
+
+	for _, device := range l.bySignature[fingerprint.Signature] {
+		if ts.Sub(device.lastSeen) > l.MaxDelay || ts.Before(device.lastSeen) {
+			continue
+		}
+
+		// sequence numbers are 12 bits, and wrap around
+		gap := (seq - device.lastSeq) & 0xfff
+		if gap == 0 || gap > l.MaxSeqGap {
+			continue
+		}
+		if best == nil || gap < bestGap {
+			best = device
+			bestGap = gap
+		}
+	}
+	return best
+}
+
+func (l *DeviceLinker) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+
+	for address, device := range l.byAddress {
+		if now.Sub(device.lastSeen) > l.MaxAge {
+			delete(l.byAddress, address)
+		}
+	}
+
+	l.nbActive = 0
+	for signature, devices := range l.bySignature {
+		active := devices[:0]
+		for _, device := range devices {
+			if now.Sub(device.lastSeen) <= l.MaxAge {
+				active = append(active, device)
+			}
+		}
+		if len(active) == 0 {
+			delete(l.bySignature, signature)
+		} else {
+			l.bySignature[signature] = active
+		}
+		l.nbActive += len(active)
+	}
+}
+
+/*
+Returns the number of devices tracked, i.e. seen for the last time less than
+`MaxAge` ago (give or take the minute between two prunings).
+*/
+func (l *DeviceLinker) Active() int {
+	return l.nbActive
+}
@@ -0,0 +1,187 @@
+package djijoe
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const phantom3Signature = "ie:0,1,50,3,45|rates:02040b160c121824,3048606c|" +
+	"ht:ef111bffff000000000000000000000100000000000000000000|vht:|ext:"
+
+func element(id layers.Dot11InformationElementID, info []byte) *layers.Dot11InformationElement {
+	return &layers.Dot11InformationElement{ID: id, Length: uint8(len(info)), Info: info}
+}
+
+func TestIsLocallyAdministered(t *testing.T) {
+	tests := map[string]bool{
+		"60:60:1f:42:11:b8": false,
+		"02:18:2a:7f:41:4d": true,
+		"6e:a5:e7:52:28:89": true,
+		"ff:ff:ff:ff:ff:ff": true,
+	}
+
+	for address, expected := range tests {
+		if IsLocallyAdministered(mustParseMAC(t, address)) != expected {
+			t.Errorf("%s: expected %v", address, expected)
+		}
+	}
+}
+
+func TestDeviceLinker(t *testing.T) {
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	phone := &Fingerprint{Signature: "ie:0,1,221(0050f208)|rates:82848b96|ht:|vht:|ext:"}
+	drone := &Fingerprint{Signature: phantom3Signature}
+
+	linker := NewDeviceLinker()
+	first, _ := linker.Observe(mustParseMAC(t, "62:00:00:00:00:01"), phone, 4090, ts)
+
+	tests := []struct {
+		name        string
+		address     string
+		fingerprint *Fingerprint
+		seq         uint16
+		delay       time.Duration
+		linked      bool
+	}{
+		{"same address", "62:00:00:00:00:01", phone, 4093, time.Second, false},
+		{"wrapped sequence number", "62:00:00:00:00:02", phone, 3, time.Second, true},
+		{"other fingerprint", "62:00:00:00:00:03", drone, 4, time.Second, false},
+		{"sequence gap too large", "62:00:00:00:00:04", phone, 3 + LINKER_MAX_SEQ_GAP + 1, time.Second, false},
+		{"sequence going back", "62:00:00:00:00:05", phone, 2, time.Second, false},
+		{"too late", "62:00:00:00:00:06", phone, 5, LINKER_MAX_DELAY + time.Second, false},
+	}
+
+	for _, test := range tests {
+		ts = ts.Add(test.delay)
+		device, linked := linker.Observe(mustParseMAC(t, test.address), test.fingerprint, test.seq, ts)
+		if linked != test.linked || (device == first) != (test.linked || test.address == "62:00:00:00:00:01") {
+			t.Errorf("%s: got %s (linked %v)", test.name, device.Id, linked)
+		}
+	}
+
+	if len(first.Addresses) != 2 || first.Addresses[1].String() != "62:00:00:00:00:02" {
+		t.Errorf("addresses of %s: %v", first.Id, first.Addresses)
+	}
+}
+
+func TestDeviceLinkerPrune(t *testing.T) {
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	drone := &Fingerprint{Signature: phantom3Signature}
+
+	linker := NewDeviceLinker()
+	for i := 0; i < 100; i++ {
+		phone := &Fingerprint{Signature: fmt.Sprintf("ie:0,1|rates:%02x", i)}
+		linker.Observe(net.HardwareAddr{0x62, 0, 0, 0, 1, byte(i)}, phone, 10, ts)
+	}
+	first, _ := linker.Observe(mustParseMAC(t, "62:00:00:00:00:01"), drone, 10, ts)
+	if linker.Active() != 101 || len(linker.bySignature) != 101 {
+		t.Errorf("%d devices for %d signatures", linker.Active(), len(linker.bySignature))
+	}
+
+	ts = ts.Add(LINKER_MAX_AGE / 2)
+	if device, _ := linker.Observe(mustParseMAC(t, "62:00:00:00:00:01"), drone, 12, ts); device != first {
+		t.Errorf("got %s, expected %s", device.Id, first.Id)
+	}
+
+	ts = ts.Add(LINKER_MAX_AGE/2 + time.Minute)
+	linker.Observe(mustParseMAC(t, "62:00:00:00:00:01"), drone, 14, ts)
+	if linker.Active() != 1 || len(linker.bySignature) != 1 || len(linker.byAddress) != 1 {
+		t.Errorf("%d devices for %d signatures and %d addresses after pruning", linker.Active(), len(linker.bySignature), len(linker.byAddress))
+	}
+}
+
+func TestLoadFingerprintsFromFile(t *testing.T) {
+	fingerprints, err := LoadFingerprintsFromFile("../../misc/fingerprints.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	known := fingerprints.Match(&Fingerprint{Signature: phantom3Signature})
+	if known == nil || known.Vendor != "SZ DJI Technology Co.,Ltd" || known.Model != "Phantom 3" {
+		t.Errorf("Phantom 3 not known: %v", known)
+	}
+
+	for _, content := range []string{"DJI;Phantom 3\n", ";Phantom 3;ie:0\n", "DJI;Phantom 3;0,1,50\n"} {
+		if _, err := LoadFingerprintsFromFile(writeTempFile(t, "fingerprints.csv", content)); err == nil {
+			t.Errorf("no error for %q", content)
+		}
+	}
+}
+
+func TestEngineFlagsKnownFingerprint(t *testing.T) {
+	fingerprints, err := LoadFingerprintsFromFile("../../misc/fingerprints.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// no DJI prefix: the drone is only recognized by its fingerprint
+	vendors, err := LoadVendorsInfoFromFile(writeTempFile(t, "oui.csv", "Parrot SA;9003b7;\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source, err := OpenFileSource("../../pcaps/test.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	_, detections := runEngine(t, source, Config{Vendors: vendors, Fingerprints: fingerprints})
+
+	if len(detections) != len(phantom3ProbeStrengths) {
+		t.Fatalf("got %d detections, expected %d", len(detections), len(phantom3ProbeStrengths))
+	}
+	for i, info := range detections {
+		if info.Vendor != "SZ DJI Technology Co.,Ltd" || info.Model != "Phantom 3" ||
+			info.MacAddress.String() != "60:60:1f:42:11:b8" || info.Randomized ||
+			info.DeviceId != detections[0].DeviceId || info.Fingerprint != "18239620d784" {
+			t.Errorf("detection #%d = %+v", i, info)
+		}
+	}
+}
+
+func TestEngineLinksRandomizedAddress(t *testing.T) {
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	dji := mustParseMAC(t, "60:60:1f:00:00:01")
+	randomized := mustParseMAC(t, "62:a1:b2:c3:d4:e5")
+	other := mustParseMAC(t, "6a:00:00:00:00:01")
+	broadcast := mustParseMAC(t, "ff:ff:ff:ff:ff:ff")
+
+	probe := func(address []byte, seq uint16, rates []byte) RawPacket {
+		ts = ts.Add(time.Second)
+		return buildFrame(t, ts, -45, 2412,
+			&layers.Dot11{
+				Type:           layers.Dot11TypeMgmtProbeReq,
+				Address1:       broadcast,
+				Address2:       address,
+				Address3:       broadcast,
+				SequenceNumber: seq,
+			},
+			ssidElement(""),
+			element(layers.Dot11InformationElementIDRates, rates))
+	}
+	rates := []byte{0x02, 0x04, 0x0b, 0x16}
+
+	source := NewSliceSource(layers.LinkTypeIEEE80211Radio, []RawPacket{
+		probe(dji, 100, rates),
+		probe(randomized, 101, rates),
+		// same sequence, but not the same device
+		probe(other, 102, []byte{0x82, 0x84}),
+	})
+	_, detections := runEngine(t, source, Config{Vendors: loadTestVendors(t)})
+
+	if len(detections) != 2 {
+		t.Fatalf("got %d detections, expected 2", len(detections))
+	}
+	linked := detections[1]
+	if !bytes.Equal(linked.MacAddress, randomized) || !linked.Randomized ||
+		linked.Vendor != "SZ DJI Technology Co.,Ltd" || linked.DeviceId != detections[0].DeviceId {
+		t.Errorf("randomized address not linked: %+v (first: %+v)", linked, detections[0])
+	}
+	if detections[0].Randomized {
+		t.Errorf("%s flagged as randomized", dji)
+	}
+}
@@ -0,0 +1,439 @@
+package djijoe
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/kellydunn/golang-geo"
+)
+
+const (
+	GEN_DEFAULT_DURATION           = 60
+	GEN_DEFAULT_PATH_LOSS_EXPONENT = 2.0
+	GEN_DEFAULT_TX_POWER           = -30 // dBm, received at 1 m
+	GEN_DEFAULT_SENSITIVITY        = -95
+	GEN_DEFAULT_CHANNEL            = 6
+)
+
+/*
+A point of the trajectory of a simulated drone.
+*/
+type Waypoint struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Altitude  float64 `json:"altitude"`
+}
+
+/*
+A simulated drone. It flies along its waypoints at `Speed` m/s and hovers over
+the last one. Intervals are in seconds, 0 disables the frame type: beacons
+(optionally carrying a Remote ID IE) are sent as an access point, probe
+requests as a client looking for its controller.
+*/
+type SimulatedDrone struct {
+	MacAddress     string     `json:"macaddr"`
+	Ssid           string     `json:"ssid"`
+	SerialNumber   string     `json:"serial"`
+	Channel        int        `json:"channel"`
+	TxPower        float64    `json:"tx_power"`
+	BeaconInterval float64    `json:"beacon_interval"`
+	ProbeInterval  float64    `json:"probe_interval"`
+	RemoteId       bool       `json:"remote_id"`
+	Speed          float64    `json:"speed"`
+	Waypoints      []Waypoint `json:"waypoints"`
+
+	hwaddr net.HardwareAddr
+}
+
+/*
+A simulated probe, i.e. where the frames of a scenario are received. `Noise` is
+the standard deviation (in dB) of the noise added to the RSSI.
+*/
+type SimulatedProbe struct {
+	Name        string  `json:"name"`
+	Latitude    float64 `json:"latitude"`
+	Longitude   float64 `json:"longitude"`
+	Noise       float64 `json:"noise"`
+	Sensitivity float64 `json:"sensitivity"`
+}
+
+/*
+Describes the drones and probes to simulate, and for how long (in seconds).
+*/
+type Scenario struct {
+	Start            time.Time         `json:"start"`
+	Duration         float64           `json:"duration"`
+	Seed             int64             `json:"seed"`
+	PathLossExponent float64           `json:"path_loss_exponent"`
+	Drones           []*SimulatedDrone `json:"drones"`
+	Probes           []*SimulatedProbe `json:"probes"`
+}
+
+/*
+Demo scenario: a DJI drone flying away from two probes while beaconing its
+Remote ID, and a Parrot drone hovering and probing for its controller.
+*/
+func DefaultScenario() *Scenario {
+	s := &Scenario{
+		Start: time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC),
+		Drones: []*SimulatedDrone{
+			{
+				MacAddress:     "60:60:1f:de:ad:01",
+				Ssid:           "Mavic-1a2b3c",
+				SerialNumber:   "1581F4XFC00000000001",
+				Channel:        6,
+				BeaconInterval: 0.1024,
+				RemoteId:       true,
+				Speed:          10,
+				Waypoints: []Waypoint{
+					{Latitude: 48.858200, Longitude: 2.294500, Altitude: 50},
+					{Latitude: 48.862000, Longitude: 2.294500, Altitude: 80},
+				},
+			},
+			{
+				MacAddress:    "90:03:b7:de:ad:02",
+				Ssid:          "Bebop2-123456",
+				Channel:       1,
+				ProbeInterval: 0.5,
+				Waypoints: []Waypoint{
+					{Latitude: 48.857500, Longitude: 2.295500, Altitude: 20},
+				},
+			},
+		},
+		Probes: []*SimulatedProbe{
+			{Name: "north", Latitude: 48.859000, Longitude: 2.294000, Noise: 2},
+			{Name: "south", Latitude: 48.857000, Longitude: 2.295000, Noise: 2},
+		},
+	}
+
+	// cannot fail, the addresses above are valid
+	s.Validate()
+	return s
+}
+
+func LoadScenarioFromFile(filePath string) (*Scenario, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var s Scenario
+	if err := json.NewDecoder(file).Decode(&s); err != nil {
+		return nil, fmt.Errorf("invalid scenario '%s': %v", filePath, err)
+	}
+
+	err = s.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+/*
+Checks the scenario, and fills in the default values.
+*/
+func (s *Scenario) Validate() error {
+	if s.Start.IsZero() {
+		s.Start = time.Now().UTC().Truncate(time.Second)
+	}
+	if s.Duration <= 0 {
+		s.Duration = GEN_DEFAULT_DURATION
+	}
+	if s.PathLossExponent <= 0 {
+		s.PathLossExponent = GEN_DEFAULT_PATH_LOSS_EXPONENT
+	}
+	if len(s.Drones) == 0 {
+		return fmt.Errorf("no drone to simulate")
+	}
+	if len(s.Probes) == 0 {
+		return fmt.Errorf("no probe to simulate")
+	}
+
+	for _, d := range s.Drones {
+		hwaddr, err := net.ParseMAC(d.MacAddress)
+		if err != nil || len(hwaddr) != 6 {
+			return fmt.Errorf("invalid MAC address '%s' for drone '%s'", d.MacAddress, d.Ssid)
+		}
+		d.hwaddr = hwaddr
+
+		if len(d.Waypoints) == 0 {
+			return fmt.Errorf("drone %s has no waypoint", d.MacAddress)
+		}
+		if d.BeaconInterval < 0 || d.ProbeInterval < 0 || d.BeaconInterval+d.ProbeInterval == 0 {
+			return fmt.Errorf("drone %s sends no frame", d.MacAddress)
+		}
+		if d.Channel == 0 {
+			d.Channel = GEN_DEFAULT_CHANNEL
+		}
+		if ChannelToFrequency(d.Channel) == 0 {
+			return fmt.Errorf("invalid channel %d for drone %s", d.Channel, d.MacAddress)
+		}
+		if d.TxPower == 0 {
+			d.TxPower = GEN_DEFAULT_TX_POWER
+		}
+	}
+
+	names := make(map[string]bool)
+	for i, p := range s.Probes {
+		if p.Name == "" {
+			p.Name = fmt.Sprintf("probe%d", i)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("duplicate probe name '%s'", p.Name)
+		}
+		names[p.Name] = true
+
+		if p.Sensitivity == 0 {
+			p.Sensitivity = GEN_DEFAULT_SENSITIVITY
+		}
+	}
+
+	return nil
+}
+
+/*
+Returns where the drone is `elapsed` after the start of the scenario, and its
+heading (in degrees) and vertical speed (in m/s).
+*/
+func (d *SimulatedDrone) PositionAt(elapsed time.Duration) (Waypoint, float64, float64) {
+	distance := d.Speed * elapsed.Seconds() / 1000 // km
+
+	for i := 0; i+1 < len(d.Waypoints); i++ {
+		from, to := d.Waypoints[i], d.Waypoints[i+1]
+		start := geo.NewPoint(from.Latitude, from.Longitude)
+		end := geo.NewPoint(to.Latitude, to.Longitude)
+
+		length := start.GreatCircleDistance(end)
+		heading := math.Mod(start.BearingTo(end)+360, 360)
+		if distance >= length {
+			distance -= length
+			continue
+		}
+
+		ratio := distance / length
+		pt := start.PointAtDistanceAndBearing(distance, heading)
+		climb := (to.Altitude - from.Altitude) / (length * 1000) * d.Speed
+
+		return Waypoint{
+			Latitude:  pt.Lat(),
+			Longitude: pt.Lng(),
+			Altitude:  from.Altitude + ratio*(to.Altitude-from.Altitude),
+		}, heading, climb
+	}
+
+	return d.Waypoints[len(d.Waypoints)-1], 0, 0
+}
+
+/*
+Log-distance path loss model: RSSI received by the probe from a drone at
+`position`, without noise.
+*/
+func (s *Scenario) signalStrength(d *SimulatedDrone, p *SimulatedProbe, position Waypoint) float64 {
+	ground := geo.NewPoint(p.Latitude, p.Longitude).GreatCircleDistance(geo.NewPoint(position.Latitude, position.Longitude)) * 1000
+	distance := math.Max(math.Hypot(ground, position.Altitude), 1)
+	return d.TxPower - 10*s.PathLossExponent*math.Log10(distance)
+}
+
+/*
+A frame sent by a drone at a given time of the scenario.
+*/
+type simulatedFrame struct {
+	drone       *SimulatedDrone
+	elapsed     time.Duration
+	messageType int
+	seq         uint16
+}
+
+func (s *Scenario) frames() []simulatedFrame {
+	var frames []simulatedFrame
+	duration := time.Duration(s.Duration * float64(time.Second))
+
+	for i, d := range s.Drones {
+		// spread the drones so their frames do not all share the same timestamp
+		offset := time.Duration(i) * 7 * time.Millisecond
+		var seq uint16
+
+		emit := func(interval float64, messageType int) {
+			if interval == 0 {
+				return
+			}
+			step := time.Duration(interval * float64(time.Second))
+			for t := offset; t < duration; t += step {
+				frames = append(frames, simulatedFrame{d, t, messageType, seq})
+				seq = (seq + 1) & 0xfff
+			}
+		}
+
+		emit(d.BeaconInterval, TYPE_BEACON)
+		emit(d.ProbeInterval, TYPE_PROBE_REQUEST)
+	}
+
+	sort.SliceStable(frames, func(i, j int) bool {
+		return frames[i].elapsed < frames[j].elapsed
+	})
+	return frames
+}
+
+func (s *Scenario) buildFrame(f simulatedFrame, signal int8) ([]byte, error) {
+	d := f.drone
+	broadcast := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	ts := s.Start.Add(f.elapsed)
+
+	radio := &layers.RadioTap{
+		Present:          layers.RadioTapPresentTSFT | layers.RadioTapPresentChannel | layers.RadioTapPresentDBMAntennaSignal,
+		TSFT:             uint64(f.elapsed / time.Microsecond),
+		ChannelFrequency: layers.RadioTapChannelFrequency(ChannelToFrequency(d.Channel)),
+		ChannelFlags:     layers.RadioTapChannelFlagsGhz2 | layers.RadioTapChannelFlagsOFDM,
+		DBMAntennaSignal: signal,
+	}
+	if d.Channel > 14 {
+		radio.ChannelFlags = layers.RadioTapChannelFlagsGhz5 | layers.RadioTapChannelFlagsOFDM
+	}
+
+	ssid := &layers.Dot11InformationElement{
+		ID:     layers.Dot11InformationElementIDSSID,
+		Length: uint8(len(d.Ssid)),
+		Info:   []byte(d.Ssid),
+	}
+	rates := &layers.Dot11InformationElement{
+		ID:     layers.Dot11InformationElementIDRates,
+		Length: 8,
+		Info:   []byte{0x82, 0x84, 0x8b, 0x96, 0x0c, 0x12, 0x18, 0x24},
+	}
+	dsset := &layers.Dot11InformationElement{
+		ID:     layers.Dot11InformationElementIDDSSet,
+		Length: 1,
+		Info:   []byte{byte(d.Channel)},
+	}
+
+	var all []gopacket.SerializableLayer
+	switch f.messageType {
+	case TYPE_BEACON:
+		all = []gopacket.SerializableLayer{
+			radio,
+			&layers.Dot11{
+				Type:           layers.Dot11TypeMgmtBeacon,
+				Address1:       broadcast,
+				Address2:       d.hwaddr,
+				Address3:       d.hwaddr,
+				SequenceNumber: f.seq,
+			},
+			&layers.Dot11MgmtBeacon{
+				Timestamp: uint64(f.elapsed / time.Microsecond),
+				Interval:  uint16(d.BeaconInterval * 1000000 / 1024),
+				Flags:     0x0001, // ESS
+			},
+			ssid, rates, dsset,
+		}
+
+		if d.RemoteId {
+			position, heading, climb := d.PositionAt(f.elapsed)
+			rid := RemoteId{
+				SerialNumber:  d.SerialNumber,
+				Latitude:      position.Latitude,
+				Longitude:     position.Longitude,
+				Altitude:      position.Altitude,
+				Height:        position.Altitude - d.Waypoints[0].Altitude,
+				Direction:     heading,
+				Speed:         d.Speed,
+				VerticalSpeed: climb,
+				Timestamp:     ts,
+			}
+			if heading == 0 && climb == 0 {
+				rid.Speed = 0
+			}
+			all = append(all, rid.InformationElement(uint8(f.seq)))
+		}
+
+	case TYPE_PROBE_REQUEST:
+		all = []gopacket.SerializableLayer{
+			radio,
+			&layers.Dot11{
+				Type:           layers.Dot11TypeMgmtProbeReq,
+				Address1:       broadcast,
+				Address2:       d.hwaddr,
+				Address3:       broadcast,
+				SequenceNumber: f.seq,
+			},
+			ssid, rates,
+		}
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true}
+	err := gopacket.SerializeLayers(buffer, options, all...)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+/*
+Returns the frames received by `probe` during the scenario, in chronological
+order. The RSSI follows the distance between the drones and the probe; frames
+below the sensitivity of the probe are lost.
+*/
+func (s *Scenario) Generate(probe *SimulatedProbe) ([]RawPacket, error) {
+	var packets []RawPacket
+
+	// one generator per probe, so each of them gets the same noise for a given seed
+	rng := rand.New(rand.NewSource(s.Seed))
+
+	for _, f := range s.frames() {
+		position, _, _ := f.drone.PositionAt(f.elapsed)
+		rssi := s.signalStrength(f.drone, probe, position) + rng.NormFloat64()*probe.Noise
+		if rssi < probe.Sensitivity {
+			continue
+		}
+		signal := int8(math.Max(math.Round(rssi), math.MinInt8))
+		if rssi > 0 {
+			signal = 0
+		}
+
+		data, err := s.buildFrame(f, signal)
+		if err != nil {
+			return nil, err
+		}
+
+		packets = append(packets, RawPacket{
+			Data: data,
+			CaptureInfo: gopacket.CaptureInfo{
+				Timestamp:     s.Start.Add(f.elapsed),
+				CaptureLength: len(data),
+				Length:        len(data),
+			},
+		})
+	}
+
+	return packets, nil
+}
+
+/*
+Writes frames to a (radiotap) PCAP file.
+*/
+func WritePcap(w io.Writer, packets []RawPacket) error {
+	writer := pcapgo.NewWriter(w)
+	err := writer.WriteFileHeader(PCAPNG_DEFAULT_SNAPLEN, layers.LinkTypeIEEE80211Radio)
+	if err != nil {
+		return err
+	}
+
+	for _, packet := range packets {
+		err = writer.WritePacket(packet.CaptureInfo, packet.Data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
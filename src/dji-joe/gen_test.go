@@ -0,0 +1,210 @@
+package djijoe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func decodeRemoteIdLocation(t *testing.T, info []byte) (float64, float64) {
+	// OUI (3) + OUI type + counter + pack header + message size + count
+	if len(info) != 8+2*REMOTEID_MESSAGE_SIZE || !bytes.Equal(info[:3], REMOTEID_OUI) || info[3] != REMOTEID_OUI_TYPE {
+		t.Fatalf("not a Remote ID message pack: %x", info)
+	}
+	location := info[8+REMOTEID_MESSAGE_SIZE:]
+	if location[0] != remoteIdHeader(REMOTEID_MSG_LOCATION) {
+		t.Fatalf("not a Location message: %x", location)
+	}
+	lat := float64(int32(binary.LittleEndian.Uint32(location[5:]))) / 1e7
+	lng := float64(int32(binary.LittleEndian.Uint32(location[9:]))) / 1e7
+	return lat, lng
+}
+
+func TestSimulatedDronePosition(t *testing.T) {
+	d := &SimulatedDrone{
+		Speed: 10,
+		Waypoints: []Waypoint{
+			{Latitude: 48.8582, Longitude: 2.2945, Altitude: 50},
+			{Latitude: 48.8672, Longitude: 2.2945, Altitude: 150},
+		},
+	}
+
+	// ~1 km due north, reached after ~100 s
+	position, heading, climb := d.PositionAt(50 * time.Second)
+	if math.Abs(position.Latitude-48.8627) > 0.0001 || math.Abs(position.Longitude-2.2945) > 0.0001 {
+		t.Errorf("position after 50s = %+v", position)
+	}
+	if math.Abs(position.Altitude-100) > 1 || math.Abs(heading) > 0.01 || math.Abs(climb-1) > 0.01 {
+		t.Errorf("after 50s: altitude=%f heading=%f climb=%f", position.Altitude, heading, climb)
+	}
+
+	position, heading, climb = d.PositionAt(time.Hour)
+	if position != d.Waypoints[1] || heading != 0 || climb != 0 {
+		t.Errorf("not hovering over the last waypoint: %+v", position)
+	}
+}
+
+func TestParseRemoteId(t *testing.T) {
+	sent := RemoteId{
+		SerialNumber:  "1581F4XFC00000000001",
+		Latitude:      48.8582123,
+		Longitude:     -2.2945678,
+		Altitude:      120.5,
+		Height:        40,
+		Direction:     270,
+		Speed:         12.25,
+		VerticalSpeed: -1.5,
+		Timestamp:     time.Date(2020, 1, 1, 12, 59, 59, 900000000, time.UTC),
+	}
+	ie := sent.InformationElement(7)
+
+	// received just after the hour
+	received := ParseRemoteId(ie.Info, sent.Timestamp.Add(200*time.Millisecond))
+	if received == nil {
+		t.Fatalf("no Remote ID in %x", ie.Info)
+	}
+	if *received != sent {
+		t.Errorf("got %+v, expected %+v", *received, sent)
+	}
+
+	// a single Location message
+	info := append(append([]byte{}, ie.Info[:5]...), sent.locationMessage()...)
+	if received := ParseRemoteId(info, sent.Timestamp); received == nil || received.SerialNumber != "" || received.Latitude != sent.Latitude {
+		t.Errorf("single message: %+v", received)
+	}
+
+	for _, bad := range [][]byte{ie.Info[:20], append([]byte{}, sent.basicIdMessage()...), append(append([]byte{}, ie.Info[:5]...), sent.basicIdMessage()...)} {
+		if received := ParseRemoteId(bad, sent.Timestamp); received != nil {
+			t.Errorf("%x: got %+v", bad, received)
+		}
+	}
+}
+
+func TestScenarioGenerate(t *testing.T) {
+	vendors := loadTestVendors(t)
+	scenario := DefaultScenario()
+	scenario.Duration = 20
+	dji := scenario.Drones[0]
+
+	for _, probe := range scenario.Probes {
+		packets, err := scenario.Generate(probe)
+		if err != nil {
+			t.Fatalf("Generate(%s): %v", probe.Name, err)
+		}
+
+		// same seed, same frames
+		again, _ := scenario.Generate(probe)
+		if len(again) != len(packets) || !bytes.Equal(again[len(again)-1].Data, packets[len(packets)-1].Data) {
+			t.Errorf("%s: the generation is not deterministic", probe.Name)
+		}
+
+		var djiStrengths []int8
+		for i, raw := range packets {
+			if i > 0 && raw.CaptureInfo.Timestamp.Before(packets[i-1].CaptureInfo.Timestamp) {
+				t.Fatalf("%s: frame #%d is out of order", probe.Name, i)
+			}
+
+			packet := gopacket.NewPacket(raw.Data, layers.LayerTypeRadioTap, gopacket.Default)
+			dot11 := packet.Layer(layers.LayerTypeDot11).(*layers.Dot11)
+			radio := packet.Layer(layers.LayerTypeRadioTap).(*layers.RadioTap)
+			if !bytes.Equal(dot11.Address2, dji.hwaddr) {
+				continue
+			}
+			djiStrengths = append(djiStrengths, radio.DBMAntennaSignal)
+
+			if packet.Layer(layers.LayerTypeDot11MgmtBeacon) == nil || getSsid(packet) != dji.Ssid {
+				t.Fatalf("%s: frame #%d is not a beacon for %s", probe.Name, i, dji.Ssid)
+			}
+
+			elapsed := raw.CaptureInfo.Timestamp.Sub(scenario.Start)
+			expected, _, _ := dji.PositionAt(elapsed)
+			found := false
+			for _, ie := range managementInformationElements(packet) {
+				if ie.ID != layers.Dot11InformationElementIDVendor {
+					continue
+				}
+				lat, lng := decodeRemoteIdLocation(t, ie.Info)
+				if math.Abs(lat-expected.Latitude) > 1e-6 || math.Abs(lng-expected.Longitude) > 1e-6 {
+					t.Errorf("%s: frame #%d is at (%f, %f), expected (%f, %f)",
+						probe.Name, i, lat, lng, expected.Latitude, expected.Longitude)
+				}
+				found = true
+			}
+			if !found {
+				t.Fatalf("%s: frame #%d has no Remote ID", probe.Name, i)
+			}
+		}
+
+		// the DJI flies away from both probes
+		n := len(djiStrengths) / 10
+		if n == 0 || mean(djiStrengths[:n]) <= mean(djiStrengths[len(djiStrengths)-n:]) {
+			t.Errorf("%s: RSSI of the DJI does not decrease: %v", probe.Name, djiStrengths)
+		}
+
+		// the frames go through a PCAP file and the detection engine
+		var pcap bytes.Buffer
+		if err := WritePcap(&pcap, packets); err != nil {
+			t.Fatalf("WritePcap: %v", err)
+		}
+		path := filepath.Join(t.TempDir(), probe.Name+".pcap")
+		if err := ioutil.WriteFile(path, pcap.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		source, err := OpenFileSource(path)
+		if err != nil {
+			t.Fatalf("OpenFileSource: %v", err)
+		}
+		report, err := Analyze(probe.Name, source, vendors)
+		source.Close()
+		if err != nil {
+			t.Fatalf("Analyze: %v", err)
+		}
+		if report.NbPackets != uint64(len(packets)) || len(report.Devices) != 2 {
+			t.Fatalf("%s: analyzed %d frames (%d devices), expected %d (2)",
+				probe.Name, report.NbPackets, len(report.Devices), len(packets))
+		}
+		parrot := report.Devices[1]
+		if parrot.Vendor != "Parrot SA" || parrot.NbProbes == 0 || parrot.Ssids[0] != "Bebop2-123456" || parrot.Channels[0] != 1 {
+			t.Errorf("%s: unexpected Parrot device %+v", probe.Name, parrot)
+		}
+	}
+}
+
+func mean(values []int8) float64 {
+	sum := 0.0
+	for _, v := range values {
+		sum += float64(v)
+	}
+	return sum / float64(len(values))
+}
+
+func TestScenarioValidate(t *testing.T) {
+	waypoints := []Waypoint{{Latitude: 1, Longitude: 1}}
+	probes := []*SimulatedProbe{{Name: "p"}}
+
+	tests := []struct {
+		name     string
+		scenario Scenario
+	}{
+		{"no drone", Scenario{Probes: probes}},
+		{"no probe", Scenario{Drones: []*SimulatedDrone{{MacAddress: "60:60:1f:00:00:01", BeaconInterval: 1, Waypoints: waypoints}}}},
+		{"bad MAC", Scenario{Probes: probes, Drones: []*SimulatedDrone{{MacAddress: "60:60:1f", BeaconInterval: 1, Waypoints: waypoints}}}},
+		{"no waypoint", Scenario{Probes: probes, Drones: []*SimulatedDrone{{MacAddress: "60:60:1f:00:00:01", BeaconInterval: 1}}}},
+		{"silent", Scenario{Probes: probes, Drones: []*SimulatedDrone{{MacAddress: "60:60:1f:00:00:01", Waypoints: waypoints}}}},
+		{"bad channel", Scenario{Probes: probes, Drones: []*SimulatedDrone{{MacAddress: "60:60:1f:00:00:01", BeaconInterval: 1, Channel: 15, Waypoints: waypoints}}}},
+		{"duplicate probe", Scenario{Probes: []*SimulatedProbe{{Name: "p"}, {Name: "p"}}, Drones: []*SimulatedDrone{{MacAddress: "60:60:1f:00:00:01", BeaconInterval: 1, Waypoints: waypoints}}}},
+	}
+
+	for _, test := range tests {
+		if err := test.scenario.Validate(); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
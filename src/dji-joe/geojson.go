@@ -0,0 +1,126 @@
+package djijoe
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+/*
+A ring of a polygon, as [longitude, latitude] points (the GeoJSON order).
+*/
+type geoRing [][2]float64
+
+/*
+A polygon: its outer ring, then its holes.
+*/
+type geoPolygon []geoRing
+
+/*
+An area made of polygons.
+*/
+type GeoZone []geoPolygon
+
+type geoJsonObject struct {
+	Type        string            `json:"type"`
+	Coordinates json.RawMessage   `json:"coordinates"`
+	Geometry    *geoJsonObject    `json:"geometry"`
+	Features    []json.RawMessage `json:"features"`
+}
+
+/*
+Parses a GeoJSON Polygon or MultiPolygon, or a Feature or FeatureCollection of
+them.
+*/
+func ParseGeoJson(data []byte) (GeoZone, error) {
+	var obj geoJsonObject
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, fmt.Errorf("invalid GeoJSON: %v", err)
+	}
+
+	var zone GeoZone
+	switch obj.Type {
+	case "Polygon":
+		var polygon geoPolygon
+		if err := json.Unmarshal(obj.Coordinates, &polygon); err != nil {
+			return nil, fmt.Errorf("invalid GeoJSON Polygon: %v", err)
+		}
+		zone = GeoZone{polygon}
+
+	case "MultiPolygon":
+		if err := json.Unmarshal(obj.Coordinates, &zone); err != nil {
+			return nil, fmt.Errorf("invalid GeoJSON MultiPolygon: %v", err)
+		}
+
+	case "Feature":
+		if obj.Geometry == nil {
+			return nil, fmt.Errorf("GeoJSON Feature without a geometry")
+		}
+		geometry, _ := json.Marshal(obj.Geometry)
+		return ParseGeoJson(geometry)
+
+	case "FeatureCollection":
+		for _, feature := range obj.Features {
+			polygons, err := ParseGeoJson(feature)
+			if err != nil {
+				return nil, err
+			}
+			zone = append(zone, polygons...)
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported GeoJSON type '%s', expected a Polygon or a MultiPolygon", obj.Type)
+	}
+
+	for _, polygon := range zone {
+		if len(polygon) == 0 {
+			return nil, fmt.Errorf("GeoJSON polygon without any ring")
+		}
+		for _, ring := range polygon {
+			if len(ring) < 4 {
+				return nil, fmt.Errorf("GeoJSON ring of %d positions, expected at least 4", len(ring))
+			}
+		}
+	}
+	if len(zone) == 0 {
+		return nil, fmt.Errorf("empty GeoJSON zone")
+	}
+	return zone, nil
+}
+
+/*
+Returns whether the point is inside the ring (even-odd rule).
+*/
+func (r geoRing) contains(lat float64, lng float64) bool {
+	inside := false
+	for i, j := 0, len(r)-1; i < len(r); j, i = i, i+1 {
+		xi, yi := r[i][0], r[i][1]
+		xj, yj := r[j][0], r[j][1]
+		if (yi > lat) != (yj > lat) && lng < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+/*
+Returns whether a position is in one of the polygons of the zone, and not in
+one of its holes.
+*/
+func (z GeoZone) Contains(lat float64, lng float64) bool {
+	for _, polygon := range z {
+		if !polygon[0].contains(lat, lng) {
+			continue
+		}
+		inHole := false
+		for _, hole := range polygon[1:] {
+			if hole.contains(lat, lng) {
+				inHole = true
+				break
+			}
+		}
+		if !inHole {
+			return true
+		}
+	}
+	return false
+}
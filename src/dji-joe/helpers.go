@@ -1,18 +1,85 @@
 package djijoe
 
+import (
+	"fmt"
+	"net"
+	"time"
 
-func MessageTypeToString(MessageType int) string {
-	switch MessageType {
-	case TYPE_PROBE_REQUEST:
-		return "ProbeRequest"
+	"github.com/google/gopacket"
+)
 
-	case TYPE_BEACON:
-		return "Beacon"
+var messageTypeNames = map[int]string{
+	TYPE_UNDEFINED:              "Undefined",
+	TYPE_PROBE_REQUEST:          "ProbeRequest",
+	TYPE_BEACON:                 "Beacon",
+	TYPE_DATA:                   "Data",
+	TYPE_PROBE_RESPONSE:         "ProbeResponse",
+	TYPE_ASSOCIATION_REQUEST:    "AssociationRequest",
+	TYPE_ASSOCIATION_RESPONSE:   "AssociationResponse",
+	TYPE_REASSOCIATION_REQUEST:  "ReassociationRequest",
+	TYPE_REASSOCIATION_RESPONSE: "ReassociationResponse",
+	TYPE_AUTHENTICATION:         "Authentication",
+	TYPE_DEAUTHENTICATION:       "Deauthentication",
+	TYPE_DISASSOCIATION:         "Disassociation",
+	TYPE_ACTION:                 "Action",
+	TYPE_OTHER_MANAGEMENT:       "Management",
+	TYPE_NULL_DATA:              "NullData",
+	TYPE_CONTROL:                "Control",
+}
 
-	default:
-		Log.FatalF("Incorrect type %d", MessageType)
+/*
+Returns the name of a TYPE_*, or "Unknown(<n>)" for a value which is not one
+(e.g. sent by a newer probe).
+*/
+func MessageTypeToString(MessageType int) string {
+	name, ok := messageTypeNames[MessageType]
+	if !ok {
+		return fmt.Sprintf("Unknown(%d)", MessageType)
 	}
-	return ""
+	return name
+}
+
+/*
+Returns the time a packet was captured at, as recorded by the capture source.
+Falls back to the current time for packets without capture metadata.
+*/
+func packetTimestamp(packet gopacket.Packet) time.Time {
+	ts := packet.Metadata().Timestamp
+	if ts.IsZero() {
+		return time.Now()
+	}
+	return ts
+}
+
+/*
+Returns true if the MAC address is a broadcast or multicast address.
+*/
+func isGroupMac(hwaddr net.HardwareAddr) bool {
+	return len(hwaddr) == 0 || hwaddr[0]&0x01 == 0x01
 }
 
+/*
+Returns true if the MAC address is locally administered, i.e. not assigned by
+the IEEE, as the randomized addresses used to probe for networks.
+*/
+func IsLocallyAdministered(hwaddr net.HardwareAddr) bool {
+	return len(hwaddr) > 0 && hwaddr[0]&0x02 == 0x02
+}
 
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,243 @@
+package djijoe
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+/*
+A tagged parameter of a 802.11 management frame.
+*/
+type InformationElement struct {
+	ID   layers.Dot11InformationElementID
+	Info []byte
+}
+
+/*
+Splits a buffer of tagged parameters, stopping at the first truncated one.
+*/
+func parseInformationElements(data []byte) []InformationElement {
+	var elements []InformationElement
+
+	for len(data) >= 2 {
+		length := int(data[1])
+		if len(data) < 2+length {
+			break
+		}
+
+		elements = append(elements, InformationElement{
+			ID:   layers.Dot11InformationElementID(data[0]),
+			Info: data[2 : 2+length],
+		})
+		data = data[2+length:]
+	}
+
+	return elements
+}
+
+/*
+Returns the tagged parameters of a 802.11 management frame, in the order they
+were sent. gopacket does not decode them for all the subtypes (e.g.
+ProbeRequest), so they are parsed from the body of the frame.
+*/
+func managementInformationElements(packet gopacket.Packet) []InformationElement {
+	// length of the fixed parameters preceding the tagged ones
+	subtypes := []struct {
+		layerType gopacket.LayerType
+		offset    int
+	}{
+		{layers.LayerTypeDot11MgmtBeacon, 12},
+		{layers.LayerTypeDot11MgmtProbeResp, 12},
+		{layers.LayerTypeDot11MgmtProbeReq, 0},
+		{layers.LayerTypeDot11MgmtAssociationReq, 4},
+		{layers.LayerTypeDot11MgmtReassociationReq, 10},
+	}
+
+	for _, subtype := range subtypes {
+		layer := packet.Layer(subtype.layerType)
+		if layer == nil {
+			continue
+		}
+
+		// depending on the gopacket version, the contents are either the whole
+		// body or only its fixed parameters
+		body := layer.LayerContents()
+		if len(body) <= subtype.offset {
+			body = append(body[:len(body):len(body)], layer.LayerPayload()...)
+		}
+		if len(body) < subtype.offset {
+			return nil
+		}
+		return parseInformationElements(body[subtype.offset:])
+	}
+
+	return nil
+}
+
+/*
+Returns the SSID advertised in (or probed by) a 802.11 management frame.
+*/
+func getSsid(packet gopacket.Packet) string {
+	for _, ie := range managementInformationElements(packet) {
+		if ie.ID == layers.Dot11InformationElementIDSSID {
+			return string(ie.Info)
+		}
+	}
+	return ""
+}
+
+// bit of the capability information of beacons and probe responses
+const CAPABILITY_PRIVACY = 0x0010
+
+var (
+	OUI_IEEE_80211 = []byte{0x00, 0x0f, 0xac}
+	OUI_MICROSOFT  = []byte{0x00, 0x50, 0xf2}
+)
+
+// names of the key management suites of the RSN IE (00:0f:ac:<type>)
+var rsnAkmSuites = map[byte]string{
+	1:  "WPA2-EAP",
+	2:  "WPA2-PSK",
+	3:  "FT-EAP",
+	4:  "FT-PSK",
+	5:  "WPA2-EAP",
+	6:  "WPA2-PSK",
+	8:  "WPA3-SAE",
+	9:  "FT-SAE",
+	12: "WPA3-EAP",
+	18: "OWE",
+}
+
+// names of the key management suites of the WPA IE (00:50:f2:<type>)
+var wpaAkmSuites = map[byte]string{
+	1: "WPA-EAP",
+	2: "WPA-PSK",
+}
+
+/*
+What a management frame tells about the network it advertises, or probes for.
+*/
+type NetworkInfo struct {
+	Ssid     string   `json:"ssid,omitempty"`
+	Channel  int      `json:"channel,omitempty"`
+	Security []string `json:"security,omitempty"`
+	Country  string   `json:"country,omitempty"`
+
+	// the "capabilities info" fields of the HT and VHT capabilities IEs
+	HtCapabilities  uint16 `json:"ht_capabilities,omitempty"`
+	VhtCapabilities uint32 `json:"vht_capabilities,omitempty"`
+}
+
+/*
+Parses the information elements of a management frame. The security is only
+known for the frames sent by an AP (beacons and probe responses): "Open",
+"WEP", or the key management suites it accepts (e.g. "WPA2-PSK").
+*/
+func ParseNetworkInfo(packet gopacket.Packet) NetworkInfo {
+	var info NetworkInfo
+	var rsn, wpa []string
+
+	for _, ie := range managementInformationElements(packet) {
+		switch ie.ID {
+		case layers.Dot11InformationElementIDSSID:
+			info.Ssid = string(ie.Info)
+
+		case layers.Dot11InformationElementIDDSSet:
+			if len(ie.Info) == 1 {
+				info.Channel = int(ie.Info[0])
+			}
+
+		case layers.Dot11InformationElementIDCountryInfo:
+			// the third character tells the environment (indoor, outdoor...)
+			if len(ie.Info) >= 2 {
+				info.Country = string(bytes.TrimRight(ie.Info[:2], " \x00"))
+			}
+
+		case layers.Dot11InformationElementIDHTCapabilities:
+			if len(ie.Info) >= 2 {
+				info.HtCapabilities = binary.LittleEndian.Uint16(ie.Info)
+			}
+
+		case layers.Dot11InformationElementIDVHTCapabilities:
+			if len(ie.Info) >= 4 {
+				info.VhtCapabilities = binary.LittleEndian.Uint32(ie.Info)
+			}
+
+		case layers.Dot11InformationElementIDRSNInfo:
+			rsn = parseAkmSuites(ie.Info, OUI_IEEE_80211, rsnAkmSuites, "RSN")
+
+		case layers.Dot11InformationElementIDVendor:
+			if len(ie.Info) >= 4 && bytes.Equal(ie.Info[:3], OUI_MICROSOFT) && ie.Info[3] == 1 {
+				wpa = parseAkmSuites(ie.Info[4:], OUI_MICROSOFT, wpaAkmSuites, "WPA")
+			}
+		}
+	}
+
+	capabilities, isAp := apCapabilities(packet)
+	switch {
+	case len(rsn) > 0 || len(wpa) > 0:
+		info.Security = append(rsn, wpa...)
+	case isAp && capabilities&CAPABILITY_PRIVACY != 0:
+		info.Security = []string{"WEP"}
+	case isAp:
+		info.Security = []string{"Open"}
+	}
+
+	return info
+}
+
+/*
+Returns the capability information of a beacon or a probe response.
+*/
+func apCapabilities(packet gopacket.Packet) (uint16, bool) {
+	if beacon, ok := packet.Layer(layers.LayerTypeDot11MgmtBeacon).(*layers.Dot11MgmtBeacon); ok {
+		return beacon.Flags, true
+	}
+	if response, ok := packet.Layer(layers.LayerTypeDot11MgmtProbeResp).(*layers.Dot11MgmtProbeResp); ok {
+		return response.Flags, true
+	}
+	return 0, false
+}
+
+/*
+Returns the names of the key management suites of a RSN IE, or of a WPA IE
+(past its OUI and type): version, group cipher, pairwise ciphers, then key
+management suites. Unknown suites are named after `fallback`.
+*/
+func parseAkmSuites(data []byte, oui []byte, names map[byte]string, fallback string) []string {
+	// version and group cipher
+	offset := 2 + 4
+	if len(data) < offset+2 {
+		return []string{fallback}
+	}
+
+	nbPairwise := int(binary.LittleEndian.Uint16(data[offset:]))
+	offset += 2 + 4*nbPairwise
+	if len(data) < offset+2 {
+		return []string{fallback}
+	}
+
+	var suites []string
+	nbAkm := int(binary.LittleEndian.Uint16(data[offset:]))
+	offset += 2
+	for i := 0; i < nbAkm && offset+4 <= len(data); i++ {
+		suite := data[offset : offset+4]
+		offset += 4
+
+		name, ok := names[suite[3]]
+		if !ok || !bytes.Equal(suite[:3], oui) {
+			name = fallback
+		}
+		if !containsString(suites, name) {
+			suites = append(suites, name)
+		}
+	}
+
+	if len(suites) == 0 {
+		return []string{fallback}
+	}
+	return suites
+}
@@ -0,0 +1,113 @@
+package djijoe
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	// WPA2-PSK + WPA3-SAE (transition mode), CCMP
+	testRsn = []byte{
+		0x01, 0x00, 0x00, 0x0f, 0xac, 0x04,
+		0x01, 0x00, 0x00, 0x0f, 0xac, 0x04,
+		0x02, 0x00, 0x00, 0x0f, 0xac, 0x02, 0x00, 0x0f, 0xac, 0x08,
+		0x8c, 0x00,
+	}
+	// WPA-PSK, TKIP
+	testWpa = []byte{
+		0x00, 0x50, 0xf2, 0x01, 0x01, 0x00, 0x00, 0x50, 0xf2, 0x02,
+		0x01, 0x00, 0x00, 0x50, 0xf2, 0x02,
+		0x01, 0x00, 0x00, 0x50, 0xf2, 0x02,
+	}
+)
+
+func TestParseNetworkInfo(t *testing.T) {
+	dji := mustParseMAC(t, "60:60:1f:00:00:01")
+	broadcast := mustParseMAC(t, "ff:ff:ff:ff:ff:ff")
+	ts := time.Now()
+
+	beacon := func(flags uint16, elements ...gopacket.SerializableLayer) RawPacket {
+		return buildFrame(t, ts, -40, 2437,
+			&layers.Dot11{Type: layers.Dot11TypeMgmtBeacon, Address1: broadcast, Address2: dji, Address3: dji},
+			append([]gopacket.SerializableLayer{&layers.Dot11MgmtBeacon{Interval: 100, Flags: flags}}, elements...)...)
+	}
+
+	tests := []struct {
+		name     string
+		frame    RawPacket
+		expected NetworkInfo
+	}{
+		{
+			name: "WPA2/WPA3 beacon",
+			frame: beacon(0x0411,
+				ssidElement("Mavic-123456"),
+				element(layers.Dot11InformationElementIDDSSet, []byte{6}),
+				element(layers.Dot11InformationElementIDCountryInfo, []byte("CN \x01\x0d\x14")),
+				element(layers.Dot11InformationElementIDRSNInfo, testRsn),
+				element(layers.Dot11InformationElementIDHTCapabilities, append([]byte{0x6e, 0x11}, make([]byte, 24)...)),
+				element(layers.Dot11InformationElementIDVHTCapabilities, []byte{0xb1, 0x79, 0x8b, 0x0f, 0, 0, 0, 0, 0, 0, 0, 0})),
+			expected: NetworkInfo{
+				Ssid:            "Mavic-123456",
+				Channel:         6,
+				Security:        []string{"WPA2-PSK", "WPA3-SAE"},
+				Country:         "CN",
+				HtCapabilities:  0x116e,
+				VhtCapabilities: 0x0f8b79b1,
+			},
+		},
+		{
+			name:     "WEP beacon",
+			frame:    beacon(0x0011, ssidElement("Spark-ABCDEF")),
+			expected: NetworkInfo{Ssid: "Spark-ABCDEF", Security: []string{"WEP"}},
+		},
+		{
+			name:     "open beacon",
+			frame:    beacon(0x0001, ssidElement("Bebop2-001122")),
+			expected: NetworkInfo{Ssid: "Bebop2-001122", Security: []string{"Open"}},
+		},
+		{
+			name: "WPA probe response",
+			frame: buildFrame(t, ts, -40, 2437,
+				&layers.Dot11{Type: layers.Dot11TypeMgmtProbeResp, Address1: broadcast, Address2: dji, Address3: dji},
+				&layers.Dot11MgmtProbeResp{Interval: 100, Flags: 0x0011},
+				ssidElement("Phantom3-123456"),
+				element(layers.Dot11InformationElementIDVendor, testWpa)),
+			expected: NetworkInfo{Ssid: "Phantom3-123456", Security: []string{"WPA-PSK"}},
+		},
+		{
+			name: "probe request",
+			frame: buildFrame(t, ts, -40, 2437,
+				&layers.Dot11{Type: layers.Dot11TypeMgmtProbeReq, Address1: broadcast, Address2: dji, Address3: broadcast},
+				ssidElement("PHANTOM3_4211b8"),
+				element(layers.Dot11InformationElementIDDSSet, []byte{1}),
+				element(layers.Dot11InformationElementIDHTCapabilities, append([]byte{0xef, 0x11}, make([]byte, 24)...))),
+			expected: NetworkInfo{Ssid: "PHANTOM3_4211b8", Channel: 1, HtCapabilities: 0x11ef},
+		},
+	}
+
+	for _, test := range tests {
+		packet := gopacket.NewPacket(test.frame.Data, layers.LayerTypeRadioTap, gopacket.Default)
+		got := ParseNetworkInfo(packet)
+
+		if got.Ssid != test.expected.Ssid ||
+			got.Channel != test.expected.Channel ||
+			strings.Join(got.Security, ",") != strings.Join(test.expected.Security, ",") ||
+			got.Country != test.expected.Country ||
+			got.HtCapabilities != test.expected.HtCapabilities ||
+			got.VhtCapabilities != test.expected.VhtCapabilities {
+			t.Errorf("%s: got %+v, expected %+v", test.name, got, test.expected)
+		}
+	}
+}
+
+func TestParseAkmSuitesTruncated(t *testing.T) {
+	for _, data := range [][]byte{nil, testRsn[:4], testRsn[:10], testRsn[:14]} {
+		if suites := parseAkmSuites(data, OUI_IEEE_80211, rsnAkmSuites, "RSN"); strings.Join(suites, ",") != "RSN" {
+			t.Errorf("%x: got %v", data, suites)
+		}
+	}
+}
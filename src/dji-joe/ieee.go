@@ -0,0 +1,188 @@
+package djijoe
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// https://standards-oui.ieee.org/oui/oui.csv (and mam.csv, oui36.csv)
+// https://www.wireshark.org/download/automated/data/manuf
+const IEEE_REGISTRY_HEADER = "Registry,Assignment,Organization Name"
+
+/*
+Case-insensitive patterns matched against the vendor names: a vendor is kept if
+its name contains any of them. An empty filter keeps all the vendors.
+*/
+type VendorFilter []string
+
+/*
+The vendors known to make drones (or their WiFi remotes), as named in the IEEE
+registries.
+*/
+var DRONE_VENDOR_FILTER = VendorFilter{
+	"SZ DJI Technology",
+	"DJI Baiwang",
+	"Parrot",
+	"Yuneec",
+	"Autel Robotics",
+	"Skydio",
+	"3D Robotics",
+	"Hubsan",
+	"Walkera",
+}
+
+func (f VendorFilter) Match(name string) bool {
+	if len(f) == 0 {
+		return true
+	}
+
+	name = strings.ToLower(name)
+	for _, pattern := range f {
+		if strings.Contains(name, strings.ToLower(pattern)) {
+			return true
+		}
+	}
+	return false
+}
+
+func isIeeeRegistry(data []byte) bool {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	return bytes.HasPrefix(data, []byte(IEEE_REGISTRY_HEADER))
+}
+
+/*
+An assignment of a MAC address prefix, as found in a registry.
+*/
+type RegistryEntry struct {
+	Prefix       MacPrefix
+	Organization string
+}
+
+/*
+Reads an IEEE registry: `Registry,Assignment,Organization Name,Organization
+Address`, where the length of the assignment (6, 7 or 9 hexadecimal digits)
+gives the length of the prefix (MA-L, MA-M or MA-S/IAB).
+*/
+func readIeeeRegistry(r io.Reader, log Logger) ([]RegistryEntry, error) {
+	var entries []RegistryEntry
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	lineno := 0
+
+	for {
+		records, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		lineno++
+
+		// skip the header
+		if lineno == 1 {
+			continue
+		}
+
+		if len(records) < 3 {
+			log.ErrorF("Incorrect entry line %d, skipping...", lineno)
+			continue
+		}
+
+		prefix, err := ParseMacPrefix(records[1])
+		if err != nil {
+			log.ErrorF("Incorrect %s entry line %d (%v), skipping...", records[0], lineno, err)
+			continue
+		}
+
+		entries = append(entries, RegistryEntry{prefix, strings.TrimSpace(records[2])})
+	}
+
+	return entries, nil
+}
+
+/*
+Reads Wireshark's manuf file: `prefix<TAB>short name[<TAB>full name]`, where
+the prefix may have a '/N' length suffix. The entries which are not vendor
+prefixes (e.g. well-known multicast addresses) are skipped.
+*/
+func readManuf(r io.Reader, log Logger) ([]RegistryEntry, error) {
+	var entries []RegistryEntry
+
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 {
+			log.ErrorF("Incorrect entry line %d, skipping...", lineno)
+			continue
+		}
+
+		prefix, err := ParseMacPrefix(strings.TrimSpace(fields[0]))
+		if err != nil || prefix.Length == MACPREFIX_MAX_LENGTH {
+			log.DebugF("Not a vendor prefix line %d, skipping...", lineno)
+			continue
+		}
+
+		name := strings.TrimSpace(fields[1])
+		if len(fields) > 2 {
+			name = strings.TrimSpace(fields[2])
+		}
+		entries = append(entries, RegistryEntry{prefix, name})
+	}
+
+	return entries, scanner.Err()
+}
+
+/*
+Reads the prefix assignments from an IEEE registry (oui.csv, mam.csv or
+oui36.csv) or from Wireshark's manuf file.
+*/
+func ReadRegistryFile(filePath string, log Logger) ([]RegistryEntry, error) {
+	if log == nil {
+		log = NopLogger{}
+	}
+
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if isIeeeRegistry(data) {
+		return readIeeeRegistry(bytes.NewReader(data), log)
+	}
+	return readManuf(bytes.NewReader(data), log)
+}
+
+/*
+Adds the vendors of an IEEE registry matching `filter`.
+*/
+func (v *Vendors) loadIeeeRegistry(r io.Reader, filter VendorFilter, log Logger) (int, error) {
+	entries, err := readIeeeRegistry(r, log)
+	if err != nil {
+		return 0, err
+	}
+
+	nbPrefix := 0
+	for _, entry := range entries {
+		if !filter.Match(entry.Organization) {
+			continue
+		}
+		if v.addPrefix(entry.Organization, entry.Prefix, "", log) {
+			nbPrefix++
+		}
+	}
+	return nbPrefix, nil
+}
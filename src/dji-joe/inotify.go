@@ -0,0 +1,107 @@
+// +build linux
+
+package djijoe
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+/*
+Notifies (over `Events`) the changes of a set of files, with inotify. The
+directories holding the files are watched rather than the files themselves, so
+that files replaced by a rename (as most editors and `oui update` do) are still
+followed.
+*/
+type fileWatcher struct {
+	Events chan struct{}
+
+	file  *os.File
+	dirs  map[int32]string
+	files map[string]bool
+}
+
+const FILE_WATCHER_EVENTS = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_DELETE
+
+func newFileWatcher(paths []string) (*fileWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+
+	w := &fileWatcher{
+		Events: make(chan struct{}, 1),
+		// non-blocking, so that Close() interrupts a pending Read()
+		file:  os.NewFile(uintptr(fd), "inotify"),
+		dirs:  make(map[int32]string),
+		files: make(map[string]bool),
+	}
+
+	watched := make(map[string]bool)
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			w.file.Close()
+			return nil, err
+		}
+		w.files[abs] = true
+
+		dir := filepath.Dir(abs)
+		if watched[dir] {
+			continue
+		}
+		watched[dir] = true
+
+		wd, err := syscall.InotifyAddWatch(fd, dir, FILE_WATCHER_EVENTS)
+		if err != nil {
+			w.file.Close()
+			return nil, &os.PathError{Op: "inotify_add_watch", Path: dir, Err: err}
+		}
+		w.dirs[int32(wd)] = dir
+	}
+
+	go w.readEvents()
+	return w, nil
+}
+
+func (w *fileWatcher) readEvents() {
+	buffer := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+
+	for {
+		n, err := w.file.Read(buffer)
+		if err != nil {
+			return
+		}
+
+		changed := false
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			nameEnd := nameStart + int(event.Len)
+			if nameEnd > n {
+				break
+			}
+
+			name := string(bytes.TrimRight(buffer[nameStart:nameEnd], "\x00"))
+			if w.files[filepath.Join(w.dirs[event.Wd], name)] {
+				changed = true
+			}
+			offset = nameEnd
+		}
+
+		if changed {
+			select {
+			case w.Events <- struct{}{}:
+			default:
+				// a change is already pending
+			}
+		}
+	}
+}
+
+func (w *fileWatcher) Close() error {
+	return w.file.Close()
+}
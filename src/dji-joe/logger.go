@@ -0,0 +1,49 @@
+package djijoe
+
+import (
+	"os"
+
+	"github.com/apsdehal/go-logger"
+)
+
+/*
+What the package needs to log. `*logger.Logger` (as returned by `InitLogger`)
+satisfies it.
+*/
+type Logger interface {
+	Debug(message string)
+	DebugF(format string, a ...interface{})
+	Info(message string)
+	InfoF(format string, a ...interface{})
+	Notice(message string)
+	NoticeF(format string, a ...interface{})
+	Warning(message string)
+	WarningF(format string, a ...interface{})
+	Error(message string)
+	ErrorF(format string, a ...interface{})
+}
+
+func InitLogger(name string) *logger.Logger {
+	_log, err := logger.New(name, 1, os.Stderr)
+	if err != nil {
+		panic(err)
+	}
+
+	return _log
+}
+
+/*
+Discards everything, used when no logger is given.
+*/
+type NopLogger struct{}
+
+func (NopLogger) Debug(string)                    {}
+func (NopLogger) DebugF(string, ...interface{})   {}
+func (NopLogger) Info(string)                     {}
+func (NopLogger) InfoF(string, ...interface{})    {}
+func (NopLogger) Notice(string)                   {}
+func (NopLogger) NoticeF(string, ...interface{})  {}
+func (NopLogger) Warning(string)                  {}
+func (NopLogger) WarningF(string, ...interface{}) {}
+func (NopLogger) Error(string)                    {}
+func (NopLogger) ErrorF(string, ...interface{})   {}
@@ -0,0 +1,122 @@
+package djijoe
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// the shortest IEEE assignment is a MA-L (OUI), the longest a MA-S (OUI-36)
+const (
+	MACPREFIX_MIN_LENGTH = 24
+	MACPREFIX_MAX_LENGTH = 48
+
+	MACPREFIX_MA_L_LENGTH = 24
+	MACPREFIX_MA_M_LENGTH = 28
+	MACPREFIX_MA_S_LENGTH = 36
+)
+
+/*
+The first `Length` bits of a MAC address; the bits past `Length` are always 0.
+*/
+type MacPrefix struct {
+	Address [6]byte
+	Length  int
+}
+
+/*
+Parses a MAC address prefix, given as hexadecimal digits (optionally separated
+by ':', '-' or '.'). Each digit counts for 4 bits, unless an explicit length is
+given with a '/N' suffix (as in Wireshark's manuf file). For example, these are
+valid prefixes:
+
+	60601f                    (MA-L, 24 bits)
+	70:B3:D5:F2:D             (MA-S, 36 bits)
+	00:1b:c5:00:00:00/28      (MA-M, 28 bits)
+*/
+func ParseMacPrefix(s string) (MacPrefix, error) {
+	var prefix MacPrefix
+
+	digits := s
+	length := -1
+	if idx := strings.IndexByte(s, '/'); idx >= 0 {
+		n, err := strconv.Atoi(s[idx+1:])
+		if err != nil {
+			return prefix, fmt.Errorf("invalid length in MAC prefix '%s'", s)
+		}
+		digits = s[:idx]
+		length = n
+	}
+
+	digits = strings.NewReplacer(":", "", "-", "", ".", "").Replace(digits)
+	if len(digits)*4 > MACPREFIX_MAX_LENGTH {
+		return prefix, fmt.Errorf("MAC prefix '%s' is too long", s)
+	}
+
+	for i, c := range digits {
+		nibble, err := strconv.ParseUint(string(c), 16, 8)
+		if err != nil {
+			return prefix, fmt.Errorf("invalid hexadecimal digit '%c' in MAC prefix '%s'", c, s)
+		}
+		prefix.Address[i/2] |= byte(nibble) << uint(4*(1-i%2))
+	}
+
+	if length < 0 {
+		length = len(digits) * 4
+	}
+	if length < MACPREFIX_MIN_LENGTH || length > MACPREFIX_MAX_LENGTH || length > len(digits)*4 {
+		return prefix, fmt.Errorf("invalid length %d for MAC prefix '%s'", length, s)
+	}
+
+	prefix.Length = length
+	prefix.Address = prefix.masked(prefix.Address[:])
+	return prefix, nil
+}
+
+/*
+Returns the first `Length` bits of `hwaddr`.
+*/
+func (p MacPrefix) masked(hwaddr []byte) [6]byte {
+	var address [6]byte
+	copy(address[:], hwaddr)
+
+	for i := range address {
+		switch {
+		case (i+1)*8 <= p.Length:
+		case i*8 >= p.Length:
+			address[i] = 0
+		default:
+			address[i] &= 0xff << uint(8-p.Length%8)
+		}
+	}
+	return address
+}
+
+/*
+Returns the `idx`-th bit (from the most significant one) of a MAC address.
+*/
+func macAddressBit(hwaddr []byte, idx int) int {
+	return int(hwaddr[idx/8]>>uint(7-idx%8)) & 1
+}
+
+/*
+Checks if a MAC address starts with the prefix.
+*/
+func (p MacPrefix) Contains(hwaddr net.HardwareAddr) bool {
+	if len(hwaddr) < (p.Length+7)/8 {
+		return false
+	}
+	return p.masked(hwaddr) == p.Address
+}
+
+/*
+Formats the prefix as its bytes when it is byte aligned (e.g. 60:60:1f), with
+the '/N' notation otherwise (e.g. 70:b3:d5:f2:d0:00/36).
+*/
+func (p MacPrefix) String() string {
+	if p.Length%8 == 0 {
+		return net.HardwareAddr(p.Address[:p.Length/8]).String()
+	}
+	return fmt.Sprintf("%s/%d", net.HardwareAddr(p.Address[:]), p.Length)
+}
@@ -12,8 +12,27 @@ const (
 	TYPE_PROBE_REQUEST = iota
 	TYPE_BEACON        = iota
 	TYPE_DATA          = iota
+
+	// management frames
+	TYPE_PROBE_RESPONSE         = iota
+	TYPE_ASSOCIATION_REQUEST    = iota
+	TYPE_ASSOCIATION_RESPONSE   = iota
+	TYPE_REASSOCIATION_REQUEST  = iota
+	TYPE_REASSOCIATION_RESPONSE = iota
+	TYPE_AUTHENTICATION         = iota
+	TYPE_DEAUTHENTICATION       = iota
+	TYPE_DISASSOCIATION         = iota
+	TYPE_ACTION                 = iota
+	TYPE_OTHER_MANAGEMENT       = iota
+
+	// data frames without payload (e.g. Null, QoS Null)
+	TYPE_NULL_DATA = iota
+	TYPE_CONTROL   = iota
 )
 
+// number of TYPE_* values
+const NB_MESSAGE_TYPES = TYPE_CONTROL + 1
+
 type HeartBeatMessage struct {
 	Timestamp time.Time `json:"ts"`
 	Hostname  string    `json:"host"`
@@ -39,5 +58,15 @@ type DroneInfoMessage struct {
 	SignalStrength int8             `json:"strength"`
 	Frequency      uint16           `json:"frequency"`
 	Vendor         string           `json:"vendor"`
-	MacAddress     net.HardwareAddr `json"macaddr"`
+	MacAddress     net.HardwareAddr `json:"MacAddress"` // the key the API server expects
+	Role           string           `json:"role,omitempty"`
+	Tsft           uint64           `json:"tsft,omitempty"`
+	Model          string           `json:"model,omitempty"`
+	Randomized     bool             `json:"randomized,omitempty"`
+	DeviceId       string           `json:"device,omitempty"`
+	Fingerprint    string           `json:"fingerprint,omitempty"`
+	Bearing        *BearingEstimate `json:"bearing,omitempty"`
+	RemoteId       *RemoteId        `json:"remote_id,omitempty"`
+	NetworkInfo
+	RadioInfo
 }
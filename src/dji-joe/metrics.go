@@ -0,0 +1,134 @@
+package djijoe
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// content type of the Prometheus text exposition format
+const METRICS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+/*
+Serves the metrics of an engine, and of the radio it captures from (nil when
+reading a file), in the Prometheus text format.
+*/
+type MetricsHandler struct {
+	Engine *Engine
+	Radio  *Radio
+}
+
+func NewMetricsHandler(engine *Engine, radio *Radio) *MetricsHandler {
+	return &MetricsHandler{Engine: engine, Radio: radio}
+}
+
+func (h *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var m metricsWriter
+	h.write(&m)
+
+	w.Header().Set("Content-Type", METRICS_CONTENT_TYPE)
+	w.Write(m.Bytes())
+}
+
+func (h *MetricsHandler) write(m *metricsWriter) {
+	stats := h.Engine.Stats()
+
+	m.family("djijoe_frames_captured_total", "counter", "Frames read from the capture source.")
+	m.sample("djijoe_frames_captured_total", nil, stats.Captured)
+	m.family("djijoe_bytes_captured_total", "counter", "Bytes read from the capture source.")
+	m.sample("djijoe_bytes_captured_total", nil, stats.Bytes)
+	m.family("djijoe_kernel_frames_received_total", "counter", "Frames received by the kernel, according to the capture source.")
+	m.sample("djijoe_kernel_frames_received_total", nil, stats.KernelReceived)
+	m.family("djijoe_kernel_frames_dropped_total", "counter", "Frames dropped by the kernel before they could be read.")
+	m.sample("djijoe_kernel_frames_dropped_total", nil, stats.KernelDropped)
+
+	m.family("djijoe_frames_total", "counter", "Frames with a valid FCS, by type.")
+	for _, messageType := range sortedKeys(stats.Frames) {
+		m.sample("djijoe_frames_total", []string{"type", messageType}, stats.Frames[messageType])
+	}
+	m.family("djijoe_frames_bad_fcs_total", "counter", "Frames dropped because of a bad FCS.")
+	m.sample("djijoe_frames_bad_fcs_total", nil, stats.BadFcs)
+	m.family("djijoe_frames_filtered_total", "counter", "Frames dropped because they had no flagged address.")
+	m.sample("djijoe_frames_filtered_total", nil, stats.Filtered)
+	m.family("djijoe_frames_processed_total", "counter", "Frames looked at for flagged devices.")
+	m.sample("djijoe_frames_processed_total", nil, stats.Processed)
+
+	m.family("djijoe_detections_total", "counter", "Detections of flagged devices, by vendor.")
+	for _, vendor := range sortedKeys(stats.Detections) {
+		m.sample("djijoe_detections_total", []string{"vendor", vendor}, stats.Detections[vendor])
+	}
+	m.family("djijoe_tracked_devices", "gauge", "Devices currently tracked by the fingerprint of their probe requests.")
+	m.sample("djijoe_tracked_devices", nil, stats.TrackedDevices)
+
+	m.family("djijoe_queue_depth", "gauge", "Items waiting between two stages of the engine.")
+	m.sample("djijoe_queue_depth", []string{"queue", "capture"}, stats.CaptureQueue)
+	m.sample("djijoe_queue_depth", []string{"queue", "decode"}, stats.DecodeQueue)
+	m.family("djijoe_api_queue_depth", "gauge", "Detections waiting to be sent to the API server.")
+	m.sample("djijoe_api_queue_depth", nil, stats.ReportQueue)
+	m.family("djijoe_api_reports_total", "counter", "Detections sent to the API server, or dropped as it is disabled.")
+	m.sample("djijoe_api_reports_total", nil, stats.Reported)
+	m.family("djijoe_api_failures_total", "counter", "Detections the API server did not accept.")
+	m.sample("djijoe_api_failures_total", nil, stats.ApiFailures)
+
+	if h.Radio != nil {
+		m.family("djijoe_channel", "gauge", "Channel the interface is listening on.")
+		m.sample("djijoe_channel", nil, h.Radio.Channel())
+		m.family("djijoe_channel_hops_total", "counter", "Channel changes made by the channel hopper.")
+		m.sample("djijoe_channel_hops_total", nil, h.Radio.Hops())
+	}
+}
+
+/*
+Writes the Prometheus text format.
+*/
+type metricsWriter struct {
+	bytes.Buffer
+}
+
+func (m *metricsWriter) family(name string, kind string, help string) {
+	fmt.Fprintf(m, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(m, "# TYPE %s %s\n", name, kind)
+}
+
+/*
+Writes a sample: `labels` alternates names and values.
+*/
+func (m *metricsWriter) sample(name string, labels []string, value interface{}) {
+	m.WriteString(name)
+
+	if len(labels) > 0 {
+		m.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				m.WriteByte(',')
+			}
+			fmt.Fprintf(m, "%s=\"%s\"", labels[i], escapeLabelValue(labels[i+1]))
+		}
+		m.WriteByte('}')
+	}
+
+	fmt.Fprintf(m, " %v\n", value)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+func sortedKeys(counts map[string]uint64) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
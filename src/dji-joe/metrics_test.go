@@ -0,0 +1,90 @@
+package djijoe
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrapeMetrics(t *testing.T, handler http.Handler) string {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != METRICS_CONTENT_TYPE {
+		t.Fatalf("got %d (%s)", w.Code, w.Header().Get("Content-Type"))
+	}
+	return w.Body.String()
+}
+
+func TestMetricsHandler(t *testing.T) {
+	source, err := OpenFileSource("../../pcaps/test.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	engine, _ := runEngine(t, source, Config{Vendors: loadTestVendors(t)})
+
+	radio := NewRadio(net.Interface{Name: "wlan0mon"}, nil, 0)
+	radio.counters.channel = 6
+	radio.counters.hops = 42
+	metrics := scrapeMetrics(t, NewMetricsHandler(engine, radio))
+
+	for _, line := range []string{
+		"# TYPE djijoe_frames_captured_total counter",
+		"djijoe_frames_captured_total 1776",
+		"djijoe_bytes_captured_total 360464",
+		"djijoe_kernel_frames_dropped_total 0",
+		`djijoe_frames_total{type="Beacon"} 636`,
+		`djijoe_frames_total{type="ProbeRequest"} 43`,
+		`djijoe_frames_total{type="Control"} 449`,
+		"djijoe_frames_bad_fcs_total 34",
+		`djijoe_detections_total{vendor="SZ DJI Technology Co.,Ltd"} 163`,
+		"# TYPE djijoe_tracked_devices gauge",
+		"djijoe_api_queue_depth 0",
+		"djijoe_api_failures_total 0",
+		"djijoe_channel 6",
+		"djijoe_channel_hops_total 42",
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("no %q in:\n%s", line, metrics)
+		}
+	}
+
+	// nothing about the channel when reading a file
+	if metrics := scrapeMetrics(t, NewMetricsHandler(engine, nil)); strings.Contains(metrics, "djijoe_channel") {
+		t.Errorf("channel metrics without a radio:\n%s", metrics)
+	}
+}
+
+func TestMetricsApiFailures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	source, err := OpenFileSource("../../pcaps/test.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	engine := NewEngine(source, Config{Vendors: loadTestVendors(t), ApiEndpoint: server.URL})
+	if err := engine.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the API stays enabled after an error response
+	if metrics := scrapeMetrics(t, NewMetricsHandler(engine, nil)); !strings.Contains(metrics, "\ndjijoe_api_failures_total 163\n") {
+		t.Errorf("failures not counted:\n%s", metrics)
+	}
+}
+
+func TestMetricsLabelEscaping(t *testing.T) {
+	var m metricsWriter
+	m.sample("djijoe_detections_total", []string{"vendor", "A \"B\" \\ C\nD"}, 1)
+	if expected := `djijoe_detections_total{vendor="A \"B\" \\ C\nD"} 1` + "\n"; m.String() != expected {
+		t.Errorf("got %q, expected %q", m.String(), expected)
+	}
+}
@@ -0,0 +1,566 @@
+package djijoe
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MQTT 3.1.1 control packet types
+const (
+	MQTT_CONNECT    = 1
+	MQTT_CONNACK    = 2
+	MQTT_PUBLISH    = 3
+	MQTT_PUBACK     = 4
+	MQTT_PUBREC     = 5
+	MQTT_PUBREL     = 6
+	MQTT_PUBCOMP    = 7
+	MQTT_SUBSCRIBE  = 8
+	MQTT_SUBACK     = 9
+	MQTT_PINGREQ    = 12
+	MQTT_PINGRESP   = 13
+	MQTT_DISCONNECT = 14
+)
+
+const (
+	MQTT_DEFAULT_PORT     = "1883"
+	MQTT_DEFAULT_TLS_PORT = "8883"
+	MQTT_KEEPALIVE        = 60 * time.Second
+	// how long to wait for the broker to answer
+	MQTT_TIMEOUT = 10 * time.Second
+	// larger packets are refused
+	MQTT_MAX_PACKET_SIZE = 1 << 20
+
+	// the default topics, "{host}" being replaced by the hostname
+	MQTT_DEFAULT_TOPIC_PREFIX = "djijoe/{host}"
+	MQTT_STATUS_ONLINE        = "online"
+	MQTT_STATUS_OFFLINE       = "offline"
+)
+
+// return codes of CONNACK
+var mqttConnectErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+type mqttPacket struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+func writeMqttPacket(w io.Writer, kind byte, flags byte, body []byte) error {
+	header := []byte{kind<<4 | flags}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		header = append(header, digit)
+		if length == 0 {
+			break
+		}
+	}
+
+	_, err := w.Write(append(header, body...))
+	return err
+}
+
+func readMqttPacket(r *bufio.Reader) (mqttPacket, error) {
+	var packet mqttPacket
+
+	first, err := r.ReadByte()
+	if err != nil {
+		return packet, err
+	}
+	packet.kind, packet.flags = first>>4, first&0x0f
+
+	var length, shift int
+	for i := 0; ; i++ {
+		if i == 4 {
+			return packet, errors.New("malformed MQTT remaining length")
+		}
+		digit, err := r.ReadByte()
+		if err != nil {
+			return packet, err
+		}
+		length |= int(digit&0x7f) << uint(shift)
+		shift += 7
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	if length > MQTT_MAX_PACKET_SIZE {
+		return packet, fmt.Errorf("MQTT packet of %d bytes", length)
+	}
+
+	packet.body = make([]byte, length)
+	_, err = io.ReadFull(r, packet.body)
+	return packet, err
+}
+
+func appendMqttString(buffer []byte, s string) []byte {
+	buffer = append(buffer, byte(len(s)>>8), byte(len(s)))
+	return append(buffer, s...)
+}
+
+/*
+Reads a length-prefixed string at the start of `data`, and returns what
+follows it.
+*/
+func readMqttString(data []byte) (string, []byte, error) {
+	if len(data) < 2 || len(data) < 2+int(binary.BigEndian.Uint16(data)) {
+		return "", nil, errors.New("truncated MQTT string")
+	}
+	length := int(binary.BigEndian.Uint16(data))
+	return string(data[2 : 2+length]), data[2+length:], nil
+}
+
+/*
+A message to publish. `Qos` is 0 (at most once), 1 (at least once) or 2
+(exactly once).
+*/
+type MqttMessage struct {
+	Topic   string
+	Payload []byte
+	Qos     byte
+	Retain  bool
+}
+
+/*
+One connection to the broker: `done` is closed once it is broken.
+*/
+type mqttConn struct {
+	conn      net.Conn
+	writeLock sync.Mutex
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *mqttConn) write(kind byte, flags byte, body []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(MQTT_TIMEOUT))
+	return writeMqttPacket(c.conn, kind, flags, body)
+}
+
+func (c *mqttConn) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+/*
+A MQTT 3.1.1 client, only publishing. It connects (again) when it has something
+to publish and no connection, with a clean session: messages are not queued
+while the broker is unreachable. `Will` is published by the broker if the
+connection breaks, and `Birth` by the client each time it is connected.
+*/
+type MqttClient struct {
+	Url       *url.URL
+	ClientId  string
+	KeepAlive time.Duration
+	Will      *MqttMessage
+	Birth     *MqttMessage
+	TlsConfig *tls.Config
+
+	conn    *mqttConn
+	lastId  uint16
+	pending map[uint16]chan byte
+	lock    sync.Mutex
+}
+
+/*
+Returns a client for a broker URL: mqtt://[user:password@]host[:port], or
+mqtts:// for TLS.
+*/
+func NewMqttClient(rawurl string, clientId string) (*MqttClient, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "mqtt" && u.Scheme != "mqtts" && u.Scheme != "tcp" && u.Scheme != "ssl") || u.Host == "" {
+		return nil, fmt.Errorf("invalid MQTT broker URL '%s', expected mqtt://host[:port] or mqtts://host[:port]", rawurl)
+	}
+
+	return &MqttClient{
+		Url:       u,
+		ClientId:  clientId,
+		KeepAlive: MQTT_KEEPALIVE,
+		pending:   make(map[uint16]chan byte),
+	}, nil
+}
+
+func (c *MqttClient) useTls() bool {
+	return c.Url.Scheme == "mqtts" || c.Url.Scheme == "ssl"
+}
+
+/*
+Returns the current connection, connecting first if there is none: `connected`
+is then true.
+*/
+func (c *MqttClient) connection() (m *mqttConn, connected bool, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.conn != nil {
+		select {
+		case <-c.conn.done:
+			c.conn = nil
+		default:
+			return c.conn, false, nil
+		}
+	}
+
+	m, err = c.connect()
+	if err != nil {
+		return nil, false, err
+	}
+	c.conn = m
+	return m, true, nil
+}
+
+func (c *MqttClient) connect() (*mqttConn, error) {
+	address := c.Url.Host
+	if c.Url.Port() == "" {
+		port := MQTT_DEFAULT_PORT
+		if c.useTls() {
+			port = MQTT_DEFAULT_TLS_PORT
+		}
+		address = net.JoinHostPort(c.Url.Hostname(), port)
+	}
+
+	dialer := &net.Dialer{Timeout: MQTT_TIMEOUT}
+	var conn net.Conn
+	var err error
+	if c.useTls() {
+		config := c.TlsConfig
+		if config == nil {
+			config = &tls.Config{ServerName: c.Url.Hostname()}
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, config)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	flags := byte(0x02) // clean session
+	body := appendMqttString(nil, "MQTT")
+	body = append(body, 4, 0, byte(c.KeepAlive/time.Second>>8), byte(c.KeepAlive/time.Second))
+	body = appendMqttString(body, c.ClientId)
+	if c.Will != nil {
+		flags |= 0x04 | c.Will.Qos<<3
+		if c.Will.Retain {
+			flags |= 0x20
+		}
+		body = appendMqttString(body, c.Will.Topic)
+		body = appendMqttString(body, string(c.Will.Payload))
+	}
+	if user := c.Url.User; user != nil {
+		flags |= 0x80
+		body = appendMqttString(body, user.Username())
+		if password, ok := user.Password(); ok {
+			flags |= 0x40
+			body = appendMqttString(body, password)
+		}
+	}
+	body[7] = flags
+
+	m := &mqttConn{conn: conn, done: make(chan struct{})}
+	err = m.write(MQTT_CONNECT, 0, body)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(MQTT_TIMEOUT))
+	connack, err := readMqttPacket(reader)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if connack.kind != MQTT_CONNACK || len(connack.body) != 2 {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected MQTT packet %d instead of CONNACK", connack.kind)
+	}
+	if code := connack.body[1]; code != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("MQTT connection refused: %s", mqttConnectErrors[code])
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	go c.read(m, reader)
+	go c.ping(m)
+	return m, nil
+}
+
+/*
+Reads the acknowledgements of the broker until the connection breaks.
+*/
+func (c *MqttClient) read(m *mqttConn, reader *bufio.Reader) {
+	defer m.close()
+
+	for {
+		// the broker answers the pings, at least
+		m.conn.SetReadDeadline(time.Now().Add(c.KeepAlive + MQTT_TIMEOUT))
+		packet, err := readMqttPacket(reader)
+		if err != nil {
+			return
+		}
+
+		switch packet.kind {
+		case MQTT_PUBACK, MQTT_PUBREC, MQTT_PUBCOMP:
+			if len(packet.body) < 2 {
+				return
+			}
+			id := binary.BigEndian.Uint16(packet.body)
+			c.lock.Lock()
+			acks, ok := c.pending[id]
+			c.lock.Unlock()
+			if ok {
+				select {
+				case acks <- packet.kind:
+				default:
+				}
+			}
+		}
+	}
+}
+
+func (c *MqttClient) ping(m *mqttConn) {
+	ticker := time.NewTicker(c.KeepAlive / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			if err := m.write(MQTT_PINGREQ, 0, nil); err != nil {
+				m.close()
+				return
+			}
+		}
+	}
+}
+
+/*
+Publishes a message, and waits for the broker to acknowledge it if its QoS is
+1 or 2. `Birth` goes first on a new connection.
+*/
+func (c *MqttClient) Publish(message MqttMessage) error {
+	if message.Qos > 2 {
+		return fmt.Errorf("invalid MQTT QoS %d", message.Qos)
+	}
+
+	m, connected, err := c.connection()
+	if err != nil {
+		return err
+	}
+	if connected && c.Birth != nil {
+		if err := c.publish(m, *c.Birth); err != nil {
+			return err
+		}
+	}
+	return c.publish(m, message)
+}
+
+func (c *MqttClient) publish(m *mqttConn, message MqttMessage) error {
+	flags := message.Qos << 1
+	if message.Retain {
+		flags |= 0x01
+	}
+	body := appendMqttString(nil, message.Topic)
+
+	if message.Qos == 0 {
+		err := m.write(MQTT_PUBLISH, flags, append(body, message.Payload...))
+		if err != nil {
+			m.close()
+		}
+		return err
+	}
+
+	c.lock.Lock()
+	c.lastId++
+	if c.lastId == 0 {
+		c.lastId++
+	}
+	id := c.lastId
+	acks := make(chan byte, 1)
+	c.pending[id] = acks
+	c.lock.Unlock()
+
+	defer func() {
+		c.lock.Lock()
+		delete(c.pending, id)
+		c.lock.Unlock()
+	}()
+
+	body = append(body, byte(id>>8), byte(id))
+	err := m.write(MQTT_PUBLISH, flags, append(body, message.Payload...))
+	if err != nil {
+		m.close()
+		return err
+	}
+
+	expected := byte(MQTT_PUBACK)
+	if message.Qos == 2 {
+		expected = MQTT_PUBREC
+	}
+	for {
+		select {
+		case ack := <-acks:
+			if ack != expected {
+				continue
+			}
+			if ack != MQTT_PUBREC {
+				return nil
+			}
+			// QoS 2: release the message, and wait for its completion
+			err = m.write(MQTT_PUBREL, 0x02, []byte{byte(id >> 8), byte(id)})
+			if err != nil {
+				m.close()
+				return err
+			}
+			expected = MQTT_PUBCOMP
+
+		case <-m.done:
+			return fmt.Errorf("MQTT connection to %s lost before the acknowledgement of '%s'", c.Url.Host, message.Topic)
+
+		case <-time.After(MQTT_TIMEOUT):
+			m.close()
+			return fmt.Errorf("no acknowledgement of '%s' from %s", message.Topic, c.Url.Host)
+		}
+	}
+}
+
+/*
+Disconnects cleanly: the broker does not publish the will.
+*/
+func (c *MqttClient) Close() error {
+	c.lock.Lock()
+	m := c.conn
+	c.conn = nil
+	c.lock.Unlock()
+
+	if m == nil {
+		return nil
+	}
+	err := m.write(MQTT_DISCONNECT, 0, nil)
+	m.close()
+	return err
+}
+
+/*
+The topics of the events of a probe.
+*/
+type MqttTopics struct {
+	Wakeup     string
+	Heartbeat  string
+	Detections string
+	Shutdown   string
+	// retained "online" while the probe runs, "offline" once it stopped (or
+	// lost its connection)
+	Status string
+}
+
+/*
+Returns the topics under `prefix`, "{host}" being replaced by `hostname`.
+*/
+func NewMqttTopics(prefix string, hostname string) MqttTopics {
+	prefix = strings.TrimSuffix(strings.Replace(prefix, "{host}", hostname, -1), "/")
+	return MqttTopics{
+		Wakeup:     prefix + "/wakeup",
+		Heartbeat:  prefix + "/heartbeat",
+		Detections: prefix + "/detections",
+		Shutdown:   prefix + "/shutdown",
+		Status:     prefix + "/status",
+	}
+}
+
+/*
+Publishes the events of a probe (as the same JSON messages as the API) to a
+MQTT broker, with the QoS `Qos`.
+*/
+type MqttReporter struct {
+	Client *MqttClient
+	Topics MqttTopics
+	Qos    byte
+}
+
+func NewMqttReporter(rawurl string, topicPrefix string, qos byte) (*MqttReporter, error) {
+	if qos > 2 {
+		return nil, fmt.Errorf("invalid MQTT QoS %d", qos)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "NONAME"
+	}
+
+	client, err := NewMqttClient(rawurl, fmt.Sprintf("%s-%s", PROGNAME, hostname))
+	if err != nil {
+		return nil, err
+	}
+	topics := NewMqttTopics(topicPrefix, hostname)
+	client.Will = &MqttMessage{Topic: topics.Status, Payload: []byte(MQTT_STATUS_OFFLINE), Qos: 1, Retain: true}
+	client.Birth = &MqttMessage{Topic: topics.Status, Payload: []byte(MQTT_STATUS_ONLINE), Qos: 1, Retain: true}
+
+	return &MqttReporter{Client: client, Topics: topics, Qos: qos}, nil
+}
+
+func (r *MqttReporter) publish(topic string, message interface{}) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return r.Client.Publish(MqttMessage{Topic: topic, Payload: payload, Qos: r.Qos})
+}
+
+func (r *MqttReporter) setStatus(status string) error {
+	return r.Client.Publish(MqttMessage{Topic: r.Topics.Status, Payload: []byte(status), Qos: 1, Retain: true})
+}
+
+func (r *MqttReporter) Wakeup(msg WakeUpMessage) error {
+	return r.publish(r.Topics.Wakeup, msg)
+}
+
+func (r *MqttReporter) Heartbeat(msg HeartBeatMessage) error {
+	return r.publish(r.Topics.Heartbeat, msg)
+}
+
+func (r *MqttReporter) Detection(info DroneInfoMessage) error {
+	return r.publish(r.Topics.Detections, info)
+}
+
+/*
+Publishes the shutdown and the "offline" status, then disconnects.
+*/
+func (r *MqttReporter) Shutdown(msg ShutdownMessage) error {
+	err := r.publish(r.Topics.Shutdown, msg)
+	if err == nil {
+		err = r.setStatus(MQTT_STATUS_OFFLINE)
+	}
+	r.Client.Close()
+	return err
+}
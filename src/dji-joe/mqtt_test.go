@@ -0,0 +1,436 @@
+package djijoe
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+Embedded MQTT broker, recording what the clients publish (and their will, if
+their connection breaks), and keeping the retained messages.
+*/
+type testBroker struct {
+	listener net.Listener
+	password string
+
+	mu        sync.Mutex
+	conns     []net.Conn
+	connects  []mqttTestConnect
+	published []MqttMessage
+	retained  map[string]string
+}
+
+type mqttTestConnect struct {
+	clientId string
+	user     string
+	password string
+	will     *MqttMessage
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &testBroker{listener: listener, retained: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(t, conn)
+		}
+	}()
+	t.Cleanup(b.Close)
+	return b
+}
+
+func (b *testBroker) Url(userinfo string) string {
+	return "mqtt://" + userinfo + b.listener.Addr().String()
+}
+
+func (b *testBroker) Close() {
+	b.listener.Close()
+	b.DropAll()
+}
+
+/*
+Closes the connections of the clients, as if the broker restarted.
+*/
+func (b *testBroker) DropAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, conn := range b.conns {
+		conn.Close()
+	}
+	b.conns = nil
+}
+
+func (b *testBroker) publish(message MqttMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.published = append(b.published, message)
+	if message.Retain {
+		b.retained[message.Topic] = string(message.Payload)
+	}
+}
+
+func (b *testBroker) Published() []MqttMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]MqttMessage(nil), b.published...)
+}
+
+func (b *testBroker) Retained(topic string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.retained[topic]
+}
+
+func (b *testBroker) Connects() []mqttTestConnect {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]mqttTestConnect(nil), b.connects...)
+}
+
+func (b *testBroker) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	packet, err := readMqttPacket(reader)
+	if err != nil || packet.kind != MQTT_CONNECT {
+		t.Errorf("expected CONNECT, got %d (%v)", packet.kind, err)
+		return
+	}
+	connect, err := parseTestConnect(packet.body)
+	if err != nil {
+		t.Errorf("invalid CONNECT: %v", err)
+		return
+	}
+
+	b.mu.Lock()
+	b.conns = append(b.conns, conn)
+	b.connects = append(b.connects, connect)
+	b.mu.Unlock()
+
+	if b.password != "" && connect.password != b.password {
+		writeMqttPacket(conn, MQTT_CONNACK, 0, []byte{0, 4})
+		return
+	}
+	writeMqttPacket(conn, MQTT_CONNACK, 0, []byte{0, 0})
+
+	for {
+		packet, err := readMqttPacket(reader)
+		if err != nil {
+			if connect.will != nil {
+				b.publish(*connect.will)
+			}
+			return
+		}
+
+		switch packet.kind {
+		case MQTT_PUBLISH:
+			topic, rest, err := readMqttString(packet.body)
+			if err != nil {
+				t.Errorf("invalid PUBLISH: %v", err)
+				return
+			}
+			qos := packet.flags >> 1 & 0x03
+			var id []byte
+			if qos > 0 {
+				id, rest = rest[:2], rest[2:]
+			}
+			b.publish(MqttMessage{Topic: topic, Payload: rest, Qos: qos, Retain: packet.flags&0x01 != 0})
+
+			switch qos {
+			case 1:
+				writeMqttPacket(conn, MQTT_PUBACK, 0, id)
+			case 2:
+				writeMqttPacket(conn, MQTT_PUBREC, 0, id)
+			}
+
+		case MQTT_PUBREL:
+			writeMqttPacket(conn, MQTT_PUBCOMP, 0, packet.body)
+
+		case MQTT_PINGREQ:
+			writeMqttPacket(conn, MQTT_PINGRESP, 0, nil)
+
+		case MQTT_DISCONNECT:
+			return
+
+		default:
+			t.Errorf("unexpected MQTT packet %d", packet.kind)
+			return
+		}
+	}
+}
+
+func parseTestConnect(body []byte) (mqttTestConnect, error) {
+	var connect mqttTestConnect
+
+	protocol, rest, err := readMqttString(body)
+	if err != nil || protocol != "MQTT" || len(rest) < 4 || rest[0] != 4 {
+		return connect, err
+	}
+	flags := rest[1]
+	rest = rest[4:]
+
+	if connect.clientId, rest, err = readMqttString(rest); err != nil {
+		return connect, err
+	}
+	if flags&0x04 != 0 {
+		var topic, payload string
+		if topic, rest, err = readMqttString(rest); err != nil {
+			return connect, err
+		}
+		if payload, rest, err = readMqttString(rest); err != nil {
+			return connect, err
+		}
+		connect.will = &MqttMessage{Topic: topic, Payload: []byte(payload), Qos: flags >> 3 & 0x03, Retain: flags&0x20 != 0}
+	}
+	if flags&0x80 != 0 {
+		if connect.user, rest, err = readMqttString(rest); err != nil {
+			return connect, err
+		}
+	}
+	if flags&0x40 != 0 {
+		if connect.password, rest, err = readMqttString(rest); err != nil {
+			return connect, err
+		}
+	}
+	return connect, nil
+}
+
+func TestMqttPacketLength(t *testing.T) {
+	for _, length := range []int{0, 127, 128, 16383, 16384, 300000} {
+		var buffer bytes.Buffer
+		body := bytes.Repeat([]byte{0x42}, length)
+		if err := writeMqttPacket(&buffer, MQTT_PUBLISH, 0x03, body); err != nil {
+			t.Fatal(err)
+		}
+
+		packet, err := readMqttPacket(bufio.NewReader(&buffer))
+		if err != nil || packet.kind != MQTT_PUBLISH || packet.flags != 0x03 || !bytes.Equal(packet.body, body) {
+			t.Errorf("%d bytes: got %d bytes of %d/%d (%v)", length, len(packet.body), packet.kind, packet.flags, err)
+		}
+	}
+
+	// more than 4 bytes of remaining length
+	_, err := readMqttPacket(bufio.NewReader(bytes.NewReader([]byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01})))
+	if err == nil {
+		t.Errorf("no error for a malformed length")
+	}
+}
+
+func TestMqttReporter(t *testing.T) {
+	for qos := byte(0); qos <= 2; qos++ {
+		broker := newTestBroker(t)
+		r, err := NewMqttReporter(broker.Url("joe:secret@"), "djijoe/{host}/", qos)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Topics = NewMqttTopics("djijoe/{host}/", "probe1")
+		r.Client.Will.Topic = r.Topics.Status
+		r.Client.Birth.Topic = r.Topics.Status
+
+		ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+		steps := []error{
+			r.Wakeup(WakeUpMessage{Timestamp: ts, Hostname: "probe1"}),
+			r.Heartbeat(HeartBeatMessage{Timestamp: ts, Hostname: "probe1"}),
+			r.Detection(DroneInfoMessage{Timestamp: ts, Vendor: "DJI", SignalStrength: -42}),
+			r.Shutdown(ShutdownMessage{Timestamp: ts, Hostname: "probe1", ProbeRequestFound: 1}),
+		}
+		for i, err := range steps {
+			if err != nil {
+				t.Fatalf("QoS %d, step %d: %v", qos, i, err)
+			}
+		}
+
+		expected := []struct {
+			topic string
+			qos   byte
+		}{
+			{"djijoe/probe1/status", 1},
+			{"djijoe/probe1/wakeup", qos},
+			{"djijoe/probe1/heartbeat", qos},
+			{"djijoe/probe1/detections", qos},
+			{"djijoe/probe1/shutdown", qos},
+			{"djijoe/probe1/status", 1},
+		}
+		published := broker.Published()
+		if len(published) != len(expected) {
+			t.Fatalf("QoS %d: got %d messages, expected %d", qos, len(published), len(expected))
+		}
+		for i, message := range published {
+			if message.Topic != expected[i].topic || message.Qos != expected[i].qos {
+				t.Errorf("QoS %d, message %d: got %s (QoS %d), expected %s (QoS %d)",
+					qos, i, message.Topic, message.Qos, expected[i].topic, expected[i].qos)
+			}
+		}
+
+		var info DroneInfoMessage
+		if err := json.Unmarshal(published[3].Payload, &info); err != nil || info.Vendor != "DJI" || info.SignalStrength != -42 {
+			t.Errorf("QoS %d: detection %s (%v)", qos, published[3].Payload, err)
+		}
+		if status := broker.Retained("djijoe/probe1/status"); status != MQTT_STATUS_OFFLINE {
+			t.Errorf("QoS %d: retained status %q", qos, status)
+		}
+
+		connects := broker.Connects()
+		if len(connects) != 1 || connects[0].user != "joe" || connects[0].password != "secret" ||
+			connects[0].will == nil || !connects[0].will.Retain || string(connects[0].will.Payload) != MQTT_STATUS_OFFLINE {
+			t.Errorf("QoS %d: connections %+v", qos, connects)
+		}
+	}
+}
+
+func TestMqttWillAndReconnect(t *testing.T) {
+	broker := newTestBroker(t)
+	r, err := NewMqttReporter(broker.Url(""), "djijoe/probe1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Wakeup(WakeUpMessage{Hostname: "probe1"}); err != nil {
+		t.Fatal(err)
+	}
+	if status := broker.Retained(r.Topics.Status); status != MQTT_STATUS_ONLINE {
+		t.Errorf("retained status %q once awake", status)
+	}
+
+	// the probe loses its connection: the broker publishes its will
+	r.Client.lock.Lock()
+	m := r.Client.conn
+	r.Client.lock.Unlock()
+	m.conn.Close()
+	<-m.done
+
+	deadline := time.Now().Add(5 * time.Second)
+	for broker.Retained(r.Topics.Status) != MQTT_STATUS_OFFLINE && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := broker.Retained(r.Topics.Status); status != MQTT_STATUS_OFFLINE {
+		t.Errorf("retained status %q after the connection broke", status)
+	}
+
+	// and connects again for the next event
+	if err := r.Detection(DroneInfoMessage{Vendor: "DJI"}); err != nil {
+		t.Fatal(err)
+	}
+	if connects := broker.Connects(); len(connects) != 2 {
+		t.Errorf("got %d connections, expected 2", len(connects))
+	}
+	if status := broker.Retained(r.Topics.Status); status != MQTT_STATUS_ONLINE {
+		t.Errorf("retained status %q once connected again", status)
+	}
+	r.Client.Close()
+}
+
+func TestMqttRefused(t *testing.T) {
+	broker := newTestBroker(t)
+	broker.password = "secret"
+
+	r, err := NewMqttReporter(broker.Url("joe:wrong@"), MQTT_DEFAULT_TOPIC_PREFIX, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Heartbeat(HeartBeatMessage{})
+	if err == nil || !strings.Contains(err.Error(), "bad user name or password") {
+		t.Errorf("got %v", err)
+	}
+
+	for _, rawurl := range []string{"http://broker", "mqtt://", "broker:1883"} {
+		if _, err := NewMqttReporter(rawurl, MQTT_DEFAULT_TOPIC_PREFIX, 1); err == nil {
+			t.Errorf("%s: no error", rawurl)
+		}
+	}
+	if _, err := NewMqttReporter(broker.Url(""), MQTT_DEFAULT_TOPIC_PREFIX, 3); err == nil {
+		t.Errorf("no error for QoS 3")
+	}
+}
+
+func TestEngineMqtt(t *testing.T) {
+	broker := newTestBroker(t)
+	r, err := NewMqttReporter(broker.Url(""), "djijoe/probe1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source, err := OpenFileSource("../../pcaps/test.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	// without any API server
+	engine := NewEngine(source, Config{Vendors: loadTestVendors(t), Reporters: []Reporter{r}})
+	if err := engine.Run(context.Background()); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	counts := make(map[string]int)
+	for _, message := range broker.Published() {
+		counts[strings.TrimPrefix(message.Topic, "djijoe/probe1/")]++
+	}
+	expected := map[string]int{"status": 2, "wakeup": 1, "detections": 163, "shutdown": 1}
+	for topic, count := range expected {
+		if counts[topic] != count {
+			t.Errorf("got %d messages on %s, expected %d", counts[topic], topic, count)
+		}
+	}
+	if engine.Probe.ApiEnabled() {
+		t.Errorf("API enabled without an endpoint")
+	}
+	if stats := engine.Stats(); stats.ApiFailures != 0 {
+		t.Errorf("got %d failures", stats.ApiFailures)
+	}
+}
+
+func TestProbeHeartbeatMqtt(t *testing.T) {
+	broker := newTestBroker(t)
+	r, err := NewMqttReporter(broker.Url(""), "djijoe/probe1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewProbe(NopLogger{})
+	p.Reporters = FanoutReporter{r}
+	p.stop = make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		p.SendHeartbeat(5 * time.Millisecond)
+		close(done)
+	}()
+
+	// the "online" status, then the heartbeats
+	deadline := time.Now().Add(5 * time.Second)
+	for len(broker.Published()) < 4 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(p.stop)
+	<-done
+	r.Client.Close()
+
+	published := broker.Published()
+	if len(published) < 4 {
+		t.Fatalf("got %d messages", len(published))
+	}
+	if published[0].Topic != r.Topics.Status || string(published[0].Payload) != MQTT_STATUS_ONLINE {
+		t.Errorf("first message %s on %s", published[0].Payload, published[0].Topic)
+	}
+	for _, message := range published[1:] {
+		if message.Topic != r.Topics.Heartbeat {
+			t.Errorf("unexpected message on %s", message.Topic)
+		}
+	}
+
+}
@@ -1,8 +1,11 @@
 package djijoe
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
@@ -50,6 +53,54 @@ type Frequency struct {
 
 type Frequencies []Frequency
 
+/*
+A WiFi interface, and the logger its changes are reported to.
+*/
+type Radio struct {
+	Interface net.Interface
+	Log       Logger
+	Verbosity int
+
+	counters *radioCounters
+}
+
+/*
+Updated by the channel hopper, read by the metrics: allocated on their own to
+be 64-bit aligned.
+*/
+type radioCounters struct {
+	hops    uint64
+	channel uint64
+}
+
+func NewRadio(iface net.Interface, log Logger, verbosity int) *Radio {
+	if log == nil {
+		log = NopLogger{}
+	}
+
+	return &Radio{
+		Interface: iface,
+		Log:       log,
+		Verbosity: verbosity,
+		counters:  new(radioCounters),
+	}
+}
+
+/*
+Returns the channel the interface was last set to, or 0 if unknown. Safe to
+call from any goroutine.
+*/
+func (r *Radio) Channel() int {
+	return int(atomic.LoadUint64(&r.counters.channel))
+}
+
+/*
+Returns how many times the channel hopper changed channel.
+*/
+func (r *Radio) Hops() uint64 {
+	return atomic.LoadUint64(&r.counters.hops)
+}
+
 // Valid WiFi frequencies
 // 2.4GHz band
 var Wifi2GzFrequencies = Frequencies{
@@ -91,6 +142,36 @@ var Wifi5GzFrequencies = Frequencies{
 	Frequency{exponent: 7, mantissa: 570, channel: 140},
 }
 
+/*
+Returns the 802.11 channel number of a frequency (in MHz), or 0 if unknown.
+*/
+func FrequencyToChannel(frequency uint16) int {
+	switch {
+	case frequency == 2484:
+		return 14
+	case 2412 <= frequency && frequency <= 2472:
+		return int(frequency-2407) / 5
+	case 5000 <= frequency && frequency <= 5900:
+		return int(frequency-5000) / 5
+	}
+	return 0
+}
+
+/*
+Returns the frequency (in MHz) of a 802.11 channel number, or 0 if unknown.
+*/
+func ChannelToFrequency(channel int) uint16 {
+	switch {
+	case channel == 14:
+		return 2484
+	case 1 <= channel && channel <= 13:
+		return uint16(2407 + channel*5)
+	case 32 <= channel && channel <= 177:
+		return uint16(5000 + channel*5)
+	}
+	return 0
+}
+
 /*
 Change the state of the interface via ioctl: if `setUp` is true, then this is
 equivalent to `ifup <ifname>`.
@@ -110,9 +191,7 @@ func SetInterfaceUp(name string, setUp bool) error {
 	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(sockFd), syscall.SIOCGIFFLAGS,
 		uintptr(unsafe.Pointer(&ifl)))
 	if errno != 0 {
-		err = errno
-		Log.ErrorF("ioctl(SIOCSIFFLAGS) failed: %+v", err)
-		return err
+		return fmt.Errorf("ioctl(SIOCGIFFLAGS) failed: %v", errno)
 	}
 
 	if setUp {
@@ -125,9 +204,7 @@ func SetInterfaceUp(name string, setUp bool) error {
 	_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, uintptr(sockFd), syscall.SIOCSIFFLAGS,
 		uintptr(unsafe.Pointer(&ifl)))
 	if errno != 0 {
-		err = errno
-		Log.ErrorF("ioctl(SIOCSIFFLAGS) failed: %+v", err)
-		return err
+		return fmt.Errorf("ioctl(SIOCSIFFLAGS) failed: %v", errno)
 	}
 	return nil
 }
@@ -139,8 +216,7 @@ func ioctlSetMode(ifName string, mode int) error {
 
 	sockFd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_IP)
 	if err != nil {
-		Log.ErrorF("Socket() failed: %+v", err)
-		return err
+		return fmt.Errorf("Socket() failed: %v", err)
 	}
 	defer syscall.Close(sockFd)
 
@@ -151,9 +227,7 @@ func ioctlSetMode(ifName string, mode int) error {
 	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(sockFd), SIOCSIWMODE,
 		uintptr(unsafe.Pointer(&iwl)))
 	if errno != 0 {
-		err = errno
-		Log.ErrorF("ioctl(SIOCSIWMODE) failed: %+v", err)
-		return err
+		return fmt.Errorf("ioctl(SIOCSIWMODE) failed: %v", errno)
 	}
 
 	return nil
@@ -163,16 +237,18 @@ func ioctlSetMode(ifName string, mode int) error {
 Change the selected interface mode.
 
 */
-func SwitchToMode(iface net.Interface, mode int) error {
+func (r *Radio) SwitchToMode(mode int) error {
 	var mode_str string
 	var err error
 
+	iface := r.Interface
+
 	switch mode {
 	case IW_MODE_MONITOR:
-		Log.DebugF("Switching '%s' ->  IW_MODE_MONITOR", iface.Name)
+		r.Log.DebugF("Switching '%s' ->  IW_MODE_MONITOR", iface.Name)
 		mode_str = "Monitor"
 	case IW_MODE_MANAGED:
-		Log.DebugF("Switching '%s' ->  IW_MODE_MANAGED", iface.Name)
+		r.Log.DebugF("Switching '%s' ->  IW_MODE_MANAGED", iface.Name)
 		mode_str = "Managed"
 	default:
 		return errors.New("Incorrect mode")
@@ -180,70 +256,68 @@ func SwitchToMode(iface net.Interface, mode int) error {
 
 	err = SetInterfaceUp(iface.Name, false)
 	if err != nil {
-		Log.FatalF("Failed to set '%s' state to up: %+v", iface.Name, err)
+		return fmt.Errorf("Failed to set '%s' state to down: %v", iface.Name, err)
 	}
-	Log.DebugF("'%s' is down", iface.Name)
+	r.Log.DebugF("'%s' is down", iface.Name)
 
 	err = ioctlSetMode(iface.Name, mode)
 	if err != nil {
-		Log.FatalF("Failed to switch '%s' to mode '%s': %+v", iface.Name, mode_str, err)
+		return fmt.Errorf("Failed to switch '%s' to mode '%s': %v", iface.Name, mode_str, err)
 	}
-	Log.InfoF("'%s' new mode: %s", iface.Name, mode_str)
+	r.Log.InfoF("'%s' new mode: %s", iface.Name, mode_str)
 
 	err = SetInterfaceUp(iface.Name, true)
 	if err != nil {
-		Log.FatalF("Failed to set '%s' state to up: %+v", iface.Name, err)
+		return fmt.Errorf("Failed to set '%s' state to up: %v", iface.Name, err)
 	}
-	Log.DebugF("'%s' is back up", iface.Name)
+	r.Log.DebugF("'%s' is back up", iface.Name)
 
 	return nil
 }
 
-func SwitchToModeMonitor(iface net.Interface) error {
-	return SwitchToMode(iface, IW_MODE_MONITOR)
+func (r *Radio) SwitchToModeMonitor() error {
+	return r.SwitchToMode(IW_MODE_MONITOR)
 }
 
-func SwitchToModeManaged(iface net.Interface) error {
-	return SwitchToMode(iface, IW_MODE_MANAGED)
+func (r *Radio) SwitchToModeManaged() error {
+	return r.SwitchToMode(IW_MODE_MANAGED)
 }
 
 /*
 Change 802.11 channel
 */
-func ChangeChannel(iface net.Interface, freq Frequency) error {
+func (r *Radio) ChangeChannel(freq Frequency) error {
 
 	sockFd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_IP)
 	if err != nil {
-		Log.ErrorF("[ChangeChannel]Socket() failed: %+v", err)
-		return err
+		return fmt.Errorf("[ChangeChannel]Socket() failed: %v", err)
 	}
 	defer syscall.Close(sockFd)
 
 	var iwf iwfreq
-	copy(iwf.name[:], []byte(iface.Name))
+	copy(iwf.name[:], []byte(r.Interface.Name))
 	iwf.m = int32(freq.channel)
 	iwf.e = int16(0)
 	iwf.flags = uint8(IW_FREQ_FIXED)
 
-	if Cfg.Verbosity > 2 {
-		Log.DebugF("Setting frequency=%d.1e%dGHz (channel=%d)",
+	if r.Verbosity > 2 {
+		r.Log.DebugF("Setting frequency=%d.1e%dGHz (channel=%d)",
 			freq.mantissa, freq.exponent, freq.channel)
 	}
 	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(sockFd), SIOCSIWFREQ,
 		uintptr(unsafe.Pointer(&iwf)))
 	if errno != 0 {
-		err = errno
-		Log.ErrorF("ioctl(SIOCSIWFREQ) failed: %+v", err)
-		return err
+		return fmt.Errorf("ioctl(SIOCSIWFREQ) failed: %v", errno)
 	}
 
+	atomic.StoreUint64(&r.counters.channel, uint64(freq.channel))
 	return nil
 }
 
 /*
-GoRoutine for channel hopping
+GoRoutine for channel hopping, until `ctx` is cancelled
 */
-func ChannelHopper(iface net.Interface, use5GhzBand bool) {
+func (r *Radio) ChannelHopper(ctx context.Context, use5GhzBand bool) {
 	var channels Frequencies
 
 	if use5GhzBand {
@@ -254,23 +328,33 @@ func ChannelHopper(iface net.Interface, use5GhzBand bool) {
 	var i int = 0
 	var interval time.Duration = 500 * time.Millisecond
 
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
 	for {
-		err := ChangeChannel(iface, channels[i])
+		err := r.ChangeChannel(channels[i])
 		if err != nil {
+			r.Log.ErrorF("Channel hopping stopped: %+v", err)
 			break
 		}
+		atomic.AddUint64(&r.counters.hops, 1)
 		i = (i + 1) % len(channels)
-		time.Sleep(interval)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 	}
 }
 
 /*
 Set the initial WiFi frequency.
 */
-func ChangeTo5gBand(iface net.Interface) error {
-	return ChangeChannel(iface, Wifi5GzFrequencies[0])
+func (r *Radio) ChangeTo5gBand() error {
+	return r.ChangeChannel(Wifi5GzFrequencies[0])
 }
 
-func ChangeTo2gBand(iface net.Interface) error {
-	return ChangeChannel(iface, Wifi2GzFrequencies[0])
+func (r *Radio) ChangeTo2gBand() error {
+	return r.ChangeChannel(Wifi2GzFrequencies[0])
 }
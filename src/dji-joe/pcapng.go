@@ -0,0 +1,258 @@
+package djijoe
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// https://www.ietf.org/archive/id/draft-tuexen-opsawg-pcapng-05.html
+const (
+	PCAPNG_BLOCK_SHB = 0x0A0D0D0A
+	PCAPNG_BLOCK_IDB = 0x00000001
+	PCAPNG_BLOCK_EPB = 0x00000006
+
+	PCAPNG_BYTE_ORDER_MAGIC = 0x1A2B3C4D
+
+	PCAPNG_OPT_ENDOFOPT    = 0
+	PCAPNG_OPT_COMMENT     = 1
+	PCAPNG_OPT_SHB_USERAPP = 4
+	PCAPNG_OPT_IF_NAME     = 2
+	PCAPNG_OPT_IF_DESC     = 3
+
+	PCAPNG_DEFAULT_SNAPLEN = 65535
+)
+
+type pcapngOption struct {
+	code  uint16
+	value []byte
+}
+
+/*
+Writes packets to a pcapng file, with a comment attached to each packet. When
+`MaxSize` is non-zero, the output rotates to a new file (suffixed with an
+increasing index) once the current one exceeds `MaxSize` bytes.
+*/
+type PcapngWriter struct {
+	BasePath         string
+	MaxSize          uint64
+	InterfaceName    string
+	InterfaceDesc    string
+	LinkType         layers.LinkType
+	NbPacketsWritten uint64
+
+	file    *os.File
+	writer  *bufio.Writer
+	size    uint64
+	fileIdx int
+}
+
+/*
+Returns a writer of the frames of a source of link type `linkType`.
+*/
+func NewPcapngWriter(path string, maxSize uint64, linkType layers.LinkType, ifName string, ifDesc string) (*PcapngWriter, error) {
+	w := &PcapngWriter{
+		BasePath:      path,
+		MaxSize:       maxSize,
+		InterfaceName: ifName,
+		InterfaceDesc: ifDesc,
+		LinkType:      linkType,
+	}
+
+	err := w.open()
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+/*
+Returns the path of the current output file: the first file uses `BasePath`
+as-is, the following ones get a `.N` index before the extension.
+*/
+func (w *PcapngWriter) CurrentPath() string {
+	if w.fileIdx == 0 {
+		return w.BasePath
+	}
+
+	ext := filepath.Ext(w.BasePath)
+	base := strings.TrimSuffix(w.BasePath, ext)
+	return fmt.Sprintf("%s.%d%s", base, w.fileIdx, ext)
+}
+
+func (w *PcapngWriter) open() error {
+	file, err := os.Create(w.CurrentPath())
+	if err != nil {
+		return err
+	}
+
+	w.file = file
+	w.writer = bufio.NewWriter(file)
+	w.size = 0
+
+	err = w.writeSectionHeader()
+	if err != nil {
+		return err
+	}
+	return w.writeInterfaceDescription()
+}
+
+func (w *PcapngWriter) rotate() error {
+	err := w.Close()
+	if err != nil {
+		return err
+	}
+
+	w.fileIdx++
+	return w.open()
+}
+
+func (w *PcapngWriter) Close() error {
+	if w.file == nil {
+		return nil
+	}
+
+	err := w.writer.Flush()
+	if err != nil {
+		w.file.Close()
+		return err
+	}
+
+	err = w.file.Close()
+	w.file = nil
+	w.writer = nil
+	return err
+}
+
+func pcapngPad(length int) int {
+	return (4 - length%4) % 4
+}
+
+func pcapngOptionsLength(options []pcapngOption) int {
+	if len(options) == 0 {
+		return 0
+	}
+
+	length := 4 // opt_endofopt
+	for _, opt := range options {
+		length += 4 + len(opt.value) + pcapngPad(len(opt.value))
+	}
+	return length
+}
+
+func (w *PcapngWriter) writeOptions(buf []byte, options []pcapngOption) []byte {
+	if len(options) == 0 {
+		return buf
+	}
+
+	var padding [4]byte
+	for _, opt := range options {
+		buf = binary.LittleEndian.AppendUint16(buf, opt.code)
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(opt.value)))
+		buf = append(buf, opt.value...)
+		buf = append(buf, padding[:pcapngPad(len(opt.value))]...)
+	}
+
+	buf = binary.LittleEndian.AppendUint16(buf, PCAPNG_OPT_ENDOFOPT)
+	buf = binary.LittleEndian.AppendUint16(buf, 0)
+	return buf
+}
+
+/*
+Frames a block body with its type and (repeated) total length, then writes it.
+*/
+func (w *PcapngWriter) writeBlock(blockType uint32, body []byte) error {
+	totalLength := uint32(12 + len(body))
+
+	buf := make([]byte, 0, totalLength)
+	buf = binary.LittleEndian.AppendUint32(buf, blockType)
+	buf = binary.LittleEndian.AppendUint32(buf, totalLength)
+	buf = append(buf, body...)
+	buf = binary.LittleEndian.AppendUint32(buf, totalLength)
+
+	n, err := w.writer.Write(buf)
+	w.size += uint64(n)
+	return err
+}
+
+func (w *PcapngWriter) writeSectionHeader() error {
+	options := []pcapngOption{
+		{PCAPNG_OPT_SHB_USERAPP, []byte(fmt.Sprintf("%s %s", PROGNAME, VERSION))},
+	}
+
+	body := make([]byte, 0, 16+pcapngOptionsLength(options))
+	body = binary.LittleEndian.AppendUint32(body, PCAPNG_BYTE_ORDER_MAGIC)
+	body = binary.LittleEndian.AppendUint16(body, 1) // major
+	body = binary.LittleEndian.AppendUint16(body, 0) // minor
+	body = binary.LittleEndian.AppendUint64(body, 0xffffffffffffffff)
+	body = w.writeOptions(body, options)
+
+	return w.writeBlock(PCAPNG_BLOCK_SHB, body)
+}
+
+func (w *PcapngWriter) writeInterfaceDescription() error {
+	var options []pcapngOption
+
+	if w.InterfaceName != "" {
+		options = append(options, pcapngOption{PCAPNG_OPT_IF_NAME, []byte(w.InterfaceName)})
+	}
+	if w.InterfaceDesc != "" {
+		options = append(options, pcapngOption{PCAPNG_OPT_IF_DESC, []byte(w.InterfaceDesc)})
+	}
+
+	body := make([]byte, 0, 8+pcapngOptionsLength(options))
+	body = binary.LittleEndian.AppendUint16(body, uint16(w.LinkType))
+	body = binary.LittleEndian.AppendUint16(body, 0) // reserved
+	body = binary.LittleEndian.AppendUint32(body, PCAPNG_DEFAULT_SNAPLEN)
+	body = w.writeOptions(body, options)
+
+	return w.writeBlock(PCAPNG_BLOCK_IDB, body)
+}
+
+/*
+Writes one frame as an Enhanced Packet Block, with `comment` attached to it.
+*/
+func (w *PcapngWriter) WritePacket(ci gopacket.CaptureInfo, data []byte, comment string) error {
+	if w.MaxSize > 0 && w.size >= w.MaxSize {
+		err := w.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	var options []pcapngOption
+	if comment != "" {
+		options = append(options, pcapngOption{PCAPNG_OPT_COMMENT, []byte(comment)})
+	}
+
+	var padding [4]byte
+	ts := uint64(ci.Timestamp.UnixNano() / 1000) // default if_tsresol is microseconds
+	origLength := ci.Length
+	if origLength == 0 {
+		origLength = len(data)
+	}
+
+	body := make([]byte, 0, 20+len(data)+4+pcapngOptionsLength(options))
+	body = binary.LittleEndian.AppendUint32(body, 0) // interface id
+	body = binary.LittleEndian.AppendUint32(body, uint32(ts>>32))
+	body = binary.LittleEndian.AppendUint32(body, uint32(ts))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(data)))
+	body = binary.LittleEndian.AppendUint32(body, uint32(origLength))
+	body = append(body, data...)
+	body = append(body, padding[:pcapngPad(len(data))]...)
+	body = w.writeOptions(body, options)
+
+	err := w.writeBlock(PCAPNG_BLOCK_EPB, body)
+	if err != nil {
+		return err
+	}
+
+	w.NbPacketsWritten++
+	return nil
+}
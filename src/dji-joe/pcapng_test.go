@@ -0,0 +1,243 @@
+package djijoe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+/*
+Returns the comments of the Enhanced Packet Blocks of a pcapng file, which
+the reader of gopacket does not expose.
+*/
+func pcapngComments(t *testing.T, data []byte) []string {
+	var comments []string
+	for len(data) >= 12 {
+		blockType := binary.LittleEndian.Uint32(data)
+		length := int(binary.LittleEndian.Uint32(data[4:]))
+		if length < 12 || length > len(data) || binary.LittleEndian.Uint32(data[length-4:]) != uint32(length) {
+			t.Fatalf("invalid block of %d bytes", length)
+		}
+
+		if blockType == PCAPNG_BLOCK_EPB {
+			captured := int(binary.LittleEndian.Uint32(data[20:]))
+			options := data[28+captured+pcapngPad(captured) : length-4]
+			comment := ""
+			for len(options) >= 4 {
+				code := binary.LittleEndian.Uint16(options)
+				size := int(binary.LittleEndian.Uint16(options[2:]))
+				if code == PCAPNG_OPT_ENDOFOPT {
+					break
+				}
+				if code == PCAPNG_OPT_COMMENT {
+					comment = string(options[4 : 4+size])
+				}
+				options = options[4+size+pcapngPad(size):]
+			}
+			comments = append(comments, comment)
+		}
+		data = data[length:]
+	}
+	return comments
+}
+
+func TestPcapngWriterRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flagged.pcapng")
+	w, err := NewPcapngWriter(path, 0, layers.LinkTypeIEEE80211Radio, "wlan0mon", "probe-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2020, 1, 2, 3, 4, 5, 123456000, time.UTC)
+	frames := [][]byte{{1, 2, 3}, {4, 5, 6, 7}, {8}}
+	comments := []string{"DJI (60:60:1f:42:11:b8)", "", "Parrot"}
+	for i, frame := range frames {
+		ci := gopacket.CaptureInfo{Timestamp: start.Add(time.Duration(i) * time.Millisecond), CaptureLength: len(frame)}
+		if err := w.WritePacket(ci, frame, comments[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if w.NbPacketsWritten != 3 {
+		t.Errorf("%d packets written", w.NbPacketsWritten)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := pcapgo.NewNgReader(bytes.NewReader(data), pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.LinkType() != layers.LinkTypeIEEE80211Radio {
+		t.Errorf("link type %s", r.LinkType())
+	}
+	if app := r.SectionInfo().Application; app != PROGNAME+" "+VERSION {
+		t.Errorf("application %q", app)
+	}
+	if intf, err := r.Interface(0); err != nil || intf.Name != "wlan0mon" || intf.Description != "probe-1" {
+		t.Errorf("interface %+v %v", intf, err)
+	}
+
+	for i, frame := range frames {
+		got, ci, err := r.ReadPacketData()
+		if err != nil {
+			t.Fatalf("packet #%d: %v", i, err)
+		}
+		if !bytes.Equal(got, frame) || ci.Length != len(frame) {
+			t.Errorf("packet #%d: %x (%d bytes)", i, got, ci.Length)
+		}
+		if expected := start.Add(time.Duration(i) * time.Millisecond); !ci.Timestamp.Equal(expected) {
+			t.Errorf("packet #%d at %s, expected %s", i, ci.Timestamp, expected)
+		}
+	}
+
+	got := pcapngComments(t, data)
+	if len(got) != len(comments) {
+		t.Fatalf("comments %q", got)
+	}
+	for i := range comments {
+		if got[i] != comments[i] {
+			t.Errorf("packet #%d: comment %q, expected %q", i, got[i], comments[i])
+		}
+	}
+}
+
+func TestPcapngWriterRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flagged.pcapng")
+	// the headers and a frame fill a file
+	w, err := NewPcapngWriter(path, 100, layers.LinkTypeIEEE80211Radio, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		frame := bytes.Repeat([]byte{byte(i)}, 64)
+		ci := gopacket.CaptureInfo{Timestamp: start.Add(time.Duration(i) * time.Second), CaptureLength: len(frame)}
+		if err := w.WritePacket(ci, frame, "frame"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Dir(path)
+	for i, name := range []string{"flagged.pcapng", "flagged.1.pcapng", "flagged.2.pcapng"} {
+		file, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+
+		r, err := pcapgo.NewNgReader(file, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if r.LinkType() != layers.LinkTypeIEEE80211Radio {
+			t.Errorf("%s: link type %s", name, r.LinkType())
+		}
+
+		data, ci, err := r.ReadPacketData()
+		if err != nil || len(data) != 64 || data[0] != byte(i) || !ci.Timestamp.Equal(start.Add(time.Duration(i)*time.Second)) {
+			t.Errorf("%s: first packet %x at %s (%v)", name, data, ci.Timestamp, err)
+		}
+		if _, _, err := r.ReadPacketData(); err == nil {
+			t.Errorf("%s: more than one packet", name)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "flagged.3.pcapng")); !os.IsNotExist(err) {
+		t.Errorf("a fourth file: %v", err)
+	}
+}
+
+func TestPcapngWriterLinkType(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flagged.pcapng")
+	w, err := NewPcapngWriter(path, 0, layers.LinkTypeIEEE802_11, "wlan0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WritePacket(gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: 3}, []byte{1, 2, 3}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	r, err := pcapgo.NewNgReader(file, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.LinkType() != layers.LinkTypeIEEE802_11 {
+		t.Errorf("link type %s", r.LinkType())
+	}
+}
+
+func TestEngineWritesFlaggedBssidFrames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flagged.pcapng")
+	w, err := NewPcapngWriter(path, 0, layers.LinkTypeIEEE80211Radio, "wlan0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	ap := mustParseMAC(t, "00:11:22:33:44:55")
+	frames := []RawPacket{
+		// a drone joins the network of an access point
+		buildFrame(t, ts, -40, 2437,
+			&layers.Dot11{
+				Type:     layers.Dot11TypeMgmtAssociationReq,
+				Address1: ap,
+				Address2: mustParseMAC(t, "60:60:1f:00:00:01"),
+				Address3: ap,
+			},
+			&layers.Dot11MgmtAssociationReq{CapabilityInfo: 0x0401, ListenInterval: 10}),
+		// which is then flagged
+		buildFrame(t, ts.Add(time.Second), -40, 2437,
+			&layers.Dot11{
+				Type:     layers.Dot11TypeMgmtBeacon,
+				Address1: mustParseMAC(t, "ff:ff:ff:ff:ff:ff"),
+				Address2: ap,
+				Address3: ap,
+			},
+			&layers.Dot11MgmtBeacon{Interval: 100}),
+	}
+	source := NewSliceSource(layers.LinkTypeIEEE80211Radio, frames)
+	runEngine(t, source, Config{Vendors: loadTestVendors(t), Output: w, OutputFlaggedBssid: true, Workers: 1})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	comments := pcapngComments(t, data)
+	if len(comments) != 2 {
+		t.Fatalf("comments %q", comments)
+	}
+	for i, messageType := range []int{TYPE_ASSOCIATION_REQUEST, TYPE_BEACON} {
+		if !strings.Contains(comments[i], "; type="+MessageTypeToString(messageType)+";") {
+			t.Errorf("packet #%d: comment %q", i, comments[i])
+		}
+	}
+}
@@ -0,0 +1,427 @@
+package djijoe
+
+import (
+	"context"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// capacity of the queues between the stages of the pipeline
+	PIPELINE_QUEUE_SIZE = 1024
+	// how often the statistics of the pipeline are logged
+	PIPELINE_STATS_INTERVAL = 1 * time.Minute
+)
+
+/*
+What the capture device says about the frames it received, and the ones it had
+to drop (e.g. because DJI-Joe did not read them fast enough).
+*/
+type CaptureStats struct {
+	Received uint64
+	Dropped  uint64
+}
+
+/*
+Implemented by the sources able to tell how many frames the kernel dropped.
+*/
+type CaptureStatsSource interface {
+	CaptureStats() (CaptureStats, error)
+}
+
+/*
+Counters of the engine. They come first in a struct of their own, so that they
+are 64-bit aligned for the atomic operations, even on 32-bit ARM.
+*/
+type engineCounters struct {
+	captured    uint64
+	bytes       uint64
+	filtered    uint64
+	badFcs      uint64
+	processed   uint64
+	reported    uint64
+	apiFailures uint64
+	// a gauge: the devices tracked by the linker
+	devices uint64
+	// frames with a valid FCS, by TYPE_*
+	frames [NB_MESSAGE_TYPES]uint64
+}
+
+func (e *Engine) countFrame(dot11Packet *layers.Dot11) {
+	atomic.AddUint64(&e.counters.frames[classifyDot11(dot11Packet)], 1)
+}
+
+/*
+A snapshot of the activity of the engine, and of the depth of the queues
+between its stages: frames waiting to be decoded (`CaptureQueue`), decoded
+frames waiting for the sink (`DecodeQueue`), and detections waiting to be
+reported (`ReportQueue`). `Frames` counts the frames with a valid FCS by type
+(see `MessageTypeToString`), and `Detections` the detections by vendor.
+*/
+type EngineStats struct {
+	Captured  uint64 `json:"captured"`
+	Bytes     uint64 `json:"bytes"`
+	Filtered  uint64 `json:"filtered"`
+	BadFcs    uint64 `json:"bad_fcs"`
+	Processed uint64 `json:"processed"`
+	Reported  uint64 `json:"reported"`
+
+	Frames         map[string]uint64 `json:"frames"`
+	Detections     map[string]uint64 `json:"detections"`
+	TrackedDevices uint64            `json:"tracked_devices"`
+	ApiFailures    uint64            `json:"api_failures"`
+
+	KernelReceived uint64 `json:"kernel_received"`
+	KernelDropped  uint64 `json:"kernel_dropped"`
+
+	Workers      int `json:"workers"`
+	QueueSize    int `json:"queue_size"`
+	CaptureQueue int `json:"capture_queue"`
+	DecodeQueue  int `json:"decode_queue"`
+	ReportQueue  int `json:"report_queue"`
+}
+
+/*
+Returns the statistics of the engine. Safe to call from any goroutine.
+*/
+func (e *Engine) Stats() EngineStats {
+	stats := EngineStats{
+		Captured:  atomic.LoadUint64(&e.counters.captured),
+		Bytes:     atomic.LoadUint64(&e.counters.bytes),
+		Filtered:  atomic.LoadUint64(&e.counters.filtered),
+		BadFcs:    atomic.LoadUint64(&e.counters.badFcs),
+		Processed: atomic.LoadUint64(&e.counters.processed),
+		Reported:  atomic.LoadUint64(&e.counters.reported),
+
+		Frames:         make(map[string]uint64),
+		Detections:     make(map[string]uint64),
+		TrackedDevices: atomic.LoadUint64(&e.counters.devices),
+		ApiFailures:    atomic.LoadUint64(&e.counters.apiFailures),
+	}
+
+	for messageType := range e.counters.frames {
+		if count := atomic.LoadUint64(&e.counters.frames[messageType]); count > 0 {
+			stats.Frames[MessageTypeToString(messageType)] = count
+		}
+	}
+
+	e.detectionsLock.Lock()
+	for vendor, count := range e.detections {
+		stats.Detections[vendor] = count
+	}
+	e.detectionsLock.Unlock()
+
+	if source, ok := e.Source.(CaptureStatsSource); ok {
+		kernel, err := source.CaptureStats()
+		if err == nil {
+			stats.KernelReceived = kernel.Received
+			stats.KernelDropped = kernel.Dropped
+		}
+	}
+
+	if p, _ := e.pipeline.Load().(*pipeline); p != nil {
+		stats.Workers = p.nbWorkers
+		stats.QueueSize = PIPELINE_QUEUE_SIZE
+		stats.CaptureQueue = len(p.frames)
+		stats.DecodeQueue = len(p.results)
+		stats.ReportQueue = len(p.events)
+	}
+
+	return stats
+}
+
+func (e *Engine) logStats() {
+	stats := e.Stats()
+	e.log.InfoF("%d frames captured (%d received / %d dropped by the kernel), %d filtered out, %d with a bad FCS, %d processed, %d reported; queues: capture %d, decode %d, report %d (of %d)",
+		stats.Captured, stats.KernelReceived, stats.KernelDropped, stats.Filtered, stats.BadFcs,
+		stats.Processed, stats.Reported, stats.CaptureQueue, stats.DecodeQueue, stats.ReportQueue, stats.QueueSize)
+}
+
+/*
+A frame, numbered in the order it was captured.
+*/
+type pipelineFrame struct {
+	seq  uint64
+	data []byte
+	ci   gopacket.CaptureInfo
+}
+
+/*
+A frame once decoded by a worker: `packet` is nil if it was filtered out.
+*/
+type pipelineResult struct {
+	seq    uint64
+	packet gopacket.Packet
+}
+
+/*
+The stages of the engine: one goroutine reading the frames, `nbWorkers`
+goroutines decoding them, the sink processing the ones which may matter in
+their capture order, and one goroutine reporting the detections.
+*/
+type pipeline struct {
+	engine    *Engine
+	nbWorkers int
+
+	frames  chan pipelineFrame
+	results chan pipelineResult
+	events  chan DroneInfoMessage
+	errc    chan error
+}
+
+func newPipeline(e *Engine, nbWorkers int) *pipeline {
+	if nbWorkers <= 0 {
+		nbWorkers = runtime.NumCPU()
+	}
+
+	return &pipeline{
+		engine:    e,
+		nbWorkers: nbWorkers,
+		frames:    make(chan pipelineFrame, PIPELINE_QUEUE_SIZE),
+		results:   make(chan pipelineResult, PIPELINE_QUEUE_SIZE),
+		events:    make(chan DroneInfoMessage, PIPELINE_QUEUE_SIZE),
+		errc:      make(chan error, 1),
+	}
+}
+
+/*
+Runs all the stages until the source is exhausted, fails, or `ctx` is
+cancelled. Only the sink and the reporter are waited for: the reader may be
+stuck in a blocking read, and stops at the next frame.
+*/
+func (p *pipeline) run(ctx context.Context) error {
+	var workers sync.WaitGroup
+
+	go p.read(ctx)
+
+	for i := 0; i < p.nbWorkers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			p.decode(ctx)
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(p.results)
+	}()
+
+	reported := make(chan struct{})
+	go func() {
+		defer close(reported)
+		p.report()
+	}()
+
+	p.sink(ctx)
+	close(p.events)
+	<-reported
+
+	select {
+	case err := <-p.errc:
+		p.engine.log.ErrorF("Failed to read packets: %+v", err)
+		return err
+	default:
+		return nil
+	}
+}
+
+/*
+Reads the frames of the source, until it is exhausted (the queue is then
+closed) or fails (the error is then sent over `errc`).
+*/
+func (p *pipeline) read(ctx context.Context) {
+	defer close(p.frames)
+
+	e := p.engine
+	var seq uint64
+
+	for {
+		data, ci, err := e.Source.ReadPacketData()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			if isFatalReadError(err) {
+				p.errc <- err
+				return
+			}
+			// most likely a read timeout, try again
+			time.Sleep(5 * time.Millisecond)
+			continue
+		}
+
+		atomic.AddUint64(&e.counters.captured, 1)
+		atomic.AddUint64(&e.counters.bytes, uint64(len(data)))
+
+		select {
+		case p.frames <- pipelineFrame{seq, data, ci}:
+			seq++
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+/*
+Decoding worker: only the RadioTap and 802.11 headers are decoded, into
+preallocated layers, to drop the frames which cannot matter. The others are
+fully decoded for the sink.
+*/
+func (p *pipeline) decode(ctx context.Context) {
+	e := p.engine
+	linkType := e.Source.LinkType()
+	options := gopacket.DecodeOptions{NoCopy: true, DecodeStreamsAsDatagrams: true}
+
+	var radio layers.RadioTap
+	var dot11 layers.Dot11
+	var decoded []gopacket.LayerType
+	var parser *gopacket.DecodingLayerParser
+
+	switch linkType {
+	case layers.LinkTypeIEEE80211Radio:
+		parser = gopacket.NewDecodingLayerParser(layers.LayerTypeRadioTap, &radio, &dot11)
+	case layers.LinkTypeIEEE802_11:
+		parser = gopacket.NewDecodingLayerParser(layers.LayerTypeDot11, &dot11)
+	}
+	if parser != nil {
+		// the 802.11 payload is left for the full decoding
+		parser.IgnoreUnsupported = true
+	}
+
+	for {
+		var frame pipelineFrame
+		var ok bool
+
+		select {
+		case frame, ok = <-p.frames:
+			if !ok {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+
+		result := pipelineResult{seq: frame.seq}
+
+		keep := true
+		if parser != nil {
+			parser.DecodeLayers(frame.data, &decoded)
+			keep = false
+			for _, layerType := range decoded {
+				if layerType == layers.LayerTypeDot11 {
+					keep = true
+				}
+			}
+
+			hasRadio := len(decoded) > 0 && decoded[0] == layers.LayerTypeRadioTap
+			switch {
+			case !keep:
+				atomic.AddUint64(&e.counters.filtered, 1)
+			case hasRadio && hasBadFcsLayers(&radio, &dot11):
+				atomic.AddUint64(&e.counters.badFcs, 1)
+				keep = false
+			default:
+				e.countFrame(&dot11)
+				if !e.mayMatter(&dot11) {
+					atomic.AddUint64(&e.counters.filtered, 1)
+					keep = false
+				}
+			}
+		}
+
+		if keep {
+			result.packet = gopacket.NewPacket(frame.data, linkType, options)
+			result.packet.Metadata().CaptureInfo = frame.ci
+		}
+
+		select {
+		case p.results <- result:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+/*
+The single consumer of the decoded frames: puts them back in their capture
+order (the device linker and the outputs depend on it) and processes them.
+*/
+func (p *pipeline) sink(ctx context.Context) {
+	e := p.engine
+	pending := make(map[uint64]gopacket.Packet)
+	var next uint64
+
+	statsTicker := time.NewTicker(PIPELINE_STATS_INTERVAL)
+	defer statsTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			e.log.Info("Stopping cleanly")
+			return
+
+		case <-statsTicker.C:
+			e.logStats()
+
+		case result, ok := <-p.results:
+			if !ok {
+				return
+			}
+			pending[result.seq] = result.packet
+
+			for {
+				packet, ok := pending[next]
+				if !ok {
+					break
+				}
+				delete(pending, next)
+				next++
+
+				if packet != nil {
+					atomic.AddUint64(&e.counters.processed, 1)
+					e.processFrame(packet)
+				}
+			}
+		}
+	}
+}
+
+/*
+Reports the detections, so that a slow API does not hold the processing.
+*/
+func (p *pipeline) report() {
+	e := p.engine
+
+	for info := range p.events {
+		e.sendReport(info)
+	}
+}
+
+/*
+Returns true if a frame has to go through the sink: it has a flagged address,
+it is a probe request (to fingerprint its sender, whatever its address), or it
+belongs to a BSS whose frames are saved once flagged. The sink decides for the
+latter: the frame which flags a BSS may still be on its way to the sink.
+*/
+func (e *Engine) mayMatter(dot11Packet *layers.Dot11) bool {
+	if dot11Packet.Type == layers.Dot11TypeMgmtProbeReq {
+		return true
+	}
+
+	for _, address := range frameAddresses(dot11Packet) {
+		if isFlagged, _ := e.isFlaggedMac(address.Address); isFlagged {
+			return true
+		}
+	}
+
+	if e.Config.OutputFlaggedBssid && frameBssid(dot11Packet) != nil {
+		return true
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package djijoe
+
+import (
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+/*
+A source claiming the kernel dropped some frames.
+*/
+type droppingSource struct {
+	*SliceSource
+}
+
+func (s droppingSource) CaptureStats() (CaptureStats, error) {
+	return CaptureStats{Received: 1000, Dropped: 42}, nil
+}
+
+func TestPipelineStats(t *testing.T) {
+	for _, nbWorkers := range []int{1, 8} {
+		source, err := OpenFileSource("../../pcaps/test.pcap")
+		if err != nil {
+			t.Fatal(err)
+		}
+		engine, detections := runEngine(t, source, Config{Vendors: loadTestVendors(t), Workers: nbWorkers})
+		source.Close()
+
+		stats := engine.Stats()
+		if stats.Captured != 1776 || stats.Bytes != 360464 || stats.BadFcs != 34 ||
+			stats.Filtered+stats.BadFcs+stats.Processed != stats.Captured ||
+			stats.Reported != uint64(len(detections)) {
+			t.Errorf("%d workers: got %+v", nbWorkers, stats)
+		}
+
+		// frames are processed in their capture order, whatever the number of
+		// workers
+		for i := 1; i < len(detections); i++ {
+			if detections[i].Timestamp.Before(detections[i-1].Timestamp) {
+				t.Fatalf("%d workers: detection #%d out of order", nbWorkers, i)
+			}
+		}
+	}
+}
+
+func TestPipelineKernelStats(t *testing.T) {
+	source := droppingSource{NewSliceSource(layers.LinkTypeIEEE80211Radio, nil)}
+	engine, _ := runEngine(t, source, Config{Workers: 2})
+
+	stats := engine.Stats()
+	if stats.KernelReceived != 1000 || stats.KernelDropped != 42 {
+		t.Errorf("got %+v", stats)
+	}
+}
@@ -1,10 +1,9 @@
 package djijoe
 
 import (
-	"bytes"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
@@ -26,16 +25,25 @@ type Probe struct {
 	EndTime          time.Time
 	LastHeartbeat    time.Time
 	Hostname         string
-	EnableApi        bool
 	ApiEndpoint      url.URL
 	NbBeacons        uint64
 	NbProbes         uint64
 	NbBytesCollected uint64
+	NbBadFcs         uint64
 	GpsCoordinates   geo.Point
+	Log              Logger
+	// where the events are reported, including the API server once set
+	Reporters FanoutReporter
+
+	stop chan struct{}
 }
 
 type Probes []Probe
 
+func NewProbe(log Logger) *Probe {
+	return &Probe{Log: log}
+}
+
 func (p *Probe) GetUrlTo(Path string) string {
 	return fmt.Sprintf("%s://%s%s",
 		p.ApiEndpoint.Scheme,
@@ -43,36 +51,21 @@ func (p *Probe) GetUrlTo(Path string) string {
 		Path)
 }
 
-func (p *Probe) NotifyWakeup() bool {
-	if !p.EnableApi {
-		return false
-	}
-
+func (p *Probe) NotifyWakeup() error {
 	var msg = WakeUpMessage{
 		Hostname:  p.Hostname,
 		Timestamp: p.StartTime,
 	}
-	Log.DebugF("Sending WAKEUP from %s at %s", p.Hostname, p.StartTime)
-	jsonValue, err := json.Marshal(msg)
-	if err != nil {
-		return false
-	}
 
-	Url := p.GetUrlTo(API_WAKEUP)
-	resp, err := http.Post(Url, "application/json", bytes.NewBuffer(jsonValue))
+	p.Log.DebugF("Sending WAKEUP from %s at %s", p.Hostname, p.StartTime)
+	err := p.Reporters.Wakeup(msg)
 	if err != nil {
-		Log.ErrorF("NotifyWakeup() HTTP POST failed: %+v", err)
-		p.EnableApi = false
-		return false
+		p.Log.ErrorF("NotifyWakeup() failed: %+v", err)
 	}
-	return resp.StatusCode == http.StatusNoContent
+	return err
 }
 
-func (p *Probe) NotifyShutdown() bool {
-	if !p.EnableApi {
-		return false
-	}
-
+func (p *Probe) NotifyShutdown() error {
 	var msg = ShutdownMessage{
 		Hostname:          p.Hostname,
 		Timestamp:         p.EndTime,
@@ -80,59 +73,61 @@ func (p *Probe) NotifyShutdown() bool {
 		ProbeRequestFound: p.NbProbes,
 	}
 
-	Log.DebugF("Sending SHUTDOWN from %s at %s", p.Hostname, p.EndTime)
-	jsonValue, err := json.Marshal(msg)
+	p.Log.DebugF("Sending SHUTDOWN from %s at %s", p.Hostname, p.EndTime)
+	err := p.Reporters.Shutdown(msg)
 	if err != nil {
-		return false
+		p.Log.ErrorF("NotifyShutdown() failed: %+v", err)
 	}
-
-	Url := p.GetUrlTo(API_SHUTDOWN)
-	resp, err := http.Post(Url, "application/json", bytes.NewBuffer(jsonValue))
-	if err != nil {
-		Log.ErrorF("NotifyShutdown() HTTP POST failed: %+v", err)
-		p.EnableApi = false
-		return false
-	}
-	return resp.StatusCode == http.StatusNoContent
+	return err
 }
 
+/*
+Reports a detection to all the reporters, and returns their errors.
+*/
 func (p *Probe) ProcessFlaggedPacket(info DroneInfoMessage) error {
-	if !p.EnableApi {
-		return nil
-	}
-
-	var httpTransport = &http.Transport{
-		MaxIdleConns:       10,
-		IdleConnTimeout:    30 * time.Second,
-		DisableCompression: true,
+	err := p.Reporters.Detection(info)
+	if err != nil {
+		p.Log.ErrorF("NEWDRONEINFO report failed: %+v", err)
 	}
+	return err
+}
 
+/*
+Fetches the vendor file published by the server, unless it still has the ETag
+`etag`, and returns it with its new ETag. Returns nil if there is nothing new.
+*/
+func (p *Probe) FetchVendors(etag string) ([]byte, string, error) {
 	var httpRequest = &http.Client{
-		Timeout:   10 * time.Second,
-		Transport: httpTransport,
+		Timeout: 30 * time.Second,
 	}
 
-	jsonValue, err := json.Marshal(info)
+	req, err := http.NewRequest(http.MethodGet, p.GetUrlTo(API_VENDORS), nil)
 	if err != nil {
-		Log.ErrorF("ProcessFlaggedPacket(): JSON Marshalling failed: %+v", err)
-		return err
+		return nil, etag, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
 	}
 
-	Url := p.GetUrlTo(API_NEWDRONEINFO)
-	httpResponse, err := httpRequest.Post(Url, "application/json", bytes.NewBuffer(jsonValue))
+	resp, err := httpRequest.Do(req)
 	if err != nil {
-		Log.ErrorF("NEWDRONEINFO HTTP request failed: %+v", err)
-		p.EnableApi = false
-		return err
+		return nil, etag, err
 	}
-	defer httpResponse.Body.Close()
+	defer resp.Body.Close()
 
-	if httpResponse.StatusCode != http.StatusAccepted {
-		Log.ErrorF("Unexpected response: got %d , expected %d", httpResponse.StatusCode, http.StatusOK)
-		return nil
+	switch resp.StatusCode {
+	case http.StatusOK:
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, etag, err
+		}
+		return data, resp.Header.Get("ETag"), nil
+
+	case http.StatusNotModified, http.StatusNoContent, http.StatusNotFound:
+		return nil, etag, nil
 	}
 
-	return nil
+	return nil, etag, fmt.Errorf("unexpected response to GET %s: %s", API_VENDORS, resp.Status)
 }
 
 func (p *Probe) Wakeup() error {
@@ -150,81 +145,108 @@ func (p *Probe) Wakeup() error {
 	p.NbBeacons = uint64(0)
 	p.NbProbes = uint64(0)
 	p.NbBytesCollected = uint64(0)
+	p.NbBadFcs = uint64(0)
 
-	Log.DebugF("Starting probe '%s'", p.Hostname)
+	p.Log.DebugF("Starting probe '%s'", p.Hostname)
 
 	// notify server of new probe
 	p.NotifyWakeup()
 
 	// and start the Heartbeat goroutine
 	p.State = PROBE_STATE_RUNNING
-	go p.SendHeartbeat(interval)
+	p.stop = make(chan struct{})
+	if len(p.Reporters) > 0 {
+		go p.SendHeartbeat(interval)
+	}
 	return nil
 }
 
+/*
+GoRoutine sending heartbeats until the probe shuts down.
+*/
 func (p *Probe) SendHeartbeat(interval time.Duration) {
-	if !p.EnableApi {
-		return
-	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
 	for {
-		if p.State != PROBE_STATE_RUNNING {
-			break
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
 		}
-		time.Sleep(interval)
 
 		var msg = HeartBeatMessage{
 			Hostname:  p.Hostname,
 			Timestamp: time.Now(),
 		}
 
-		Log.DebugF("Sending HEARTBEAT from %s", p.Hostname)
-		jsonValue, err := json.Marshal(msg)
-		if err != nil {
-			break
-		}
-
-		Url := p.GetUrlTo(API_HEARTBEAT)
-		_, err = http.Post(Url, "application/json", bytes.NewBuffer(jsonValue))
-		if err != nil {
-			Log.ErrorF("SendHeartbeat() HTTP POST failed: %+v", err)
-			p.EnableApi = false
-			break
+		p.Log.DebugF("Sending HEARTBEAT from %s", p.Hostname)
+		if err := p.Reporters.Heartbeat(msg); err != nil {
+			p.Log.ErrorF("SendHeartbeat() failed: %+v", err)
 		}
 	}
 }
 
 func (p *Probe) Shutdown() error {
-	Log.DebugF("Stopping probe '%s'", p.Hostname)
+	p.Log.DebugF("Stopping probe '%s'", p.Hostname)
 
+	if p.State == PROBE_STATE_RUNNING {
+		close(p.stop)
+	}
 	p.EndTime = time.Now()
 	p.State = PROBE_STATE_STOPPED
 
-	Log.InfoF("Finished monitoring in %d ms, read %d bytes",
+	p.Log.InfoF("Finished monitoring in %d ms, read %d bytes",
 		(p.EndTime.UnixNano()-p.StartTime.UnixNano())/1000, p.NbBytesCollected)
-	Log.InfoF("Discovered %d DJI ProbeRequests, %d DJI Beacon", p.NbProbes, p.NbBeacons)
+	p.Log.InfoF("Discovered %d DJI ProbeRequests, %d DJI Beacon", p.NbProbes, p.NbBeacons)
+	if p.NbBadFcs > 0 {
+		p.Log.InfoF("Dropped %d frames with a bad FCS", p.NbBadFcs)
+	}
 
 	// notify server of shutdown
 	p.NotifyShutdown()
 	return nil
 }
 
+/*
+Sets the API server, which the vendors are fetched from and the events are
+reported to (instead of the previous one).
+*/
 func (p *Probe) SetApiEndpoint(ApiEndpoint string) error {
 	u, err := url.Parse(ApiEndpoint)
 	if err != nil {
-		Log.DebugF("Refusing change of API Endpoint to '%s': invalid URL: %+v", ApiEndpoint, err)
-		p.EnableApi = false
+		p.Log.DebugF("Refusing change of API Endpoint to '%s': invalid URL: %+v", ApiEndpoint, err)
 		return err
 	}
 
-	Log.DebugF("Changing API Endpoint to '%s'", ApiEndpoint)
+	p.Log.DebugF("Changing API Endpoint to '%s'", ApiEndpoint)
 	p.ApiEndpoint = *u
-	p.EnableApi = true
+
+	reporters := FanoutReporter{NewHttpReporter(*u, p.Log)}
+	for _, r := range p.Reporters {
+		if _, ok := r.(*HttpReporter); !ok {
+			reporters = append(reporters, r)
+		}
+	}
+	p.Reporters = reporters
 	return nil
 }
 
+/*
+Returns whether the events are posted to the API server, which stops after
+its first failure.
+*/
+func (p *Probe) ApiEnabled() bool {
+	for _, r := range p.Reporters {
+		if api, ok := r.(*HttpReporter); ok && api.Enabled() {
+			return true
+		}
+	}
+	return false
+}
+
 func (p *Probe) SetGpsCoordinates(lat float64, long float64) error {
-	Log.DebugF("Updating GPS position of '%s' to (%.5f, %.5f)", p.Hostname, lat, long)
+	p.Log.DebugF("Updating GPS position of '%s' to (%.5f, %.5f)", p.Hostname, lat, long)
 	pt := geo.NewPoint(lat, long)
 	p.GpsCoordinates = *pt
 	return nil
@@ -0,0 +1,233 @@
+package djijoe
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+Fake DJI-Jane server, recording the payloads posted to each API path.
+*/
+type apiRecorder struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	payloads map[string][][]byte
+}
+
+func newApiRecorder(t *testing.T) *apiRecorder {
+	r := &apiRecorder{payloads: make(map[string][][]byte)}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			t.Errorf("unexpected %s %s", req.Method, req.URL.Path)
+		}
+		if req.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected content type %q for %s", req.Header.Get("Content-Type"), req.URL.Path)
+		}
+
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Errorf("failed to read %s payload: %v", req.URL.Path, err)
+		}
+
+		r.mu.Lock()
+		r.payloads[req.URL.Path] = append(r.payloads[req.URL.Path], body)
+		r.mu.Unlock()
+
+		switch req.URL.Path {
+		case API_NEWDRONEINFO:
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *apiRecorder) Payloads(path string) [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]byte(nil), r.payloads[path]...)
+}
+
+func (r *apiRecorder) Detections(t *testing.T) []DroneInfoMessage {
+	var detections []DroneInfoMessage
+	for _, payload := range r.Payloads(API_NEWDRONEINFO) {
+		var info DroneInfoMessage
+		if err := json.Unmarshal(payload, &info); err != nil {
+			t.Fatalf("invalid %s payload %s: %v", API_NEWDRONEINFO, payload, err)
+		}
+		detections = append(detections, info)
+	}
+	return detections
+}
+
+/*
+Decodes a payload as a generic JSON object, to check the exact field names.
+*/
+func decodeObject(t *testing.T, payload []byte) map[string]interface{} {
+	var obj map[string]interface{}
+	if err := json.Unmarshal(payload, &obj); err != nil {
+		t.Fatalf("invalid payload %s: %v", payload, err)
+	}
+	return obj
+}
+
+func newTestProbe(t *testing.T, server *apiRecorder) *Probe {
+	p := NewProbe(NopLogger{})
+	if err := p.SetApiEndpoint(server.URL); err != nil {
+		t.Fatalf("SetApiEndpoint(%q): %v", server.URL, err)
+	}
+	return p
+}
+
+func TestProbeWakeupAndShutdown(t *testing.T) {
+	server := newApiRecorder(t)
+	p := newTestProbe(t, server)
+
+	p.Wakeup()
+	p.NbBeacons = 3
+	p.NbProbes = 5
+	p.Shutdown()
+
+	wakeups := server.Payloads(API_WAKEUP)
+	if len(wakeups) != 1 {
+		t.Fatalf("got %d %s payloads, expected 1", len(wakeups), API_WAKEUP)
+	}
+	wakeup := decodeObject(t, wakeups[0])
+	if wakeup["host"] != p.Hostname {
+		t.Errorf("wakeup host = %v, expected %q", wakeup["host"], p.Hostname)
+	}
+	if wakeup["ts"] != p.StartTime.Format(time.RFC3339Nano) {
+		t.Errorf("wakeup ts = %v, expected %v", wakeup["ts"], p.StartTime.Format(time.RFC3339Nano))
+	}
+	if _, ok := wakeup["position"]; !ok {
+		t.Errorf("wakeup has no position: %s", wakeups[0])
+	}
+
+	shutdowns := server.Payloads(API_SHUTDOWN)
+	if len(shutdowns) != 1 {
+		t.Fatalf("got %d %s payloads, expected 1", len(shutdowns), API_SHUTDOWN)
+	}
+	shutdown := decodeObject(t, shutdowns[0])
+	expected := map[string]interface{}{
+		"host":      p.Hostname,
+		"ts":        p.EndTime.Format(time.RFC3339Nano),
+		"nb_beacon": float64(3),
+		"nb_probes": float64(5),
+	}
+	for key, value := range expected {
+		if shutdown[key] != value {
+			t.Errorf("shutdown %s = %v, expected %v", key, shutdown[key], value)
+		}
+	}
+
+	if !p.ApiEnabled() {
+		t.Errorf("API got disabled")
+	}
+	if p.State != PROBE_STATE_STOPPED {
+		t.Errorf("State = %d, expected %d", p.State, PROBE_STATE_STOPPED)
+	}
+}
+
+func TestProbeHeartbeat(t *testing.T) {
+	server := newApiRecorder(t)
+	p := newTestProbe(t, server)
+	p.Hostname = "probe-1"
+	p.stop = make(chan struct{})
+
+	done := make(chan struct{})
+	go func() {
+		p.SendHeartbeat(5 * time.Millisecond)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(server.Payloads(API_HEARTBEAT)) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(p.stop)
+	<-done
+
+	heartbeats := server.Payloads(API_HEARTBEAT)
+	if len(heartbeats) < 2 {
+		t.Fatalf("got %d %s payloads, expected at least 2", len(heartbeats), API_HEARTBEAT)
+	}
+	for _, payload := range heartbeats {
+		heartbeat := decodeObject(t, payload)
+		if heartbeat["host"] != "probe-1" {
+			t.Errorf("heartbeat host = %v, expected probe-1", heartbeat["host"])
+		}
+		if _, err := time.Parse(time.RFC3339Nano, heartbeat["ts"].(string)); err != nil {
+			t.Errorf("heartbeat ts %v: %v", heartbeat["ts"], err)
+		}
+	}
+}
+
+func TestProbeProcessFlaggedPacket(t *testing.T) {
+	server := newApiRecorder(t)
+	p := newTestProbe(t, server)
+
+	info := DroneInfoMessage{
+		Timestamp:      time.Date(2017, 6, 1, 21, 24, 36, 661535000, time.UTC),
+		Hostname:       "probe-1",
+		MessageType:    TYPE_PROBE_REQUEST,
+		SignalStrength: -33,
+		Frequency:      2412,
+		Vendor:         "SZ DJI Technology Co.,Ltd",
+		MacAddress:     []byte{0x60, 0x60, 0x1f, 0x42, 0x11, 0xb8},
+		Tsft:           88579302,
+	}
+
+	if err := p.ProcessFlaggedPacket(info); err != nil {
+		t.Fatalf("ProcessFlaggedPacket: %v", err)
+	}
+
+	payloads := server.Payloads(API_NEWDRONEINFO)
+	if len(payloads) != 1 {
+		t.Fatalf("got %d %s payloads, expected 1", len(payloads), API_NEWDRONEINFO)
+	}
+	obj := decodeObject(t, payloads[0])
+	expected := map[string]interface{}{
+		"ts":         "2017-06-01T21:24:36.661535Z",
+		"host":       "probe-1",
+		"type":       float64(TYPE_PROBE_REQUEST),
+		"strength":   float64(-33),
+		"frequency":  float64(2412),
+		"vendor":     "SZ DJI Technology Co.,Ltd",
+		"MacAddress": "YGAfQhG4",
+		"tsft":       float64(88579302),
+	}
+	for key, value := range expected {
+		if obj[key] != value {
+			t.Errorf("%s = %v, expected %v", key, obj[key], value)
+		}
+	}
+	if len(obj) != len(expected) {
+		t.Errorf("unexpected fields in %s", payloads[0])
+	}
+}
+
+func TestProbeDisablesApiOnFailure(t *testing.T) {
+	server := newApiRecorder(t)
+	p := newTestProbe(t, server)
+	server.Close()
+
+	if err := p.ProcessFlaggedPacket(DroneInfoMessage{}); err == nil {
+		t.Fatalf("ProcessFlaggedPacket succeeded with the server down")
+	}
+	if p.ApiEnabled() {
+		t.Errorf("API still enabled after a failure")
+	}
+
+	// once disabled, nothing is sent anymore
+	if err := p.ProcessFlaggedPacket(DroneInfoMessage{}); err != nil {
+		t.Errorf("ProcessFlaggedPacket with API disabled: %v", err)
+	}
+}
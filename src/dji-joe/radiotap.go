@@ -0,0 +1,288 @@
+package djijoe
+
+import (
+	"encoding/binary"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// bits of the radiotap "present" bitmaps
+const (
+	RADIOTAP_PRESENT_DBM_ANTENNA_SIGNAL = 5
+	RADIOTAP_PRESENT_ANTENNA            = 11
+	RADIOTAP_PRESENT_TLV                = 28
+	RADIOTAP_PRESENT_RADIOTAP_NS        = 29
+	RADIOTAP_PRESENT_VENDOR_NS          = 30
+	RADIOTAP_PRESENT_EXT                = 31
+)
+
+// alignment and size of the fields of the radiotap namespace, by present bit
+var radiotapFields = [RADIOTAP_PRESENT_TLV]struct{ align, size int }{
+	{8, 8},  // TSFT
+	{1, 1},  // flags
+	{1, 1},  // rate
+	{2, 4},  // channel
+	{1, 2},  // FHSS
+	{1, 1},  // dBm antenna signal
+	{1, 1},  // dBm antenna noise
+	{2, 2},  // lock quality
+	{2, 2},  // TX attenuation
+	{2, 2},  // dB TX attenuation
+	{1, 1},  // dBm TX power
+	{1, 1},  // antenna
+	{1, 1},  // dB antenna signal
+	{1, 1},  // dB antenna noise
+	{2, 2},  // RX flags
+	{2, 2},  // TX flags
+	{1, 1},  // RTS retries
+	{1, 1},  // data retries
+	{4, 8},  // XChannel
+	{1, 3},  // MCS
+	{4, 8},  // A-MPDU status
+	{2, 12}, // VHT
+	{8, 12}, // timestamp
+	{2, 12}, // HE
+	{2, 12}, // HE-MU
+	{2, 6},  // HE-MU-other-user
+	{1, 1},  // 0-length PSDU
+	{2, 4},  // L-SIG
+}
+
+/*
+The signal received by one of the antennas of the capture device.
+*/
+type AntennaSignal struct {
+	Antenna uint8 `json:"antenna"`
+	Signal  int8  `json:"strength"`
+}
+
+/*
+How a frame was received, from its radiotap header. `Rate` (in Mb/s) is set
+for the legacy rates, `Phy`, `Mcs`, `Nss` and `Bandwidth` for the HT ("HT")
+and VHT ("VHT") ones.
+*/
+type RadioInfo struct {
+	Antenna        *uint8          `json:"antenna,omitempty"`
+	AntennaSignals []AntennaSignal `json:"antenna_strengths,omitempty"`
+	Noise          int8            `json:"noise,omitempty"`
+	Snr            int8            `json:"snr,omitempty"`
+	Rate           float32         `json:"rate,omitempty"`
+	Phy            string          `json:"phy,omitempty"`
+	Mcs            *uint8          `json:"mcs,omitempty"`
+	Nss            uint8           `json:"nss,omitempty"`
+	Bandwidth      int             `json:"bandwidth,omitempty"`
+	ShortGi        bool            `json:"short_gi,omitempty"`
+	ChannelFlags   string          `json:"channel_flags,omitempty"`
+	RadiotapFlags  string          `json:"radiotap_flags,omitempty"`
+}
+
+// bandwidth (in MHz) of the VHT bandwidth field values
+var vhtBandwidths = []int{20, 40, 40, 40, 80, 80, 80, 80, 80, 80, 80, 160}
+
+/*
+Extracts the reception metadata of a frame from its radiotap header.
+*/
+func ParseRadioInfo(radio *layers.RadioTap) RadioInfo {
+	var info RadioInfo
+	present := radio.Present
+
+	if present.Antenna() {
+		antenna := radio.Antenna
+		info.Antenna = &antenna
+	}
+	info.AntennaSignals = parseAntennaSignals(radio.Contents)
+
+	if present.DBMAntennaNoise() {
+		info.Noise = radio.DBMAntennaNoise
+		if present.DBMAntennaSignal() {
+			info.Snr = radio.DBMAntennaSignal - radio.DBMAntennaNoise
+		}
+	}
+
+	if present.Rate() {
+		info.Rate = 0.5 * float32(radio.Rate)
+	}
+
+	if present.MCS() && radio.MCS.Known.MCSIndex() {
+		mcs := radio.MCS.MCS
+		info.Phy = "HT"
+		info.Mcs = &mcs
+		info.Nss = mcs/8 + 1
+		if radio.MCS.Known.Bandwidth() {
+			info.Bandwidth = []int{20, 40, 20, 20}[radio.MCS.Flags.Bandwidth()]
+		}
+		info.ShortGi = radio.MCS.Known.GuardInterval() && radio.MCS.Flags&layers.RadioTapMCSFlagsShortGI != 0
+	}
+
+	if present.VHT() {
+		// the first user (the only one, but for MU-MIMO)
+		for _, mcsNss := range radio.VHT.MCSNSS {
+			if mcsNss.Present() {
+				mcs := uint8(mcsNss >> 4)
+				info.Phy = "VHT"
+				info.Mcs = &mcs
+				info.Nss = uint8(mcsNss & 0x0f)
+				break
+			}
+		}
+		if radio.VHT.Known.Bandwidth() && int(radio.VHT.Bandwidth&0x1f) < len(vhtBandwidths) {
+			info.Bandwidth = vhtBandwidths[radio.VHT.Bandwidth&0x1f]
+		}
+		info.ShortGi = radio.VHT.Known.GI() && radio.VHT.Flags.SGI()
+	}
+
+	if present.Channel() {
+		info.ChannelFlags = trimFlags(radio.ChannelFlags.String())
+	}
+	if present.Flags() {
+		info.RadiotapFlags = trimFlags(radio.Flags.String())
+	}
+
+	return info
+}
+
+func trimFlags(flags string) string {
+	if len(flags) > 0 && flags[len(flags)-1] == ',' {
+		return flags[:len(flags)-1]
+	}
+	return flags
+}
+
+/*
+Returns the signal received by each antenna. gopacket only decodes the first
+"present" bitmap, which holds the combined signal: the per-antenna ones are in
+the following radiotap namespaces, each with its own antenna index.
+*/
+func parseAntennaSignals(header []byte) []AntennaSignal {
+	if len(header) < 8 {
+		return nil
+	}
+
+	// the bitmaps, and whether each one starts a new radiotap namespace
+	// (true) or a vendor namespace (false)
+	type bitmap struct {
+		value    uint32
+		radiotap bool
+		first    bool
+	}
+	var bitmaps []bitmap
+
+	offset := 4
+	radiotap, first := true, true
+	for offset+4 <= len(header) {
+		value := binary.LittleEndian.Uint32(header[offset:])
+		bitmaps = append(bitmaps, bitmap{value, radiotap, first})
+		offset += 4
+
+		if value&(1<<RADIOTAP_PRESENT_EXT) == 0 {
+			break
+		}
+		switch {
+		case value&(1<<RADIOTAP_PRESENT_RADIOTAP_NS) != 0:
+			radiotap, first = true, true
+		case value&(1<<RADIOTAP_PRESENT_VENDOR_NS) != 0:
+			radiotap, first = false, true
+		default:
+			first = false
+		}
+	}
+
+	var signals []AntennaSignal
+	for i, bm := range bitmaps {
+		if !bm.first {
+			// the extensions of a namespace: nothing we can parse
+			if bm.value&^(1<<RADIOTAP_PRESENT_RADIOTAP_NS|1<<RADIOTAP_PRESENT_VENDOR_NS|1<<RADIOTAP_PRESENT_EXT) != 0 {
+				break
+			}
+			continue
+		}
+
+		if !bm.radiotap {
+			// vendor namespace: OUI, sub-namespace, and the length to skip
+			offset += align(offset, 2)
+			if offset+6 > len(header) {
+				break
+			}
+			offset += 6 + int(binary.LittleEndian.Uint16(header[offset+4:]))
+			continue
+		}
+
+		var signal *int8
+		var antenna *uint8
+		for bit := 0; bit < RADIOTAP_PRESENT_TLV; bit++ {
+			if bm.value&(1<<uint(bit)) == 0 {
+				continue
+			}
+			field := radiotapFields[bit]
+			offset += align(offset, field.align)
+			if offset+field.size > len(header) {
+				return signals
+			}
+
+			switch bit {
+			case RADIOTAP_PRESENT_DBM_ANTENNA_SIGNAL:
+				value := int8(header[offset])
+				signal = &value
+			case RADIOTAP_PRESENT_ANTENNA:
+				value := header[offset]
+				antenna = &value
+			}
+			offset += field.size
+		}
+		if bm.value&(1<<RADIOTAP_PRESENT_TLV) != 0 {
+			break
+		}
+
+		// the first namespace holds the combined signal
+		if i > 0 && signal != nil && antenna != nil {
+			signals = append(signals, AntennaSignal{*antenna, *signal})
+		}
+	}
+
+	return signals
+}
+
+func align(offset int, width int) int {
+	if offset%width == 0 {
+		return 0
+	}
+	return width - offset%width
+}
+
+/*
+Returns the strength (dBm) and the frequency (MHz) a frame was received with,
+or zeros without a radiotap header.
+*/
+func packetSignal(packet gopacket.Packet) (int8, uint16) {
+	radio, ok := packet.Layer(layers.LayerTypeRadioTap).(*layers.RadioTap)
+	if !ok {
+		return 0, 0
+	}
+	return radio.DBMAntennaSignal, uint16(radio.ChannelFrequency)
+}
+
+/*
+Returns true if the frame did not pass its FCS check: either the driver says
+so, or the FCS was captured and does not match.
+*/
+func hasBadFcs(packet gopacket.Packet) bool {
+	radio, ok := packet.Layer(layers.LayerTypeRadioTap).(*layers.RadioTap)
+	if !ok {
+		return false
+	}
+	dot11, _ := packet.Layer(layers.LayerTypeDot11).(*layers.Dot11)
+	return hasBadFcsLayers(radio, dot11)
+}
+
+func hasBadFcsLayers(radio *layers.RadioTap, dot11 *layers.Dot11) bool {
+	if radio.Flags.BadFCS() {
+		return true
+	}
+
+	// gopacket removes the padding of some drivers, which then breaks the FCS
+	if !radio.Flags.FCS() || radio.Flags.Datapad() || dot11 == nil {
+		return false
+	}
+	return !dot11.ChecksumValid()
+}
@@ -0,0 +1,146 @@
+package djijoe
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+/*
+Builds a DJI beacon with a radiotap header holding the flags, channel and
+signal fields, followed by its FCS.
+*/
+func buildFcsFrame(t *testing.T, flags layers.RadioTapFlags, validFcs bool) RawPacket {
+	buffer := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true},
+		&layers.Dot11{
+			Type:     layers.Dot11TypeMgmtBeacon,
+			Address1: mustParseMAC(t, "ff:ff:ff:ff:ff:ff"),
+			Address2: mustParseMAC(t, "60:60:1f:00:00:01"),
+			Address3: mustParseMAC(t, "60:60:1f:00:00:01"),
+		},
+		&layers.Dot11MgmtBeacon{Interval: 100},
+		ssidElement("Mavic-123456"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := buffer.Bytes()
+
+	radiotap := []byte{
+		0, 0, 15, 0, 0x2a, 0, 0, 0, // flags, channel, dBm signal
+		byte(flags), 0,
+		0x6c, 0x09, 0xa0, 0x00, // 2412 MHz, CCK 2GHz
+		0xd8, // -40 dBm
+	}
+
+	fcs := crc32.ChecksumIEEE(frame)
+	if !validFcs {
+		fcs++
+	}
+	data := append(append(radiotap, frame...), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(data[len(data)-4:], fcs)
+
+	return RawPacket{Data: data, CaptureInfo: gopacket.CaptureInfo{Timestamp: time.Now()}}
+}
+
+func TestEngineDropsBadFcs(t *testing.T) {
+	tests := []struct {
+		name     string
+		frame    RawPacket
+		detected bool
+	}{
+		{"valid FCS", buildFcsFrame(t, layers.RadioTapFlagsFCS, true), true},
+		{"flagged by the driver", buildFcsFrame(t, layers.RadioTapFlagsFCS|layers.RadioTapFlagsBadFCS, true), false},
+		{"corrupted", buildFcsFrame(t, layers.RadioTapFlagsFCS, false), false},
+	}
+
+	for _, test := range tests {
+		source := NewSliceSource(layers.LinkTypeIEEE80211Radio, []RawPacket{test.frame})
+		engine, detections := runEngine(t, source, Config{Vendors: loadTestVendors(t)})
+
+		if (len(detections) == 1) != test.detected || (engine.Probe.NbBadFcs == 1) == test.detected {
+			t.Errorf("%s: %d detections, %d bad FCS", test.name, len(detections), engine.Probe.NbBadFcs)
+		}
+		if test.detected && (detections[0].Ssid != "Mavic-123456" || detections[0].RadiotapFlags != "FCS") {
+			t.Errorf("%s: got %+v", test.name, detections[0])
+		}
+	}
+}
+
+func TestParseAntennaSignals(t *testing.T) {
+	header := []byte{
+		0, 0, 41, 0,
+		// flags, channel, dBm signal; radiotap namespace follows
+		0x2a, 0x00, 0x00, 0xa0,
+		// dBm signal, antenna; vendor namespace follows
+		0x20, 0x08, 0x00, 0xc0,
+		// vendor namespace; radiotap namespace follows
+		0x01, 0x00, 0x00, 0xa0,
+		// dBm signal, antenna
+		0x20, 0x08, 0x00, 0x00,
+		// first namespace: flags, (pad) channel, signal
+		0x00, 0x00, 0x6c, 0x09, 0xa0, 0x00, 0xd8,
+		// antenna 0 at -42 dBm
+		0xd6, 0x00,
+		// (pad) vendor namespace skipping 3 bytes
+		0x00, 0x00, 0x11, 0x22, 0x01, 0x03, 0x00, 0xff, 0xff, 0xff,
+		// antenna 1 at -38 dBm
+		0xda, 0x01,
+	}
+
+	signals := parseAntennaSignals(header)
+	if len(signals) != 2 || signals[0] != (AntennaSignal{0, -42}) || signals[1] != (AntennaSignal{1, -38}) {
+		t.Errorf("got %+v", signals)
+	}
+
+	// truncated headers
+	for length := 0; length < len(header); length++ {
+		if signals := parseAntennaSignals(header[:length]); len(signals) > 1 {
+			t.Errorf("%d bytes: got %+v", length, signals)
+		}
+	}
+}
+
+func TestParseRadioInfo(t *testing.T) {
+	ht := ParseRadioInfo(&layers.RadioTap{
+		Present:          layers.RadioTapPresentDBMAntennaSignal | layers.RadioTapPresentDBMAntennaNoise | layers.RadioTapPresentAntenna | layers.RadioTapPresentMCS,
+		DBMAntennaSignal: -40,
+		DBMAntennaNoise:  -95,
+		Antenna:          1,
+		MCS: layers.RadioTapMCS{
+			Known: layers.RadioTapMCSKnownBandwidth | layers.RadioTapMCSKnownMCSIndex | layers.RadioTapMCSKnownGuardInterval,
+			Flags: 1 | layers.RadioTapMCSFlagsShortGI,
+			MCS:   9,
+		},
+	})
+	if ht.Antenna == nil || *ht.Antenna != 1 || ht.Noise != -95 || ht.Snr != 55 ||
+		ht.Phy != "HT" || ht.Mcs == nil || *ht.Mcs != 9 || ht.Nss != 2 || ht.Bandwidth != 40 || !ht.ShortGi {
+		t.Errorf("HT: got %+v", ht)
+	}
+
+	vht := ParseRadioInfo(&layers.RadioTap{
+		Present: layers.RadioTapPresentVHT,
+		VHT: layers.RadioTapVHT{
+			Known:     layers.RadioTapVHTKnownBandwidth | layers.RadioTapVHTKnownGI,
+			Bandwidth: 4,
+			MCSNSS:    [4]layers.RadioTapVHTMCSNSS{0x72},
+		},
+	})
+	if vht.Antenna != nil || vht.Snr != 0 || vht.Phy != "VHT" || vht.Mcs == nil || *vht.Mcs != 7 ||
+		vht.Nss != 2 || vht.Bandwidth != 80 || vht.ShortGi {
+		t.Errorf("VHT: got %+v", vht)
+	}
+
+	legacy := ParseRadioInfo(&layers.RadioTap{
+		Present:      layers.RadioTapPresentRate | layers.RadioTapPresentChannel,
+		Rate:         11,
+		ChannelFlags: layers.RadioTapChannelFlagsGhz2 | layers.RadioTapChannelFlagsCCK,
+	})
+	if legacy.Rate != 5.5 || legacy.Phy != "" || legacy.Mcs != nil || legacy.ChannelFlags != "CCK,Ghz2" {
+		t.Errorf("legacy: got %+v", legacy)
+	}
+}
@@ -0,0 +1,258 @@
+package djijoe
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// delay before reloading after a file changed, to let its writer finish
+const RELOAD_SETTLE_DELAY = 500 * time.Millisecond
+
+// the IEEE registries all together weigh less than 10 MB
+const VENDORS_PUSH_MAX_SIZE = 32 << 20
+
+/*
+A validated set of vendors, with its lookup index. It is never modified once
+built: reloading builds a new one, which replaces the old one as a whole.
+*/
+type VendorSet struct {
+	Vendors  Vendors
+	Index    *VendorIndex
+	Source   string
+	LoadedAt time.Time
+}
+
+var EmptyVendorSetError = errors.New("No MAC address prefix in the vendor set")
+
+/*
+Builds a vendor set, refusing it if it is empty, or has a vendor without name
+or prefix. A prefix claimed by several vendors (e.g. by DJI-Joe's file and by
+the IEEE registry, under different names) goes to the first one, as when the
+engine starts.
+*/
+func NewVendorSet(vendors Vendors, source string) (*VendorSet, error) {
+	for _, vendor := range vendors {
+		if strings.TrimSpace(vendor.Name) == "" {
+			return nil, fmt.Errorf("%s: vendor without name", source)
+		}
+		if len(vendor.MacAddressPrefixes) == 0 {
+			return nil, fmt.Errorf("%s: vendor '%s' has no MAC address prefix", source, vendor.Name)
+		}
+	}
+
+	idx := vendors.Index()
+	if idx.NbPrefixes == 0 {
+		return nil, fmt.Errorf("%s: %v", source, EmptyVendorSetError)
+	}
+
+	return &VendorSet{
+		Vendors:  vendors,
+		Index:    idx,
+		Source:   source,
+		LoadedAt: time.Now(),
+	}, nil
+}
+
+/*
+Reloads the vendors of an engine when its vendor files change (inotify), when
+the process gets SIGHUP, when the vendor file published by the collector
+changed (polled), or when the collector pushes one (ServeHTTP).
+A new set replaces the current one only once fully loaded and validated: on
+error, the engine keeps flagging the previous vendors.
+*/
+type VendorReloader struct {
+	Engine *Engine
+	Files  []string
+	Filter VendorFilter
+	Log    Logger
+
+	// when set, the vendor file published by the collector is fetched every
+	// `PollInterval`
+	Collector    *Probe
+	PollInterval time.Duration
+
+	// the bearer token the collector pushes the vendor files with; pushing is
+	// refused without one
+	PushToken string
+
+	etag string
+}
+
+func NewVendorReloader(engine *Engine, files []string, filter VendorFilter, log Logger) *VendorReloader {
+	if log == nil {
+		log = NopLogger{}
+	}
+
+	return &VendorReloader{
+		Engine: engine,
+		Files:  files,
+		Filter: filter,
+		Log:    log,
+	}
+}
+
+func (r *VendorReloader) swap(vendors Vendors, source string) error {
+	set, err := NewVendorSet(vendors, source)
+	if err != nil {
+		r.Log.ErrorF("Refusing the new vendors: %+v", err)
+		return err
+	}
+
+	r.Engine.SetVendors(set)
+	return nil
+}
+
+/*
+Reloads the vendor files.
+*/
+func (r *VendorReloader) ReloadFiles(reason string) error {
+	r.Log.InfoF("Reloading %s (%s)", strings.Join(r.Files, ", "), reason)
+
+	vendors, err := LoadVendorsInfoFromFiles(r.Files, r.Filter, r.Log)
+	if err != nil {
+		r.Log.ErrorF("Failed to reload the vendors: %+v", err)
+		return err
+	}
+	return r.swap(vendors, strings.Join(r.Files, ","))
+}
+
+/*
+Loads the vendors from the content of a vendor file, e.g. sent by the collector.
+*/
+func (r *VendorReloader) ReloadData(data []byte, source string) error {
+	vendors, err := LoadVendorsInfoFromData(data, r.Filter, r.Log)
+	if err != nil {
+		r.Log.ErrorF("Failed to load the vendors from %s: %+v", source, err)
+		return err
+	}
+	return r.swap(vendors, source)
+}
+
+/*
+Fetches the vendor file published by the collector, and loads it if it changed.
+*/
+func (r *VendorReloader) PollCollector() error {
+	data, etag, err := r.Collector.FetchVendors(r.etag)
+	if err != nil {
+		r.Log.WarningF("Failed to fetch the vendors from the collector: %+v", err)
+		return err
+	}
+	if data == nil {
+		return nil
+	}
+
+	err = r.ReloadData(data, r.Collector.GetUrlTo(API_VENDORS))
+	if err != nil {
+		return err
+	}
+
+	// only remember the version once it was accepted, so a broken file is not
+	// skipped forever once fixed with the same ETag
+	r.etag = etag
+	return nil
+}
+
+/*
+Loads the vendor file pushed by the collector: `PUT` (or `POST`) with the file
+as body, and the header `Authorization: Bearer <PushToken>`. Answers
+`204 No Content` once the vendors are replaced, `422 Unprocessable Entity` if
+the file is refused.
+*/
+func (r *VendorReloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPut && req.Method != http.MethodPost {
+		w.Header().Set("Allow", "PUT, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if r.PushToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(r.PushToken)) != 1 {
+		r.Log.WarningF("Refusing the vendors pushed by %s: bad token", req.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, VENDORS_PUSH_MAX_SIZE))
+	if err != nil {
+		status := http.StatusBadRequest
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	err = r.ReloadData(data, "push from "+req.RemoteAddr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+Starts watching for reload triggers, until `ctx` is cancelled. Every signal
+received on `hup` (typically SIGHUP) reloads the files. The files are watched
+once Start() returns.
+*/
+func (r *VendorReloader) Start(ctx context.Context, hup <-chan os.Signal) error {
+	var watcher *fileWatcher
+	var err error
+
+	if len(r.Files) > 0 {
+		watcher, err = newFileWatcher(r.Files)
+		if err != nil {
+			return err
+		}
+	}
+
+	go r.watch(ctx, hup, watcher)
+	return nil
+}
+
+func (r *VendorReloader) watch(ctx context.Context, hup <-chan os.Signal, watcher *fileWatcher) {
+	var fileEvents <-chan struct{}
+	var pollTicks <-chan time.Time
+	var settle <-chan time.Time
+
+	if watcher != nil {
+		defer watcher.Close()
+		fileEvents = watcher.Events
+	}
+
+	if r.Collector != nil && r.PollInterval > 0 {
+		ticker := time.NewTicker(r.PollInterval)
+		defer ticker.Stop()
+		pollTicks = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case sig := <-hup:
+			r.ReloadFiles(fmt.Sprintf("got %v", sig))
+
+		case <-fileEvents:
+			// editors often write files in several steps
+			settle = time.After(RELOAD_SETTLE_DELAY)
+
+		case <-settle:
+			settle = nil
+			r.ReloadFiles("file changed")
+
+		case <-pollTicks:
+			r.PollCollector()
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package djijoe
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+/*
+Runs a DJI beacon through the engine, and returns the vendor that flagged it.
+*/
+func flaggedVendor(t *testing.T, engine *Engine) string {
+	frame := buildFrame(t, time.Now(), -40, 2437,
+		&layers.Dot11{
+			Type:     layers.Dot11TypeMgmtBeacon,
+			Address1: mustParseMAC(t, "ff:ff:ff:ff:ff:ff"),
+			Address2: mustParseMAC(t, "60:60:1f:00:00:01"),
+			Address3: mustParseMAC(t, "60:60:1f:00:00:01"),
+		},
+		&layers.Dot11MgmtBeacon{Interval: 100})
+
+	packet := gopacket.NewPacket(frame.Data, layers.LayerTypeRadioTap, gopacket.Default)
+	dot11 := packet.Layer(layers.LayerTypeDot11).(*layers.Dot11)
+	_, vendor := engine.isFlaggedMac(dot11.Address2)
+	return vendor
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewVendorSet(t *testing.T) {
+	dji, _ := ParseMacPrefix("60601f")
+	djiLonger, _ := ParseMacPrefix("60601f4")
+
+	tests := []struct {
+		name    string
+		vendors Vendors
+		fails   bool
+	}{
+		{"valid", Vendors{{Name: "DJI", MacAddressPrefixes: []MacPrefix{dji, djiLonger}}}, false},
+		{"empty", Vendors{}, true},
+		{"no prefix", Vendors{{Name: "DJI"}}, true},
+		{"no name", Vendors{{Name: " ", MacAddressPrefixes: []MacPrefix{dji}}}, true},
+		// the first vendor wins
+		{"conflict", Vendors{
+			{Name: "DJI", MacAddressPrefixes: []MacPrefix{dji, djiLonger}},
+			{Name: "Other", MacAddressPrefixes: []MacPrefix{dji}},
+		}, false},
+	}
+
+	for _, test := range tests {
+		set, err := NewVendorSet(test.vendors, test.name)
+		if (err != nil) != test.fails {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+		if err != nil {
+			continue
+		}
+		if set.Index.NbPrefixes != 2 {
+			t.Errorf("%s: %d prefixes indexed", test.name, set.Index.NbPrefixes)
+		}
+		if vendor, _ := set.Index.Lookup(mustParseMAC(t, "60:60:1f:00:00:01")); vendor.Name != "DJI" {
+			t.Errorf("%s: flagged by %s", test.name, vendor.Name)
+		}
+	}
+}
+
+func TestVendorReloaderReloadsStartupFiles(t *testing.T) {
+	// the setup of the README: DJI-Joe's file, then the IEEE registry which
+	// names DJI differently
+	ieee := writeTempFile(t, "oui.csv", "Registry,Assignment,Organization Name,Organization Address\n"+
+		"MA-L,60601F,\"SZ DJI TECHNOLOGY CO.,LTD\",\"2F,Education Building,Hong Kong Shenzhen CN 518057 \"\n"+
+		"MA-L,903AE6,PARROT SA,174 Quai de Jemmapes Paris  FR 75010 \n")
+	files := []string{"../../misc/oui.csv", ieee}
+	filter := VendorFilter{"DJI", "Parrot"}
+
+	vendors, err := LoadVendorsInfoFromFiles(files, filter, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := NewEngine(NewSliceSource(layers.LinkTypeIEEE80211Radio, nil), Config{Vendors: vendors})
+	before := flaggedVendor(t, engine)
+	nbPrefixes := engine.Vendors().Index.NbPrefixes
+
+	reloader := NewVendorReloader(engine, files, filter, nil)
+	if err := reloader.ReloadFiles("test"); err != nil {
+		t.Fatalf("ReloadFiles: %v", err)
+	}
+	if after := flaggedVendor(t, engine); after != before || after != "SZ DJI Technology Co.,Ltd" {
+		t.Errorf("flagged by %q after the reload, by %q before", after, before)
+	}
+	if engine.Vendors().Index.NbPrefixes != nbPrefixes || engine.Vendors().Source != strings.Join(files, ",") {
+		t.Errorf("reloaded %d prefixes from %s, started with %d", engine.Vendors().Index.NbPrefixes, engine.Vendors().Source, nbPrefixes)
+	}
+}
+
+func TestVendorReloaderKeepsOldSetOnError(t *testing.T) {
+	path := writeTempFile(t, "oui.csv", "DJI;60601f;\n")
+	vendors, err := LoadVendorsInfoFromFile(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	engine := NewEngine(NewSliceSource(layers.LinkTypeIEEE80211Radio, nil), Config{Vendors: vendors})
+	reloader := NewVendorReloader(engine, []string{path}, nil, nil)
+
+	if err := reloader.ReloadData([]byte("DJI;60601e;\n"), "test"); err != nil {
+		t.Fatalf("ReloadData: %v", err)
+	}
+	if vendor := flaggedVendor(t, engine); vendor != "" {
+		t.Errorf("still flagged by %q after the reload", vendor)
+	}
+
+	for _, invalid := range []string{"", "# nothing\n", "DJI;\"60601f;\n"} {
+		if err := reloader.ReloadData([]byte(invalid), "test"); err == nil {
+			t.Errorf("accepted %q", invalid)
+		}
+	}
+
+	os.Remove(path)
+	if err := reloader.ReloadFiles("test"); err == nil {
+		t.Errorf("reloaded a missing file")
+	}
+
+	if engine.Vendors().Index.NbPrefixes != 1 || engine.Vendors().Vendors[0].MacAddressPrefixes[0].Hex() != "60601e" {
+		t.Errorf("the previous vendors were not kept: %v", engine.Vendors().Vendors)
+	}
+}
+
+func TestVendorReloaderPush(t *testing.T) {
+	vendors, err := LoadVendorsInfoFromData([]byte("Parrot SA;903ae6;\n"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := NewEngine(NewSliceSource(layers.LinkTypeIEEE80211Radio, nil), Config{Vendors: vendors})
+	reloader := NewVendorReloader(engine, nil, nil, nil)
+	reloader.PushToken = "secret"
+
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		body   string
+		status int
+		vendor string
+	}{
+		{"get", http.MethodGet, "secret", "", http.StatusMethodNotAllowed, ""},
+		{"no token", http.MethodPut, "", "DJI;60601f;\n", http.StatusUnauthorized, ""},
+		{"bad token", http.MethodPut, "wrong", "DJI;60601f;\n", http.StatusUnauthorized, ""},
+		{"empty file", http.MethodPut, "secret", "# nothing\n", http.StatusUnprocessableEntity, ""},
+		{"valid file", http.MethodPut, "secret", "DJI pushed;60601f;\n", http.StatusNoContent, "DJI pushed"},
+		{"post", http.MethodPost, "secret", "DJI posted;60601f;\n", http.StatusNoContent, "DJI posted"},
+		// the pushed vendors stay
+		{"broken file", http.MethodPut, "secret", "DJI;\"60601f;\n", http.StatusUnprocessableEntity, "DJI posted"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "/api/vendors", strings.NewReader(test.body))
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		reloader.ServeHTTP(w, req)
+
+		if w.Code != test.status {
+			t.Errorf("%s: status %d, expected %d", test.name, w.Code, test.status)
+		}
+		if vendor := flaggedVendor(t, engine); vendor != test.vendor {
+			t.Errorf("%s: flagged by %q, expected %q", test.name, vendor, test.vendor)
+		}
+	}
+
+	// no token, no push
+	reloader.PushToken = ""
+	req := httptest.NewRequest(http.MethodPut, "/api/vendors", strings.NewReader("DJI;60601f;\n"))
+	req.Header.Set("Authorization", "Bearer ")
+	w := httptest.NewRecorder()
+	reloader.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("without a token: status %d", w.Code)
+	}
+}
+
+func TestVendorReloaderRun(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "oui.csv")
+	if err := ioutil.WriteFile(path, []byte("Parrot SA;903ae6;\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	vendors, _ := LoadVendorsInfoFromFile(path, nil)
+
+	// collector publishing its own vendor file
+	var mu sync.Mutex
+	published := ""
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, req.Header.Get("If-None-Match"))
+
+		switch {
+		case req.URL.Path != API_VENDORS:
+			w.WriteHeader(http.StatusNotFound)
+		case published == "":
+			w.WriteHeader(http.StatusNoContent)
+		case req.Header.Get("If-None-Match") == "\"v1\"":
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.Header().Set("ETag", "\"v1\"")
+			w.Write([]byte(published))
+		}
+	}))
+	defer server.Close()
+
+	engine := NewEngine(NewSliceSource(layers.LinkTypeIEEE80211Radio, nil), Config{Vendors: vendors})
+	reloader := NewVendorReloader(engine, []string{path}, nil, nil)
+	reloader.Collector = NewProbe(NopLogger{})
+	reloader.Collector.SetApiEndpoint(server.URL)
+	reloader.PollInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hup := make(chan os.Signal, 1)
+	if err := reloader.Start(ctx, hup); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	if vendor := flaggedVendor(t, engine); vendor != "" {
+		t.Fatalf("flagged by %q before any reload", vendor)
+	}
+
+	// the file is replaced, as an editor would do
+	tmp := filepath.Join(dir, ".oui.csv.swp")
+	ioutil.WriteFile(tmp, []byte("DJI from file;60601f;\n"), 0644)
+	os.Rename(tmp, path)
+	waitFor(t, "the file reload", func() bool { return flaggedVendor(t, engine) == "DJI from file" })
+
+	// SIGHUP, while the file is still being written (so before inotify notices)
+	ioutil.WriteFile(filepath.Join(dir, "unrelated"), []byte("x"), 0644)
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0644)
+	f.WriteString("DJI after HUP;60601f;\n")
+	hup <- syscall.SIGHUP
+	waitFor(t, "the SIGHUP reload", func() bool { return flaggedVendor(t, engine) == "DJI after HUP" })
+	f.Close()
+
+	// let the reload triggered by the close settle
+	time.Sleep(RELOAD_SETTLE_DELAY + 100*time.Millisecond)
+
+	// the collector publishes a new vendor file
+	mu.Lock()
+	published = "DJI from collector;60601f;\n"
+	mu.Unlock()
+	waitFor(t, "the collector poll", func() bool { return flaggedVendor(t, engine) == "DJI from collector" })
+
+	// once accepted, the collector's version is not fetched again
+	waitFor(t, "a conditional request", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests[len(requests)-1] == "\"v1\""
+	})
+}
@@ -0,0 +1,209 @@
+package djijoe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// ASTM F3411 Remote ID, broadcast over Wi-Fi beacons (vendor specific IE)
+var REMOTEID_OUI = []byte{0xfa, 0x0b, 0xbc}
+
+const (
+	REMOTEID_OUI_TYPE = 0x0d
+
+	REMOTEID_PROTOCOL_VERSION = 2
+	REMOTEID_MESSAGE_SIZE     = 25
+
+	REMOTEID_MSG_BASIC_ID = 0x0
+	REMOTEID_MSG_LOCATION = 0x1
+	REMOTEID_MSG_PACK     = 0xf
+
+	REMOTEID_ID_TYPE_SERIAL     = 1
+	REMOTEID_UA_TYPE_ROTORCRAFT = 2
+
+	REMOTEID_STATUS_AIRBORNE = 2
+)
+
+/*
+What a drone broadcasts over Remote ID: its serial number and where it is.
+*/
+type RemoteId struct {
+	SerialNumber  string    `json:"serial,omitempty"`
+	Latitude      float64   `json:"latitude"`
+	Longitude     float64   `json:"longitude"`
+	Altitude      float64   `json:"altitude"`       // meters, geodetic
+	Height        float64   `json:"height"`         // meters, above the take-off point
+	Direction     float64   `json:"direction"`      // degrees, clockwise from the true north
+	Speed         float64   `json:"speed"`          // m/s, horizontal
+	VerticalSpeed float64   `json:"vertical_speed"` // m/s, positive upwards
+	Timestamp     time.Time `json:"ts"`
+}
+
+func remoteIdHeader(messageType byte) byte {
+	return messageType<<4 | REMOTEID_PROTOCOL_VERSION
+}
+
+func (r *RemoteId) basicIdMessage() []byte {
+	msg := make([]byte, REMOTEID_MESSAGE_SIZE)
+	msg[0] = remoteIdHeader(REMOTEID_MSG_BASIC_ID)
+	msg[1] = REMOTEID_ID_TYPE_SERIAL<<4 | REMOTEID_UA_TYPE_ROTORCRAFT
+	copy(msg[2:22], r.SerialNumber)
+	return msg
+}
+
+/*
+Encodes an altitude with a 0.5 m resolution, offset by -1000 m.
+*/
+func encodeRemoteIdAltitude(altitude float64) uint16 {
+	return uint16(math.Round((altitude + 1000) / 0.5))
+}
+
+func (r *RemoteId) locationMessage() []byte {
+	msg := make([]byte, REMOTEID_MESSAGE_SIZE)
+	msg[0] = remoteIdHeader(REMOTEID_MSG_LOCATION)
+
+	// the direction fits a byte by moving the east/west half in the flags
+	flags := byte(REMOTEID_STATUS_AIRBORNE << 4)
+	direction := math.Mod(r.Direction+360, 360)
+	if direction >= 180 {
+		flags |= 1 << 1
+		direction -= 180
+	}
+
+	// 0.25 m/s steps up to 63.75 m/s, then 0.75 m/s steps
+	var speed float64
+	if r.Speed <= 63.75 {
+		speed = r.Speed / 0.25
+	} else {
+		flags |= 1
+		speed = math.Min((r.Speed-63.75)/0.75, 254)
+	}
+
+	msg[1] = flags
+	msg[2] = byte(math.Round(direction))
+	msg[3] = byte(math.Round(speed))
+	msg[4] = byte(int8(math.Round(math.Max(math.Min(r.VerticalSpeed/0.5, 126), -126))))
+	binary.LittleEndian.PutUint32(msg[5:], uint32(int32(math.Round(r.Latitude*1e7))))
+	binary.LittleEndian.PutUint32(msg[9:], uint32(int32(math.Round(r.Longitude*1e7))))
+	binary.LittleEndian.PutUint16(msg[13:], encodeRemoteIdAltitude(r.Altitude))
+	binary.LittleEndian.PutUint16(msg[15:], encodeRemoteIdAltitude(r.Altitude))
+	binary.LittleEndian.PutUint16(msg[17:], encodeRemoteIdAltitude(r.Height))
+
+	// tenths of second since the start of the hour
+	hour := r.Timestamp.Truncate(time.Hour)
+	binary.LittleEndian.PutUint16(msg[21:], uint16(r.Timestamp.Sub(hour)/(100*time.Millisecond)))
+	return msg
+}
+
+/*
+Builds the vendor specific IE carrying a message pack with the Basic ID and the
+Location messages. `counter` is incremented by the sender for each new frame.
+*/
+func (r *RemoteId) InformationElement(counter uint8) *layers.Dot11InformationElement {
+	messages := [][]byte{r.basicIdMessage(), r.locationMessage()}
+
+	info := append([]byte{}, REMOTEID_OUI...)
+	info = append(info, REMOTEID_OUI_TYPE, counter)
+	info = append(info, remoteIdHeader(REMOTEID_MSG_PACK), REMOTEID_MESSAGE_SIZE, byte(len(messages)))
+	for _, msg := range messages {
+		info = append(info, msg...)
+	}
+
+	return &layers.Dot11InformationElement{
+		ID:     layers.Dot11InformationElementIDVendor,
+		Length: uint8(len(info)),
+		Info:   info,
+	}
+}
+
+func decodeRemoteIdAltitude(data []byte) float64 {
+	return float64(binary.LittleEndian.Uint16(data))*0.5 - 1000
+}
+
+func (r *RemoteId) parseLocationMessage(msg []byte, ts time.Time) {
+	flags := msg[1]
+
+	r.Direction = float64(msg[2])
+	if flags&(1<<1) != 0 {
+		r.Direction += 180
+	}
+	if flags&1 != 0 {
+		r.Speed = float64(msg[3])*0.75 + 63.75
+	} else {
+		r.Speed = float64(msg[3]) * 0.25
+	}
+	r.VerticalSpeed = float64(int8(msg[4])) * 0.5
+	r.Latitude = float64(int32(binary.LittleEndian.Uint32(msg[5:]))) / 1e7
+	r.Longitude = float64(int32(binary.LittleEndian.Uint32(msg[9:]))) / 1e7
+	r.Altitude = decodeRemoteIdAltitude(msg[15:])
+	r.Height = decodeRemoteIdAltitude(msg[17:])
+
+	// the closest time to `ts` with these tenths of second past the hour
+	hour := ts.Truncate(time.Hour)
+	r.Timestamp = hour.Add(time.Duration(binary.LittleEndian.Uint16(msg[21:])) * 100 * time.Millisecond)
+	if r.Timestamp.Sub(ts) > 30*time.Minute {
+		r.Timestamp = r.Timestamp.Add(-time.Hour)
+	} else if ts.Sub(r.Timestamp) > 30*time.Minute {
+		r.Timestamp = r.Timestamp.Add(time.Hour)
+	}
+}
+
+/*
+Decodes the Remote ID of a vendor specific IE (its OUI, type and counter, then
+a message pack or a single message), received at `ts`. Returns nil if it is
+not a Remote ID or does not locate the drone.
+*/
+func ParseRemoteId(info []byte, ts time.Time) *RemoteId {
+	if len(info) < 5 || !bytes.Equal(info[:3], REMOTEID_OUI) || info[3] != REMOTEID_OUI_TYPE {
+		return nil
+	}
+
+	messages := info[5:]
+	if len(messages) >= 3 && messages[0]>>4 == REMOTEID_MSG_PACK {
+		if messages[1] != REMOTEID_MESSAGE_SIZE || len(messages) < 3+int(messages[2])*REMOTEID_MESSAGE_SIZE {
+			return nil
+		}
+		messages = messages[3 : 3+int(messages[2])*REMOTEID_MESSAGE_SIZE]
+	}
+
+	var r RemoteId
+	located := false
+	for len(messages) >= REMOTEID_MESSAGE_SIZE {
+		msg := messages[:REMOTEID_MESSAGE_SIZE]
+		messages = messages[REMOTEID_MESSAGE_SIZE:]
+
+		switch msg[0] >> 4 {
+		case REMOTEID_MSG_BASIC_ID:
+			r.SerialNumber = string(bytes.TrimRight(msg[2:22], "\x00 "))
+		case REMOTEID_MSG_LOCATION:
+			r.parseLocationMessage(msg, ts)
+			located = r.Latitude != 0 || r.Longitude != 0
+		}
+	}
+
+	if !located {
+		return nil
+	}
+	return &r
+}
+
+/*
+Returns the Remote ID broadcast in a management frame received at `ts`, if
+any.
+*/
+func ParseRemoteIdElement(packet gopacket.Packet, ts time.Time) *RemoteId {
+	for _, ie := range managementInformationElements(packet) {
+		if ie.ID != layers.Dot11InformationElementIDVendor {
+			continue
+		}
+		if r := ParseRemoteId(ie.Info, ts); r != nil {
+			return r
+		}
+	}
+	return nil
+}
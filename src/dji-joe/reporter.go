@@ -0,0 +1,230 @@
+package djijoe
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const REPORTER_HTTP_TIMEOUT = 10 * time.Second
+
+/*
+Where a probe reports its events: its start and its end, its heartbeats, and
+its detections.
+*/
+type Reporter interface {
+	Wakeup(msg WakeUpMessage) error
+	Heartbeat(msg HeartBeatMessage) error
+	Detection(info DroneInfoMessage) error
+	Shutdown(msg ShutdownMessage) error
+}
+
+/*
+Reports the events to all its reporters, even if some of them fail.
+*/
+type FanoutReporter []Reporter
+
+type reporterErrors []error
+
+func (errs reporterErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (f FanoutReporter) each(send func(r Reporter) error) error {
+	var errs reporterErrors
+	for _, r := range f {
+		if err := send(r); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	return errs
+}
+
+func (f FanoutReporter) Wakeup(msg WakeUpMessage) error {
+	return f.each(func(r Reporter) error { return r.Wakeup(msg) })
+}
+
+func (f FanoutReporter) Heartbeat(msg HeartBeatMessage) error {
+	return f.each(func(r Reporter) error { return r.Heartbeat(msg) })
+}
+
+func (f FanoutReporter) Detection(info DroneInfoMessage) error {
+	return f.each(func(r Reporter) error { return r.Detection(info) })
+}
+
+func (f FanoutReporter) Shutdown(msg ShutdownMessage) error {
+	return f.each(func(r Reporter) error { return r.Shutdown(msg) })
+}
+
+/*
+Posts the events to the API server (DJI-Jane). It disables itself after a
+failure to reach the server, and then drops the events.
+*/
+type HttpReporter struct {
+	Endpoint url.URL
+	Client   *http.Client
+	Log      Logger
+
+	disabled int32
+}
+
+func NewHttpReporter(endpoint url.URL, log Logger) *HttpReporter {
+	if log == nil {
+		log = NopLogger{}
+	}
+
+	var httpTransport = &http.Transport{
+		MaxIdleConns:       10,
+		IdleConnTimeout:    30 * time.Second,
+		DisableCompression: true,
+	}
+
+	return &HttpReporter{
+		Endpoint: endpoint,
+		Client:   &http.Client{Timeout: REPORTER_HTTP_TIMEOUT, Transport: httpTransport},
+		Log:      log,
+	}
+}
+
+func (h *HttpReporter) Enabled() bool {
+	return atomic.LoadInt32(&h.disabled) == 0
+}
+
+/*
+Posts `msg` to `path`, and checks the server answered with `status`.
+*/
+func (h *HttpReporter) post(path string, msg interface{}, status int) error {
+	if !h.Enabled() {
+		return nil
+	}
+
+	jsonValue, err := json.Marshal(msg)
+	if err != nil {
+		h.Log.ErrorF("%s: JSON Marshalling failed: %+v", path, err)
+		return err
+	}
+
+	Url := fmt.Sprintf("%s://%s%s", h.Endpoint.Scheme, h.Endpoint.Host, path)
+	resp, err := h.Client.Post(Url, "application/json", bytes.NewBuffer(jsonValue))
+	if err != nil {
+		h.Log.ErrorF("%s HTTP POST failed: %+v", path, err)
+		atomic.StoreInt32(&h.disabled, 1)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != status {
+		h.Log.ErrorF("Unexpected response: got %d , expected %d", resp.StatusCode, status)
+		return fmt.Errorf("unexpected response to POST %s: %s", path, resp.Status)
+	}
+	return nil
+}
+
+func (h *HttpReporter) Wakeup(msg WakeUpMessage) error {
+	return h.post(API_WAKEUP, msg, http.StatusNoContent)
+}
+
+func (h *HttpReporter) Heartbeat(msg HeartBeatMessage) error {
+	return h.post(API_HEARTBEAT, msg, http.StatusNoContent)
+}
+
+func (h *HttpReporter) Detection(info DroneInfoMessage) error {
+	return h.post(API_NEWDRONEINFO, info, http.StatusAccepted)
+}
+
+func (h *HttpReporter) Shutdown(msg ShutdownMessage) error {
+	return h.post(API_SHUTDOWN, msg, http.StatusNoContent)
+}
+
+/*
+Appends the events to a file, one JSON object per line, with their kind in
+"event" (e.g. {"event":"detection","ts":...}).
+*/
+type FileReporter struct {
+	out    io.Writer
+	closer io.Closer
+	lock   sync.Mutex
+}
+
+/*
+Opens a file to append the events to, or stdout for "-".
+*/
+func NewFileReporter(path string) (*FileReporter, error) {
+	if path == "-" {
+		return &FileReporter{out: os.Stdout}, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileReporter{out: file, closer: file}, nil
+}
+
+func NewWriterReporter(out io.Writer) *FileReporter {
+	return &FileReporter{out: out}
+}
+
+func (f *FileReporter) write(event string, msg interface{}) error {
+	jsonValue, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	line := make([]byte, 0, len(jsonValue)+len(event)+16)
+	line = append(line, `{"event":"`...)
+	line = append(line, event...)
+	line = append(line, '"')
+	if len(jsonValue) > 2 {
+		line = append(line, ',')
+	}
+	line = append(line, jsonValue[1:]...)
+	line = append(line, '\n')
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	_, err = f.out.Write(line)
+	return err
+}
+
+func (f *FileReporter) Wakeup(msg WakeUpMessage) error {
+	return f.write("wakeup", msg)
+}
+
+func (f *FileReporter) Heartbeat(msg HeartBeatMessage) error {
+	return f.write("heartbeat", msg)
+}
+
+func (f *FileReporter) Detection(info DroneInfoMessage) error {
+	return f.write("detection", info)
+}
+
+func (f *FileReporter) Shutdown(msg ShutdownMessage) error {
+	return f.write("shutdown", msg)
+}
+
+func (f *FileReporter) Close() error {
+	if f.closer == nil {
+		return nil
+	}
+	return f.closer.Close()
+}
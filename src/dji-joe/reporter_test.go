@@ -0,0 +1,151 @@
+package djijoe
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+Reporter recording the kinds of the events, failing with `err` if set.
+*/
+type recordingReporter struct {
+	err error
+
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *recordingReporter) record(event string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+	return r.err
+}
+
+func (r *recordingReporter) Events() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.events...)
+}
+
+func (r *recordingReporter) Wakeup(msg WakeUpMessage) error        { return r.record("wakeup") }
+func (r *recordingReporter) Heartbeat(msg HeartBeatMessage) error  { return r.record("heartbeat") }
+func (r *recordingReporter) Detection(info DroneInfoMessage) error { return r.record("detection") }
+func (r *recordingReporter) Shutdown(msg ShutdownMessage) error    { return r.record("shutdown") }
+
+func TestFanoutReporter(t *testing.T) {
+	first := &recordingReporter{err: errors.New("first failed")}
+	second := &recordingReporter{}
+	third := &recordingReporter{err: errors.New("third failed")}
+
+	if err := (FanoutReporter{first, second}).Detection(DroneInfoMessage{}); err == nil || err.Error() != "first failed" {
+		t.Errorf("one failure: got %v", err)
+	}
+	// a failure does not stop the other reporters
+	err := FanoutReporter{first, second, third}.Wakeup(WakeUpMessage{})
+	if err == nil || err.Error() != "first failed; third failed" {
+		t.Errorf("two failures: got %v", err)
+	}
+	if err := (FanoutReporter{second}).Shutdown(ShutdownMessage{}); err != nil {
+		t.Errorf("no failure: got %v", err)
+	}
+	if err := (FanoutReporter{}).Heartbeat(HeartBeatMessage{}); err != nil {
+		t.Errorf("no reporter: got %v", err)
+	}
+
+	if events := strings.Join(second.Events(), ","); events != "detection,wakeup,shutdown" {
+		t.Errorf("got events %s", events)
+	}
+}
+
+func TestProbeReporters(t *testing.T) {
+	server := newApiRecorder(t)
+	first, second := &recordingReporter{}, &recordingReporter{}
+
+	p := NewProbe(NopLogger{})
+	p.Reporters = FanoutReporter{first}
+	p.SetApiEndpoint(server.URL)
+	// replaces the previous API server
+	p.SetApiEndpoint(server.URL)
+	p.Reporters = append(p.Reporters, second)
+
+	p.Wakeup()
+	if err := p.ProcessFlaggedPacket(DroneInfoMessage{}); err != nil {
+		t.Errorf("ProcessFlaggedPacket: %v", err)
+	}
+	p.Shutdown()
+
+	for _, r := range []*recordingReporter{first, second} {
+		if events := strings.Join(r.Events(), ","); events != "wakeup,detection,shutdown" {
+			t.Errorf("got events %s", events)
+		}
+	}
+	for _, path := range []string{API_WAKEUP, API_NEWDRONEINFO, API_SHUTDOWN} {
+		if payloads := server.Payloads(path); len(payloads) != 1 {
+			t.Errorf("got %d %s payloads, expected 1", len(payloads), path)
+		}
+	}
+	if len(p.Reporters) != 3 || !p.ApiEnabled() {
+		t.Errorf("got %d reporters", len(p.Reporters))
+	}
+}
+
+func TestFileReporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// appended to what the file already holds
+	if err := ioutil.WriteFile(path, []byte(`{"event":"shutdown"}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewFileReporter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Wakeup(WakeUpMessage{Timestamp: ts, Hostname: "probe-1"})
+	r.Heartbeat(HeartBeatMessage{Timestamp: ts, Hostname: "probe-1"})
+	r.Detection(DroneInfoMessage{Timestamp: ts, Hostname: "probe-1", Vendor: "DJI", SignalStrength: -42})
+	r.Shutdown(ShutdownMessage{Timestamp: ts, Hostname: "probe-1", ProbeRequestFound: 2})
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	expected := []string{"shutdown", "wakeup", "heartbeat", "detection", "shutdown"}
+	if len(lines) != len(expected) {
+		t.Fatalf("got %d lines: %s", len(lines), data)
+	}
+	for i, line := range lines {
+		obj := decodeObject(t, []byte(line))
+		if obj["event"] != expected[i] {
+			t.Errorf("line %d: got event %v, expected %s", i, obj["event"], expected[i])
+		}
+		if i > 0 && (obj["host"] != "probe-1" || obj["ts"] != "2020-01-02T03:04:05Z") {
+			t.Errorf("line %d: %s", i, line)
+		}
+	}
+	if obj := decodeObject(t, []byte(lines[3])); obj["vendor"] != "DJI" || obj["strength"] != float64(-42) {
+		t.Errorf("detection: %s", lines[3])
+	}
+}
+
+func TestWriterReporterEmptyMessage(t *testing.T) {
+	var buffer bytes.Buffer
+	r := NewWriterReporter(&buffer)
+	if err := r.write("test", struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if buffer.String() != `{"event":"test"}`+"\n" {
+		t.Errorf("got %q", buffer.String())
+	}
+}
@@ -0,0 +1,210 @@
+package djijoe
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+)
+
+const SNAPLEN int = 1600
+
+/*
+Where the engine reads its frames from.
+*/
+type PacketSource interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+	Close()
+}
+
+/*
+Implemented by the sources able to send frames over the air.
+*/
+type PacketInjector interface {
+	WritePacketData(data []byte) error
+}
+
+var InjectionNotSupportedError = errors.New("The packet source does not support injection")
+
+/*
+Live capture (or offline read) using libpcap.
+*/
+type PcapSource struct {
+	*pcap.Handle
+}
+
+/*
+Open `ifaceName` for a live capture with libpcap. The interface is expected to
+be in Monitor mode already.
+*/
+func OpenLiveSource(ifaceName string) (*PcapSource, error) {
+	inactive, err := pcap.NewInactiveHandle(ifaceName)
+	if err != nil {
+		return nil, err
+	}
+	defer inactive.CleanUp()
+
+	inactive.SetSnapLen(SNAPLEN)
+	inactive.SetImmediateMode(true)
+	inactive.SetPromisc(true)
+
+	handle, err := inactive.Activate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &PcapSource{handle}, nil
+}
+
+/*
+Returns the statistics of libpcap: frames received, and dropped because the
+buffer was full, or by the interface.
+*/
+func (s *PcapSource) CaptureStats() (CaptureStats, error) {
+	stats, err := s.Handle.Stats()
+	if err != nil {
+		return CaptureStats{}, err
+	}
+
+	return CaptureStats{
+		Received: uint64(stats.PacketsReceived),
+		Dropped:  uint64(stats.PacketsDropped + stats.PacketsIfDropped),
+	}, nil
+}
+
+func (s *PcapSource) SetFilter(expr string) error {
+	return s.Handle.SetBPFFilter(expr)
+}
+
+/*
+Open a PCAP or PCAPNG file with libpcap.
+*/
+func OpenPcapOfflineSource(filePath string) (*PcapSource, error) {
+	handle, err := pcap.OpenOffline(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PcapSource{handle}, nil
+}
+
+/*
+Reads a PCAP or PCAPNG file without relying on libpcap.
+*/
+type FileSource struct {
+	file     *os.File
+	reader   gopacket.PacketDataSource
+	linkType layers.LinkType
+}
+
+/*
+Open a PCAP or PCAPNG file, the format being guessed from its magic.
+*/
+func OpenFileSource(filePath string) (*FileSource, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	buffered := bufio.NewReader(file)
+	magic, err := buffered.Peek(4)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	src := &FileSource{file: file}
+
+	if magic[0] == 0x0a && magic[1] == 0x0d && magic[2] == 0x0d && magic[3] == 0x0a {
+		reader, err := pcapgo.NewNgReader(buffered, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		src.reader = reader
+		src.linkType = reader.LinkType()
+	} else {
+		reader, err := pcapgo.NewReader(buffered)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		src.reader = reader
+		src.linkType = reader.LinkType()
+	}
+
+	return src, nil
+}
+
+func (s *FileSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return s.reader.ReadPacketData()
+}
+
+func (s *FileSource) LinkType() layers.LinkType {
+	return s.linkType
+}
+
+func (s *FileSource) Close() {
+	s.file.Close()
+}
+
+/*
+A captured frame, as stored by `SliceSource`.
+*/
+type RawPacket struct {
+	Data        []byte
+	CaptureInfo gopacket.CaptureInfo
+}
+
+/*
+Serves frames from memory, for instance to inject a synthetic stream into the
+engine. Frames written to it (i.e. DeAuth) are kept in `Written`.
+*/
+type SliceSource struct {
+	Packets  []RawPacket
+	Written  [][]byte
+	linkType layers.LinkType
+	idx      int
+}
+
+func NewSliceSource(linkType layers.LinkType, packets []RawPacket) *SliceSource {
+	return &SliceSource{
+		Packets:  packets,
+		linkType: linkType,
+	}
+}
+
+func (s *SliceSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if s.idx >= len(s.Packets) {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+
+	packet := s.Packets[s.idx]
+	s.idx++
+
+	ci := packet.CaptureInfo
+	if ci.CaptureLength == 0 {
+		ci.CaptureLength = len(packet.Data)
+	}
+	if ci.Length == 0 {
+		ci.Length = len(packet.Data)
+	}
+	return packet.Data, ci, nil
+}
+
+func (s *SliceSource) WritePacketData(data []byte) error {
+	s.Written = append(s.Written, append([]byte(nil), data...))
+	return nil
+}
+
+func (s *SliceSource) LinkType() layers.LinkType {
+	return s.linkType
+}
+
+func (s *SliceSource) Close() {}
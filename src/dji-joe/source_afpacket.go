@@ -0,0 +1,84 @@
+// +build linux
+
+package djijoe
+
+import (
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+)
+
+const (
+	AFPACKET_FRAME_SIZE = 2048
+	AFPACKET_BLOCK_SIZE = AFPACKET_FRAME_SIZE * 128
+	AFPACKET_NB_BLOCKS  = 64
+)
+
+/*
+Live capture using an AF_PACKET socket with a TPACKET_V3 memory-mapped ring,
+bypassing libpcap.
+*/
+type AfpacketSource struct {
+	*afpacket.TPacket
+}
+
+/*
+Open `ifaceName` for a live capture over AF_PACKET. The interface is expected to
+be in Monitor mode already, so the frames are prefixed by a RadioTap header.
+*/
+func OpenAfpacketSource(ifaceName string) (*AfpacketSource, error) {
+	tpacket, err := afpacket.NewTPacket(
+		afpacket.OptInterface(ifaceName),
+		afpacket.OptTPacketVersion(afpacket.TPacketVersion3),
+		afpacket.OptFrameSize(AFPACKET_FRAME_SIZE),
+		afpacket.OptBlockSize(AFPACKET_BLOCK_SIZE),
+		afpacket.OptNumBlocks(AFPACKET_NB_BLOCKS),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AfpacketSource{tpacket}, nil
+}
+
+func (s *AfpacketSource) LinkType() layers.LinkType {
+	return layers.LinkTypeIEEE80211Radio
+}
+
+/*
+Returns the statistics of the socket: frames received, and dropped because the
+ring was full.
+*/
+func (s *AfpacketSource) CaptureStats() (CaptureStats, error) {
+	_, stats, err := s.TPacket.SocketStats()
+	if err != nil {
+		return CaptureStats{}, err
+	}
+
+	return CaptureStats{
+		Received: uint64(stats.Packets()),
+		Dropped:  uint64(stats.Drops()),
+	}, nil
+}
+
+/*
+Compiles `expr` with libpcap, and attaches it to the socket.
+*/
+func (s *AfpacketSource) SetFilter(expr string) error {
+	instructions, err := pcap.CompileBPFFilter(s.LinkType(), AFPACKET_FRAME_SIZE, expr)
+	if err != nil {
+		return err
+	}
+
+	program := make([]bpf.RawInstruction, len(instructions))
+	for i, instruction := range instructions {
+		program[i] = bpf.RawInstruction{
+			Op: instruction.Code,
+			Jt: instruction.Jt,
+			Jf: instruction.Jf,
+			K:  instruction.K,
+		}
+	}
+	return s.TPacket.SetBPF(program)
+}
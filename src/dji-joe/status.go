@@ -0,0 +1,252 @@
+package djijoe
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// number of detections kept for the status API
+	STATUS_RECENT_DETECTIONS = 200
+	// a device is live on the dashboard if seen less than this long ago
+	STATUS_LIVE_DELAY = 5 * time.Minute
+)
+
+/*
+Records a detection for the status API: the device table only holds what the
+flagged devices sent, not the frames they received. Returns when the device
+was first seen, or a zero time for what it received.
+*/
+func (e *Engine) recordDetection(info DroneInfoMessage) time.Time {
+	e.devicesLock.Lock()
+	defer e.devicesLock.Unlock()
+
+	if len(e.recent) == STATUS_RECENT_DETECTIONS {
+		copy(e.recent, e.recent[1:])
+		e.recent = e.recent[:len(e.recent)-1]
+	}
+	e.recent = append(e.recent, info)
+
+	if info.Role != "" && info.Role != ROLE_TRANSMITTER {
+		return time.Time{}
+	}
+	device := e.devices.GetOrCreate(info.MacAddress, info.Vendor, info.Model)
+	device.Update(info.Timestamp, info.MessageType, info.SignalStrength, info.Frequency)
+	device.AddSsid(info.Ssid)
+	return device.FirstSeen
+}
+
+/*
+Records a data frame of a flagged device in the device table: the frames it
+sent, and the stations it exchanged them with. Data frames are not reported.
+*/
+func (e *Engine) recordDataFrame(dot11Packet *layers.Dot11, match FrameAddress, vendor string, ts time.Time, signal int8, frequency uint16) {
+	e.devicesLock.Lock()
+	defer e.devicesLock.Unlock()
+
+	if match.Role == ROLE_TRANSMITTER {
+		_, model := e.Vendors().Index.Lookup(match.Address)
+		device := e.devices.GetOrCreate(match.Address, vendor, model)
+		device.Update(ts, TYPE_DATA, signal, frequency)
+		device.AddClient(dot11Packet.Address1)
+		return
+	}
+
+	// sent to the device, or in its network
+	if device := e.devices.Get(match.Address); device != nil {
+		device.AddClient(dot11Packet.Address2)
+	}
+}
+
+/*
+Returns a copy of the flagged devices seen so far, sorted by the time they were
+first seen. Safe to call from any goroutine.
+*/
+func (e *Engine) Devices() []Device {
+	e.devicesLock.RLock()
+	defer e.devicesLock.RUnlock()
+
+	devices := e.devices.Devices()
+	clones := make([]Device, len(devices))
+	for i, device := range devices {
+		clones[i] = device.Clone()
+	}
+	return clones
+}
+
+/*
+Returns the last `limit` detections (all the ones kept if `limit` <= 0), oldest
+first. Safe to call from any goroutine.
+*/
+func (e *Engine) RecentDetections(limit int) []DroneInfoMessage {
+	e.devicesLock.RLock()
+	defer e.devicesLock.RUnlock()
+
+	recent := e.recent
+	if limit > 0 && limit < len(recent) {
+		recent = recent[len(recent)-limit:]
+	}
+	return append([]DroneInfoMessage{}, recent...)
+}
+
+/*
+State of the interface the probe captures from.
+*/
+type RadioStatus struct {
+	Interface string `json:"interface"`
+	Channel   int    `json:"channel"`
+	Frequency uint16 `json:"frequency"`
+	Hops      uint64 `json:"hops"`
+}
+
+/*
+Identity of the probe, the vendors it flags, and the statistics of its engine.
+*/
+type ProbeStatus struct {
+	Hostname      string      `json:"host"`
+	Version       string      `json:"version"`
+	StartTime     time.Time   `json:"start"`
+	Uptime        float64     `json:"uptime"`
+	VendorsSource string      `json:"vendors_source"`
+	VendorsLoaded time.Time   `json:"vendors_loaded"`
+	NbVendors     int         `json:"nb_vendors"`
+	Engine        EngineStats `json:"engine"`
+}
+
+/*
+Serves the local status of a probe, for the field teams: a dashboard on `/`, and
+JSON on:
+
+	/api/devices       the flagged devices seen so far (`?live=1` for the ones
+	                   seen in the last 5 minutes, the strongest first)
+	/api/detections    the last detections (`?limit=N` for the last N only)
+	/api/radio         the channel the interface listens on (null for a file)
+	/api/stats         the probe and its engine
+*/
+type StatusHandler struct {
+	Engine *Engine
+	Radio  *Radio
+
+	startTime time.Time
+	hostname  string
+	mux       *http.ServeMux
+}
+
+func NewStatusHandler(engine *Engine, radio *Radio) *StatusHandler {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "NONAME"
+	}
+
+	h := &StatusHandler{
+		Engine:    engine,
+		Radio:     radio,
+		startTime: time.Now(),
+		hostname:  hostname,
+		mux:       http.NewServeMux(),
+	}
+	h.mux.HandleFunc("/", h.serveDashboard)
+	h.mux.HandleFunc("/api/devices", h.serveDevices)
+	h.mux.HandleFunc("/api/detections", h.serveDetections)
+	h.mux.HandleFunc("/api/radio", h.serveRadio)
+	h.mux.HandleFunc("/api/stats", h.serveStats)
+	return h
+}
+
+func (h *StatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *StatusHandler) serveDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(statusDashboard))
+}
+
+func (h *StatusHandler) serveDevices(w http.ResponseWriter, r *http.Request) {
+	devices := h.Engine.Devices()
+	if r.URL.Query().Get("live") != "" {
+		devices = liveDevices(devices, time.Now())
+	}
+	writeJSON(w, devices)
+}
+
+/*
+Returns the devices seen less than STATUS_LIVE_DELAY before `now`, the
+strongest signal first.
+*/
+func liveDevices(devices []Device, now time.Time) []Device {
+	live := []Device{}
+	for _, device := range devices {
+		if now.Sub(device.LastSeen) < STATUS_LIVE_DELAY {
+			live = append(live, device)
+		}
+	}
+
+	sort.SliceStable(live, func(i, j int) bool {
+		return live[i].LastSignal > live[j].LastSignal
+	})
+	return live
+}
+
+func (h *StatusHandler) serveDetections(w http.ResponseWriter, r *http.Request) {
+	limit := 0
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, h.Engine.RecentDetections(limit))
+}
+
+func (h *StatusHandler) serveRadio(w http.ResponseWriter, r *http.Request) {
+	if h.Radio == nil {
+		writeJSON(w, nil)
+		return
+	}
+
+	channel := h.Radio.Channel()
+	writeJSON(w, RadioStatus{
+		Interface: h.Radio.Interface.Name,
+		Channel:   channel,
+		Frequency: ChannelToFrequency(channel),
+		Hops:      h.Radio.Hops(),
+	})
+}
+
+func (h *StatusHandler) serveStats(w http.ResponseWriter, r *http.Request) {
+	vendors := h.Engine.Vendors()
+	writeJSON(w, ProbeStatus{
+		Hostname:      h.hostname,
+		Version:       VERSION,
+		StartTime:     h.startTime,
+		Uptime:        time.Since(h.startTime).Seconds(),
+		VendorsSource: vendors.Source,
+		VendorsLoaded: vendors.LoadedAt,
+		NbVendors:     len(vendors.Vendors),
+		Engine:        h.Engine.Stats(),
+	})
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(value)
+}
@@ -0,0 +1,124 @@
+package djijoe
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getStatus(t *testing.T, handler http.Handler, method string, path string, value interface{}) int {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	if value != nil && w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), value); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+	}
+	return w.Code
+}
+
+func TestStatusHandler(t *testing.T) {
+	source, err := OpenFileSource("../../pcaps/test.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	engine, detections := runEngine(t, source, Config{Vendors: loadTestVendors(t)})
+
+	radio := NewRadio(net.Interface{Name: "wlan0mon"}, nil, 0)
+	radio.counters.channel = 6
+	handler := NewStatusHandler(engine, radio)
+
+	// only the probe requests sent by the drone, not the responses it got
+	var devices []map[string]interface{}
+	getStatus(t, handler, http.MethodGet, "/api/devices", &devices)
+	if len(devices) != 1 || devices[0]["macaddr"] != "60:60:1f:42:11:b8" ||
+		devices[0]["nb_frames"] != float64(22) || devices[0]["last_strength"] != float64(-39) {
+		t.Errorf("got devices %v", devices)
+	}
+
+	// seen in 2017
+	getStatus(t, handler, http.MethodGet, "/api/devices?live=1", &devices)
+	if len(devices) != 0 {
+		t.Errorf("got live devices %v", devices)
+	}
+
+	var recent []DroneInfoMessage
+	getStatus(t, handler, http.MethodGet, "/api/detections", &recent)
+	if len(recent) != len(detections) {
+		t.Errorf("got %d detections, expected %d", len(recent), len(detections))
+	}
+	getStatus(t, handler, http.MethodGet, "/api/detections?limit=5", &recent)
+	if len(recent) != 5 || !recent[4].Timestamp.Equal(detections[len(detections)-1].Timestamp) {
+		t.Errorf("got detections %v", recent)
+	}
+	if code := getStatus(t, handler, http.MethodGet, "/api/detections?limit=x", nil); code != http.StatusBadRequest {
+		t.Errorf("invalid limit: got %d", code)
+	}
+
+	var radioStatus RadioStatus
+	getStatus(t, handler, http.MethodGet, "/api/radio", &radioStatus)
+	if radioStatus != (RadioStatus{Interface: "wlan0mon", Channel: 6, Frequency: 2437}) {
+		t.Errorf("got radio %+v", radioStatus)
+	}
+
+	var stats ProbeStatus
+	getStatus(t, handler, http.MethodGet, "/api/stats", &stats)
+	if stats.Version != VERSION || stats.Engine.Captured != 1776 || stats.NbVendors == 0 ||
+		stats.Engine.Detections["SZ DJI Technology Co.,Ltd"] != uint64(len(detections)) {
+		t.Errorf("got stats %+v", stats)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "api/devices?live=1") {
+		t.Errorf("no dashboard: %d", w.Code)
+	}
+	if code := getStatus(t, handler, http.MethodGet, "/nothing", nil); code != http.StatusNotFound {
+		t.Errorf("unknown path: got %d", code)
+	}
+	if code := getStatus(t, handler, http.MethodPost, "/api/devices", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: got %d", code)
+	}
+
+	// no radio when reading a file
+	w = httptest.NewRecorder()
+	NewStatusHandler(engine, nil).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/radio", nil))
+	if strings.TrimSpace(w.Body.String()) != "null" {
+		t.Errorf("got radio %s without a radio", w.Body.String())
+	}
+}
+
+func TestLiveDevices(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	devices := []Device{
+		{Vendor: "weak", LastSeen: now.Add(-time.Minute), LastSignal: -80},
+		{Vendor: "gone", LastSeen: now.Add(-STATUS_LIVE_DELAY), LastSignal: -20},
+		{Vendor: "strong", LastSeen: now, LastSignal: -40},
+	}
+
+	live := liveDevices(devices, now)
+	if len(live) != 2 || live[0].Vendor != "strong" || live[1].Vendor != "weak" {
+		t.Errorf("got %v", live)
+	}
+}
+
+func TestRecentDetectionsBounded(t *testing.T) {
+	engine := NewEngine(nil, Config{})
+	for i := 0; i < STATUS_RECENT_DETECTIONS+10; i++ {
+		engine.recordDetection(DroneInfoMessage{Tsft: uint64(i), MacAddress: net.HardwareAddr{0x60, 0x60, 0x1f, 0, 0, 1}})
+	}
+
+	recent := engine.RecentDetections(0)
+	if len(recent) != STATUS_RECENT_DETECTIONS || recent[0].Tsft != 10 ||
+		recent[len(recent)-1].Tsft != STATUS_RECENT_DETECTIONS+9 {
+		t.Errorf("got %d detections, from %d to %d", len(recent), recent[0].Tsft, recent[len(recent)-1].Tsft)
+	}
+	if devices := engine.Devices(); len(devices) != 1 || devices[0].NbFrames != STATUS_RECENT_DETECTIONS+10 {
+		t.Errorf("got devices %v", devices)
+	}
+}
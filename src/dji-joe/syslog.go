@@ -0,0 +1,475 @@
+package djijoe
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SYSLOG_FACILITY_DAEMON = 3
+	SYSLOG_APP_NAME        = "dji-joe"
+	SYSLOG_DEFAULT_PORT    = "514"
+	// RFC 5425
+	SYSLOG_DEFAULT_TLS_PORT = "6514"
+	SYSLOG_LOCAL_SOCKET     = "/dev/log"
+	SYSLOG_TIMEOUT          = 10 * time.Second
+	SYSLOG_TIME_FORMAT      = "2006-01-02T15:04:05.000000Z07:00"
+
+	// a device silent for this long is new again
+	SYSLOG_NEW_DEVICE_AFTER = 10 * time.Minute
+
+	SYSLOG_FORMAT_TEXT = "text"
+	SYSLOG_FORMAT_CEF  = "cef"
+	SYSLOG_FORMAT_LEEF = "leef"
+
+	CEF_DEVICE_VENDOR = "hugsy"
+)
+
+// syslog severities (RFC 5424)
+const (
+	SYSLOG_EMERGENCY = iota
+	SYSLOG_ALERT
+	SYSLOG_CRITICAL
+	SYSLOG_ERROR
+	SYSLOG_WARNING
+	SYSLOG_NOTICE
+	SYSLOG_INFORMATIONAL
+	SYSLOG_DEBUG
+)
+
+// CEF severities (0 to 10) of the events
+const (
+	CEF_SEVERITY_HEARTBEAT = 0
+	CEF_SEVERITY_PROBE     = 1
+	CEF_SEVERITY_ONGOING   = 3
+	CEF_SEVERITY_NEW       = 8
+)
+
+/*
+Returns the syslog severity of a CEF severity: very high (9-10) is critical,
+high (7-8) a warning, medium (4-6) a notice, low (1-3) informational.
+*/
+func syslogSeverity(cefSeverity int) int {
+	switch {
+	case cefSeverity >= 9:
+		return SYSLOG_CRITICAL
+	case cefSeverity >= 7:
+		return SYSLOG_WARNING
+	case cefSeverity >= 4:
+		return SYSLOG_NOTICE
+	case cefSeverity >= 1:
+		return SYSLOG_INFORMATIONAL
+	}
+	return SYSLOG_DEBUG
+}
+
+/*
+Sends RFC 5424 messages to a syslog server, over UDP (one message per
+datagram), TCP or TLS (octet counting framing, RFC 6587 and RFC 5425), or to
+the local daemon. It connects when it has something to send, and once again
+after a failure.
+*/
+type SyslogWriter struct {
+	Network   string
+	Address   string
+	TlsConfig *tls.Config
+	AppName   string
+
+	conn net.Conn
+	lock sync.Mutex
+}
+
+/*
+Returns a writer to "udp://host[:port]", "tcp://host[:port]",
+"tls://host[:port]", or "local" for the local daemon.
+*/
+func NewSyslogWriter(rawurl string) (*SyslogWriter, error) {
+	w := &SyslogWriter{AppName: SYSLOG_APP_NAME}
+	if rawurl == "local" {
+		w.Network, w.Address = "unixgram", SYSLOG_LOCAL_SOCKET
+		return w, nil
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host == "" || (u.Scheme != "udp" && u.Scheme != "tcp" && u.Scheme != "tls") {
+		return nil, fmt.Errorf("invalid syslog server '%s', expected 'local', udp://, tcp:// or tls://host[:port]", rawurl)
+	}
+
+	w.Network, w.Address = u.Scheme, u.Host
+	if u.Port() == "" {
+		port := SYSLOG_DEFAULT_PORT
+		if u.Scheme == "tls" {
+			port = SYSLOG_DEFAULT_TLS_PORT
+		}
+		w.Address = net.JoinHostPort(u.Hostname(), port)
+	}
+	return w, nil
+}
+
+func (w *SyslogWriter) connect() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: SYSLOG_TIMEOUT}
+	if w.Network != "tls" {
+		return dialer.Dial(w.Network, w.Address)
+	}
+
+	config := w.TlsConfig
+	if config == nil {
+		host, _, _ := net.SplitHostPort(w.Address)
+		config = &tls.Config{ServerName: host}
+	}
+	return tls.DialWithDialer(dialer, "tcp", w.Address, config)
+}
+
+/*
+Keeps a field of the header printable and short enough, "-" if empty.
+*/
+func syslogHeaderField(value string, max int) string {
+	field := []byte(value)
+	for i, c := range field {
+		if c <= ' ' || c > '~' {
+			field[i] = '_'
+		}
+	}
+	if len(field) > max {
+		field = field[:max]
+	}
+	if len(field) == 0 {
+		return "-"
+	}
+	return string(field)
+}
+
+/*
+Formats a RFC 5424 message, without structured data.
+*/
+func (w *SyslogWriter) format(severity int, ts time.Time, hostname string, msgid string, msg string) string {
+	return fmt.Sprintf("<%d>1 %s %s %s %d %s - %s",
+		SYSLOG_FACILITY_DAEMON*8+severity,
+		ts.Format(SYSLOG_TIME_FORMAT),
+		syslogHeaderField(hostname, 255),
+		syslogHeaderField(w.AppName, 48),
+		os.Getpid(),
+		syslogHeaderField(msgid, 32),
+		msg)
+}
+
+/*
+Sends a message dated `ts`, from `hostname`.
+*/
+func (w *SyslogWriter) Write(severity int, ts time.Time, hostname string, msgid string, msg string) error {
+	line := w.format(severity, ts, hostname, msgid, msg)
+	if w.Network == "tcp" || w.Network == "tls" {
+		line = strconv.Itoa(len(line)) + " " + line
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if w.conn == nil {
+			w.conn, err = w.connect()
+			if err != nil {
+				return err
+			}
+		}
+
+		w.conn.SetWriteDeadline(time.Now().Add(SYSLOG_TIMEOUT))
+		_, err = w.conn.Write([]byte(line))
+		if err == nil {
+			return nil
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	return err
+}
+
+func (w *SyslogWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
+
+type syslogExtension struct {
+	key   string
+	value string
+}
+
+/*
+An event, before it is formatted as text, CEF or LEEF. Its extensions use
+the CEF keys.
+*/
+type syslogEvent struct {
+	ts         time.Time
+	hostname   string
+	id         string
+	name       string
+	severity   int
+	text       string
+	extensions []syslogExtension
+}
+
+func (e *syslogEvent) add(key string, value string) {
+	if value != "" {
+		e.extensions = append(e.extensions, syslogExtension{key, value})
+	}
+}
+
+/*
+Adds a custom CEF extension, with its label.
+*/
+func (e *syslogEvent) addCustom(key string, label string, value string) {
+	if value != "" {
+		e.add(key+"Label", label)
+		e.add(key, value)
+	}
+}
+
+var cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+var cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+
+/*
+Formats an event as CEF (ArcSight Common Event Format, version 0).
+*/
+func formatCef(e syslogEvent) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "CEF:0|%s|%s|%s|%s|%s|%d|",
+		cefHeaderEscaper.Replace(CEF_DEVICE_VENDOR),
+		cefHeaderEscaper.Replace(PROGNAME),
+		cefHeaderEscaper.Replace(VERSION),
+		cefHeaderEscaper.Replace(e.id),
+		cefHeaderEscaper.Replace(e.name),
+		e.severity)
+
+	fmt.Fprintf(&b, "rt=%d dvchost=%s", e.ts.UnixNano()/int64(time.Millisecond), cefExtensionEscaper.Replace(e.hostname))
+	for _, extension := range e.extensions {
+		fmt.Fprintf(&b, " %s=%s", extension.key, cefExtensionEscaper.Replace(extension.value))
+	}
+	return b.String()
+}
+
+// the LEEF keys of the CEF extensions which have one
+var leefKeys = map[string]string{
+	"smac": "srcMAC",
+	"msg":  "msg",
+	"cat":  "cat",
+}
+
+var leefValueEscaper = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+
+// the format of `devTime`: LEEF_DEV_TIME_FORMAT in Go, and in Java
+// (SimpleDateFormat) as `devTimeFormat` for the consumers
+const (
+	LEEF_DEV_TIME_FORMAT      = "Jan 02 2006 15:04:05.000 MST"
+	LEEF_DEV_TIME_FORMAT_JAVA = "MMM dd yyyy HH:mm:ss.SSS zzz"
+)
+
+/*
+Formats an event as LEEF (IBM QRadar Log Event Extended Format, version 1.0),
+its attributes separated by tabs. The custom CEF extensions are named after
+their label.
+*/
+func formatLeef(e syslogEvent) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "LEEF:1.0|%s|%s|%s|%s|",
+		cefHeaderEscaper.Replace(CEF_DEVICE_VENDOR),
+		cefHeaderEscaper.Replace(PROGNAME),
+		cefHeaderEscaper.Replace(VERSION),
+		cefHeaderEscaper.Replace(e.id))
+
+	fmt.Fprintf(&b, "devTime=%s\tdevTimeFormat=%s\tidentHostName=%s\tsev=%d",
+		e.ts.UTC().Format(LEEF_DEV_TIME_FORMAT), LEEF_DEV_TIME_FORMAT_JAVA,
+		leefValueEscaper.Replace(e.hostname), e.severity)
+
+	labels := make(map[string]string)
+	for _, extension := range e.extensions {
+		if strings.HasSuffix(extension.key, "Label") {
+			labels[strings.TrimSuffix(extension.key, "Label")] = extension.value
+		}
+	}
+	for _, extension := range e.extensions {
+		if strings.HasSuffix(extension.key, "Label") {
+			continue
+		}
+		key, ok := leefKeys[extension.key]
+		if !ok {
+			key, ok = labels[extension.key]
+		}
+		if !ok {
+			key = extension.key
+		}
+		fmt.Fprintf(&b, "\t%s=%s", key, leefValueEscaper.Replace(extension.value))
+	}
+	return b.String()
+}
+
+/*
+Sends the events to a syslog server as text, CEF or LEEF. A detection of a
+device not seen for SYSLOG_NEW_DEVICE_AFTER (by the timestamps of its frames)
+has a high severity, the following ones a low one.
+*/
+type SyslogReporter struct {
+	Writer *SyslogWriter
+	Format string
+
+	lastSeen  map[string]time.Time
+	lastPrune time.Time
+	lock      sync.Mutex
+}
+
+func NewSyslogReporter(rawurl string, format string) (*SyslogReporter, error) {
+	switch format {
+	case SYSLOG_FORMAT_TEXT, SYSLOG_FORMAT_CEF, SYSLOG_FORMAT_LEEF:
+	default:
+		return nil, fmt.Errorf("unknown syslog format '%s', expected %s, %s or %s",
+			format, SYSLOG_FORMAT_TEXT, SYSLOG_FORMAT_CEF, SYSLOG_FORMAT_LEEF)
+	}
+
+	writer, err := NewSyslogWriter(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogReporter{Writer: writer, Format: format, lastSeen: make(map[string]time.Time)}, nil
+}
+
+func (s *SyslogReporter) send(e syslogEvent) error {
+	msg := e.text
+	switch s.Format {
+	case SYSLOG_FORMAT_CEF:
+		msg = formatCef(e)
+	case SYSLOG_FORMAT_LEEF:
+		msg = formatLeef(e)
+	}
+	return s.Writer.Write(syslogSeverity(e.severity), e.ts, e.hostname, strings.ToUpper(e.id), msg)
+}
+
+/*
+Returns whether a detection is the first one of its device for a while. The
+device is the physical device linked by its fingerprint if there is one, as
+its MAC address may be randomized.
+*/
+func (s *SyslogReporter) isNew(info DroneInfoMessage) bool {
+	key := info.DeviceId
+	if key == "" {
+		key = info.MacAddress.String()
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.prune(info.Timestamp)
+
+	// the detections are reported in the order of their capture
+	last, seen := s.lastSeen[key]
+	s.lastSeen[key] = info.Timestamp
+	return !seen || info.Timestamp.Sub(last) > SYSLOG_NEW_DEVICE_AFTER
+}
+
+/*
+Forgets the devices silent for more than SYSLOG_NEW_DEVICE_AFTER: their next
+detection is new anyway.
+*/
+func (s *SyslogReporter) prune(now time.Time) {
+	if now.Sub(s.lastPrune) < time.Minute {
+		return
+	}
+	s.lastPrune = now
+
+	for key, last := range s.lastSeen {
+		if now.Sub(last) > SYSLOG_NEW_DEVICE_AFTER {
+			delete(s.lastSeen, key)
+		}
+	}
+}
+
+func (s *SyslogReporter) Wakeup(msg WakeUpMessage) error {
+	return s.send(syslogEvent{
+		ts:       msg.Timestamp,
+		hostname: msg.Hostname,
+		id:       "wakeup",
+		name:     "Probe started",
+		severity: CEF_SEVERITY_PROBE,
+		text:     fmt.Sprintf("Probe '%s' started", msg.Hostname),
+	})
+}
+
+func (s *SyslogReporter) Heartbeat(msg HeartBeatMessage) error {
+	return s.send(syslogEvent{
+		ts:       msg.Timestamp,
+		hostname: msg.Hostname,
+		id:       "heartbeat",
+		name:     "Probe alive",
+		severity: CEF_SEVERITY_HEARTBEAT,
+		text:     fmt.Sprintf("Probe '%s' is alive", msg.Hostname),
+	})
+}
+
+func (s *SyslogReporter) Detection(info DroneInfoMessage) error {
+	e := syslogEvent{
+		ts:       info.Timestamp,
+		hostname: info.Hostname,
+		id:       "drone",
+		name:     "Drone detected",
+		severity: CEF_SEVERITY_ONGOING,
+	}
+	if s.isNew(info) {
+		e.id, e.name, e.severity = "new-drone", "New drone detected", CEF_SEVERITY_NEW
+	}
+
+	e.text = fmt.Sprintf("%s: 802.11 %s from vendor %s (device %s) - strength=%d dBm, frequency=%d MHz",
+		e.name, MessageTypeToString(info.MessageType), info.Vendor, info.MacAddress, info.SignalStrength, info.Frequency)
+	if info.Model != "" {
+		e.text += ", model=" + info.Model
+	}
+
+	e.add("cat", MessageTypeToString(info.MessageType))
+	e.add("smac", info.MacAddress.String())
+	e.addCustom("cs1", "vendor", info.Vendor)
+	e.addCustom("cs2", "model", info.Model)
+	e.addCustom("cs3", "ssid", info.Ssid)
+	e.addCustom("cs4", "role", info.Role)
+	e.addCustom("cs5", "device", info.DeviceId)
+	e.addCustom("cn1", "rssi", strconv.Itoa(int(info.SignalStrength)))
+	e.addCustom("cn2", "frequency", strconv.Itoa(int(info.Frequency)))
+	if info.Channel != 0 {
+		e.addCustom("cn3", "channel", strconv.Itoa(info.Channel))
+	}
+	if info.Randomized {
+		e.addCustom("cs6", "randomized", "true")
+	}
+	if info.Bearing != nil {
+		e.addCustom("cfp1", "bearing", strconv.FormatFloat(info.Bearing.Bearing, 'f', -1, 64))
+	}
+	return s.send(e)
+}
+
+func (s *SyslogReporter) Shutdown(msg ShutdownMessage) error {
+	e := syslogEvent{
+		ts:       msg.Timestamp,
+		hostname: msg.Hostname,
+		id:       "shutdown",
+		name:     "Probe stopped",
+		severity: CEF_SEVERITY_PROBE,
+		text: fmt.Sprintf("Probe '%s' stopped: %d DJI ProbeRequests, %d DJI Beacon",
+			msg.Hostname, msg.ProbeRequestFound, msg.BeaconFound),
+	}
+	e.addCustom("cn1", "probe_requests", strconv.FormatUint(msg.ProbeRequestFound, 10))
+	e.addCustom("cn2", "beacons", strconv.FormatUint(msg.BeaconFound, 10))
+
+	err := s.send(e)
+	s.Writer.Close()
+	return err
+}
@@ -0,0 +1,321 @@
+package djijoe
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testDetection(t *testing.T, ts time.Time) DroneInfoMessage {
+	info := DroneInfoMessage{
+		Timestamp:      ts,
+		Hostname:       "probe-1",
+		MessageType:    TYPE_PROBE_REQUEST,
+		SignalStrength: -42,
+		Frequency:      2412,
+		Vendor:         "SZ DJI Technology Co.,Ltd",
+		MacAddress:     mustParseMAC(t, "60:60:1f:42:11:b8"),
+		Role:           ROLE_TRANSMITTER,
+		Model:          "Phantom 3",
+	}
+	info.Ssid = "PHANTOM3_a=b|c"
+	info.Channel = 1
+	return info
+}
+
+func TestFormatCef(t *testing.T) {
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 678000000, time.UTC)
+	e := syslogEvent{ts: ts, hostname: "probe-1", id: "new-drone", name: `New drone | \ detected`, severity: CEF_SEVERITY_NEW}
+	e.add("smac", "60:60:1f:42:11:b8")
+	e.addCustom("cs3", "ssid", "a=b\nc\\d")
+	// nothing for an empty value
+	e.addCustom("cs4", "role", "")
+
+	expected := `CEF:0|hugsy|DJI-Joe|` + VERSION + `|new-drone|New drone \| \\ detected|8|rt=1577934245678 dvchost=probe-1 smac=60:60:1f:42:11:b8 cs3Label=ssid cs3=a\=b\nc\\d`
+	if got := formatCef(e); got != expected {
+		t.Errorf("got\n%s\nexpected\n%s", got, expected)
+	}
+
+	expected = "LEEF:1.0|hugsy|DJI-Joe|" + VERSION + "|new-drone|devTime=Jan 02 2020 03:04:05.678 UTC\tdevTimeFormat=MMM dd yyyy HH:mm:ss.SSS zzz\tidentHostName=probe-1\tsev=8\tsrcMAC=60:60:1f:42:11:b8\tssid=a=b c\\d"
+	if got := formatLeef(e); got != expected {
+		t.Errorf("got\n%q\nexpected\n%q", got, expected)
+	}
+}
+
+/*
+Reads the messages sent to a UDP syslog server.
+*/
+func listenSyslogUdp(t *testing.T) (net.PacketConn, func() string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn, func() string {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buffer := make([]byte, 4096)
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buffer[:n])
+	}
+}
+
+func TestSyslogReporterSeverity(t *testing.T) {
+	conn, next := listenSyslogUdp(t)
+	r, err := NewSyslogReporter("udp://"+conn.LocalAddr().String(), SYSLOG_FORMAT_CEF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Writer.Close()
+
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	header := fmt.Sprintf("1 2020-01-02T03:%%s.000000Z probe-1 %s %d ", SYSLOG_APP_NAME, os.Getpid())
+	tests := []struct {
+		delay    time.Duration
+		priority int
+		id       string
+		severity int
+	}{
+		{0, 28, "new-drone", CEF_SEVERITY_NEW},
+		{time.Minute, 30, "drone", CEF_SEVERITY_ONGOING},
+		{6 * time.Minute, 30, "drone", CEF_SEVERITY_ONGOING},
+		// silent for more than 10 minutes
+		{17 * time.Minute, 28, "new-drone", CEF_SEVERITY_NEW},
+	}
+
+	for i, test := range tests {
+		ts := start.Add(test.delay)
+		if err := r.Detection(testDetection(t, ts)); err != nil {
+			t.Fatal(err)
+		}
+
+		message := next()
+		prefix := fmt.Sprintf("<%d>", test.priority) + fmt.Sprintf(header, ts.Format("04:05")) + strings.ToUpper(test.id) + " - "
+		if !strings.HasPrefix(message, prefix) {
+			t.Errorf("%d: got %q, expected %q...", i, message, prefix)
+			continue
+		}
+
+		cef := strings.TrimPrefix(message, prefix)
+		fields := strings.SplitN(cef, "|", 8)
+		if len(fields) != 8 || fields[4] != test.id || fields[6] != strconv.Itoa(test.severity) {
+			t.Errorf("%d: got %q", i, cef)
+		}
+		for _, extension := range []string{
+			"dvchost=probe-1", "smac=60:60:1f:42:11:b8", "cat=ProbeRequest",
+			"cs1Label=vendor cs1=SZ DJI Technology Co.,Ltd", "cs2Label=model cs2=Phantom 3",
+			`cs3Label=ssid cs3=PHANTOM3_a\=b|c`, "cn1Label=rssi cn1=-42", "cn2Label=frequency cn2=2412",
+			"cn3Label=channel cn3=1", "cs4Label=role cs4=transmitter",
+		} {
+			if !strings.Contains(cef, " "+extension) {
+				t.Errorf("%d: no %q in %q", i, extension, cef)
+			}
+		}
+	}
+
+	// the probe events
+	r.Wakeup(WakeUpMessage{Timestamp: start, Hostname: "probe-1"})
+	if message := next(); !strings.HasPrefix(message, "<30>1 ") || !strings.Contains(message, "|wakeup|Probe started|1|") {
+		t.Errorf("wakeup: got %q", message)
+	}
+	r.Heartbeat(HeartBeatMessage{Timestamp: start, Hostname: "probe-1"})
+	if message := next(); !strings.HasPrefix(message, "<31>1 ") || !strings.Contains(message, "|heartbeat|Probe alive|0|") {
+		t.Errorf("heartbeat: got %q", message)
+	}
+}
+
+func TestSyslogReporterForgetsSilentDevices(t *testing.T) {
+	r := &SyslogReporter{lastSeen: make(map[string]time.Time)}
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for i := 0; i < 100; i++ {
+		info := testDetection(t, start)
+		info.MacAddress = net.HardwareAddr{0x62, 0, 0, 0, 0, byte(i)}
+		if !r.isNew(info) {
+			t.Errorf("%s not new", info.MacAddress)
+		}
+	}
+
+	// the same device, under another (randomized) address
+	info := testDetection(t, start.Add(time.Minute))
+	info.DeviceId = "device-1"
+	r.isNew(info)
+	info.MacAddress = mustParseMAC(t, "62:00:00:00:01:00")
+	if r.isNew(info) {
+		t.Errorf("device-1 new again")
+	}
+
+	info.Timestamp = start.Add(SYSLOG_NEW_DEVICE_AFTER + 30*time.Second)
+	if r.isNew(info) {
+		t.Errorf("device-1 new again")
+	}
+	if len(r.lastSeen) != 1 {
+		t.Errorf("%d devices remembered", len(r.lastSeen))
+	}
+}
+
+func TestSyslogReporterLeefAndText(t *testing.T) {
+	conn, next := listenSyslogUdp(t)
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	leef, err := NewSyslogReporter("udp://"+conn.LocalAddr().String(), SYSLOG_FORMAT_LEEF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leef.Writer.Close()
+	leef.Detection(testDetection(t, ts))
+	message := next()
+	for _, attribute := range []string{
+		"|new-drone|devTime=Jan 02 2020 03:04:05.000 UTC\tdevTimeFormat=MMM dd yyyy HH:mm:ss.SSS zzz\t", "\tidentHostName=probe-1", "\tsev=8", "\tsrcMAC=60:60:1f:42:11:b8",
+		"\tvendor=SZ DJI Technology Co.,Ltd", "\tmodel=Phantom 3", "\trssi=-42", "\tchannel=1",
+	} {
+		if !strings.Contains(message, attribute) {
+			t.Errorf("no %q in %q", attribute, message)
+		}
+	}
+
+	text, err := NewSyslogReporter("udp://"+conn.LocalAddr().String(), SYSLOG_FORMAT_TEXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer text.Writer.Close()
+	text.Detection(testDetection(t, ts))
+	expected := "New drone detected: 802.11 ProbeRequest from vendor SZ DJI Technology Co.,Ltd (device 60:60:1f:42:11:b8) - strength=-42 dBm, frequency=2412 MHz, model=Phantom 3"
+	if message := next(); !strings.HasSuffix(message, " NEW-DRONE - "+expected) {
+		t.Errorf("got %q", message)
+	}
+
+	for _, bad := range [][2]string{{"udp://host:514", "json"}, {"http://host", "cef"}, {"udp://", "cef"}} {
+		if _, err := NewSyslogReporter(bad[0], bad[1]); err == nil {
+			t.Errorf("%v: no error", bad)
+		}
+	}
+}
+
+/*
+Reads the octet-counted messages of a stream.
+*/
+func readSyslogFrames(t *testing.T, conn net.Conn, count int) []string {
+	reader := bufio.NewReader(conn)
+	var messages []string
+	for len(messages) < count {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		length, err := reader.ReadString(' ')
+		if err != nil {
+			t.Fatalf("reading a frame: %v", err)
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+		if err != nil {
+			t.Fatalf("invalid frame length %q", length)
+		}
+		frame := make([]byte, n)
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, string(frame))
+	}
+	return messages
+}
+
+func selfSignedCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "syslog.test"},
+		DNSNames:     []string{"syslog.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestSyslogStreams(t *testing.T) {
+	cert, pool := selfSignedCertificate(t)
+
+	for _, scheme := range []string{"tcp", "tls"} {
+		var listener net.Listener
+		var err error
+		if scheme == "tls" {
+			listener, err = tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+		} else {
+			listener, err = net.Listen("tcp", "127.0.0.1:0")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+
+		r, err := NewSyslogReporter(scheme+"://"+listener.Addr().String(), SYSLOG_FORMAT_CEF)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Writer.TlsConfig = &tls.Config{RootCAs: pool, ServerName: "syslog.test"}
+
+		ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+		info := testDetection(t, ts)
+		errc := make(chan error, 1)
+		go func() {
+			if err := r.Wakeup(WakeUpMessage{Timestamp: ts, Hostname: "probe-1"}); err != nil {
+				errc <- err
+				return
+			}
+			if err := r.Detection(info); err != nil {
+				errc <- err
+				return
+			}
+			errc <- r.Shutdown(ShutdownMessage{Timestamp: ts, Hostname: "probe-1", ProbeRequestFound: 2})
+		}()
+
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages := readSyslogFrames(t, conn, 3)
+		conn.Close()
+		if err := <-errc; err != nil {
+			t.Fatalf("%s: %v", scheme, err)
+		}
+
+		for i, id := range []string{"WAKEUP", "NEW-DRONE", "SHUTDOWN"} {
+			if !strings.HasPrefix(messages[i], "<") || !strings.Contains(messages[i], " probe-1 "+SYSLOG_APP_NAME+" ") ||
+				!strings.Contains(messages[i], " "+id+" - CEF:0|") {
+				t.Errorf("%s: message %d: %q", scheme, i, messages[i])
+			}
+		}
+		if !strings.Contains(messages[2], "cn1Label=probe_requests cn1=2") {
+			t.Errorf("%s: shutdown %q", scheme, messages[2])
+		}
+	}
+}
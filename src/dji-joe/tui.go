@@ -0,0 +1,459 @@
+package djijoe
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// how often the screen is redrawn
+	TUI_REFRESH_INTERVAL = 500 * time.Millisecond
+	// RSSI samples kept per device, the sparkline of the fox hunt view
+	TUI_HISTORY = 60
+	// RSSI samples in the sparkline of the table
+	TUI_SPARKLINE = 16
+	// log messages shown under the table
+	TUI_LOG_LINES = 3
+	// samples averaged on each side to tell the trend of the signal
+	TUI_TREND_SAMPLES = 5
+	// dB of difference to call the trend warmer or colder
+	TUI_TREND_THRESHOLD = 2.0
+
+	// range of the sparklines and of the signal bar
+	TUI_MIN_SIGNAL = -100
+	TUI_MAX_SIGNAL = -20
+)
+
+const (
+	ANSI_ALTERNATE_SCREEN = "\x1b[?1049h"
+	ANSI_NORMAL_SCREEN    = "\x1b[?1049l"
+	ANSI_CLEAR            = "\x1b[H\x1b[2J"
+	ANSI_RESET            = "\x1b[0m"
+	ANSI_BOLD             = "\x1b[1m"
+	ANSI_DIM              = "\x1b[2m"
+	ANSI_RED              = "\x1b[31m"
+	ANSI_GREEN            = "\x1b[32m"
+	ANSI_YELLOW           = "\x1b[33m"
+)
+
+var sparklineLevels = []rune("▁▂▃▄▅▆▇█")
+
+/*
+What the terminal UI knows about a device.
+*/
+type tuiDevice struct {
+	MacAddress string
+	Vendor     string
+	Model      string
+	Ssid       string
+	Channel    int
+	Signal     int8
+	Peak       int8
+	PeakTime   time.Time
+	LastSeen   time.Time
+	NbFrames   uint64
+	Bearing    *BearingEstimate
+	history    []int8
+}
+
+/*
+A full-screen terminal view of the detections: a table of the devices, or the
+"fox hunt" view of one of them, to walk towards it by following its signal.
+*/
+type Tui struct {
+	Out io.Writer
+
+	devices map[string]*tuiDevice
+	// MAC address of the device of the fox hunt view, if any
+	focus string
+	// devices in the order of the last table drawn, to select them by number
+	rows []string
+	logs []string
+	lock sync.Mutex
+
+	now func() time.Time
+}
+
+func NewTui(out io.Writer) *Tui {
+	return &Tui{
+		Out:     out,
+		devices: make(map[string]*tuiDevice),
+		now:     time.Now,
+	}
+}
+
+/*
+Records a detection. Only the frames sent by the device tell how far it is.
+*/
+func (t *Tui) Update(info DroneInfoMessage) {
+	if info.Role != "" && info.Role != ROLE_TRANSMITTER {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	mac := info.MacAddress.String()
+	device, ok := t.devices[mac]
+	if !ok {
+		device = &tuiDevice{MacAddress: mac, Peak: info.SignalStrength}
+		t.devices[mac] = device
+	}
+
+	device.Vendor = info.Vendor
+	if info.Model != "" {
+		device.Model = info.Model
+	}
+	if info.Ssid != "" {
+		device.Ssid = info.Ssid
+	}
+	if channel := FrequencyToChannel(info.Frequency); channel != 0 {
+		device.Channel = channel
+	}
+
+	if info.Bearing != nil {
+		device.Bearing = info.Bearing
+	}
+
+	device.LastSeen = t.now()
+	device.NbFrames++
+	device.Signal = info.SignalStrength
+	if info.SignalStrength >= device.Peak {
+		device.Peak = info.SignalStrength
+		device.PeakTime = device.LastSeen
+	}
+
+	device.history = append(device.history, info.SignalStrength)
+	if len(device.history) > TUI_HISTORY {
+		device.history = device.history[len(device.history)-TUI_HISTORY:]
+	}
+}
+
+/*
+Switches to the fox hunt view of a device (given by its MAC address, or its
+number in the table), or back to the table if `target` is empty.
+*/
+func (t *Tui) Focus(target string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	target = strings.ToLower(strings.TrimSpace(target))
+	if target == "" {
+		t.focus = ""
+		return nil
+	}
+
+	if n, err := strconv.Atoi(target); err == nil {
+		if n < 1 || n > len(t.rows) {
+			return fmt.Errorf("no device #%d", n)
+		}
+		t.focus = t.rows[n-1]
+		return nil
+	}
+
+	if _, ok := t.devices[target]; !ok {
+		return fmt.Errorf("no device %s", target)
+	}
+	t.focus = target
+	return nil
+}
+
+/*
+Shows a log message under the table.
+*/
+func (t *Tui) log(level string, message string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	line := fmt.Sprintf("%s %s %s", t.now().Format("15:04:05"), level, message)
+	t.logs = append(t.logs, line)
+	if len(t.logs) > TUI_LOG_LINES {
+		t.logs = t.logs[len(t.logs)-TUI_LOG_LINES:]
+	}
+}
+
+/*
+Returns a logger showing its messages under the table, as anything written to
+the terminal would be overwritten at the next refresh.
+*/
+func (t *Tui) Logger() Logger {
+	return tuiLogger{t}
+}
+
+type tuiLogger struct {
+	tui *Tui
+}
+
+func (l tuiLogger) Debug(string)                  {}
+func (l tuiLogger) DebugF(string, ...interface{}) {}
+func (l tuiLogger) Info(message string)           { l.tui.log("INF", message) }
+func (l tuiLogger) InfoF(format string, a ...interface{}) {
+	l.tui.log("INF", fmt.Sprintf(format, a...))
+}
+func (l tuiLogger) Notice(message string) { l.tui.log("NOT", message) }
+func (l tuiLogger) NoticeF(format string, a ...interface{}) {
+	l.tui.log("NOT", fmt.Sprintf(format, a...))
+}
+func (l tuiLogger) Warning(message string) { l.tui.log("WAR", message) }
+func (l tuiLogger) WarningF(format string, a ...interface{}) {
+	l.tui.log("WAR", fmt.Sprintf(format, a...))
+}
+func (l tuiLogger) Error(message string) { l.tui.log("ERR", message) }
+func (l tuiLogger) ErrorF(format string, a ...interface{}) {
+	l.tui.log("ERR", fmt.Sprintf(format, a...))
+}
+
+/*
+Draws the screen until `ctx` is cancelled or "q" is entered, with the
+detections of `events`. The commands are read line by line from `input`: the
+number or the MAC address of a device for its fox hunt view, an empty line to
+go back to the table.
+*/
+func (t *Tui) Run(ctx context.Context, events <-chan DroneInfoMessage, input io.Reader) {
+	commands := make(chan string)
+	if input != nil {
+		go func() {
+			scanner := bufio.NewScanner(input)
+			for scanner.Scan() {
+				select {
+				case commands <- scanner.Text():
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	io.WriteString(t.Out, ANSI_ALTERNATE_SCREEN)
+	defer io.WriteString(t.Out, ANSI_NORMAL_SCREEN)
+
+	ticker := time.NewTicker(TUI_REFRESH_INTERVAL)
+	defer ticker.Stop()
+
+	t.Draw()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case info := <-events:
+			t.Update(info)
+
+		case command := <-commands:
+			if strings.TrimSpace(command) == "q" {
+				return
+			}
+			if err := t.Focus(command); err != nil {
+				t.log("ERR", err.Error())
+			}
+			t.Draw()
+
+		case <-ticker.C:
+			t.Draw()
+		}
+	}
+}
+
+/*
+Redraws the whole screen.
+*/
+func (t *Tui) Draw() {
+	var screen bytes.Buffer
+	screen.WriteString(ANSI_CLEAR)
+	t.Render(&screen)
+	t.Out.Write(screen.Bytes())
+}
+
+/*
+Writes the current view, without clearing the screen.
+*/
+func (t *Tui) Render(w io.Writer) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := t.now()
+	if device, ok := t.devices[t.focus]; ok {
+		t.renderFoxHunt(w, device, now)
+	} else {
+		t.renderTable(w, now)
+	}
+
+	fmt.Fprintln(w)
+	for _, line := range t.logs {
+		fmt.Fprintf(w, "%s%s%s\n", ANSI_DIM, line, ANSI_RESET)
+	}
+}
+
+func (t *Tui) renderTable(w io.Writer, now time.Time) {
+	devices := make([]*tuiDevice, 0, len(t.devices))
+	for _, device := range t.devices {
+		devices = append(devices, device)
+	}
+	// the devices heard recently first, the closest first
+	sort.Slice(devices, func(i, j int) bool {
+		iRecent := now.Sub(devices[i].LastSeen) < STATUS_LIVE_DELAY
+		jRecent := now.Sub(devices[j].LastSeen) < STATUS_LIVE_DELAY
+		if iRecent != jRecent {
+			return iRecent
+		}
+		if devices[i].Signal != devices[j].Signal {
+			return devices[i].Signal > devices[j].Signal
+		}
+		return devices[i].MacAddress < devices[j].MacAddress
+	})
+
+	fmt.Fprintf(w, "%s%s %s%s - %d device(s) - %s\n\n", ANSI_BOLD, PROGNAME, VERSION, ANSI_RESET,
+		len(devices), now.Format("15:04:05"))
+	fmt.Fprintf(w, "%s%3s  %-9s %-*s  %-20s %-14s %-16s %-17s %3s %6s%s\n", ANSI_BOLD,
+		"#", "RSSI/peak", TUI_SPARKLINE, "", "Vendor", "Model", "SSID", "MAC", "Ch", "Age", ANSI_RESET)
+
+	t.rows = t.rows[:0]
+	for i, device := range devices {
+		t.rows = append(t.rows, device.MacAddress)
+
+		color := signalColor(device.Signal)
+		if now.Sub(device.LastSeen) >= STATUS_LIVE_DELAY {
+			color = ANSI_DIM
+		}
+		fmt.Fprintf(w, "%3d  %s%4d%s/%-4d %-*s  %-20s %-14s %-16s %-17s %3s %6s\n", i+1,
+			color, device.Signal, ANSI_RESET, device.Peak,
+			TUI_SPARKLINE, sparkline(device.history, TUI_SPARKLINE),
+			truncate(device.Vendor, 20), truncate(device.Model, 14), truncate(device.Ssid, 16),
+			device.MacAddress, formatChannel(device.Channel), formatAge(now.Sub(device.LastSeen)))
+	}
+	if len(devices) == 0 {
+		fmt.Fprintf(w, "%s     Nothing detected yet%s\n", ANSI_DIM, ANSI_RESET)
+	}
+
+	fmt.Fprintf(w, "\n%s<#> or <MAC> + Enter: fox hunt, q + Enter: quit%s\n", ANSI_DIM, ANSI_RESET)
+}
+
+func (t *Tui) renderFoxHunt(w io.Writer, device *tuiDevice, now time.Time) {
+	name := strings.TrimSpace(device.Vendor + " " + device.Model)
+	fmt.Fprintf(w, "%sFox hunt: %s%s (%s)\n\n", ANSI_BOLD, device.MacAddress, ANSI_RESET, name)
+	if device.Ssid != "" {
+		fmt.Fprintf(w, "  SSID      %s\n", device.Ssid)
+	}
+	fmt.Fprintf(w, "  Channel   %s\n", formatChannel(device.Channel))
+	fmt.Fprintf(w, "  Frames    %d, last one %s ago\n\n", device.NbFrames, formatAge(now.Sub(device.LastSeen)))
+
+	fmt.Fprintf(w, "  Signal    %s%s%4d dBm%s  %s\n", ANSI_BOLD, signalColor(device.Signal), device.Signal, ANSI_RESET,
+		signalBar(device.Signal, 40))
+	fmt.Fprintf(w, "  Peak      %4d dBm  %s ago\n", device.Peak, formatAge(now.Sub(device.PeakTime)))
+
+	trend, delta := signalTrend(device.history)
+	fmt.Fprintf(w, "  Trend     %s (%+.1f dB)\n", trend, delta)
+	if device.Bearing != nil {
+		fmt.Fprintf(w, "  Bearing   %s%.0f°%s (confidence %.0f%%, %d samples)\n", ANSI_BOLD,
+			device.Bearing.Bearing, ANSI_RESET, 100*device.Bearing.Confidence, device.Bearing.Samples)
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintf(w, "  %s\n", sparkline(device.history, TUI_HISTORY))
+	fmt.Fprintf(w, "  %s%d..%d dBm, last %d frames%s\n", ANSI_DIM, TUI_MIN_SIGNAL, TUI_MAX_SIGNAL, len(device.history), ANSI_RESET)
+
+	fmt.Fprintf(w, "\n%sEnter: back to the table, q + Enter: quit%s\n", ANSI_DIM, ANSI_RESET)
+}
+
+/*
+Returns whether the signal gets stronger ("warmer") or weaker ("colder"), from
+the mean of the last samples compared to the one of the samples before them.
+*/
+func signalTrend(history []int8) (string, float64) {
+	if len(history) < 2*TUI_TREND_SAMPLES {
+		return "?", 0
+	}
+
+	mean := func(samples []int8) float64 {
+		var sum float64
+		for _, s := range samples {
+			sum += float64(s)
+		}
+		return sum / float64(len(samples))
+	}
+	last := history[len(history)-TUI_TREND_SAMPLES:]
+	before := history[len(history)-2*TUI_TREND_SAMPLES : len(history)-TUI_TREND_SAMPLES]
+	delta := mean(last) - mean(before)
+
+	switch {
+	case delta >= TUI_TREND_THRESHOLD:
+		return "↑ warmer", delta
+	case delta <= -TUI_TREND_THRESHOLD:
+		return "↓ colder", delta
+	}
+	return "→ steady", delta
+}
+
+func signalLevel(signal int8, levels int) int {
+	level := (int(signal) - TUI_MIN_SIGNAL) * levels / (TUI_MAX_SIGNAL - TUI_MIN_SIGNAL)
+	if level < 0 {
+		return 0
+	}
+	if level >= levels {
+		return levels - 1
+	}
+	return level
+}
+
+/*
+Returns the last `width` samples as a sparkline.
+*/
+func sparkline(history []int8, width int) string {
+	if len(history) > width {
+		history = history[len(history)-width:]
+	}
+
+	line := make([]rune, len(history))
+	for i, signal := range history {
+		line[i] = sparklineLevels[signalLevel(signal, len(sparklineLevels))]
+	}
+	return string(line)
+}
+
+func signalBar(signal int8, width int) string {
+	filled := signalLevel(signal, width) + 1
+	return "[" + strings.Repeat("█", filled) + strings.Repeat(" ", width-filled) + "]"
+}
+
+func signalColor(signal int8) string {
+	switch {
+	case signal >= -50:
+		return ANSI_RED
+	case signal >= -70:
+		return ANSI_YELLOW
+	}
+	return ANSI_GREEN
+}
+
+func formatChannel(channel int) string {
+	if channel == 0 {
+		return "-"
+	}
+	return strconv.Itoa(channel)
+}
+
+func formatAge(age time.Duration) string {
+	switch {
+	case age < time.Minute:
+		return fmt.Sprintf("%ds", int(age.Seconds()))
+	case age < time.Hour:
+		return fmt.Sprintf("%dm%02ds", int(age.Minutes()), int(age.Seconds())%60)
+	}
+	return fmt.Sprintf("%dh%02dm", int(age.Hours()), int(age.Minutes())%60)
+}
+
+func truncate(s string, width int) string {
+	runes := []rune(s)
+	if len(runes) <= width {
+		return s
+	}
+	return string(runes[:width-1]) + "…"
+}
@@ -0,0 +1,125 @@
+package djijoe
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEngineSubscribe(t *testing.T) {
+	source, err := OpenFileSource("../../pcaps/test.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	engine := NewEngine(source, Config{Vendors: loadTestVendors(t), ApiEndpoint: newApiRecorder(t).URL})
+	events := engine.Subscribe(1000)
+	// a subscriber not reading does not hold the others
+	engine.Subscribe(1)
+	if err := engine.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 163 {
+		t.Errorf("got %d events, expected 163", len(events))
+	}
+}
+
+func TestTui(t *testing.T) {
+	source, err := OpenFileSource("../../pcaps/test.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	_, detections := runEngine(t, source, Config{Vendors: loadTestVendors(t)})
+
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tui := NewTui(nil)
+	tui.now = func() time.Time { return now }
+	for _, info := range detections {
+		tui.Update(info)
+	}
+	now = now.Add(90 * time.Second)
+
+	var table bytes.Buffer
+	tui.Render(&table)
+	for _, expected := range []string{"1 device(s)", "  1  ", "-39" + ANSI_RESET + "/-32", "60:60:1f:42:11:b8", "PHANTOM3_430fd3", "1m30s"} {
+		if !strings.Contains(table.String(), expected) {
+			t.Errorf("no %q in the table:\n%s", expected, table.String())
+		}
+	}
+
+	if err := tui.Focus("2"); err == nil {
+		t.Errorf("focused on a missing row")
+	}
+	if err := tui.Focus("1"); err != nil {
+		t.Fatal(err)
+	}
+	var hunt bytes.Buffer
+	tui.Render(&hunt)
+	for _, expected := range []string{"Fox hunt: 60:60:1f:42:11:b8", "Peak       -32 dBm", "Trend     ", "last 22 frames"} {
+		if !strings.Contains(hunt.String(), expected) {
+			t.Errorf("no %q in the fox hunt view:\n%s", expected, hunt.String())
+		}
+	}
+
+	tui.Focus("")
+	tui.Logger().ErrorF("%d errors", 3)
+	table.Reset()
+	tui.Render(&table)
+	if !strings.Contains(table.String(), "Vendor") || !strings.Contains(table.String(), "ERR 3 errors") {
+		t.Errorf("not back to the table:\n%s", table.String())
+	}
+}
+
+func TestTuiRun(t *testing.T) {
+	var screen bytes.Buffer
+	tui := NewTui(&screen)
+	events := make(chan DroneInfoMessage)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tui.Run(context.Background(), events, strings.NewReader("60:60:1F:42:11:B8\nq\n"))
+	}()
+	events <- DroneInfoMessage{MacAddress: []byte{0x60, 0x60, 0x1f, 0x42, 0x11, 0xb8}, SignalStrength: -60}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("q did not quit")
+	}
+	if !strings.HasPrefix(screen.String(), ANSI_ALTERNATE_SCREEN) || !strings.HasSuffix(screen.String(), ANSI_NORMAL_SCREEN) {
+		t.Errorf("screen not restored")
+	}
+}
+
+func TestSignalTrend(t *testing.T) {
+	tests := []struct {
+		history []int8
+		trend   string
+	}{
+		{[]int8{-70, -70, -70}, "?"},
+		{[]int8{-70, -70, -70, -70, -70, -60, -61, -62, -60, -60}, "↑ warmer"},
+		{[]int8{-60, -60, -60, -60, -60, -61, -60, -59, -61, -60}, "→ steady"},
+		{[]int8{-90, -50, -50, -50, -50, -50, -55, -55, -55, -55, -55}, "↓ colder"},
+	}
+
+	for _, test := range tests {
+		if trend, delta := signalTrend(test.history); trend != test.trend {
+			t.Errorf("%v: got %s (%+.1f)", test.history, trend, delta)
+		}
+	}
+}
+
+func TestSparkline(t *testing.T) {
+	if line := sparkline([]int8{-110, -100, -60, -21, -20, 0}, 5); line != "▁▅███" {
+		t.Errorf("got %q", line)
+	}
+	if bar := signalBar(-60, 4); bar != "[███ ]" {
+		t.Errorf("got %q", bar)
+	}
+}
@@ -0,0 +1,257 @@
+package djijoe
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+Selects the registry entries of a vendor: the organizations whose name contains
+`Pattern` (case-insensitive) are listed as `Name` in the vendor file.
+*/
+type VendorRule struct {
+	Name    string
+	Pattern string
+}
+
+type VendorRules []VendorRule
+
+/*
+Loads the rules selecting the vendors from the registries, one per line:
+`vendor name;pattern`. Empty lines and lines starting with '#' are ignored.
+*/
+func LoadVendorRulesFromFile(filePath string) (VendorRules, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var rules VendorRules
+	scanner := bufio.NewScanner(file)
+	lineno := 0
+
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		idx := strings.LastIndexByte(line, ';')
+		if idx <= 0 || strings.TrimSpace(line[idx+1:]) == "" {
+			return nil, fmt.Errorf("%s:%d: expected 'vendor name;pattern'", filePath, lineno)
+		}
+		rules = append(rules, VendorRule{
+			Name:    strings.TrimSpace(line[:idx]),
+			Pattern: strings.TrimSpace(line[idx+1:]),
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("%s: no rule", filePath)
+	}
+	return rules, nil
+}
+
+/*
+Returns the vendor name an organization is listed as, if any rule selects it.
+*/
+func (rules VendorRules) Match(organization string) (string, bool) {
+	organization = strings.ToLower(organization)
+	for _, rule := range rules {
+		if strings.Contains(organization, strings.ToLower(rule.Pattern)) {
+			return rule.Name, true
+		}
+	}
+	return "", false
+}
+
+/*
+Checks if the vendor file entries of `name` are managed by the rules.
+*/
+func (rules VendorRules) Manages(name string) bool {
+	for _, rule := range rules {
+		if rule.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+A line of the vendor file.
+*/
+type VendorEntry struct {
+	Vendor string
+	Prefix MacPrefix
+	Model  string
+}
+
+/*
+What `UpdateVendors` changed: `Added` and `Removed` entries of the vendors
+managed by the rules, and the `Kept` ones (of all the vendors).
+*/
+type VendorFileDiff struct {
+	Added   []VendorEntry
+	Removed []VendorEntry
+	Kept    []VendorEntry
+}
+
+/*
+Lists the entries of the vendors, sorted by vendor name and prefix.
+*/
+func (v Vendors) Entries() []VendorEntry {
+	var entries []VendorEntry
+	for _, vendor := range v {
+		for _, prefix := range vendor.MacAddressPrefixes {
+			entries = append(entries, VendorEntry{vendor.Name, prefix, vendor.ModelOf(prefix)})
+		}
+	}
+	sortVendorEntries(entries)
+	return entries
+}
+
+func sortVendorEntries(entries []VendorEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Vendor != b.Vendor {
+			return a.Vendor < b.Vendor
+		}
+		if c := bytes.Compare(a.Prefix.Address[:], b.Prefix.Address[:]); c != 0 {
+			return c < 0
+		}
+		return a.Prefix.Length < b.Prefix.Length
+	})
+}
+
+/*
+Rebuilds the vendor list from the registry entries selected by the rules. The
+entries of the vendors not managed by the rules (e.g. added by hand) are kept
+as-is, and so are the models of the prefixes still assigned to the same vendor.
+*/
+func UpdateVendors(current Vendors, registry []RegistryEntry, rules VendorRules) (Vendors, *VendorFileDiff) {
+	diff := new(VendorFileDiff)
+	var updated Vendors
+
+	type key struct {
+		vendor string
+		prefix MacPrefix
+	}
+	old := make(map[key]VendorEntry)
+	for _, entry := range current.Entries() {
+		if !rules.Manages(entry.Vendor) {
+			updated.GetOrCreateVendor(entry.Vendor).AddPrefix(entry.Prefix)
+			if entry.Model != "" {
+				updated.GetOrCreateVendor(entry.Vendor).SetModel(entry.Prefix, entry.Model)
+			}
+			diff.Kept = append(diff.Kept, entry)
+			continue
+		}
+		old[key{entry.Vendor, entry.Prefix}] = entry
+	}
+
+	selected := make(map[key]bool)
+	for _, assignment := range registry {
+		name, ok := rules.Match(assignment.Organization)
+		if !ok {
+			continue
+		}
+
+		k := key{name, assignment.Prefix}
+		if selected[k] {
+			continue
+		}
+		selected[k] = true
+
+		vendor := updated.GetOrCreateVendor(name)
+		vendor.AddPrefix(assignment.Prefix)
+
+		entry, existed := old[k]
+		if existed {
+			if entry.Model != "" {
+				vendor.SetModel(entry.Prefix, entry.Model)
+			}
+			diff.Kept = append(diff.Kept, entry)
+		} else {
+			diff.Added = append(diff.Added, VendorEntry{Vendor: name, Prefix: assignment.Prefix})
+		}
+	}
+
+	for k, entry := range old {
+		if !selected[k] {
+			diff.Removed = append(diff.Removed, entry)
+		}
+	}
+
+	sortVendorEntries(diff.Added)
+	sortVendorEntries(diff.Removed)
+	sortVendorEntries(diff.Kept)
+	return updated, diff
+}
+
+/*
+Formats a prefix as in the vendor file: only the hexadecimal digits when the
+prefix is a multiple of 4 bits (e.g. 60601f, 70b3d5f2d), with its length
+otherwise.
+*/
+func (p MacPrefix) Hex() string {
+	if p.Length%4 != 0 {
+		return p.String()
+	}
+	return fmt.Sprintf("%x", p.Address[:])[:p.Length/4]
+}
+
+/*
+Writes the vendors in DJI-Joe's format (see `LoadVendorsInfoFromFile`).
+*/
+func (v Vendors) WriteCsv(w io.Writer) error {
+	fmt.Fprintf(w, "# Generated by %s %s on %s\n", PROGNAME, VERSION, time.Now().UTC().Format(time.RFC3339))
+
+	writer := csv.NewWriter(w)
+	writer.Comma = ';'
+	for _, entry := range v.Entries() {
+		err := writer.Write([]string{entry.Vendor, entry.Prefix.Hex(), entry.Model})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+/*
+Writes a human-readable summary of the changes.
+*/
+func (d *VendorFileDiff) WriteReport(w io.Writer) error {
+	sections := []struct {
+		sign    string
+		entries []VendorEntry
+	}{
+		{"+", d.Added},
+		{"-", d.Removed},
+	}
+
+	for _, section := range sections {
+		for _, entry := range section.entries {
+			_, err := fmt.Fprintf(w, "%s %-24s %s\n", section.sign, entry.Prefix, entry.Vendor)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "%d prefix(es) added, %d removed, %d unchanged\n",
+		len(d.Added), len(d.Removed), len(d.Kept))
+	return err
+}
@@ -0,0 +1,130 @@
+package djijoe
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const testManuf = "# Wireshark manuf\n" +
+	"00:12:1C\tParrot\tPARROT SA\n" +
+	"0C:73:EB:00:00:00/28\tYuneec\tYuneec International (China) Co.\n" +
+	"70:B3:D5:F2:D0:00/36\tSkydio\tSkydio Inc.\n" +
+	"B8:27:EB\tRaspberr\tRaspberry Pi Foundation\n" +
+	"01:00:0C:CC:CC:CC\tCDP/VTP\n" +
+	"FF:FF:FF:FF:FF:FF\tBroadcast\n"
+
+func TestReadRegistryFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected []string
+	}{
+		{"oui.csv", testOuiCsv, []string{
+			"60:60:1f SZ DJI TECHNOLOGY CO.,LTD",
+			"b8:27:eb Raspberry Pi Foundation",
+			"90:3a:e6 PARROT SA",
+			"70:b3:d5 IEEE Registration Authority",
+		}},
+		{"manuf", testManuf, []string{
+			"00:12:1c PARROT SA",
+			"0c:73:eb:00:00:00/28 Yuneec International (China) Co.",
+			"70:b3:d5:f2:d0:00/36 Skydio Inc.",
+			"b8:27:eb Raspberry Pi Foundation",
+		}},
+	}
+
+	for _, test := range tests {
+		entries, err := ReadRegistryFile(writeTempFile(t, test.name, test.content), nil)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		var got []string
+		for _, entry := range entries {
+			got = append(got, entry.Prefix.String()+" "+entry.Organization)
+		}
+		if strings.Join(got, "\n") != strings.Join(test.expected, "\n") {
+			t.Errorf("%s: got\n%s\nexpected\n%s", test.name, strings.Join(got, "\n"), strings.Join(test.expected, "\n"))
+		}
+	}
+}
+
+func TestUpdateVendors(t *testing.T) {
+	current, err := LoadVendorsInfoFromFile(writeTempFile(t, "oui.csv",
+		"Shenzhen Bilian Electronic Co.;28F366;CX-10\n"+
+			"SZ DJI Technology Co.,Ltd;60601f;Phantom 3\n"+
+			"Parrot SA;9003b7;AR Drone 2\n"+
+			"Parrot SA;00121c;\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := LoadVendorRulesFromFile(writeTempFile(t, "oui-vendors.conf",
+		"# comment\n"+
+			"SZ DJI Technology Co.,Ltd;sz dji technology\n"+
+			"Parrot SA;Parrot SA\n"+
+			"Skydio;Skydio\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var registry []RegistryEntry
+	for _, name := range []string{"oui.csv", "manuf"} {
+		content := map[string]string{"oui.csv": testOuiCsv, "manuf": testManuf}[name]
+		entries, err := ReadRegistryFile(writeTempFile(t, name, content), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		registry = append(registry, entries...)
+	}
+
+	updated, diff := UpdateVendors(current, registry, rules)
+
+	var report bytes.Buffer
+	diff.WriteReport(&report)
+	expectedReport := "" +
+		"+ 90:3a:e6                 Parrot SA\n" +
+		"+ 70:b3:d5:f2:d0:00/36     Skydio\n" +
+		"- 90:03:b7                 Parrot SA\n" +
+		"2 prefix(es) added, 1 removed, 3 unchanged\n"
+	if report.String() != expectedReport {
+		t.Errorf("got report\n%s\nexpected\n%s", report.String(), expectedReport)
+	}
+
+	// the regenerated file loads back the same vendors, with their models
+	var csv bytes.Buffer
+	if err := updated.WriteCsv(&csv); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := LoadVendorsInfoFromFile(writeTempFile(t, "new.csv", csv.String()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.SplitN(csv.String(), "\n", 2)
+	expectedCsv := "" +
+		"Parrot SA;00121c;\n" +
+		"Parrot SA;903ae6;\n" +
+		"SZ DJI Technology Co.,Ltd;60601f;Phantom 3\n" +
+		"Shenzhen Bilian Electronic Co.;28f366;CX-10\n" +
+		"Skydio;70b3d5f2d;\n"
+	if !strings.HasPrefix(lines[0], "# Generated by") || lines[1] != expectedCsv {
+		t.Errorf("got vendor file\n%s\nexpected\n%s", csv.String(), expectedCsv)
+	}
+
+	if _, model := reloaded.Lookup(mustParseMAC(t, "60:60:1f:42:11:b8")); model != "Phantom 3" {
+		t.Errorf("model not kept: %q", model)
+	}
+	if vendor, _ := reloaded.Lookup(mustParseMAC(t, "70:b3:d5:f2:d1:23")); vendor == nil || vendor.Name != "Skydio" {
+		t.Errorf("36-bit prefix not written back: %v", vendor)
+	}
+}
+
+func TestLoadVendorRulesFromMalformedFile(t *testing.T) {
+	for _, content := range []string{"", "# only comments\n", "no separator\n", "Vendor;\n", ";pattern\n"} {
+		if _, err := LoadVendorRulesFromFile(writeTempFile(t, "rules.conf", content)); err == nil {
+			t.Errorf("no error for %q", content)
+		}
+	}
+}
@@ -3,24 +3,25 @@ package djijoe
 import (
 	"bytes"
 	"encoding/csv"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"os"
+	"io/ioutil"
+	"net"
 )
 
 type Vendor struct {
 	Name               string
-	MacAddressPrefixes [][]byte
+	MacAddressPrefixes []MacPrefix
+	Models             map[MacPrefix]string
 }
 
 /*
 Checks if a MAC address prefix belongs to the vendor.
 */
-func (v *Vendor) HasPrefix(mac []byte) bool {
-	for _, prefix := range v.MacAddressPrefixes {
-		if bytes.Compare(mac, prefix) == 0 {
+func (v *Vendor) HasPrefix(prefix MacPrefix) bool {
+	for _, p := range v.MacAddressPrefixes {
+		if p == prefix {
 			return true
 		}
 	}
@@ -32,15 +33,48 @@ var AlreadyExistingMacError = errors.New("The MAC address is already defined")
 /*
 Add a new prefix to the list of the vendor
 */
-func (v *Vendor) AddPrefix(mac []byte) error {
-	if v.HasPrefix(mac) {
+func (v *Vendor) AddPrefix(prefix MacPrefix) error {
+	if v.HasPrefix(prefix) {
 		return AlreadyExistingMacError
 	}
 
-	v.MacAddressPrefixes = append(v.MacAddressPrefixes, mac)
+	v.MacAddressPrefixes = append(v.MacAddressPrefixes, prefix)
 	return nil
 }
 
+/*
+Returns the longest prefix of the vendor matching a MAC address.
+*/
+func (v *Vendor) Match(hwaddr net.HardwareAddr) (MacPrefix, bool) {
+	var best MacPrefix
+	found := false
+
+	for _, prefix := range v.MacAddressPrefixes {
+		if prefix.Contains(hwaddr) && (!found || prefix.Length > best.Length) {
+			best = prefix
+			found = true
+		}
+	}
+	return best, found
+}
+
+/*
+Set the model name of the devices using the given MAC address prefix.
+*/
+func (v *Vendor) SetModel(prefix MacPrefix, model string) {
+	if v.Models == nil {
+		v.Models = make(map[MacPrefix]string)
+	}
+	v.Models[prefix] = model
+}
+
+/*
+Returns the model name associated to a MAC address prefix, if known.
+*/
+func (v *Vendor) ModelOf(prefix MacPrefix) string {
+	return v.Models[prefix]
+}
+
 func (v Vendor) String() string {
 	return fmt.Sprintf("<Vendor name='%s', prefix=%v>", v.Name, v.MacAddressPrefixes)
 }
@@ -63,55 +97,235 @@ func (v *Vendors) GetOrCreateVendor(name string) *Vendor {
 }
 
 /*
-Load the vendor MAC address prefixes
+Returns the vendor and the model (if known) a MAC address belongs to, or nil if
+it does not belong to any of the vendors. The longest matching prefix wins.
+
+This walks all the prefixes: to look up many addresses, use `Index()` instead.
 */
-func LoadVendorsInfoFromFile(filePath string) Vendors {
-	file, err := os.Open(filePath)
+func (v Vendors) Lookup(hwaddr net.HardwareAddr) (*Vendor, string) {
+	var best *Vendor
+	var bestPrefix MacPrefix
+
+	for _, vendor := range v {
+		prefix, ok := vendor.Match(hwaddr)
+		if ok && (best == nil || prefix.Length > bestPrefix.Length) {
+			best = vendor
+			bestPrefix = prefix
+		}
+	}
+
+	if best == nil {
+		return nil, ""
+	}
+	return best, best.ModelOf(bestPrefix)
+}
+
+/*
+Binary trie of the MAC address prefixes, one level per bit: looking up an
+address costs at most MACPREFIX_MAX_LENGTH steps, whatever the number of
+prefixes.
+*/
+type VendorIndex struct {
+	NbPrefixes int
+
+	root vendorIndexNode
+}
+
+type vendorIndexNode struct {
+	children [2]*vendorIndexNode
+	vendor   *Vendor
+	prefix   MacPrefix
+}
+
+var ConflictingMacPrefixError = errors.New("The MAC address prefix belongs to another vendor")
+
+/*
+Builds the index of all the prefixes of the vendors. When a prefix is claimed by
+several vendors, the first one wins.
+*/
+func (v Vendors) Index() *VendorIndex {
+	idx := new(VendorIndex)
+	for _, vendor := range v {
+		for _, prefix := range vendor.MacAddressPrefixes {
+			idx.Insert(prefix, vendor)
+		}
+	}
+	return idx
+}
+
+func (idx *VendorIndex) Insert(prefix MacPrefix, vendor *Vendor) error {
+	node := &idx.root
+	for i := 0; i < prefix.Length; i++ {
+		bit := macAddressBit(prefix.Address[:], i)
+		if node.children[bit] == nil {
+			node.children[bit] = new(vendorIndexNode)
+		}
+		node = node.children[bit]
+	}
+
+	if node.vendor != nil {
+		if node.vendor == vendor {
+			return AlreadyExistingMacError
+		}
+		return ConflictingMacPrefixError
+	}
+
+	node.vendor = vendor
+	node.prefix = prefix
+	idx.NbPrefixes++
+	return nil
+}
+
+/*
+Same as `Vendors.Lookup()`, using the trie.
+*/
+func (idx *VendorIndex) Lookup(hwaddr net.HardwareAddr) (*Vendor, string) {
+	var best *vendorIndexNode
+
+	node := &idx.root
+	for i := 0; node != nil; i++ {
+		if node.vendor != nil {
+			best = node
+		}
+		if i >= len(hwaddr)*8 {
+			break
+		}
+		node = node.children[macAddressBit(hwaddr, i)]
+	}
+
+	if best == nil {
+		return nil, ""
+	}
+	return best.vendor, best.vendor.ModelOf(best.prefix)
+}
+
+/*
+Load the vendor MAC address prefixes, either from DJI-Joe's own CSV format or
+from an IEEE registry (oui.csv, mam.csv or oui36.csv), of which only the drone
+vendors are kept (see DRONE_VENDOR_FILTER).
+*/
+func LoadVendorsInfoFromFile(filePath string, log Logger) (Vendors, error) {
+	return LoadVendorsInfoFromFiles([]string{filePath}, DRONE_VENDOR_FILTER, log)
+}
+
+/*
+Load and merge the vendor MAC address prefixes from several files. `filter`
+selects the vendors kept from the IEEE registries (nil keeps them all); it does
+not apply to the files in DJI-Joe's format.
+*/
+func LoadVendorsInfoFromFiles(filePaths []string, filter VendorFilter, log Logger) (Vendors, error) {
+	if log == nil {
+		log = NopLogger{}
+	}
+
+	var v Vendors
+	nbPrefix := 0
+
+	for _, filePath := range filePaths {
+		data, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return nil, err
+		}
+
+		n, err := v.load(data, filter, log)
+		if err != nil {
+			return nil, err
+		}
+
+		log.DebugF("%d MAC address prefixes loaded from '%s'", n, filePath)
+		nbPrefix += n
+	}
+
+	log.InfoF("%d vendors loaded (%d MAC address prefixes)", len(v), nbPrefix)
+	return v, nil
+}
+
+/*
+Same as `LoadVendorsInfoFromFiles`, for the content of one file.
+*/
+func LoadVendorsInfoFromData(data []byte, filter VendorFilter, log Logger) (Vendors, error) {
+	if log == nil {
+		log = NopLogger{}
+	}
+
+	var v Vendors
+	_, err := v.load(data, filter, log)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (v *Vendors) load(data []byte, filter VendorFilter, log Logger) (int, error) {
+	if isIeeeRegistry(data) {
+		return v.loadIeeeRegistry(bytes.NewReader(data), filter, log)
+	}
+	return v.loadCsv(bytes.NewReader(data), log)
+}
+
+/*
+Adds a prefix to a vendor (created if needed), and returns true if it is new.
+*/
+func (v *Vendors) addPrefix(name string, prefix MacPrefix, model string, log Logger) bool {
+	vendor := v.GetOrCreateVendor(name)
+	if model != "" {
+		vendor.SetModel(prefix, model)
+	}
+
+	err := vendor.AddPrefix(prefix)
 	if err != nil {
-		Log.FatalF("Failed to open '%s': %+v", filePath, err)
+		log.WarningF("Cannot add prefix: %+v", err)
+		return false
 	}
-	defer file.Close()
 
-	reader := csv.NewReader(file)
+	log.DebugF("Added prefix '%s' for vendor '%s'", prefix, name)
+	return true
+}
+
+/*
+Reads DJI-Joe's format: `vendor;prefix;model`, where the model is optional.
+Lines starting with '#' are comments.
+*/
+func (v *Vendors) loadCsv(r io.Reader, log Logger) (int, error) {
+	reader := csv.NewReader(r)
 	reader.Comma = ';'
+	reader.Comment = '#'
+	// the model is optional: the lines do not all have the same fields
+	reader.FieldsPerRecord = -1
 	lineno := 0
 	nbPrefix := 0
 
-	var v Vendors
-
 	for {
 		records, err := reader.Read()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			Log.FatalF("Error: %+v", err)
+			return 0, err
 		}
 
-		if len(records) < 2 || len(records[1]) != 6 {
-			Log.ErrorF("Incorrect entry line %d, skipping...", lineno)
+		if len(records) < 2 || len(records) > 3 {
+			log.ErrorF("Incorrect entry line %d, skipping...", lineno)
 			lineno++
 			continue
 		}
 
-		decoded, err := hex.DecodeString(records[1])
+		prefix, err := ParseMacPrefix(records[1])
 		if err != nil {
-			Log.ErrorF("Incorrect entry line %d, skipping...", lineno)
+			log.ErrorF("Incorrect entry line %d (%v), skipping...", lineno, err)
 			lineno++
 			continue
 		}
 
-		new_vendor := v.GetOrCreateVendor(records[0])
-		err = new_vendor.AddPrefix(decoded)
-		if err != nil {
-			Log.WarningF("Cannot add prefix: %+v", err)
-		} else {
-			Log.DebugF("Added prefix '%s' for vendor '%s'", records[1], records[0])
+		model := ""
+		if len(records) > 2 {
+			model = records[2]
+		}
+		if v.addPrefix(records[0], prefix, model, log) {
 			nbPrefix++
 		}
 		lineno++
 	}
 
-	Log.InfoF("%d vendors loaded (%d MAC address prefixes)", len(v), nbPrefix)
-	return v
+	return nbPrefix, nil
 }
@@ -0,0 +1,259 @@
+package djijoe
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTempFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadVendorsInfoFromFile(t *testing.T) {
+	vendors, err := LoadVendorsInfoFromFile("../../misc/oui.csv", nil)
+	if err != nil {
+		t.Fatalf("LoadVendorsInfoFromFile: %v", err)
+	}
+
+	tests := []struct {
+		mac    string
+		vendor string
+		model  string
+	}{
+		{"60:60:1f:42:11:b8", "SZ DJI Technology Co.,Ltd", ""},
+		{"90:03:b7:00:00:01", "Parrot SA", "AR Drone 2"},
+		{"28:f3:66:aa:bb:cc", "Shenzhen Bilian Electronic Co.", "CX-10"},
+		{"00:12:1c:00:00:00", "Parrot SA", ""},
+		{"60:60:1e:42:11:b8", "", ""},
+		{"b8:27:eb:c3:72:df", "", ""},
+	}
+
+	for _, test := range tests {
+		hwaddr, _ := net.ParseMAC(test.mac)
+		vendor, model := vendors.Lookup(hwaddr)
+
+		name := ""
+		if vendor != nil {
+			name = vendor.Name
+		}
+		if name != test.vendor || model != test.model {
+			t.Errorf("Lookup(%s) = (%q, %q), expected (%q, %q)",
+				test.mac, name, model, test.vendor, test.model)
+		}
+	}
+}
+
+func TestLoadVendorsInfoFromMalformedFile(t *testing.T) {
+	tests := []struct {
+		name       string
+		content    string
+		nbVendors  int
+		nbPrefixes int
+		fails      bool
+	}{
+		{"empty", "", 0, 0, false},
+		{"valid", "DJI;60601f;\nParrot SA;903ae6;\n", 2, 2, false},
+		{"no model column", "DJI;60601f\nParrot SA;903ae6\n", 2, 2, false},
+		{"bad hex", "DJI;60601f;\nBad;zz11ff;\n", 1, 1, false},
+		{"short prefix", "DJI;60601;\nParrot SA;903ae6;\n", 1, 1, false},
+		{"too long prefix", "DJI;60601f4211b800;\nParrot SA;903ae6;\n", 1, 1, false},
+		{"36-bit prefix", "DJI;60601f42;\nParrot SA;70b3d5f2d;\n", 2, 2, false},
+		{"separators and length", "DJI;60:60:1F;\nParrot SA;00-1B-C5-00-00-00/28;\n", 2, 2, false},
+		{"length past the digits", "DJI;60601f/28;\nParrot SA;903ae6;\n", 1, 1, false},
+		{"missing prefix", "DJI\nParrot SA\n", 0, 0, false},
+		{"duplicate prefix", "DJI;60601f;\nDJI;60601f;\nDJI;60601e;\n", 1, 2, false},
+		{"model on some lines only", "DJI;60601f\nDJI;34d262;Mavic\nParrot SA;903ae6\n", 2, 3, false},
+		{"too many fields", "DJI;60601f;\nParrot SA;903ae6;;extra\n", 1, 1, false},
+		{"bare quote", "DJI;\"60601f;\n", 0, 0, true},
+	}
+
+	for _, test := range tests {
+		path := writeTempFile(t, "oui.csv", test.content)
+		vendors, err := LoadVendorsInfoFromFile(path, nil)
+
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: no error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		nbPrefixes := 0
+		for _, vendor := range vendors {
+			nbPrefixes += len(vendor.MacAddressPrefixes)
+		}
+		if len(vendors) != test.nbVendors || nbPrefixes != test.nbPrefixes {
+			t.Errorf("%s: got %d vendors (%d prefixes), expected %d (%d)",
+				test.name, len(vendors), nbPrefixes, test.nbVendors, test.nbPrefixes)
+		}
+	}
+}
+
+func TestLoadVendorsInfoFromMissingFile(t *testing.T) {
+	_, err := LoadVendorsInfoFromFile(filepath.Join(t.TempDir(), "missing.csv"), nil)
+	if !os.IsNotExist(err) {
+		t.Errorf("got %v, expected a not-exist error", err)
+	}
+}
+
+func TestParseMacPrefix(t *testing.T) {
+	tests := []struct {
+		prefix   string
+		length   int
+		str      string
+		match    string
+		mismatch string
+	}{
+		{"60601f", 24, "60:60:1f", "60:60:1f:42:11:b8", "60:60:1e:42:11:b8"},
+		{"00:1B:C5:0", 28, "00:1b:c5:00:00:00/28", "00:1b:c5:0f:ff:ff", "00:1b:c5:10:00:00"},
+		{"00:1b:c5:0a:bc:de/28", 28, "00:1b:c5:00:00:00/28", "00:1b:c5:01:02:03", "00:1b:c5:a0:00:00"},
+		{"70B3D5F2D", 36, "70:b3:d5:f2:d0:00/36", "70:b3:d5:f2:df:ff", "70:b3:d5:f2:e0:00"},
+		{"60601f42", 32, "60:60:1f:42", "60:60:1f:42:00:01", "60:60:1f:43:00:01"},
+	}
+
+	for _, test := range tests {
+		prefix, err := ParseMacPrefix(test.prefix)
+		if err != nil {
+			t.Errorf("ParseMacPrefix(%s): %v", test.prefix, err)
+			continue
+		}
+		if prefix.Length != test.length || prefix.String() != test.str {
+			t.Errorf("ParseMacPrefix(%s) = %s (%d bits), expected %s (%d bits)",
+				test.prefix, prefix, prefix.Length, test.str, test.length)
+		}
+		if !prefix.Contains(mustParseMAC(t, test.match)) || prefix.Contains(mustParseMAC(t, test.mismatch)) {
+			t.Errorf("%s should contain %s, but not %s", prefix, test.match, test.mismatch)
+		}
+	}
+
+	for _, invalid := range []string{"", "60601", "60601g", "60601f4211b800", "60601f/20", "60601f/x", "60601f/28"} {
+		if _, err := ParseMacPrefix(invalid); err == nil {
+			t.Errorf("ParseMacPrefix(%q) succeeded", invalid)
+		}
+	}
+}
+
+const (
+	testOuiCsv = "Registry,Assignment,Organization Name,Organization Address\n" +
+		"MA-L,60601F,\"SZ DJI TECHNOLOGY CO.,LTD\",\"2F,Education Building,Hong Kong Shenzhen CN 518057 \"\n" +
+		"MA-L,B827EB,Raspberry Pi Foundation,Mitchell Wood House Caldecote Cambridgeshire GB CB23 7NU \n" +
+		"MA-L,903AE6,PARROT SA,174 Quai de Jemmapes Paris  FR 75010 \n" +
+		"MA-L,70B3D5,IEEE Registration Authority,445 Hoes Lane Piscataway NJ US 08554 \n"
+	testMamCsv = "Registry,Assignment,Organization Name,Organization Address\n" +
+		"MA-M,0C73EB0,Yuneec International (China) Co.,Shanghai CN 201203 \n" +
+		"MA-M,0C73EB1,Some Camera Maker,Somewhere \n"
+	testOui36Csv = "Registry,Assignment,Organization Name,Organization Address\n" +
+		"MA-S,70B3D5F2D,Skydio Inc.,Redwood City CA US 94063 \n" +
+		"IAB,0050C2ABC,Old Autel Robotics,Bothell WA US 98011 \n"
+)
+
+func TestLoadVendorsFromIeeeRegistries(t *testing.T) {
+	files := []string{
+		writeTempFile(t, "oui.csv", testOuiCsv),
+		writeTempFile(t, "mam.csv", testMamCsv),
+		writeTempFile(t, "oui36.csv", testOui36Csv),
+		"../../misc/oui.csv",
+	}
+
+	tests := []struct {
+		mac    string
+		drones string
+		all    string
+	}{
+		{"60:60:1f:42:11:b8", "SZ DJI TECHNOLOGY CO.,LTD", "SZ DJI TECHNOLOGY CO.,LTD"},
+		{"b8:27:eb:c3:72:df", "", "Raspberry Pi Foundation"},
+		{"90:03:b7:00:00:01", "Parrot SA", "Parrot SA"},
+		{"0c:73:eb:01:02:03", "Yuneec International (China) Co.", "Yuneec International (China) Co."},
+		{"0c:73:eb:11:02:03", "", "Some Camera Maker"},
+		{"70:b3:d5:f2:d1:23", "Skydio Inc.", "Skydio Inc."},
+		{"70:b3:d5:f2:e1:23", "", "IEEE Registration Authority"},
+		{"00:50:c2:ab:c0:01", "Old Autel Robotics", "Old Autel Robotics"},
+	}
+
+	drones, err := LoadVendorsInfoFromFiles(files, DRONE_VENDOR_FILTER, nil)
+	if err != nil {
+		t.Fatalf("LoadVendorsInfoFromFiles: %v", err)
+	}
+	all, err := LoadVendorsInfoFromFiles(files, nil, nil)
+	if err != nil {
+		t.Fatalf("LoadVendorsInfoFromFiles: %v", err)
+	}
+	dronesIndex, allIndex := drones.Index(), all.Index()
+
+	name := func(vendor *Vendor) string {
+		if vendor == nil {
+			return ""
+		}
+		return vendor.Name
+	}
+
+	for _, test := range tests {
+		hwaddr := mustParseMAC(t, test.mac)
+
+		// the trie and the linear lookup must always agree
+		vendor, model := drones.Lookup(hwaddr)
+		indexed, indexedModel := dronesIndex.Lookup(hwaddr)
+		if name(vendor) != test.drones || vendor != indexed || model != indexedModel {
+			t.Errorf("drones: Lookup(%s) = %q, index says %q, expected %q",
+				test.mac, name(vendor), name(indexed), test.drones)
+		}
+
+		vendor, _ = all.Lookup(hwaddr)
+		indexed, _ = allIndex.Lookup(hwaddr)
+		if name(vendor) != test.all || vendor != indexed {
+			t.Errorf("all: Lookup(%s) = %q, index says %q, expected %q",
+				test.mac, name(vendor), name(indexed), test.all)
+		}
+	}
+
+	// the model from DJI-Joe's format is kept
+	if _, model := dronesIndex.Lookup(mustParseMAC(t, "90:03:b7:00:00:01")); model != "AR Drone 2" {
+		t.Errorf("got model %q, expected AR Drone 2", model)
+	}
+}
+
+func TestVendorIndex(t *testing.T) {
+	dji := &Vendor{Name: "DJI"}
+	other := &Vendor{Name: "Other"}
+	idx := new(VendorIndex)
+
+	short, _ := ParseMacPrefix("60601f")
+	long, _ := ParseMacPrefix("60601f4")
+
+	if err := idx.Insert(long, dji); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.Insert(short, other); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.Insert(long, dji); err != AlreadyExistingMacError {
+		t.Errorf("duplicate insert: got %v", err)
+	}
+	if err := idx.Insert(long, other); err != ConflictingMacPrefixError {
+		t.Errorf("conflicting insert: got %v", err)
+	}
+	if idx.NbPrefixes != 2 {
+		t.Errorf("%d prefixes indexed, expected 2", idx.NbPrefixes)
+	}
+
+	if vendor, _ := idx.Lookup(mustParseMAC(t, "60:60:1f:4f:ff:ff")); vendor != dji {
+		t.Errorf("longest prefix does not win: %v", vendor)
+	}
+	if vendor, _ := idx.Lookup(mustParseMAC(t, "60:60:1f:5f:ff:ff")); vendor != other {
+		t.Errorf("shorter prefix does not match: %v", vendor)
+	}
+	if vendor, _ := idx.Lookup(net.HardwareAddr{0x60, 0x60}); vendor != nil {
+		t.Errorf("truncated address matches: %v", vendor)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	// the package
+	"dji-joe"
+
+	// standard libraries
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+/*
+`analyze` subcommand: reads one or more PCAP files and prints the report of all
+the flagged devices found in them.
+*/
+func analyzeMain(args []string) {
+	flags := flag.NewFlagSet("analyze", flag.ExitOnError)
+	ouiCsvFile := flags.String("f", OUI_CSV_FILE, "Path to file(s) holding the MAC prefixes, comma-separated")
+	vendorFilter := flags.String("vendor-filter", strings.Join(djijoe.DRONE_VENDOR_FILTER, ","), "Comma-separated vendor name patterns kept from the IEEE files (empty: keep all)")
+	format := flags.String("format", "table", "Output format: table, json or markdown")
+	outputFileName := flags.String("o", "", "Write the report to this file (default: stdout)")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s analyze [options] file.pcap [file.pcap...]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	switch *format {
+	case "table", "json", "markdown", "md":
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown format '%s', expected table, json or markdown\n", *format)
+		os.Exit(2)
+	}
+
+	var out io.Writer = os.Stdout
+	if *outputFileName != "" {
+		file, err := os.Create(*outputFileName)
+		if err != nil {
+			Log.FatalF("Failed to create '%s': %+v", *outputFileName, err)
+		}
+		defer file.Close()
+		out = file
+	}
+
+	vendors := loadVendors(*ouiCsvFile, *vendorFilter)
+
+	// the JSON reports of all the files make a single array
+	var reports djijoe.SightingReports
+	for _, pcapFileName := range flags.Args() {
+		source, err := djijoe.OpenFileSource(pcapFileName)
+		if err != nil {
+			Log.FatalF("Failed to open '%s': %+v", pcapFileName, err)
+		}
+
+		report, err := djijoe.Analyze(pcapFileName, source, vendors)
+		source.Close()
+		if err != nil {
+			Log.FatalF("Failed to analyze '%s': %+v", pcapFileName, err)
+		}
+
+		switch *format {
+		case "json":
+			reports = append(reports, report)
+		case "markdown", "md":
+			err = report.WriteMarkdown(out)
+		default:
+			err = report.WriteTable(out)
+		}
+		if err != nil {
+			Log.FatalF("Failed to write the report: %+v", err)
+		}
+	}
+
+	if *format == "json" {
+		err := reports.WriteJSON(out)
+		if err != nil {
+			Log.FatalF("Failed to write the report: %+v", err)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	// the package
+	"dji-joe"
+
+	// standard libraries
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+`gen` subcommand: simulates drones and writes the frames each probe of the
+scenario would receive to a PCAP file.
+*/
+func genMain(args []string) {
+	flags := flag.NewFlagSet("gen", flag.ExitOnError)
+	scenarioFile := flags.String("s", "", "Path to the JSON scenario (default: built-in demo scenario)")
+	outputFileName := flags.String("o", "synthetic.pcap", "Output PCAP file; with several probes, suffixed with the probe name")
+	duration := flags.Float64("d", 0, "Override the duration of the scenario (in seconds)")
+	seed := flags.Int64("seed", 0, "Override the seed of the RSSI noise")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s gen [options]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	var scenario *djijoe.Scenario
+	var err error
+
+	if *scenarioFile != "" {
+		scenario, err = djijoe.LoadScenarioFromFile(*scenarioFile)
+		if err != nil {
+			Log.FatalF("Failed to load '%s': %+v", *scenarioFile, err)
+		}
+	} else {
+		scenario = djijoe.DefaultScenario()
+	}
+
+	if *duration > 0 {
+		scenario.Duration = *duration
+	}
+	if *seed != 0 {
+		scenario.Seed = *seed
+	}
+
+	for _, probe := range scenario.Probes {
+		path := *outputFileName
+		if len(scenario.Probes) > 1 {
+			ext := filepath.Ext(path)
+			path = fmt.Sprintf("%s.%s%s", strings.TrimSuffix(path, ext), probe.Name, ext)
+		}
+
+		packets, err := scenario.Generate(probe)
+		if err != nil {
+			Log.FatalF("Failed to generate the frames of probe '%s': %+v", probe.Name, err)
+		}
+
+		file, err := os.Create(path)
+		if err != nil {
+			Log.FatalF("Failed to create '%s': %+v", path, err)
+		}
+		err = djijoe.WritePcap(file, packets)
+		file.Close()
+		if err != nil {
+			Log.FatalF("Failed to write '%s': %+v", path, err)
+		}
+
+		Log.InfoF("Wrote %d frames received by probe '%s' (%f, %f) to '%s'",
+			len(packets), probe.Name, probe.Latitude, probe.Longitude, path)
+	}
+}
@@ -1,33 +1,120 @@
-package main
-
 // +build linux
 
+package main
+
 import (
 	// the package
 	"dji-joe"
 
 	// standard libraries
 	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
-
-	// external libraries
-	"github.com/google/gopacket/pcap"
+	"syscall"
+	"time"
 )
 
 const OUI_CSV_FILE string = "./misc/oui.csv"
+const FINGERPRINTS_FILE string = "./misc/fingerprints.csv"
 
 var ifaceName = flag.String("i", "", "Specify the interface to read packets from")
 var ifaceFromMenu = flag.Bool("l", true, "Choose the interface to read packets from from an interactive menu")
 var pcapFileName = flag.String("r", "", "Filename to read from, overrides -i")
-var oui_csv_file = flag.String("f", OUI_CSV_FILE, "Path to file holding the MAC prefixes")
+var oui_csv_file = flag.String("f", OUI_CSV_FILE, "Path to file(s) holding the MAC prefixes, comma-separated (DJI-Joe or IEEE oui.csv/mam.csv/oui36.csv format)")
+var vendorFilter = flag.String("vendor-filter", strings.Join(djijoe.DRONE_VENDOR_FILTER, ","), "Comma-separated vendor name patterns kept from the IEEE files (empty: keep all)")
 var api_endpoint = flag.String("api", "", "URL to the API endpoint")
+var mqttBroker = flag.String("mqtt", "", "Publish the events to this MQTT broker: mqtt://[user:password@]host[:port], or mqtts:// for TLS")
+var mqttTopic = flag.String("mqtt-topic", djijoe.MQTT_DEFAULT_TOPIC_PREFIX, "Prefix of the MQTT topics, '{host}' being replaced by the hostname")
+var mqttQos = flag.Uint("mqtt-qos", 1, "QoS of the MQTT messages (0, 1 or 2)")
+var jsonlFileName = flag.String("jsonl", "", "Append the events to this file, one JSON object per line ('-' for stdout)")
+var syslogServer = flag.String("syslog", "", "Send the events to syslog (RFC 5424): 'local', or udp://, tcp:// or tls://host[:port]")
+var syslogFormat = flag.String("syslog-format", djijoe.SYSLOG_FORMAT_CEF, "Format of the syslog messages: cef, leef or text")
+var alertRulesFile = flag.String("alerts", "", "Evaluate the alert rules of this JSON file on the detections")
 var verbosity = flag.Int("v", 0, "Verbosity level")
 var use5GhzBand = flag.Bool("5", false, "If set, the interface will be scanning the 5GHz band (default: false -> 2.4GHz band)")
+var nbWorkers = flag.Int("workers", 0, "Number of goroutines decoding the frames (0: one per CPU)")
+var useAfpacket = flag.Bool("afpacket", false, "Capture with an AF_PACKET (TPACKET_V3) socket instead of libpcap")
+var outputFileName = flag.String("w", "", "Write the flagged frames to this pcapng file")
+var outputMaxSize = flag.Uint64("C", 0, "Rotate the pcapng output file every N megabytes (0: never rotate)")
+var outputFlaggedBssid = flag.Bool("w-bssid", false, "Also write to the pcapng output all the frames from a flagged BSSID")
+var bpfFilter = flag.String("bpf", "", "pcap-filter expression the captured frames must also match")
+var bpfVendors = flag.Bool("bpf-vendors", true, "Filter the frames in the kernel on the MAC prefixes of the vendors (off with -w-bssid)")
+var dfTarget = flag.String("df", "", "Estimate the bearing of the device with this MAC address, from the headings of -compass")
+var compassInput = flag.String("compass", "", "Headings of the antenna, NMEA HDT or degrees, one per line: serial device, '-' for stdin, or udp://[host]:port")
+var compassOffset = flag.Float64("compass-offset", 0, "Degrees added to the compass headings, for an antenna not aligned with the compass")
+var useTui = flag.Bool("tui", false, "Show the detections in a full-screen terminal view instead of the logs")
+var statusAddress = flag.String("status", "", "Serve the status API and dashboard on this address (e.g. ':8080')")
+var metricsAddress = flag.String("metrics", "", "Serve Prometheus metrics on this address (e.g. ':9100'), under /metrics")
+var fingerprintsFile = flag.String("fingerprints", FINGERPRINTS_FILE, "Path to the file holding the probe request fingerprints of known models")
+var vendorsPollInterval = flag.Duration("vendors-poll", time.Minute, "Fetch the vendor file published by the API server at this interval (0: never)")
+var vendorsPushToken = flag.String("vendors-push-token", "", "Accept the vendor files pushed with this bearer token, on PUT /api/vendors of -status")
+
+var Log = djijoe.InitLogger(djijoe.PROGNAME)
+
+/*
+Returns a context cancelled when the process receives SIGINT or SIGTERM.
+*/
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigc
+		Log.InfoF("Got '%+v': stopping cleanly", sig)
+		cancel()
+	}()
+
+	return ctx
+}
+
+/*
+Serves `handler` on `address` until `ctx` is cancelled.
+*/
+func serveHttp(ctx context.Context, address string, handler http.Handler, log djijoe.Logger) {
+	server := &http.Server{Addr: address, Handler: handler}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	log.InfoF("Listening on '%s'", address)
+	err := server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.ErrorF("Failed to serve on '%s': %+v", address, err)
+	}
+}
+
+/*
+Splits the comma-separated vendor name patterns of `-vendor-filter`.
+*/
+func parseVendorFilter(filter string) djijoe.VendorFilter {
+	var patterns djijoe.VendorFilter
+	for _, pattern := range strings.Split(filter, ",") {
+		if strings.TrimSpace(pattern) != "" {
+			patterns = append(patterns, strings.TrimSpace(pattern))
+		}
+	}
+	return patterns
+}
+
+/*
+Loads the vendors from the comma-separated list of files `files`.
+*/
+func loadVendors(files string, filter string) djijoe.Vendors {
+	vendors, err := djijoe.LoadVendorsInfoFromFiles(strings.Split(files, ","), parseVendorFilter(filter), Log)
+	if err != nil {
+		Log.FatalF("Failed to load '%s': %+v", files, err)
+	}
+	return vendors
+}
 
 /*
 Command-line menu to select the network interface if none was provided as an argument.
@@ -35,11 +122,11 @@ Command-line menu to select the network interface if none was provided as an arg
 func ChooseInterface() net.Interface {
 	var selectedIface net.Interface
 
-	djijoe.Log.Info("Listing available interfaces")
+	Log.Info("Listing available interfaces")
 
 	ifaces, err := net.Interfaces()
 	if err != nil {
-		djijoe.Log.FatalF("%+v", err)
+		Log.FatalF("%+v", err)
 	}
 
 	for idx, iface := range ifaces {
@@ -64,7 +151,7 @@ func ChooseInterface() net.Interface {
 			break
 		}
 
-		djijoe.Log.WarningF("Incorrect index %d", ifaceIdx)
+		Log.WarningF("Incorrect index %d", ifaceIdx)
 	}
 
 	return selectedIface
@@ -76,20 +163,43 @@ Where the magic begins...
 func main() {
 	var iface net.Interface
 	var _iface *net.Interface
-	var handle *pcap.Handle
+	var source djijoe.PacketSource
+	var radio *djijoe.Radio
 	var err error
 
-	djijoe.Log = djijoe.InitLogger(djijoe.PROGNAME)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "analyze":
+			analyzeMain(os.Args[2:])
+			return
+		case "gen":
+			genMain(os.Args[2:])
+			return
+		case "oui":
+			ouiMain(os.Args[2:])
+			return
+		}
+	}
+
 	flag.Parse()
 
-	djijoe.Log.InfoF("Starting %s [%s]", djijoe.PROGNAME, djijoe.VERSION)
+	Log.InfoF("Starting %s [%s]", djijoe.PROGNAME, djijoe.VERSION)
+	ctx := signalContext()
+
+	// once the terminal view is up, the logs go under its table
+	var runLog djijoe.Logger = Log
+	var tui *djijoe.Tui
+	if *useTui {
+		tui = djijoe.NewTui(os.Stdout)
+		runLog = tui.Logger()
+	}
 
 	if *pcapFileName != "" {
-		djijoe.Log.InfoF("From PCAP file: '%s'", *pcapFileName)
+		Log.InfoF("From PCAP file: '%s'", *pcapFileName)
 
-		handle, err = pcap.OpenOffline(*pcapFileName)
+		source, err = djijoe.OpenPcapOfflineSource(*pcapFileName)
 		if err != nil {
-			djijoe.Log.FatalF("PCAP OpenOffline error: %+v", err)
+			Log.FatalF("PCAP OpenOffline error: %+v", err)
 		}
 
 	} else {
@@ -97,60 +207,219 @@ func main() {
 		if *ifaceName != "" {
 			_iface, err = net.InterfaceByName(*ifaceName)
 			if err != nil {
-				djijoe.Log.FatalF("%+v", err)
+				Log.FatalF("%+v", err)
 			}
 			iface = *_iface
-			djijoe.Log.InfoF("Selected interface: '%s'", iface.Name)
+			Log.InfoF("Selected interface: '%s'", iface.Name)
 
 		} else {
-			djijoe.Log.Info("Selecting interface from menu")
+			Log.Info("Selecting interface from menu")
 			iface = ChooseInterface()
-			djijoe.Log.InfoF("Selected interface: '%s'", iface.Name)
+			Log.InfoF("Selected interface: '%s'", iface.Name)
 		}
 
-		djijoe.SwitchToModeMonitor(iface)
-		defer djijoe.SwitchToModeManaged(iface)
+		radio = djijoe.NewRadio(iface, runLog, *verbosity)
+
+		err = radio.SwitchToModeMonitor()
+		if err != nil {
+			Log.FatalF("%+v", err)
+		}
+		defer radio.SwitchToModeManaged()
 
 		if *use5GhzBand {
-			djijoe.Log.Info("Using 5GHz band")
-			err = djijoe.ChangeTo5gBand(iface)
+			Log.Info("Using 5GHz band")
+			err = radio.ChangeTo5gBand()
+			if err != nil {
+				Log.FatalF("Failed to change card to 5GHz: %+v", err)
+			}
+		} else {
+			Log.Info("Using 2.4GHz band")
+			err = radio.ChangeTo2gBand()
+			if err != nil {
+				Log.FatalF("Failed to change card to 2GHz: %+v", err)
+			}
+		}
+
+		go radio.ChannelHopper(ctx, *use5GhzBand)
+
+		if *useAfpacket {
+			source, err = djijoe.OpenAfpacketSource(iface.Name)
 			if err != nil {
-				djijoe.Log.FatalF("Failed to change card to 5GHz: %+v", err)
+				Log.FatalF("AF_PACKET open error: %+v", err)
 			}
 		} else {
-			djijoe.Log.Info("Using 2.4GHz band")
-			err = djijoe.ChangeTo2gBand(iface)
+			source, err = djijoe.OpenLiveSource(iface.Name)
 			if err != nil {
-				djijoe.Log.FatalF("Failed to change card to 2GHz: %+v", err)
+				Log.FatalF("PCAP Activate error: %+v", err)
 			}
 		}
+	}
+	defer source.Close()
+
+	var output *djijoe.PcapngWriter
+	if *outputFileName != "" {
+		ifName := iface.Name
+		if *pcapFileName != "" {
+			ifName = *pcapFileName
+		}
+		ifDesc := fmt.Sprintf("%s %s flagged frames captured from '%s'", djijoe.PROGNAME, djijoe.VERSION, ifName)
+
+		output, err = djijoe.NewPcapngWriter(*outputFileName, *outputMaxSize*1024*1024, source.LinkType(), ifName, ifDesc)
+		if err != nil {
+			Log.FatalF("Failed to create '%s': %+v", *outputFileName, err)
+		}
+		defer output.Close()
+		Log.InfoF("Writing flagged frames to '%s'", *outputFileName)
+	}
+
+	vendors := loadVendors(*oui_csv_file, *vendorFilter)
+
+	fingerprints, err := djijoe.LoadFingerprintsFromFile(*fingerprintsFile)
+	if err != nil {
+		Log.WarningF("No fingerprint of known models: %+v", err)
+	}
+
+	cfg := djijoe.Config{
+		Interface:          iface,
+		Log:                runLog,
+		Vendors:            vendors,
+		ApiEndpoint:        *api_endpoint,
+		Verbosity:          *verbosity,
+		Output:             output,
+		OutputFlaggedBssid: *outputFlaggedBssid,
+		Fingerprints:       fingerprints,
+		Workers:            *nbWorkers,
+		BpfPrefilter:       *bpfVendors,
+		BpfFilter:          *bpfFilter,
+	}
+
+	if *mqttBroker != "" {
+		if *mqttQos > 2 {
+			Log.FatalF("Invalid MQTT QoS %d, expected 0, 1 or 2", *mqttQos)
+		}
+		mqtt, err := djijoe.NewMqttReporter(*mqttBroker, *mqttTopic, byte(*mqttQos))
+		if err != nil {
+			Log.FatalF("Invalid MQTT broker '%s': %+v", *mqttBroker, err)
+		}
+		cfg.Reporters = append(cfg.Reporters, mqtt)
+		Log.InfoF("Publishing the events to '%s', the detections on '%s'", mqtt.Client.Url.Host, mqtt.Topics.Detections)
+	}
+
+	if *jsonlFileName != "" {
+		jsonl, err := djijoe.NewFileReporter(*jsonlFileName)
+		if err != nil {
+			Log.FatalF("Failed to open '%s': %+v", *jsonlFileName, err)
+		}
+		defer jsonl.Close()
+		cfg.Reporters = append(cfg.Reporters, jsonl)
+		Log.InfoF("Appending the events to '%s'", *jsonlFileName)
+	}
 
-		go djijoe.ChannelHopper(iface, *use5GhzBand)
+	if *syslogServer != "" {
+		syslog, err := djijoe.NewSyslogReporter(*syslogServer, *syslogFormat)
+		if err != nil {
+			Log.FatalF("%+v", err)
+		}
+		cfg.Reporters = append(cfg.Reporters, syslog)
+		Log.InfoF("Sending the events to syslog '%s' as %s", *syslogServer, *syslogFormat)
+	}
 
-		inactive, err := pcap.NewInactiveHandle(iface.Name)
+	if *alertRulesFile != "" {
+		alerts, err := djijoe.LoadAlertRulesFromFile(*alertRulesFile, runLog)
 		if err != nil {
-			djijoe.Log.FatalF("PCAP NewInactiveHandle error: %+v", err)
+			Log.FatalF("%+v", err)
 		}
-		defer inactive.CleanUp()
+		cfg.Alerts = alerts
+		Log.InfoF("Loaded %d alert rule(s) from '%s'", len(alerts.Rules), *alertRulesFile)
+	}
 
-		inactive.SetSnapLen(1600)
-		inactive.SetImmediateMode(true)
-		inactive.SetPromisc(true)
+	if *dfTarget != "" {
+		target, err := net.ParseMAC(*dfTarget)
+		if err != nil {
+			Log.FatalF("Invalid -df address: %+v", err)
+		}
+		if *compassInput == "" || (*compassInput == "-" && tui != nil) {
+			Log.Fatal("-df needs the headings of a -compass (stdin is taken by -tui)")
+		}
 
-		handle, err = inactive.Activate()
+		compass, err := djijoe.OpenCompass(*compassInput)
 		if err != nil {
-			djijoe.Log.FatalF("PCAP Activate error: %+v", err)
+			Log.FatalF("%+v", err)
+		}
+		defer compass.Close()
+
+		cfg.DirectionFinder = djijoe.NewDirectionFinder(target, runLog)
+		cfg.DirectionFinder.Offset = *compassOffset
+		go func() {
+			err := cfg.DirectionFinder.Run(ctx, compass)
+			if err != nil {
+				runLog.ErrorF("Compass stopped: %+v", err)
+			}
+		}()
+		Log.InfoF("Estimating the bearing of %s from the headings of '%s'", target, *compassInput)
+	}
+
+	engine := djijoe.NewEngine(source, cfg)
+
+	// reload the vendors on SIGHUP, when their files change, when the ones
+	// published by the API server (polled) changed, or when they are pushed
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	reloader := djijoe.NewVendorReloader(engine, strings.Split(*oui_csv_file, ","), parseVendorFilter(*vendorFilter), runLog)
+	if *api_endpoint != "" {
+		reloader.Collector = engine.Probe
+		reloader.PollInterval = *vendorsPollInterval
+	}
+	if *vendorsPushToken != "" && *statusAddress == "" {
+		Log.Fatal("-vendors-push-token needs the -status server")
+	}
+	reloader.PushToken = *vendorsPushToken
+
+	// the status API and the metrics may share the same address
+	servers := make(map[string]*http.ServeMux)
+	handle := func(address string, pattern string, handler http.Handler) {
+		if servers[address] == nil {
+			servers[address] = http.NewServeMux()
+		}
+		servers[address].Handle(pattern, handler)
+	}
+	if *statusAddress != "" {
+		handle(*statusAddress, "/", djijoe.NewStatusHandler(engine, radio))
+		if *vendorsPushToken != "" {
+			handle(*statusAddress, djijoe.API_VENDORS, reloader)
 		}
 	}
-	defer handle.Close()
+	if *metricsAddress != "" {
+		handle(*metricsAddress, "/metrics", djijoe.NewMetricsHandler(engine, radio))
+	}
+	for address, mux := range servers {
+		go serveHttp(ctx, address, mux, runLog)
+	}
+
+	tuiDone := make(chan struct{})
+	if tui != nil {
+		events := engine.Subscribe(djijoe.PIPELINE_QUEUE_SIZE)
+		tuiCtx, quit := context.WithCancel(ctx)
+		ctx = tuiCtx
+		go func() {
+			defer close(tuiDone)
+			tui.Run(ctx, events, os.Stdin)
+			quit()
+		}()
+	}
+
+	err = reloader.Start(ctx, hup)
+	if err != nil {
+		Log.ErrorF("Vendor files will not be watched: %+v", err)
+	}
 
-	djijoe.Cfg = djijoe.Config{
-		Interface:   iface,
-		Handle:      handle,
-		Vendors:     djijoe.LoadVendorsInfoFromFile(*oui_csv_file),
-		ApiEndpoint: *api_endpoint,
-		Verbosity:   *verbosity,
+	err = engine.Run(ctx)
+	if err != nil {
+		runLog.ErrorF("%+v", err)
 	}
 
-	djijoe.DjiGo()
+	// the detections of a file stay on screen until the user quits
+	if tui != nil {
+		<-tuiDone
+	}
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	// the package
+	"dji-joe"
+
+	// standard libraries
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+const OUI_VENDORS_CONF_FILE string = "./misc/oui-vendors.conf"
+
+/*
+`oui` subcommand: maintenance of the vendor file.
+*/
+func ouiMain(args []string) {
+	if len(args) == 0 || args[0] != "update" {
+		fmt.Fprintf(os.Stderr, "Usage: %s oui update [options] registry [registry...]\n", os.Args[0])
+		os.Exit(2)
+	}
+	ouiUpdateMain(args[1:])
+}
+
+/*
+`oui update`: regenerates the vendor file from local copies of the IEEE
+registries (oui.csv, mam.csv, oui36.csv) and/or Wireshark's manuf file, and
+prints the prefixes added and removed.
+*/
+func ouiUpdateMain(args []string) {
+	flags := flag.NewFlagSet("oui update", flag.ExitOnError)
+	ouiCsvFile := flags.String("f", OUI_CSV_FILE, "Vendor file to update")
+	rulesFile := flags.String("c", OUI_VENDORS_CONF_FILE, "Rules selecting the vendors from the registries")
+	outputFileName := flags.String("o", "", "Write the new vendor file there (default: overwrite -f)")
+	dryRun := flags.Bool("n", false, "Only print the changes, do not write anything")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s oui update [options] registry [registry...]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	rules, err := djijoe.LoadVendorRulesFromFile(*rulesFile)
+	if err != nil {
+		Log.FatalF("Failed to load '%s': %+v", *rulesFile, err)
+	}
+
+	current, err := djijoe.LoadVendorsInfoFromFiles([]string{*ouiCsvFile}, nil, nil)
+	if err != nil && !os.IsNotExist(err) {
+		Log.FatalF("Failed to load '%s': %+v", *ouiCsvFile, err)
+	}
+
+	var registry []djijoe.RegistryEntry
+	for _, registryFile := range flags.Args() {
+		entries, err := djijoe.ReadRegistryFile(registryFile, Log)
+		if err != nil {
+			Log.FatalF("Failed to read '%s': %+v", registryFile, err)
+		}
+		Log.InfoF("%d prefixes read from '%s'", len(entries), registryFile)
+		registry = append(registry, entries...)
+	}
+
+	updated, diff := djijoe.UpdateVendors(current, registry, rules)
+	diff.WriteReport(os.Stdout)
+
+	if *dryRun {
+		return
+	}
+
+	var buffer bytes.Buffer
+	err = updated.WriteCsv(&buffer)
+	if err != nil {
+		Log.FatalF("Failed to generate the vendor file: %+v", err)
+	}
+
+	output := *outputFileName
+	if output == "" {
+		output = *ouiCsvFile
+	}
+	err = ioutil.WriteFile(output, buffer.Bytes(), 0644)
+	if err != nil {
+		Log.FatalF("Failed to write '%s': %+v", output, err)
+	}
+	Log.InfoF("Wrote '%s'", output)
+}